@@ -1,7 +1,6 @@
 package auth
 
 import (
-	"crypto/rsa"
 	"errors"
 	"fmt"
 	"github.com/golang-jwt/jwt/v5"
@@ -9,36 +8,64 @@ import (
 
 type ctxKey int
 
+// supportedAlgorithms lists the alg headers that are accepted at all. Anything else, in particular
+// "none", is rejected before any key is looked up.
+var supportedAlgorithms = []string{
+	jwt.SigningMethodRS256.Alg(),
+	jwt.SigningMethodES256.Alg(),
+	jwt.SigningMethodEdDSA.Alg(),
+	jwt.SigningMethodHS256.Alg(),
+}
+
 const Key ctxKey = 1
 
-// Auth is a type that deals with authentication-related activities. It contains two fields, privateKey and publicKey which are
-// used for token generation and verification respectively.
+// Auth is a type that deals with authentication-related activities. It holds a KeySet whose active key
+// is used for token generation and whose other keys that haven't been retired are used for verification,
+// and the Config that describes which tokens are accepted.
 type Auth struct {
-	privateKey *rsa.PrivateKey // privateKey is used to sign the JWT token.
-	publicKey  *rsa.PublicKey  // publicKey is used to validate the JWT token.
+	keys *KeySet // keys is used to sign and validate the JWT tokens.
+	cfg  Config  // cfg holds the expected issuer, audience, required claims and leeway.
 }
 
-// NewAuth is a constructor function for Auth struct. It accepts privateKey and publicKey as parameters and returns
-// an instance of Auth struct. If either of privateKey or publicKey is nil, it returns an error.
-func NewAuth(privateKey *rsa.PrivateKey, publicKey *rsa.PublicKey) (*Auth, error) {
-	if privateKey == nil || publicKey == nil {
-		return nil, errors.New("private/public key cannot be nil")
+// NewAuth is a constructor function for Auth struct. It accepts the KeySet to use and the token Config and
+// returns an instance of Auth struct, which issues JWTs whatever the Format of the Config. If keys is nil,
+// has no active key or the Config names an unknown required claim, it returns an error.
+func NewAuth(keys *KeySet, cfg Config) (*Auth, error) {
+	if keys == nil {
+		return nil, errors.New("keyset cannot be nil")
+	}
+	_, err := keys.Active()
+	if err != nil {
+		return nil, err
+	}
+	err = cfg.check()
+	if err != nil {
+		return nil, err
 	}
 	return &Auth{
-		privateKey: privateKey,
-		publicKey:  publicKey,
+		keys: keys,
+		cfg:  cfg,
 	}, nil
 }
 
-// GenerateToken is a method for Auth struct. It generates a new JWT token using the provided claims and
-// signs it using the privateKey of the Auth struct it's called upon. If there is an error during signing,
-// it returns an error.
-func (a *Auth) GenerateToken(claims jwt.RegisteredClaims) (string, error) {
-	//NewWithClaims creates a new Token with the specified signing method and claims.
-	tkn := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+// GenerateToken is a method for Auth struct. It generates a new JWT token using the provided claims, filling in
+// the configured issuer and audience if they are missing, and signs it using the active key of the Auth struct it's called upon. The kid of that key is put in the
+// token header. If there is an error during signing, it returns an error.
+func (a *Auth) GenerateToken(claims Claims) (string, error) {
+	k, err := a.keys.Active()
+	if err != nil {
+		return "", err
+	}
+
+	// Tokens are stamped with the configured issuer and audience unless the caller chose others.
+	claims = a.cfg.stamp(claims)
 
-	// Signing our token with our private key.
-	tokenStr, err := tkn.SignedString(a.privateKey)
+	//NewWithClaims creates a new Token with the signing method of the active key and the claims.
+	tkn := jwt.NewWithClaims(k.Algorithm, claims)
+	tkn.Header["kid"] = k.ID
+
+	// Signing our token with the private key (or the secret for HS256).
+	tokenStr, err := tkn.SignedString(k.PrivateKey)
 	if err != nil {
 		return "", fmt.Errorf("signing token %w", err)
 	}
@@ -46,21 +73,50 @@ func (a *Auth) GenerateToken(claims jwt.RegisteredClaims) (string, error) {
 	return tokenStr, nil
 }
 
-// ValidateToken is a method for Auth struct. It verifies the provided JWT token using the publicKey of the Auth struct
-// it's called upon and returns the parsed claims if the JWT token is valid. If the JWT token is invalid or
-// there is an error during parsing, it returns an error.
-func (a *Auth) ValidateToken(token string) (jwt.RegisteredClaims, error) {
-	var c jwt.RegisteredClaims
-	// Parse the token with the registered claims.
+// ValidateToken is a method for Auth struct. It verifies the provided JWT token using the key its kid header
+// points to, with the algorithm configured for that key, checks its claims against the Config and returns
+// the parsed claims if the JWT token is valid. If the JWT token is invalid, it returns a *ValidationError.
+func (a *Auth) ValidateToken(token string) (Claims, error) {
+	return a.validate(token, a.cfg.Audience)
+}
+
+// validate checks the signature of the token and its claims, expecting the given audience.
+func (a *Auth) validate(token string, audience string) (Claims, error) {
+	var c Claims
+	// Parse the token with our claims. The registered claims are checked by validateClaims afterwards,
+	// which knows about the configured issuer, audience, required claims and leeway.
 	tkn, err := jwt.ParseWithClaims(token, &c, func(token *jwt.Token) (interface{}, error) {
-		return a.publicKey, nil
-	})
+		kid, ok := token.Header["kid"].(string)
+		if !ok {
+			return nil, errors.New("token has no kid header")
+		}
+		k, err := a.keys.Verifier(kid)
+		if err != nil {
+			return nil, err
+		}
+		// The alg header is chosen by whoever made the token, so it has to match the algorithm of the key.
+		// Otherwise e.g. an RSA public key could be used as an HMAC secret.
+		if token.Method.Alg() != k.Algorithm.Alg() {
+			return nil, fmt.Errorf("unexpected signing method %q for key %q", token.Method.Alg(), kid)
+		}
+		return k.PublicKey, nil
+	}, jwt.WithValidMethods(supportedAlgorithms), jwt.WithoutClaimsValidation())
 	if err != nil {
-		return jwt.RegisteredClaims{}, fmt.Errorf("parsing token %w", err)
+		return Claims{}, parseError(err)
 	}
 	// Check if the parsed token is valid.
 	if !tkn.Valid {
-		return jwt.RegisteredClaims{}, errors.New("invalid token")
+		return Claims{}, &ValidationError{Err: ErrTokenSignatureInvalid}
+	}
+
+	err = a.cfg.validateClaims(c.RegisteredClaims, audience)
+	if err != nil {
+		return Claims{}, err
 	}
 	return c, nil
 }
+
+// JWKS returns the public keys that tokens issued by this Auth can be verified with.
+func (a *Auth) JWKS() JSONWebKeySet {
+	return a.keys.JWKS()
+}
@@ -0,0 +1,137 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSigningAlgorithms(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name string
+		key  SigningKey
+		alg  string
+	}{
+		{name: "RS256", key: SigningKey{PrivateKey: rsaKey}, alg: "RS256"},
+		{name: "ES256", key: SigningKey{PrivateKey: ecKey}, alg: "ES256"},
+		{name: "EdDSA", key: SigningKey{PrivateKey: edKey}, alg: "EdDSA"},
+		{name: "HS256", key: SigningKey{ID: "hmac", PrivateKey: []byte("0123456789abcdef0123456789abcdef")}, alg: "HS256"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ks := NewKeySet()
+			require.NoError(t, ks.Add(tt.key))
+			a := newTestAuth(t, ks)
+
+			token, err := a.GenerateToken(testClaims())
+			require.NoError(t, err)
+			tkn, _, err := jwt.NewParser().ParseUnverified(token, &Claims{})
+			require.NoError(t, err)
+			require.Equal(t, tt.alg, tkn.Method.Alg())
+
+			got, err := a.ValidateToken(token)
+			require.NoError(t, err)
+			require.Equal(t, "7", got.Subject)
+		})
+	}
+}
+
+func TestSigningKeyMaterial(t *testing.T) {
+	smallRSA, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.NoError(t, err)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.NoError(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name string
+		key  SigningKey
+	}{
+		{name: "no key", key: SigningKey{ID: "k"}},
+		{name: "RSA key below 2048 bits", key: SigningKey{PrivateKey: smallRSA}},
+		{name: "ECDSA key on P-384", key: SigningKey{PrivateKey: p384}},
+		{name: "short secret", key: SigningKey{ID: "k", PrivateKey: make([]byte, 31)}},
+		{name: "secret without kid", key: SigningKey{PrivateKey: make([]byte, 32)}},
+		{name: "RSA key for ES256", key: SigningKey{Algorithm: jwt.SigningMethodES256, PrivateKey: rsaKey}},
+		{name: "Ed25519 key for RS256", key: SigningKey{Algorithm: jwt.SigningMethodRS256, PrivateKey: edKey}},
+		{name: "secret for EdDSA", key: SigningKey{ID: "k", Algorithm: jwt.SigningMethodEdDSA, PrivateKey: make([]byte, 32)}},
+		{name: "unsupported algorithm", key: SigningKey{Algorithm: jwt.SigningMethodRS512, PrivateKey: rsaKey}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Error(t, NewKeySet().Add(tt.key))
+		})
+	}
+}
+
+// Tokens whose alg header doesn't match the algorithm of the key their kid points to are forged, whatever
+// key they were signed with.
+func TestValidateTokenAlgorithm(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	otherEC, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	ks := NewKeySet()
+	require.NoError(t, ks.Add(SigningKey{ID: "rsa", PrivateKey: rsaKey}))
+	require.NoError(t, ks.Add(SigningKey{ID: "ec", PrivateKey: ecKey}))
+	require.NoError(t, ks.Add(SigningKey{ID: "ed", PrivateKey: edKey}))
+	a := newTestAuth(t, ks)
+
+	// publicPEM is what anybody can get hold of, and what an attacker would use as an HMAC secret
+	publicPEM := func(pub crypto.PublicKey) []byte {
+		der, err := x509.MarshalPKIXPublicKey(pub)
+		require.NoError(t, err)
+		return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	}
+
+	tests := []struct {
+		name   string
+		method jwt.SigningMethod
+		kid    string
+		key    any
+	}{
+		{name: "alg none", method: jwt.SigningMethodNone, kid: "rsa", key: jwt.UnsafeAllowNoneSignatureType},
+		{name: "HS256 with the RSA public key", method: jwt.SigningMethodHS256, kid: "rsa", key: publicPEM(&rsaKey.PublicKey)},
+		{name: "HS256 with the ECDSA public key", method: jwt.SigningMethodHS256, kid: "ec", key: publicPEM(&ecKey.PublicKey)},
+		{name: "RS512 with the RSA key", method: jwt.SigningMethodRS512, kid: "rsa", key: rsaKey},
+		{name: "PS256 with the RSA key", method: jwt.SigningMethodPS256, kid: "rsa", key: rsaKey},
+		{name: "ES256 for the EdDSA kid", method: jwt.SigningMethodES256, kid: "ed", key: otherEC},
+		{name: "RS256 for the ES256 kid", method: jwt.SigningMethodRS256, kid: "ec", key: rsaKey},
+		{name: "ES256 with another key", method: jwt.SigningMethodES256, kid: "ec", key: otherEC},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tkn := jwt.NewWithClaims(tt.method, a.cfg.stamp(testClaims()))
+			tkn.Header["kid"] = tt.kid
+			token, err := tkn.SignedString(tt.key)
+			require.NoError(t, err)
+
+			_, err = a.ValidateToken(token)
+			require.ErrorIs(t, err, ErrTokenSignatureInvalid)
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package auth
+
+import (
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// The roles a user can have. Admins manage users, managers manage the inventory and viewers can only look at it.
+const (
+	RoleAdmin   = "admin"
+	RoleManager = "manager"
+	RoleViewer  = "viewer"
+)
+
+// Roles lists every role that can be granted.
+var Roles = []string{RoleAdmin, RoleManager, RoleViewer}
+
+// Claims are the claims of every token service-app issues. Next to the registered claims they carry
+// the roles of the user at the time the token was issued and the space-delimited scopes the token
+// may be used for.
+//
+// Tokens issued to an OAuth2 client carry its id in ClientID. When the client acts on its own behalf,
+// through the client_credentials grant, the subject is the client id as well.
+//
+// AMR lists the methods the user authenticated with, as described by RFC 8176. SessionID is the id of the
+// login session the token was issued for, tokens of clients don't belong to one.
+//
+// When an admin impersonates a user, Act names the admin, as described by RFC 8693 section 4.1. The subject
+// stays the impersonated user, so the token sees exactly what that user sees.
+//
+// Requests authenticated with an API key get Claims as well, APIKeyID is the id of that key. It is
+// never part of a token.
+type Claims struct {
+	jwt.RegisteredClaims
+	Roles     []string `json:"roles,omitempty"`
+	Scope     string   `json:"scope,omitempty"`
+	ClientID  string   `json:"client_id,omitempty"`
+	AMR       []string `json:"amr,omitempty"`
+	SessionID string   `json:"sid,omitempty"`
+	Act       *Actor   `json:"act,omitempty"`
+	APIKeyID  uint     `json:"-"`
+}
+
+// Actor is the party acting on behalf of the subject of a token, see Claims.
+type Actor struct {
+	Subject string `json:"sub"`
+}
+
+// IsImpersonation reports whether somebody else acts on behalf of the user, like an admin helping them out.
+func (c Claims) IsImpersonation() bool {
+	return c.Act != nil
+}
+
+// IsClient reports whether the principal is an OAuth2 client rather than a user.
+func (c Claims) IsClient() bool {
+	return c.ClientID != "" && c.Subject == c.ClientID
+}
+
+// HasAMR reports whether the user authenticated with the given method.
+func (c Claims) HasAMR(method string) bool {
+	return containsString(c.AMR, method)
+}
+
+// HasRole reports whether the claims carry at least one of the given roles.
+func (c Claims) HasRole(roles ...string) bool {
+	for _, r := range roles {
+		if containsString(c.Roles, r) {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidRole reports whether role is one of the known Roles.
+func ValidRole(role string) bool {
+	return containsString(Roles, role)
+}
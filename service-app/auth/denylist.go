@@ -0,0 +1,208 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rs/zerolog/log"
+)
+
+// RevocationStore is the persistent storage behind a Denylist, models.Conn implements it.
+type RevocationStore interface {
+	RevokeToken(ctx context.Context, jti string, expiresAt time.Time) error
+	IsTokenRevoked(ctx context.Context, jti string) (bool, error)
+	RevokeSubject(ctx context.Context, subject string, revokedBefore, expiresAt time.Time) error
+	SubjectRevokedBefore(ctx context.Context, subject string) (time.Time, error)
+	PruneRevokedTokens(ctx context.Context) (int64, error)
+}
+
+// cacheEntry remembers the result of a denylist lookup until 'until'.
+type cacheEntry struct {
+	revoked bool
+	until   time.Time
+}
+
+// subjectEntry remembers up to when the tokens of a subject are revoked, until 'until'.
+type subjectEntry struct {
+	revokedBefore time.Time
+	until         time.Time
+}
+
+// Denylist keeps track of access tokens that were revoked before they expired.
+// Lookups are cached so that validating a request doesn't hit the database every time. A revoked jti
+// stays cached until its token expires, a jti that is not revoked is only trusted for cacheTTL,
+// which bounds how long a token revoked by another instance of the app keeps working.
+//
+// Next to single tokens, all tokens of a subject issued up to some point in time can be revoked at once.
+type Denylist struct {
+	store    RevocationStore
+	cacheTTL time.Duration
+
+	mu       sync.Mutex
+	cache    map[string]cacheEntry
+	subjects map[string]subjectEntry
+}
+
+// NewDenylist is a constructor function for Denylist. It returns an error if store is nil.
+func NewDenylist(store RevocationStore, cacheTTL time.Duration) (*Denylist, error) {
+	if store == nil {
+		return nil, errors.New("revocation store cannot be nil")
+	}
+	return &Denylist{
+		store:    store,
+		cacheTTL: cacheTTL,
+		cache:    make(map[string]cacheEntry),
+		subjects: make(map[string]subjectEntry),
+	}, nil
+}
+
+// Revoke puts the token described by claims on the denylist until it expires.
+func (d *Denylist) Revoke(ctx context.Context, claims jwt.RegisteredClaims) error {
+	if claims.ID == "" {
+		return errors.New("token has no jti")
+	}
+	if claims.ExpiresAt == nil {
+		return errors.New("token has no expiry")
+	}
+
+	err := d.store.RevokeToken(ctx, claims.ID, claims.ExpiresAt.Time)
+	if err != nil {
+		return err
+	}
+
+	d.remember(claims.ID, true, claims.ExpiresAt.Time)
+	return nil
+}
+
+// RevokeSubject revokes every token of subject issued until now. until is when the last of those tokens
+// expires, the denylist forgets about the subject after that.
+func (d *Denylist) RevokeSubject(ctx context.Context, subject string, until time.Time) error {
+	if subject == "" {
+		return errors.New("subject cannot be empty")
+	}
+
+	now := time.Now()
+	err := d.store.RevokeSubject(ctx, subject, now, until)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	// The subject can be revoked again by another instance, so the cutoff is only trusted for cacheTTL
+	d.subjects[subject] = subjectEntry{revokedBefore: now, until: now.Add(d.cacheTTL)}
+	return nil
+}
+
+// IsRevoked reports whether the token described by claims was revoked, on its own or together with every
+// other token of its subject. Tokens without a jti can't be revoked, so they are reported as revoked as well.
+func (d *Denylist) IsRevoked(ctx context.Context, claims jwt.RegisteredClaims) (bool, error) {
+	if claims.ID == "" {
+		return true, nil
+	}
+
+	revoked, err := d.isSubjectRevoked(ctx, claims)
+	if err != nil || revoked {
+		return revoked, err
+	}
+
+	d.mu.Lock()
+	e, ok := d.cache[claims.ID]
+	d.mu.Unlock()
+	if ok && time.Now().Before(e.until) {
+		return e.revoked, nil
+	}
+
+	revoked, err = d.store.IsTokenRevoked(ctx, claims.ID)
+	if err != nil {
+		return false, fmt.Errorf("checking denylist %w", err)
+	}
+
+	until := time.Now().Add(d.cacheTTL)
+	if revoked && claims.ExpiresAt != nil {
+		until = claims.ExpiresAt.Time
+	}
+	d.remember(claims.ID, revoked, until)
+	return revoked, nil
+}
+
+// isSubjectRevoked reports whether the token was issued before every token of its subject was revoked.
+// iat only has a precision of seconds, so a token issued in the same second as the revocation counts as
+// issued before it.
+func (d *Denylist) isSubjectRevoked(ctx context.Context, claims jwt.RegisteredClaims) (bool, error) {
+	if claims.Subject == "" {
+		return false, nil
+	}
+
+	d.mu.Lock()
+	e, ok := d.subjects[claims.Subject]
+	d.mu.Unlock()
+	if !ok || !time.Now().Before(e.until) {
+		revokedBefore, err := d.store.SubjectRevokedBefore(ctx, claims.Subject)
+		if err != nil {
+			return false, fmt.Errorf("checking denylist %w", err)
+		}
+		e = subjectEntry{revokedBefore: revokedBefore, until: time.Now().Add(d.cacheTTL)}
+		d.mu.Lock()
+		d.subjects[claims.Subject] = e
+		d.mu.Unlock()
+	}
+
+	if e.revokedBefore.IsZero() {
+		return false, nil
+	}
+	// Tokens without iat can't prove they were issued afterwards
+	if claims.IssuedAt == nil {
+		return true, nil
+	}
+	return !claims.IssuedAt.After(e.revokedBefore.Truncate(time.Second)), nil
+}
+
+// remember stores the result of a lookup in the cache.
+func (d *Denylist) remember(jti string, revoked bool, until time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.cache[jti] = cacheEntry{revoked: revoked, until: until}
+}
+
+// Prune removes the entries of tokens that have expired from the store and from the cache.
+func (d *Denylist) Prune(ctx context.Context) (int64, error) {
+	now := time.Now()
+	d.mu.Lock()
+	for jti, e := range d.cache {
+		if now.After(e.until) {
+			delete(d.cache, jti)
+		}
+	}
+	for sub, e := range d.subjects {
+		if now.After(e.until) {
+			delete(d.subjects, sub)
+		}
+	}
+	d.mu.Unlock()
+
+	return d.store.PruneRevokedTokens(ctx)
+}
+
+// PruneEvery calls Prune every interval until ctx is cancelled. It is meant to be run in its own goroutine.
+func (d *Denylist) PruneEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := d.Prune(ctx)
+			if err != nil {
+				log.Error().Err(err).Msg("pruning denylist")
+				continue
+			}
+			log.Info().Int64("pruned", n).Msg("denylist pruned")
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package auth
+
+import (
+	"fmt"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// UserInfo are the OpenID Connect claims about a user. Name is only filled in with the profile scope, Email and
+// EmailVerified only with the email scope.
+type UserInfo struct {
+	Name          string `json:"name,omitempty"`
+	Email         string `json:"email,omitempty"`
+	EmailVerified *bool  `json:"email_verified,omitempty"`
+}
+
+// IDClaims are the claims of an OpenID Connect ID token. The audience is the client the user logged in to and
+// Nonce is the nonce that client sent to the authorization endpoint. AuthTime is when the user authenticated,
+// AMR how.
+type IDClaims struct {
+	jwt.RegisteredClaims
+	Nonce           string           `json:"nonce,omitempty"`
+	AuthTime        *jwt.NumericDate `json:"auth_time,omitempty"`
+	AuthorizedParty string           `json:"azp,omitempty"`
+	AMR             []string         `json:"amr,omitempty"`
+	UserInfo
+}
+
+// GenerateIDToken signs an ID token with the claims using the active key, with its kid in the header. Unlike
+// access tokens nothing is filled in, the issuer and the audience are up to the caller.
+func (a *Auth) GenerateIDToken(claims IDClaims) (string, error) {
+	k, err := a.keys.Active()
+	if err != nil {
+		return "", err
+	}
+
+	tkn := jwt.NewWithClaims(k.Algorithm, claims)
+	tkn.Header["kid"] = k.ID
+	tokenStr, err := tkn.SignedString(k.PrivateKey)
+	if err != nil {
+		return "", fmt.Errorf("signing id token %w", err)
+	}
+	return tokenStr, nil
+}
+
+// GenerateIDToken signs an ID token like Auth.GenerateIDToken. OpenID Connect only knows JWTs, so ID tokens are
+// JWTs signed with the same Ed25519 keys even though access tokens are PASETO tokens.
+func (p *Paseto) GenerateIDToken(claims IDClaims) (string, error) {
+	a := Auth{keys: p.keys, cfg: p.cfg}
+	return a.GenerateIDToken(claims)
+}
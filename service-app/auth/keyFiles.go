@@ -0,0 +1,147 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The kinds of keys GenerateKey can create, with the algorithm their tokens are signed with.
+const (
+	KeyTypeRSA     = "rsa"     // RS256
+	KeyTypeECDSA   = "ecdsa"   // ES256 on P-256
+	KeyTypeEd25519 = "ed25519" // EdDSA
+)
+
+// GenerateKey creates a new private key of the given type. rsaBits is the size of RSA keys, at least 2048.
+func GenerateKey(keyType string, rsaBits int) (crypto.PrivateKey, error) {
+	switch keyType {
+	case KeyTypeRSA:
+		if rsaBits < 2048 {
+			return nil, fmt.Errorf("rsa keys need at least 2048 bits, not %d", rsaBits)
+		}
+		return rsa.GenerateKey(rand.Reader, rsaBits)
+	case KeyTypeECDSA:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyTypeEd25519:
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		return priv, err
+	}
+	return nil, fmt.Errorf("unknown key type %q, use %s, %s or %s", keyType, KeyTypeRSA, KeyTypeECDSA, KeyTypeEd25519)
+}
+
+// MarshalPrivateKeyPEM encodes a private key as a PKCS #8 PEM block, which ParsePrivateKeyPEM reads.
+func MarshalPrivateKeyPEM(priv crypto.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, fmt.Errorf("encoding private key %w", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// MarshalPublicKeyPEM encodes a public key as a PKIX PEM block, like `openssl pkey -pubout` does.
+func MarshalPublicKeyPEM(pub crypto.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, fmt.Errorf("encoding public key %w", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
+
+// WriteNewFile writes data to a file that must not exist yet, with the given permissions. Keys are never
+// overwritten, a lost private key can't be recovered.
+func WriteNewFile(name string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err != nil {
+		f.Close()
+		return errors.Join(err, os.Remove(name))
+	}
+	return f.Close()
+}
+
+// RotateKeySetDir stores priv in the keyset directory dir, see LoadKeySet, and makes it the active key.
+// The directory is created if it doesn't exist. The previously active key stays in the directory, so that
+// tokens signed with it stay valid until they expire; retire it with RetireKeySetDir after that.
+// The kid of the new key is returned.
+func RotateKeySetDir(dir string, priv crypto.PrivateKey) (string, error) {
+	k := SigningKey{PrivateKey: priv}
+	err := k.complete()
+	if err != nil {
+		return "", err
+	}
+	kid, err := Thumbprint(k.PublicKey)
+	if err != nil {
+		return "", err
+	}
+	b, err := MarshalPrivateKeyPEM(priv)
+	if err != nil {
+		return "", err
+	}
+
+	// Only the user running the app may read the private keys
+	err = os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return "", fmt.Errorf("creating keyset directory %w", err)
+	}
+	err = WriteNewFile(filepath.Join(dir, kid+".pem"), b, 0o600)
+	if err != nil {
+		return "", fmt.Errorf("writing key %w", err)
+	}
+
+	err = replaceFile(filepath.Join(dir, ActiveKeyFile), []byte(kid+"\n"), 0o600)
+	if err != nil {
+		return "", fmt.Errorf("activating key %w", err)
+	}
+	return kid, nil
+}
+
+// RetireKeySetDir marks the key kid of the keyset directory dir as retired, tokens signed with it aren't
+// accepted anymore. The active key can't be retired.
+func RetireKeySetDir(dir, kid string) error {
+	ks, err := LoadKeySet(dir)
+	if err != nil {
+		return err
+	}
+	// Retire checks that the key exists and isn't the active one
+	err = ks.Retire(kid)
+	if err != nil {
+		return err
+	}
+
+	var retired []string
+	for _, k := range ks.Keys() {
+		if k.Retired {
+			retired = append(retired, k.ID)
+		}
+	}
+	return replaceFile(filepath.Join(dir, RetiredKeysFile), []byte(strings.Join(retired, "\n")+"\n"), 0o600)
+}
+
+// replaceFile writes data to a temporary file next to name and renames it to name, so that the app never
+// reads a half written file.
+func replaceFile(name string, data []byte, perm os.FileMode) error {
+	tmp := name + ".tmp"
+	err := os.WriteFile(tmp, data, perm)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, name)
+	if err != nil {
+		return errors.Join(err, os.Remove(tmp))
+	}
+	return nil
+}
@@ -0,0 +1,423 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// SigningKey is one key of a KeySet. ID is the kid that is stamped into the header of every token
+// signed with the key and Algorithm is the only signing method tokens with that kid are accepted with.
+//
+// The key material depends on the algorithm: *rsa.PrivateKey for RS256, *ecdsa.PrivateKey on P-256 for ES256,
+// ed25519.PrivateKey for EdDSA and the shared secret as []byte for HS256. PrivateKey may be nil for asymmetric
+// keys that are only used to verify tokens, PublicKey is derived from PrivateKey when it is nil.
+type SigningKey struct {
+	ID         string
+	Algorithm  jwt.SigningMethod
+	PrivateKey crypto.PrivateKey
+	PublicKey  crypto.PublicKey
+	CreatedAt  time.Time
+	Retired    bool
+}
+
+// minHMACSecret is the shortest HS256 secret that is accepted, as long as the SHA-256 output.
+const minHMACSecret = 32
+
+// complete fills in the algorithm and public key when they can be derived from the private key, and checks
+// that the key material matches the algorithm.
+func (k *SigningKey) complete() error {
+	if k.PrivateKey == nil && k.PublicKey == nil {
+		return errors.New("signing key needs a private or a public key")
+	}
+
+	if k.PublicKey == nil {
+		switch priv := k.PrivateKey.(type) {
+		case *rsa.PrivateKey:
+			k.PublicKey = &priv.PublicKey
+		case *ecdsa.PrivateKey:
+			k.PublicKey = &priv.PublicKey
+		case ed25519.PrivateKey:
+			k.PublicKey = priv.Public()
+		case []byte:
+			k.PublicKey = priv
+		default:
+			return fmt.Errorf("unsupported private key type %T", k.PrivateKey)
+		}
+	}
+
+	if k.Algorithm == nil {
+		switch k.PublicKey.(type) {
+		case *rsa.PublicKey:
+			k.Algorithm = jwt.SigningMethodRS256
+		case *ecdsa.PublicKey:
+			k.Algorithm = jwt.SigningMethodES256
+		case ed25519.PublicKey:
+			k.Algorithm = jwt.SigningMethodEdDSA
+		case []byte:
+			k.Algorithm = jwt.SigningMethodHS256
+		}
+	}
+
+	// Only the key types that belong to the algorithm are accepted, so a key can never be used
+	// with another algorithm than the one it was configured for.
+	switch k.Algorithm {
+	case jwt.SigningMethodRS256:
+		pub, ok := k.PublicKey.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("%s needs an RSA key", k.Algorithm.Alg())
+		}
+		if pub.N.BitLen() < 2048 {
+			return fmt.Errorf("%s needs an RSA key of at least 2048 bits", k.Algorithm.Alg())
+		}
+	case jwt.SigningMethodES256:
+		pub, ok := k.PublicKey.(*ecdsa.PublicKey)
+		if !ok || pub.Curve != elliptic.P256() {
+			return fmt.Errorf("%s needs an ECDSA P-256 key", k.Algorithm.Alg())
+		}
+	case jwt.SigningMethodEdDSA:
+		_, ok := k.PublicKey.(ed25519.PublicKey)
+		if !ok {
+			return fmt.Errorf("%s needs an Ed25519 key", k.Algorithm.Alg())
+		}
+	case jwt.SigningMethodHS256:
+		secret, ok := k.PublicKey.([]byte)
+		if !ok {
+			return fmt.Errorf("%s needs a secret", k.Algorithm.Alg())
+		}
+		// The same secret signs and verifies.
+		k.PrivateKey = secret
+		if len(secret) < minHMACSecret {
+			return fmt.Errorf("%s needs a secret of at least %d bytes", k.Algorithm.Alg(), minHMACSecret)
+		}
+		// A kid derived from the secret would leak information about it.
+		if k.ID == "" {
+			return fmt.Errorf("%s keys need an explicit kid", k.Algorithm.Alg())
+		}
+	default:
+		return fmt.Errorf("unsupported signing algorithm %v", k.Algorithm)
+	}
+	return nil
+}
+
+// Symmetric reports whether the key is a shared secret, which must never be published.
+func (k SigningKey) Symmetric() bool {
+	return k.Algorithm == jwt.SigningMethodHS256
+}
+
+// KeySet holds every key that service-app knows about. Tokens are signed with the active key and verified
+// with whichever key their kid points to, as long as that key hasn't been retired. Keeping the previous key
+// around after a rotation lets tokens signed with it stay valid until they expire.
+type KeySet struct {
+	mu     sync.RWMutex
+	keys   []*SigningKey
+	active string
+}
+
+// NewKeySet returns an empty KeySet.
+func NewKeySet() *KeySet {
+	return &KeySet{}
+}
+
+// Add puts a key into the set. The first key that has a private key becomes the active one.
+func (ks *KeySet) Add(k SigningKey) error {
+	err := k.complete()
+	if err != nil {
+		return err
+	}
+	if k.ID == "" {
+		kid, err := Thumbprint(k.PublicKey)
+		if err != nil {
+			return err
+		}
+		k.ID = kid
+	}
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	for _, existing := range ks.keys {
+		if existing.ID == k.ID {
+			return fmt.Errorf("key %q already exists", k.ID)
+		}
+	}
+	ks.keys = append(ks.keys, &k)
+	if ks.active == "" && k.PrivateKey != nil && !k.Retired {
+		ks.active = k.ID
+	}
+	return nil
+}
+
+// Activate makes the key with the given kid the one new tokens are signed with.
+func (ks *KeySet) Activate(kid string) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	k := ks.find(kid)
+	if k == nil {
+		return fmt.Errorf("key %q not found", kid)
+	}
+	if k.PrivateKey == nil || k.Retired {
+		return fmt.Errorf("key %q can't sign tokens", kid)
+	}
+	ks.active = kid
+	return nil
+}
+
+// Retire stops the key with the given kid from being used to verify tokens, and from being published.
+// The active key can't be retired.
+func (ks *KeySet) Retire(kid string) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	k := ks.find(kid)
+	if k == nil {
+		return fmt.Errorf("key %q not found", kid)
+	}
+	if ks.active == kid {
+		return fmt.Errorf("key %q is active, activate another key first", kid)
+	}
+	k.Retired = true
+	return nil
+}
+
+// Active returns the key new tokens are signed with.
+func (ks *KeySet) Active() (SigningKey, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	k := ks.find(ks.active)
+	if k == nil {
+		return SigningKey{}, errors.New("keyset has no active key")
+	}
+	return *k, nil
+}
+
+// Verifier returns the key a token with the given kid has to be verified with.
+func (ks *KeySet) Verifier(kid string) (SigningKey, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	k := ks.find(kid)
+	if k == nil || k.Retired {
+		return SigningKey{}, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return *k, nil
+}
+
+// Keys returns a copy of every key in the set.
+func (ks *KeySet) Keys() []SigningKey {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	keys := make([]SigningKey, 0, len(ks.keys))
+	for _, k := range ks.keys {
+		keys = append(keys, *k)
+	}
+	return keys
+}
+
+// find must be called with ks.mu held.
+func (ks *KeySet) find(kid string) *SigningKey {
+	for _, k := range ks.keys {
+		if k.ID == kid {
+			return k
+		}
+	}
+	return nil
+}
+
+// JSONWebKey is the public part of a signing key as described by RFC 7517 and RFC 8037.
+// Which members are set depends on the key type.
+type JSONWebKey struct {
+	Kty string `json:"kty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Kid string `json:"kid,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JSONWebKeySet is the document served at /.well-known/jwks.json.
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+// JWKS returns the public keys of every asymmetric key that hasn't been retired, so that other services
+// can verify tokens issued by service-app on their own.
+func (ks *KeySet) JWKS() JSONWebKeySet {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	set := JSONWebKeySet{Keys: make([]JSONWebKey, 0, len(ks.keys))}
+	for _, k := range ks.keys {
+		if k.Retired || k.Symmetric() {
+			continue
+		}
+		jwk, err := publicJWK(k.PublicKey)
+		if err != nil {
+			continue
+		}
+		jwk.Use = "sig"
+		jwk.Alg = k.Algorithm.Alg()
+		jwk.Kid = k.ID
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set
+}
+
+// publicJWK returns the members of the JWK that describe the public key itself.
+func publicJWK(pub crypto.PublicKey) (JSONWebKey, error) {
+	b64 := base64.RawURLEncoding.EncodeToString
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		return JSONWebKey{
+			Kty: "RSA",
+			N:   b64(pub.N.Bytes()),
+			E:   b64(big.NewInt(int64(pub.E)).Bytes()),
+		}, nil
+	case *ecdsa.PublicKey:
+		// The coordinates have the full size of the curve, including leading zeros.
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		return JSONWebKey{
+			Kty: "EC",
+			Crv: pub.Curve.Params().Name,
+			X:   b64(pub.X.FillBytes(make([]byte, size))),
+			Y:   b64(pub.Y.FillBytes(make([]byte, size))),
+		}, nil
+	case ed25519.PublicKey:
+		return JSONWebKey{
+			Kty: "OKP",
+			Crv: "Ed25519",
+			X:   b64(pub),
+		}, nil
+	}
+	return JSONWebKey{}, fmt.Errorf("unsupported public key type %T", pub)
+}
+
+// Thumbprint computes the RFC 7638 JWK thumbprint of a public key, which is used as its kid
+// when no other id is given.
+func Thumbprint(pub crypto.PublicKey) (string, error) {
+	jwk, err := publicJWK(pub)
+	if err != nil {
+		return "", err
+	}
+	// Only the required members take part, in lexicographic order and without whitespace. The
+	// omitempty tags leave out the members that don't belong to the key type.
+	b, err := json.Marshal(struct {
+		Crv string `json:"crv,omitempty"`
+		E   string `json:"e,omitempty"`
+		Kty string `json:"kty"`
+		N   string `json:"n,omitempty"`
+		X   string `json:"x,omitempty"`
+		Y   string `json:"y,omitempty"`
+	}{Crv: jwk.Crv, E: jwk.E, Kty: jwk.Kty, N: jwk.N, X: jwk.X, Y: jwk.Y})
+	if err != nil {
+		return "", fmt.Errorf("computing thumbprint %w", err)
+	}
+	sum := sha256.Sum256(b)
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// ParsePrivateKeyPEM parses a PEM encoded RSA, ECDSA or Ed25519 private key in PKCS #1, SEC 1 or PKCS #8 form.
+func ParsePrivateKeyPEM(b []byte) (crypto.PrivateKey, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		return x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+}
+
+// ActiveKeyFile and RetiredKeysFile are the files of a keyset directory that record which key is active
+// and which keys have been retired.
+const (
+	ActiveKeyFile   = "active"
+	RetiredKeysFile = "retired"
+)
+
+// LoadKeySet reads a keyset directory. Every private key is stored PEM encoded in a file named <kid>.pem,
+// HS256 secrets are stored as raw bytes in files named <kid>.secret. The kid of the active key is stored
+// in the 'active' file and the kids of retired keys, one per line, in the 'retired' file.
+func LoadKeySet(dir string) (*KeySet, error) {
+	pems, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, fmt.Errorf("listing keys %w", err)
+	}
+	secrets, err := filepath.Glob(filepath.Join(dir, "*.secret"))
+	if err != nil {
+		return nil, fmt.Errorf("listing keys %w", err)
+	}
+	files := append(pems, secrets...)
+	sort.Strings(files)
+
+	retired := make(map[string]bool)
+	b, err := os.ReadFile(filepath.Join(dir, RetiredKeysFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("reading retired keys %w", err)
+	}
+	for _, kid := range strings.Fields(string(b)) {
+		retired[kid] = true
+	}
+
+	ks := NewKeySet()
+	for _, f := range files {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("reading key %w", err)
+		}
+		ext := filepath.Ext(f)
+		var privateKey crypto.PrivateKey = b
+		if ext == ".pem" {
+			privateKey, err = ParsePrivateKeyPEM(b)
+			if err != nil {
+				return nil, fmt.Errorf("parsing key %s %w", f, err)
+			}
+		}
+		info, err := os.Stat(f)
+		if err != nil {
+			return nil, err
+		}
+		kid := strings.TrimSuffix(filepath.Base(f), ext)
+		err = ks.Add(SigningKey{
+			ID:         kid,
+			PrivateKey: privateKey,
+			CreatedAt:  info.ModTime(),
+			Retired:    retired[kid],
+		})
+		if err != nil {
+			return nil, fmt.Errorf("adding key %s %w", f, err)
+		}
+	}
+
+	active, err := os.ReadFile(filepath.Join(dir, ActiveKeyFile))
+	if err != nil {
+		return nil, fmt.Errorf("reading active key %w", err)
+	}
+	err = ks.Activate(strings.TrimSpace(string(active)))
+	if err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
@@ -0,0 +1,167 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/require"
+)
+
+// testClaims returns claims that pass DefaultRequiredClaims.
+func testClaims() Claims {
+	now := time.Now()
+	return Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   "7",
+			ID:        "jti-1",
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Minute)),
+		},
+		Scope: ScopeInventoryRead,
+	}
+}
+
+func newTestAuth(t *testing.T, ks *KeySet) *Auth {
+	a, err := NewAuth(ks, Config{Issuer: "service-app", Audience: "api", RequiredClaims: DefaultRequiredClaims})
+	require.NoError(t, err)
+	return a
+}
+
+// The example key of RFC 7638 section 3.1, with the thumbprint the RFC computes for it.
+func TestThumbprint(t *testing.T) {
+	n, err := base64.RawURLEncoding.DecodeString("0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4" +
+		"cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4Qy" +
+		"Q5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6" +
+		"WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw")
+	require.NoError(t, err)
+	pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: 65537}
+
+	kid, err := Thumbprint(pub)
+	require.NoError(t, err)
+	require.Equal(t, "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs", kid)
+
+	// Adding the key without an id makes the thumbprint its kid
+	ks := NewKeySet()
+	require.NoError(t, ks.Add(SigningKey{PublicKey: pub}))
+	k, err := ks.Verifier(kid)
+	require.NoError(t, err)
+	require.Equal(t, jwt.SigningMethodRS256, k.Algorithm)
+}
+
+func TestKeyRotation(t *testing.T) {
+	_, oldKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	newKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	ks := NewKeySet()
+	require.NoError(t, ks.Add(SigningKey{ID: "old", PrivateKey: oldKey}))
+	require.NoError(t, ks.Add(SigningKey{ID: "new", PrivateKey: newKey}))
+	a := newTestAuth(t, ks)
+
+	// The first key with a private key is the active one
+	signedWithOld, err := a.GenerateToken(testClaims())
+	require.NoError(t, err)
+	require.Error(t, ks.Retire("old"), "the active key can't be retired")
+
+	require.NoError(t, ks.Activate("new"))
+	signedWithNew, err := a.GenerateToken(testClaims())
+	require.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		token  string
+		retire bool
+		kid    string
+		valid  bool
+	}{
+		{name: "active key", token: signedWithNew, kid: "new", valid: true},
+		{name: "previous key", token: signedWithOld, kid: "old", valid: true},
+		{name: "retired key", token: signedWithOld, kid: "old", retire: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.retire {
+				require.NoError(t, ks.Retire(tt.kid))
+			}
+			tkn, _, err := jwt.NewParser().ParseUnverified(tt.token, &Claims{})
+			require.NoError(t, err)
+			require.Equal(t, tt.kid, tkn.Header["kid"])
+
+			_, err = a.ValidateToken(tt.token)
+			if !tt.valid {
+				require.ErrorIs(t, err, ErrTokenSignatureInvalid)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestValidateTokenKid(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	ks := NewKeySet()
+	require.NoError(t, ks.Add(SigningKey{ID: "k1", PrivateKey: key}))
+	a := newTestAuth(t, ks)
+
+	tests := []struct {
+		name string
+		kid  any
+	}{
+		{name: "missing kid"},
+		{name: "unknown kid", kid: "k2"},
+		{name: "kid is no string", kid: 1},
+		{name: "empty kid", kid: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := a.cfg.stamp(testClaims())
+			tkn := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+			if tt.kid != nil {
+				tkn.Header["kid"] = tt.kid
+			}
+			token, err := tkn.SignedString(key)
+			require.NoError(t, err)
+
+			_, err = a.ValidateToken(token)
+			require.ErrorIs(t, err, ErrTokenSignatureInvalid)
+		})
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	retiredKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	ks := NewKeySet()
+	require.NoError(t, ks.Add(SigningKey{ID: "rsa", PrivateKey: rsaKey}))
+	require.NoError(t, ks.Add(SigningKey{ID: "ec", PrivateKey: ecKey}))
+	require.NoError(t, ks.Add(SigningKey{ID: "ed", PrivateKey: edKey}))
+	require.NoError(t, ks.Add(SigningKey{ID: "hmac", PrivateKey: make([]byte, 32)}))
+	require.NoError(t, ks.Add(SigningKey{ID: "retired", PrivateKey: retiredKey, Retired: true}))
+
+	b64 := base64.RawURLEncoding.EncodeToString
+	want := []JSONWebKey{
+		{Kty: "RSA", Use: "sig", Alg: "RS256", Kid: "rsa", N: b64(rsaKey.N.Bytes()), E: "AQAB"},
+		{Kty: "EC", Use: "sig", Alg: "ES256", Kid: "ec", Crv: "P-256",
+			X: b64(ecKey.X.FillBytes(make([]byte, 32))), Y: b64(ecKey.Y.FillBytes(make([]byte, 32)))},
+		{Kty: "OKP", Use: "sig", Alg: "EdDSA", Kid: "ed", Crv: "Ed25519", X: b64(edPub)},
+	}
+	// Secrets and retired keys are never published
+	require.Equal(t, want, ks.JWKS().Keys)
+}
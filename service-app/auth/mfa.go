@@ -0,0 +1,56 @@
+package auth
+
+import (
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// The authentication methods of the amr claim, from RFC 8176. AMRFederated and AMREmail aren't part of it, but
+// identity providers commonly use them for users who logged in with another identity provider or with a link
+// they were mailed.
+const (
+	AMRPassword    = "pwd"
+	AMROTP         = "otp"
+	AMRMFA         = "mfa"
+	AMRHardwareKey = "hwk"
+	AMRFederated   = "fed"
+	AMREmail       = "email"
+)
+
+// MFAChallengeTTL is how long a user has to enter their second factor after the password was right.
+const MFAChallengeTTL = 5 * time.Minute
+
+// mfaAudience is the audience of MFA challenge tokens. It differs from the configured audience, so a
+// challenge token is never accepted as an access token and the other way around.
+func (cfg Config) mfaAudience() string {
+	return cfg.Audience + "/mfa"
+}
+
+// mfaChallengeClaims are the claims of the MFA challenge token for the access token with the given claims.
+// They carry its subject, scope and jti, and the amr of the first factor the user passed.
+func (cfg Config) mfaChallengeClaims(claims Claims) Claims {
+	now := time.Now()
+	return Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   claims.Subject,
+			Audience:  jwt.ClaimStrings{cfg.mfaAudience()},
+			ExpiresAt: jwt.NewNumericDate(now.Add(MFAChallengeTTL)),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ID:        claims.ID,
+		},
+		Scope: claims.Scope,
+		AMR:   claims.AMR,
+	}
+}
+
+// GenerateMFAChallenge issues a short-lived token that proves the user got their password right. It carries the
+// subject, scope and jti of claims, the claims of the access token the user will get once they pass the second factor.
+func (a *Auth) GenerateMFAChallenge(claims Claims) (string, error) {
+	return a.GenerateToken(a.cfg.mfaChallengeClaims(claims))
+}
+
+// ValidateMFAChallenge validates a token issued by GenerateMFAChallenge like ValidateToken validates access tokens.
+func (a *Auth) ValidateMFAChallenge(token string) (Claims, error) {
+	return a.validate(token, a.cfg.mfaAudience())
+}
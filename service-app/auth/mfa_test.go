@@ -0,0 +1,74 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestTokens returns the Tokens of the format, with a fresh Ed25519 key that both formats can sign with.
+func newTestTokens(t *testing.T, cfg Config) Tokens {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	ks := NewKeySet()
+	require.NoError(t, ks.Add(SigningKey{PrivateKey: priv}))
+	tokens, err := NewTokens(ks, cfg)
+	require.NoError(t, err)
+	return tokens
+}
+
+func TestConfigRequiresAudience(t *testing.T) {
+	for _, format := range []string{FormatJWT, FormatPASETO} {
+		t.Run(format, func(t *testing.T) {
+			_, priv, err := ed25519.GenerateKey(rand.Reader)
+			require.NoError(t, err)
+			ks := NewKeySet()
+			require.NoError(t, ks.Add(SigningKey{PrivateKey: priv}))
+			_, err = NewTokens(ks, Config{Issuer: "service-app", Format: format})
+			require.Error(t, err)
+		})
+	}
+}
+
+// An MFA challenge only proves the first factor, it must never pass as an access token, and an access token
+// must not stand in for a challenge either.
+func TestMFAChallengeIsNoAccessToken(t *testing.T) {
+	for _, format := range []string{FormatJWT, FormatPASETO} {
+		t.Run(format, func(t *testing.T) {
+			tokens := newTestTokens(t, Config{Issuer: "service-app", Audience: "api",
+				RequiredClaims: DefaultRequiredClaims, Format: format})
+			now := time.Now()
+			claims := Claims{
+				RegisteredClaims: jwt.RegisteredClaims{
+					Subject:   "7",
+					ID:        "jti-1",
+					IssuedAt:  jwt.NewNumericDate(now),
+					ExpiresAt: jwt.NewNumericDate(now.Add(time.Minute)),
+				},
+				Scope: ScopeInventoryRead,
+				AMR:   []string{AMRPassword},
+			}
+
+			challenge, err := tokens.GenerateMFAChallenge(claims)
+			require.NoError(t, err)
+			_, err = tokens.ValidateToken(challenge)
+			require.ErrorIs(t, err, ErrTokenInvalidAudience)
+			got, err := tokens.ValidateMFAChallenge(challenge)
+			require.NoError(t, err)
+			require.Equal(t, "7", got.Subject)
+			require.Equal(t, ScopeInventoryRead, got.Scope)
+			require.Equal(t, []string{AMRPassword}, got.AMR)
+
+			access, err := tokens.GenerateToken(claims)
+			require.NoError(t, err)
+			_, err = tokens.ValidateMFAChallenge(access)
+			require.ErrorIs(t, err, ErrTokenInvalidAudience)
+			_, err = tokens.ValidateToken(access)
+			require.NoError(t, err)
+		})
+	}
+}
@@ -0,0 +1,247 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// pasetoHeader starts every token issued by Paseto. Version and purpose are fixed, there is no alg header to pick
+// a weaker algorithm with.
+const pasetoHeader = "v4.public."
+
+// maxPasetoFooter is the largest footer that is parsed, a footer is only ever a kid.
+const maxPasetoFooter = 1024
+
+// Paseto issues and validates PASETO v4.public tokens, which are signed with Ed25519. The kid of the key is in the
+// footer of the token, which is signed as well. The claims are the same as those of the JWTs Auth issues, except
+// that exp, nbf and iat are RFC 3339 timestamps as PASETO requires.
+type Paseto struct {
+	keys *KeySet
+	cfg  Config
+}
+
+// pasetoFooter is the footer of the tokens issued by Paseto.
+type pasetoFooter struct {
+	Kid string `json:"kid"`
+}
+
+// NewPaseto is a constructor function for Paseto. The active key of keys has to be an Ed25519 key, other keys in the
+// set are never used to verify tokens.
+func NewPaseto(keys *KeySet, cfg Config) (*Paseto, error) {
+	if keys == nil {
+		return nil, errors.New("keyset cannot be nil")
+	}
+	k, err := keys.Active()
+	if err != nil {
+		return nil, err
+	}
+	if k.Algorithm != jwt.SigningMethodEdDSA {
+		return nil, fmt.Errorf("paseto v4.public needs an Ed25519 key, the active key %q is %s", k.ID, k.Algorithm.Alg())
+	}
+	err = cfg.check()
+	if err != nil {
+		return nil, err
+	}
+	return &Paseto{keys: keys, cfg: cfg}, nil
+}
+
+// GenerateToken issues a PASETO v4.public token with the claims, filling in the configured issuer and audience
+// if they are missing. It is signed with the active key.
+func (p *Paseto) GenerateToken(claims Claims) (string, error) {
+	k, err := p.keys.Active()
+	if err != nil {
+		return "", err
+	}
+	priv, ok := k.PrivateKey.(ed25519.PrivateKey)
+	if !ok {
+		return "", fmt.Errorf("active key %q is not an Ed25519 key", k.ID)
+	}
+
+	payload, err := pasetoPayload(p.cfg.stamp(claims))
+	if err != nil {
+		return "", err
+	}
+	footer, err := json.Marshal(pasetoFooter{Kid: k.ID})
+	if err != nil {
+		return "", fmt.Errorf("encoding footer %w", err)
+	}
+
+	// There is no implicit assertion, so the last piece is empty
+	sig := ed25519.Sign(priv, pae([]byte(pasetoHeader), payload, footer, nil))
+
+	b64 := base64.RawURLEncoding.EncodeToString
+	return pasetoHeader + b64(append(payload, sig...)) + "." + b64(footer), nil
+}
+
+// ValidateToken verifies the PASETO token with the key its footer names, checks its claims against the Config and
+// returns them if the token is valid. If it isn't, it returns a *ValidationError.
+func (p *Paseto) ValidateToken(token string) (Claims, error) {
+	return p.validate(token, p.cfg.Audience)
+}
+
+// GenerateMFAChallenge issues an MFA challenge token like Auth.GenerateMFAChallenge does, as a PASETO token.
+func (p *Paseto) GenerateMFAChallenge(claims Claims) (string, error) {
+	return p.GenerateToken(p.cfg.mfaChallengeClaims(claims))
+}
+
+// ValidateMFAChallenge validates a token issued by GenerateMFAChallenge like ValidateToken validates access tokens.
+func (p *Paseto) ValidateMFAChallenge(token string) (Claims, error) {
+	return p.validate(token, p.cfg.mfaAudience())
+}
+
+// JWKS returns the public keys that tokens issued by this Paseto can be verified with.
+func (p *Paseto) JWKS() JSONWebKeySet {
+	return p.keys.JWKS()
+}
+
+// validate checks the signature of the token and its claims, expecting the given audience.
+func (p *Paseto) validate(token string, audience string) (Claims, error) {
+	malformed := func(msg string) error {
+		return &ValidationError{Err: ErrTokenMalformed, Cause: errors.New(msg)}
+	}
+
+	rest, ok := strings.CutPrefix(token, pasetoHeader)
+	if !ok {
+		return Claims{}, malformed("not a v4.public token")
+	}
+	body64, footer64, _ := strings.Cut(rest, ".")
+	if len(footer64) > base64.RawURLEncoding.EncodedLen(maxPasetoFooter) {
+		return Claims{}, malformed("footer too long")
+	}
+	body, err := base64.RawURLEncoding.DecodeString(body64)
+	if err != nil {
+		return Claims{}, &ValidationError{Err: ErrTokenMalformed, Cause: err}
+	}
+	footer, err := base64.RawURLEncoding.DecodeString(footer64)
+	if err != nil {
+		return Claims{}, &ValidationError{Err: ErrTokenMalformed, Cause: err}
+	}
+	if len(body) <= ed25519.SignatureSize {
+		return Claims{}, malformed("token too short")
+	}
+	payload, sig := body[:len(body)-ed25519.SignatureSize], body[len(body)-ed25519.SignatureSize:]
+
+	// The footer is only trusted once the signature is verified, here it just names the key to verify with
+	var f pasetoFooter
+	err = json.Unmarshal(footer, &f)
+	if err != nil || f.Kid == "" {
+		return Claims{}, &ValidationError{Err: ErrTokenSignatureInvalid, Cause: errors.New("token has no kid in its footer")}
+	}
+	k, err := p.keys.Verifier(f.Kid)
+	if err != nil {
+		return Claims{}, &ValidationError{Err: ErrTokenSignatureInvalid, Cause: err}
+	}
+	pub, ok := k.PublicKey.(ed25519.PublicKey)
+	if !ok {
+		return Claims{}, &ValidationError{Err: ErrTokenSignatureInvalid,
+			Cause: fmt.Errorf("key %q is not an Ed25519 key", f.Kid)}
+	}
+	if !ed25519.Verify(pub, pae([]byte(pasetoHeader), payload, footer, nil), sig) {
+		return Claims{}, &ValidationError{Err: ErrTokenSignatureInvalid}
+	}
+
+	c, err := parsePasetoPayload(payload)
+	if err != nil {
+		return Claims{}, &ValidationError{Err: ErrTokenMalformed, Cause: err}
+	}
+	err = p.cfg.validateClaims(c.RegisteredClaims, audience)
+	if err != nil {
+		return Claims{}, err
+	}
+	return c, nil
+}
+
+// pae is the pre-authentication encoding of PASETO: the number of pieces followed by every piece prefixed with its
+// length, all as little-endian 64-bit integers. It keeps pieces from being shifted into each other.
+func pae(pieces ...[]byte) []byte {
+	b := binary.LittleEndian.AppendUint64(nil, uint64(len(pieces)))
+	for _, piece := range pieces {
+		b = binary.LittleEndian.AppendUint64(b, uint64(len(piece)))
+		b = append(b, piece...)
+	}
+	return b
+}
+
+// pasetoTimeClaims are the claims that are NumericDates in a JWT and RFC 3339 timestamps in a PASETO token.
+var pasetoTimeClaims = []string{"exp", "nbf", "iat"}
+
+// pasetoPayload encodes the claims as the payload of a PASETO token. A single audience is a plain string, like
+// PASETO expects.
+func pasetoPayload(claims Claims) ([]byte, error) {
+	b, err := json.Marshal(claims)
+	if err != nil {
+		return nil, fmt.Errorf("encoding claims %w", err)
+	}
+	var m map[string]json.RawMessage
+	err = json.Unmarshal(b, &m)
+	if err != nil {
+		return nil, fmt.Errorf("encoding claims %w", err)
+	}
+
+	times := map[string]*jwt.NumericDate{"exp": claims.ExpiresAt, "nbf": claims.NotBefore, "iat": claims.IssuedAt}
+	for _, name := range pasetoTimeClaims {
+		if times[name] == nil {
+			continue
+		}
+		m[name], err = json.Marshal(times[name].UTC().Format(time.RFC3339))
+		if err != nil {
+			return nil, fmt.Errorf("encoding %s %w", name, err)
+		}
+	}
+	if len(claims.Audience) == 1 {
+		m["aud"], err = json.Marshal(claims.Audience[0])
+		if err != nil {
+			return nil, fmt.Errorf("encoding aud %w", err)
+		}
+	}
+	return json.Marshal(m)
+}
+
+// parsePasetoPayload decodes the payload of a PASETO token into Claims.
+func parsePasetoPayload(payload []byte) (Claims, error) {
+	var m map[string]json.RawMessage
+	d := json.NewDecoder(bytes.NewReader(payload))
+	err := d.Decode(&m)
+	if err != nil {
+		return Claims{}, fmt.Errorf("decoding claims %w", err)
+	}
+
+	// The timestamps are turned into the NumericDates Claims are made of
+	for _, name := range pasetoTimeClaims {
+		raw, ok := m[name]
+		if !ok {
+			continue
+		}
+		var s string
+		err = json.Unmarshal(raw, &s)
+		if err != nil {
+			return Claims{}, fmt.Errorf("decoding %s %w", name, err)
+		}
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return Claims{}, fmt.Errorf("decoding %s %w", name, err)
+		}
+		m[name] = json.RawMessage(strconv.FormatInt(t.Unix(), 10))
+	}
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		return Claims{}, fmt.Errorf("decoding claims %w", err)
+	}
+	var c Claims
+	err = json.Unmarshal(b, &c)
+	if err != nil {
+		return Claims{}, fmt.Errorf("decoding claims %w", err)
+	}
+	return c, nil
+}
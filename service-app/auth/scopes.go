@@ -0,0 +1,100 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// The scopes an access token can carry. A route names the scope it requires when it is registered.
+const (
+	ScopeInventoryRead  = "inventory:read"
+	ScopeInventoryWrite = "inventory:write"
+	ScopeUsersAdmin     = "users:admin"
+)
+
+// AllScopes is every scope there is, as a space-delimited scope string.
+const AllScopes = ScopeInventoryRead + " " + ScopeInventoryWrite + " " + ScopeUsersAdmin
+
+// The OpenID Connect scopes. openid asks for an ID token, profile and email for the claims of the user that go
+// with them. Every user may grant them to the apps they log in to, so they aren't tied to roles.
+const (
+	ScopeOpenID  = "openid"
+	ScopeProfile = "profile"
+	ScopeEmail   = "email"
+)
+
+// OIDCScopes is every OpenID Connect scope, as a space-delimited scope string.
+const OIDCScopes = ScopeOpenID + " " + ScopeProfile + " " + ScopeEmail
+
+// ErrInvalidScope is returned when a client asks for a scope that doesn't exist or that it may not have.
+var ErrInvalidScope = errors.New("invalid scope")
+
+// roleScopes maps every role to the scopes a user with that role may be granted.
+var roleScopes = map[string][]string{
+	RoleViewer:  {ScopeInventoryRead},
+	RoleManager: {ScopeInventoryRead, ScopeInventoryWrite},
+	RoleAdmin:   {ScopeInventoryRead, ScopeInventoryWrite, ScopeUsersAdmin},
+}
+
+// AllowedScopes returns the scopes a user with the given roles may be granted, as a space-delimited
+// scope string like the one in the scope claim.
+func AllowedScopes(roles []string) string {
+	var scopes []string
+	for _, r := range roles {
+		for _, s := range roleScopes[r] {
+			if !containsString(scopes, s) {
+				scopes = append(scopes, s)
+			}
+		}
+	}
+	return strings.Join(scopes, " ")
+}
+
+// NarrowScope returns the scopes of requested, which must all be part of allowed. An empty request
+// gets every allowed scope. Both are space-delimited scope strings.
+func NarrowScope(allowed, requested string) (string, error) {
+	if strings.TrimSpace(requested) == "" {
+		return allowed, nil
+	}
+	permitted := strings.Fields(allowed)
+	var scopes []string
+	for _, s := range strings.Fields(requested) {
+		if !containsString(permitted, s) {
+			return "", fmt.Errorf("%w: %q", ErrInvalidScope, s)
+		}
+		if !containsString(scopes, s) {
+			scopes = append(scopes, s)
+		}
+	}
+	return strings.Join(scopes, " "), nil
+}
+
+// IntersectScopes returns the scopes of requested that are part of allowed, and silently drops the others.
+// Both are space-delimited scope strings.
+func IntersectScopes(allowed, requested string) string {
+	permitted := strings.Fields(allowed)
+	var scopes []string
+	for _, s := range strings.Fields(requested) {
+		if containsString(permitted, s) && !containsString(scopes, s) {
+			scopes = append(scopes, s)
+		}
+	}
+	return strings.Join(scopes, " ")
+}
+
+// Scopes returns the scopes of the scope claim.
+func (c Claims) Scopes() []string {
+	return strings.Fields(c.Scope)
+}
+
+// HasScopes reports whether the claims carry every one of the given scopes.
+func (c Claims) HasScopes(scopes ...string) bool {
+	granted := c.Scopes()
+	for _, s := range scopes {
+		if !containsString(granted, s) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,102 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAllowedScopes(t *testing.T) {
+	tests := []struct {
+		name  string
+		roles []string
+		want  string
+	}{
+		{name: "no roles", want: ""},
+		{name: "viewer", roles: []string{RoleViewer}, want: "inventory:read"},
+		{name: "manager", roles: []string{RoleManager}, want: "inventory:read inventory:write"},
+		{name: "admin", roles: []string{RoleAdmin}, want: AllScopes},
+		{name: "overlapping roles", roles: []string{RoleViewer, RoleManager}, want: "inventory:read inventory:write"},
+		{name: "unknown role", roles: []string{"owner"}, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, AllowedScopes(tt.roles))
+		})
+	}
+}
+
+func TestNarrowScope(t *testing.T) {
+	tests := []struct {
+		name      string
+		allowed   string
+		requested string
+		want      string
+		err       bool
+	}{
+		{name: "nothing requested", allowed: "inventory:read inventory:write", requested: "", want: "inventory:read inventory:write"},
+		{name: "only whitespace requested", allowed: "inventory:read", requested: "  ", want: "inventory:read"},
+		{name: "narrower", allowed: AllScopes, requested: "inventory:read", want: "inventory:read"},
+		{name: "order of the request", allowed: AllScopes, requested: "users:admin inventory:read", want: "users:admin inventory:read"},
+		{name: "duplicates", allowed: AllScopes, requested: "inventory:read  inventory:read", want: "inventory:read"},
+		{name: "more than allowed", allowed: "inventory:read", requested: "inventory:read inventory:write", err: true},
+		{name: "unknown scope", allowed: AllScopes, requested: "inventory:delete", err: true},
+		{name: "prefix of a scope", allowed: "inventory:read", requested: "inventory", err: true},
+		{name: "nothing allowed", allowed: "", requested: "inventory:read", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NarrowScope(tt.allowed, tt.requested)
+			if tt.err {
+				require.ErrorIs(t, err, ErrInvalidScope)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestHasScopes(t *testing.T) {
+	tests := []struct {
+		name   string
+		scope  string
+		needed []string
+		want   bool
+	}{
+		{name: "nothing needed", scope: "", want: true},
+		{name: "granted", scope: "inventory:read inventory:write", needed: []string{ScopeInventoryWrite}, want: true},
+		{name: "all granted", scope: AllScopes, needed: []string{ScopeInventoryRead, ScopeUsersAdmin}, want: true},
+		{name: "one missing", scope: "inventory:read", needed: []string{ScopeInventoryRead, ScopeInventoryWrite}},
+		{name: "no scope claim", scope: "", needed: []string{ScopeInventoryRead}},
+		{name: "substring doesn't count", scope: "inventory:readonly", needed: []string{ScopeInventoryRead}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, Claims{Scope: tt.scope}.HasScopes(tt.needed...))
+		})
+	}
+}
+
+func TestIntersectScopes(t *testing.T) {
+	tests := []struct {
+		name      string
+		allowed   string
+		requested string
+		want      string
+	}{
+		{name: "nothing requested", allowed: AllScopes, requested: "", want: ""},
+		{name: "all allowed", allowed: AllScopes, requested: "inventory:read users:admin", want: "inventory:read users:admin"},
+		{name: "drops what isn't allowed", allowed: "inventory:read openid", requested: "openid inventory:write inventory:read",
+			want: "openid inventory:read"},
+		{name: "nothing allowed", allowed: "", requested: "openid", want: ""},
+		{name: "unknown scopes", allowed: AllScopes, requested: "offline_access", want: ""},
+		{name: "duplicates", allowed: OIDCScopes, requested: "openid email openid", want: "openid email"},
+		{name: "extra whitespace", allowed: OIDCScopes, requested: " openid\tprofile ", want: "openid profile"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, IntersectScopes(tt.allowed, tt.requested))
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package auth
+
+import (
+	"fmt"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// The token formats NewTokens can issue, see Config.
+const (
+	FormatJWT    = "jwt"
+	FormatPASETO = "paseto"
+)
+
+// TokenIssuer issues the tokens of service-app, whatever their format.
+type TokenIssuer interface {
+	// GenerateToken issues an access token with the claims.
+	GenerateToken(claims Claims) (string, error)
+	// GenerateMFAChallenge issues the token a user exchanges for an access token once they pass their second factor.
+	GenerateMFAChallenge(claims Claims) (string, error)
+	// GenerateIDToken issues an OpenID Connect ID token, which is a JWT whatever the format of access tokens.
+	GenerateIDToken(claims IDClaims) (string, error)
+}
+
+// TokenValidator validates the tokens a TokenIssuer issued. Rejected tokens get a *ValidationError.
+type TokenValidator interface {
+	ValidateToken(token string) (Claims, error)
+	ValidateMFAChallenge(token string) (Claims, error)
+}
+
+// Tokens issues and validates tokens and publishes the keys they are verified with. *Auth implements it with JWTs,
+// *Paseto with PASETO v4.public tokens.
+type Tokens interface {
+	TokenIssuer
+	TokenValidator
+	JWKS() JSONWebKeySet
+}
+
+// NewTokens returns the Tokens for the Format of cfg.
+func NewTokens(keys *KeySet, cfg Config) (Tokens, error) {
+	switch cfg.Format {
+	case "", FormatJWT:
+		return NewAuth(keys, cfg)
+	case FormatPASETO:
+		return NewPaseto(keys, cfg)
+	}
+	return nil, fmt.Errorf("unknown token format %q", cfg.Format)
+}
+
+// stamp fills in the configured issuer and audience, unless the caller chose others.
+func (cfg Config) stamp(claims Claims) Claims {
+	if claims.Issuer == "" {
+		claims.Issuer = cfg.Issuer
+	}
+	if len(claims.Audience) == 0 && cfg.Audience != "" {
+		claims.Audience = jwt.ClaimStrings{cfg.Audience}
+	}
+	return claims
+}
@@ -0,0 +1,149 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Config describes the tokens an Auth issues and accepts.
+type Config struct {
+	// Issuer is the expected iss claim. Tokens without an issuer get this one when they are generated.
+	Issuer string
+	// Audience must be one of the aud values of a token. Tokens without an audience get this one
+	// when they are generated. It can't be empty: tokens for other purposes, like MFA challenges, are told
+	// apart from access tokens by their audience.
+	Audience string
+	// RequiredClaims lists the registered claims that must be present, e.g. "exp" or "jti".
+	RequiredClaims []string
+	// Leeway is the clock skew that is tolerated when checking exp, nbf and iat.
+	Leeway time.Duration
+	// Format is the format of the tokens, FormatJWT or FormatPASETO. The zero value means FormatJWT.
+	Format string
+}
+
+// check reports whether the Config makes sense, NewTokens calls it for every format.
+func (cfg Config) check() error {
+	for _, claim := range cfg.RequiredClaims {
+		if !containsString([]string{"iss", "sub", "aud", "exp", "nbf", "iat", "jti"}, claim) {
+			return fmt.Errorf("unknown required claim %q", claim)
+		}
+	}
+	if cfg.Audience == "" {
+		return errors.New("audience cannot be empty")
+	}
+	if cfg.Leeway < 0 {
+		return errors.New("leeway cannot be negative")
+	}
+	return nil
+}
+
+// DefaultRequiredClaims are the claims every token issued by service-app carries.
+var DefaultRequiredClaims = []string{"iss", "sub", "aud", "exp", "iat", "jti"}
+
+// The errors a token can be rejected with. ValidateToken wraps them in a *ValidationError,
+// errors.Is can be used to tell them apart.
+var (
+	ErrTokenMalformed        = errors.New("token is malformed")
+	ErrTokenSignatureInvalid = errors.New("token signature is invalid")
+	ErrTokenExpired          = errors.New("token is expired")
+	ErrTokenNotValidYet      = errors.New("token is not valid yet")
+	ErrTokenUsedBeforeIssued = errors.New("token used before issued")
+	ErrTokenInvalidIssuer    = errors.New("token has invalid issuer")
+	ErrTokenInvalidAudience  = errors.New("token has invalid audience")
+	ErrTokenMissingClaim     = errors.New("token is missing a required claim")
+)
+
+// ValidationError is returned by ValidateToken when a token is rejected. Err is one of the errors above,
+// Claim is the claim that failed the check, if there is one, and Cause the underlying error, if any.
+type ValidationError struct {
+	Err   error
+	Claim string
+	Cause error
+}
+
+func (e *ValidationError) Error() string {
+	msg := e.Err.Error()
+	if e.Claim != "" {
+		msg = fmt.Sprintf("%s: %s", msg, e.Claim)
+	}
+	if e.Cause != nil {
+		msg = fmt.Sprintf("%s: %v", msg, e.Cause)
+	}
+	return msg
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// parseError turns an error of the jwt parser into a *ValidationError.
+func parseError(err error) error {
+	if errors.Is(err, jwt.ErrTokenMalformed) {
+		return &ValidationError{Err: ErrTokenMalformed, Cause: err}
+	}
+	// Everything else went wrong while looking up the key or checking the signature.
+	return &ValidationError{Err: ErrTokenSignatureInvalid, Cause: err}
+}
+
+// validateClaims checks the registered claims against the configuration, whatever the format of the token.
+// The audience is passed in so that tokens meant for other purposes than API access can be checked with the
+// same rules.
+func (cfg Config) validateClaims(c jwt.RegisteredClaims, audience string) error {
+	for _, claim := range cfg.RequiredClaims {
+		if !hasClaim(c, claim) {
+			return &ValidationError{Err: ErrTokenMissingClaim, Claim: claim}
+		}
+	}
+
+	now := time.Now()
+	if c.ExpiresAt != nil && now.After(c.ExpiresAt.Add(cfg.Leeway)) {
+		return &ValidationError{Err: ErrTokenExpired, Claim: "exp"}
+	}
+	if c.NotBefore != nil && now.Add(cfg.Leeway).Before(c.NotBefore.Time) {
+		return &ValidationError{Err: ErrTokenNotValidYet, Claim: "nbf"}
+	}
+	if c.IssuedAt != nil && now.Add(cfg.Leeway).Before(c.IssuedAt.Time) {
+		return &ValidationError{Err: ErrTokenUsedBeforeIssued, Claim: "iat"}
+	}
+
+	if cfg.Issuer != "" && c.Issuer != cfg.Issuer {
+		return &ValidationError{Err: ErrTokenInvalidIssuer, Claim: "iss"}
+	}
+	if audience != "" && !containsString(c.Audience, audience) {
+		return &ValidationError{Err: ErrTokenInvalidAudience, Claim: "aud"}
+	}
+	return nil
+}
+
+// hasClaim reports whether the registered claim with the given name is set.
+func hasClaim(c jwt.RegisteredClaims, claim string) bool {
+	switch claim {
+	case "iss":
+		return c.Issuer != ""
+	case "sub":
+		return c.Subject != ""
+	case "aud":
+		return len(c.Audience) > 0
+	case "exp":
+		return c.ExpiresAt != nil
+	case "nbf":
+		return c.NotBefore != nil
+	case "iat":
+		return c.IssuedAt != nil
+	case "jti":
+		return c.ID != ""
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"service-app/auth"
+	"text/tabwriter"
+	"time"
+)
+
+// keysUsage describes the keys subcommand, it is printed for -h and for unknown commands.
+const keysUsage = `usage: service-app keys <command> [flags]
+
+commands:
+  generate  write a new keypair to private.pem and pubkey.pem
+  rotate    add a new key to a keyset directory and make it the active one
+  retire    stop accepting tokens signed with a key of a keyset directory
+  list      list the keys of a keyset directory with their kids and ages
+  jwks      print the JWKS of a keyset directory
+
+Run 'service-app keys <command> -h' for the flags of a command.
+`
+
+// runKeys runs the keys subcommand, which manages the keys tokens are signed with. args are the arguments
+// after "keys".
+func runKeys(args []string, stdout io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(keysUsage)
+	}
+
+	var err error
+	switch args[0] {
+	case "generate":
+		err = keysGenerate(args[1:], stdout)
+	case "rotate":
+		err = keysRotate(args[1:], stdout)
+	case "retire":
+		err = keysRetire(args[1:], stdout)
+	case "list":
+		err = keysList(args[1:], stdout)
+	case "jwks":
+		err = keysJWKS(args[1:], stdout)
+	case "-h", "-help", "--help", "help":
+		fmt.Fprint(stdout, keysUsage)
+	default:
+		err = fmt.Errorf("unknown keys command %q\n\n%s", args[0], keysUsage)
+	}
+	// The flag package already printed the usage of the command
+	if errors.Is(err, flag.ErrHelp) {
+		return nil
+	}
+	return err
+}
+
+// keyTypeFlags adds the flags that choose the type of a new key.
+func keyTypeFlags(fs *flag.FlagSet) (*string, *int) {
+	keyType := fs.String("type", auth.KeyTypeRSA, "key type: rsa, ecdsa or ed25519")
+	bits := fs.Int("bits", 2048, "size of rsa keys")
+	return keyType, bits
+}
+
+// keysGenerate writes a new keypair to single files, like the openssl commands did. The private key is only
+// readable by its owner.
+func keysGenerate(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("keys generate", flag.ContinueOnError)
+	keyType, bits := keyTypeFlags(fs)
+	privateFile := fs.String("private", "private.pem", "file for the private key")
+	publicFile := fs.String("public", "pubkey.pem", "file for the public key")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	priv, err := auth.GenerateKey(*keyType, *bits)
+	if err != nil {
+		return err
+	}
+	privatePEM, err := auth.MarshalPrivateKeyPEM(priv)
+	if err != nil {
+		return err
+	}
+	publicPEM, err := auth.MarshalPublicKeyPEM(priv.(crypto.Signer).Public())
+	if err != nil {
+		return err
+	}
+
+	err = auth.WriteNewFile(*privateFile, privatePEM, 0o600)
+	if err != nil {
+		return fmt.Errorf("writing private key %w", err)
+	}
+	err = auth.WriteNewFile(*publicFile, publicPEM, 0o644)
+	if err != nil {
+		return fmt.Errorf("writing public key %w", err)
+	}
+
+	fmt.Fprintf(stdout, "wrote %s key to %s and %s\n", *keyType, *privateFile, *publicFile)
+	return nil
+}
+
+// keysRotate adds a new key to a keyset directory and activates it. The app picks it up when it is restarted.
+func keysRotate(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("keys rotate", flag.ContinueOnError)
+	keyType, bits := keyTypeFlags(fs)
+	dir := fs.String("dir", "keys", "keyset directory")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	priv, err := auth.GenerateKey(*keyType, *bits)
+	if err != nil {
+		return err
+	}
+	kid, err := auth.RotateKeySetDir(*dir, priv)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stdout, "activated %s key %s in %s\n", *keyType, kid, *dir)
+	fmt.Fprintln(stdout, "keep the previous key until the tokens signed with it have expired, then retire it")
+	return nil
+}
+
+// keysRetire retires a key of a keyset directory.
+func keysRetire(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("keys retire", flag.ContinueOnError)
+	dir := fs.String("dir", "keys", "keyset directory")
+	kid := fs.String("kid", "", "kid of the key to retire")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if *kid == "" {
+		return errors.New("please provide -kid")
+	}
+
+	err = auth.RetireKeySetDir(*dir, *kid)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "retired key %s in %s\n", *kid, *dir)
+	return nil
+}
+
+// keysList prints every key of a keyset directory with its algorithm, status and age.
+func keysList(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("keys list", flag.ContinueOnError)
+	dir := fs.String("dir", "keys", "keyset directory")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	ks, err := auth.LoadKeySet(*dir)
+	if err != nil {
+		return err
+	}
+	active, err := ks.Active()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "KID\tALG\tSTATUS\tAGE")
+	for _, k := range ks.Keys() {
+		status := "verifying"
+		switch {
+		case k.ID == active.ID:
+			status = "active"
+		case k.Retired:
+			status = "retired"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", k.ID, k.Algorithm.Alg(), status, age(k.CreatedAt))
+	}
+	return w.Flush()
+}
+
+// keysJWKS prints the JWKS that /.well-known/jwks.json serves for a keyset directory.
+func keysJWKS(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("keys jwks", flag.ContinueOnError)
+	dir := fs.String("dir", "keys", "keyset directory")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	ks, err := auth.LoadKeySet(*dir)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(ks.JWKS())
+}
+
+// age formats how long ago t was, in days once it is more than two days.
+func age(t time.Time) string {
+	d := time.Since(t)
+	if d > 48*time.Hour {
+		return fmt.Sprintf("%dd", int(d/(24*time.Hour)))
+	}
+	return d.Round(time.Minute).String()
+}
@@ -2,20 +2,41 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/base64"
 	"fmt"
-	"github.com/golang-jwt/jwt/v5"
 	"github.com/rs/zerolog/log"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"service-app/auth"
 	"service-app/database"
 	"service-app/handlers"
+	"service-app/mailer"
 	"service-app/models"
+	"service-app/passwords"
+	"service-app/sso"
+	"service-app/webauthn"
+	"strconv"
+	"strings"
 	"time"
 )
 
+// publicURL is where users reach the API.
+const publicURL = "http://localhost:8080"
+
 func main() {
+	// 'service-app keys ...' manages the signing keys instead of starting the app
+	if len(os.Args) > 1 && os.Args[1] == "keys" {
+		err := runKeys(os.Args[2:], os.Stdout)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	err := startApp()
 	if err != nil {
 		log.Panic().Err(err).Send()
@@ -27,26 +48,20 @@ func startApp() error {
 	// =========================================================================
 	// Initialize authentication support
 	log.Info().Msg("main : Started : Initializing authentication support")
-	privatePEM, err := os.ReadFile("private.pem")
-	if err != nil {
-		return fmt.Errorf("reading auth private key %w", err)
-	}
-	privateKey, err := jwt.ParseRSAPrivateKeyFromPEM(privatePEM)
-	if err != nil {
-		return fmt.Errorf("parsing auth private key %w", err)
-	}
-
-	publicPEM, err := os.ReadFile("pubkey.pem")
-	if err != nil {
-		return fmt.Errorf("reading auth public key %w", err)
-	}
-
-	publicKey, err := jwt.ParseRSAPublicKeyFromPEM(publicPEM)
+	keys, err := loadKeySet()
 	if err != nil {
-		return fmt.Errorf("parsing auth public key %w", err)
+		return err
 	}
 
-	a, err := auth.NewAuth(privateKey, publicKey)
+	// Only tokens issued by service-app for its own API are accepted, with 30 seconds of clock skew.
+	// TOKEN_FORMAT=paseto issues PASETO v4.public tokens instead of JWTs, which needs an Ed25519 active key
+	a, err := auth.NewTokens(keys, auth.Config{
+		Issuer:         "service project",
+		Audience:       "students",
+		RequiredClaims: auth.DefaultRequiredClaims,
+		Leeway:         30 * time.Second,
+		Format:         os.Getenv("TOKEN_FORMAT"),
+	})
 	if err != nil {
 		return fmt.Errorf("constructing auth %w", err)
 	}
@@ -72,7 +87,22 @@ func startApp() error {
 
 	// =========================================================================
 	//Initialize Conn layer support
-	ms, err := models.NewConn(db)
+	// REQUIRE_VERIFIED_EMAIL=true makes users verify their email before they can log in, passwords always have
+	// to satisfy the policy
+	requireVerified, err := requireVerifiedEmail()
+	if err != nil {
+		return err
+	}
+	policy, err := passwordPolicy()
+	if err != nil {
+		return err
+	}
+	// New passwords are hashed with argon2id, older hashes are upgraded when their users log in
+	ms, err := models.NewConn(db, models.Config{
+		RequireVerifiedEmail: requireVerified,
+		PasswordPolicy:       policy,
+		PasswordHasher:       passwords.DefaultHasher,
+	})
 	if err != nil {
 		return err
 	}
@@ -80,6 +110,56 @@ func startApp() error {
 	if err != nil {
 		return err
 	}
+	err = seedAdmin(ctx, ms)
+	if err != nil {
+		return err
+	}
+
+	// =========================================================================
+	// Initialize the denylist of revoked tokens
+	// Lookups are cached for a minute and expired entries are pruned every hour until the app stops
+	dl, err := auth.NewDenylist(ms, time.Minute)
+	if err != nil {
+		return fmt.Errorf("constructing denylist %w", err)
+	}
+	pruneCtx, stopPruning := context.WithCancel(context.Background())
+	defer stopPruning()
+	go dl.PruneEvery(pruneCtx, time.Hour)
+
+	// =========================================================================
+	// Initialize the mailer
+	ml, err := newMailer()
+	if err != nil {
+		return fmt.Errorf("constructing mailer %w", err)
+	}
+
+	// =========================================================================
+	// Initialize the login with the company identity provider
+	provider, err := newSSOProvider()
+	if err != nil {
+		return fmt.Errorf("constructing sso provider %w", err)
+	}
+
+	// =========================================================================
+	// Initialize the login with passkeys
+	rp, err := newRelyingParty()
+	if err != nil {
+		return fmt.Errorf("constructing webauthn relying party %w", err)
+	}
+
+	// COOKIE_SESSIONS=true lets browsers keep their tokens in HttpOnly cookies, it is off by default
+	cookies, err := cookieSessions()
+	if err != nil {
+		return err
+	}
+
+	apiCfg := handlers.Config{
+		PublicURL:      publicURL,
+		CookieSessions: cookies,
+		SSO:            provider,
+		WebAuthn:       rp,
+		MagicLinkURL:   magicLinkURL(),
+	}
 
 	// Initialize http service
 	api := http.Server{
@@ -87,7 +167,7 @@ func startApp() error {
 		ReadTimeout:  8000 * time.Second,
 		WriteTimeout: 800 * time.Second,
 		IdleTimeout:  800 * time.Second,
-		Handler:      handlers.API(a, ms),
+		Handler:      handlers.API(a, ms, dl, ml, apiCfg),
 	}
 
 	// channel to store any errors while setting up the service
@@ -120,3 +200,190 @@ func startApp() error {
 	return nil
 
 }
+
+// loadKeySet reads the signing keys from the 'keys' directory. When there is none, the single
+// private key in private.pem is used, with its JWK thumbprint as kid. The signing algorithm follows
+// from the type of the key: RS256 for RSA, ES256 for ECDSA P-256 and EdDSA for Ed25519 keys.
+func loadKeySet() (*auth.KeySet, error) {
+	_, err := os.Stat("keys")
+	if err == nil {
+		keys, err := auth.LoadKeySet("keys")
+		if err != nil {
+			return nil, fmt.Errorf("loading keyset %w", err)
+		}
+		return keys, nil
+	}
+
+	privatePEM, err := os.ReadFile("private.pem")
+	if err != nil {
+		return nil, fmt.Errorf("reading auth private key, create one with 'keys rotate' or 'keys generate' %w", err)
+	}
+	privateKey, err := auth.ParsePrivateKeyPEM(privatePEM)
+	if err != nil {
+		return nil, fmt.Errorf("parsing auth private key %w", err)
+	}
+
+	keys := auth.NewKeySet()
+	err = keys.Add(auth.SigningKey{PrivateKey: privateKey})
+	if err != nil {
+		return nil, fmt.Errorf("constructing keyset %w", err)
+	}
+	return keys, nil
+}
+
+// newMailer sends emails through the SMTP server in SMTP_HOST, if it is set. SMTP_PORT defaults to 587,
+// SMTP_USERNAME and SMTP_PASSWORD are optional and MAIL_FROM is the sender. Without SMTP_HOST every email
+// ends up in the 'outbox' directory, which is enough for local development.
+func newMailer() (mailer.Mailer, error) {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		log.Info().Msg("main : SMTP_HOST not set, emails go to the outbox directory")
+		return mailer.NewFileOutbox("outbox")
+	}
+
+	port := 587
+	if p := os.Getenv("SMTP_PORT"); p != "" {
+		var err error
+		port, err = strconv.Atoi(p)
+		if err != nil {
+			return nil, fmt.Errorf("parsing SMTP_PORT %w", err)
+		}
+	}
+	return mailer.NewSMTP(host, port, os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"), os.Getenv("MAIL_FROM"))
+}
+
+// newSSOProvider lets users log in with the OpenID Connect identity provider in SSO_ISSUER, if it is set.
+// service-app is registered there with SSO_CLIENT_ID and SSO_CLIENT_SECRET, and PublicURL/login/sso/callback as
+// its redirect URL.
+func newSSOProvider() (*sso.Provider, error) {
+	issuer := os.Getenv("SSO_ISSUER")
+	if issuer == "" {
+		log.Info().Msg("main : SSO_ISSUER not set, users can only log in with their password")
+		return nil, nil
+	}
+	return sso.NewProvider(sso.Config{
+		Issuer:       issuer,
+		ClientID:     os.Getenv("SSO_CLIENT_ID"),
+		ClientSecret: os.Getenv("SSO_CLIENT_SECRET"),
+		RedirectURL:  publicURL + "/login/sso/callback",
+		Leeway:       30 * time.Second,
+	})
+}
+
+// newRelyingParty lets users log in with passkeys. Passkeys are bound to the domain of publicURL unless
+// WEBAUTHN_RP_ID names a parent domain, and are used at publicURL unless WEBAUTHN_ORIGINS lists the origins of the
+// frontends, separated by commas. WEBAUTHN_CHALLENGE_KEY is the base64 encoded key the challenges are signed with,
+// every instance needs the same one.
+func newRelyingParty() (*webauthn.RelyingParty, error) {
+	u, err := url.Parse(publicURL)
+	if err != nil {
+		return nil, err
+	}
+	rpId := os.Getenv("WEBAUTHN_RP_ID")
+	if rpId == "" {
+		rpId = u.Hostname()
+	}
+	origins := []string{u.Scheme + "://" + u.Host}
+	if o := os.Getenv("WEBAUTHN_ORIGINS"); o != "" {
+		origins = strings.Split(o, ",")
+	}
+
+	var key []byte
+	if k := os.Getenv("WEBAUTHN_CHALLENGE_KEY"); k != "" {
+		key, err = base64.StdEncoding.DecodeString(k)
+		if err != nil {
+			return nil, fmt.Errorf("decoding WEBAUTHN_CHALLENGE_KEY %w", err)
+		}
+	} else {
+		log.Warn().Msg("main : WEBAUTHN_CHALLENGE_KEY not set, passkey ceremonies only work on this instance until it restarts")
+		key = make([]byte, 32)
+		_, err = rand.Read(key)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return webauthn.NewRelyingParty(webauthn.Config{
+		RPID:         rpId,
+		RPName:       "service-app",
+		Origins:      origins,
+		ChallengeKey: key,
+	})
+}
+
+// cookieSessions reads COOKIE_SESSIONS. Cookie sessions are off unless it is set, as requests authenticated with
+// cookies need the frontend to send CSRF tokens.
+func cookieSessions() (bool, error) {
+	return boolEnv("COOKIE_SESSIONS", "tokens are only sent in response bodies")
+}
+
+// requireVerifiedEmail reads REQUIRE_VERIFIED_EMAIL. It is off unless it is set, turning it on locks out every
+// user who hasn't verified their email yet, including the ones who signed up before verification existed.
+func requireVerifiedEmail() (bool, error) {
+	return boolEnv("REQUIRE_VERIFIED_EMAIL", "users can log in before they verified their email")
+}
+
+// boolEnv parses the environment variable name as a bool. An unset variable means false, unset tells what that
+// does to the app.
+func boolEnv(name, unset string) (bool, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		log.Info().Msgf("main : %s not set, %s", name, unset)
+		return false, nil
+	}
+	on, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("parsing %s: %w", name, err)
+	}
+	return on, nil
+}
+
+// magicLinkURL returns MAGIC_LINK_URL, the sign-in page of the frontend that magic links point to. Without it
+// users can't ask for magic links.
+func magicLinkURL() string {
+	u := os.Getenv("MAGIC_LINK_URL")
+	if u == "" {
+		log.Info().Msg("main : MAGIC_LINK_URL not set, there are no magic link logins")
+	}
+	return u
+}
+
+// seedAdmin makes the user in ADMIN_EMAIL an admin, if it is set. A user that doesn't exist yet is created with
+// ADMIN_PASSWORD and ADMIN_NAME, an existing one has to have verified the email or have ADMIN_PASSWORD as password.
+// Admins can grant roles to everybody else, nobody else becomes one on their own.
+func seedAdmin(ctx context.Context, ms *models.Conn) error {
+	email := os.Getenv("ADMIN_EMAIL")
+	if email == "" {
+		log.Info().Msg("main : ADMIN_EMAIL not set, no admin is seeded")
+		return nil
+	}
+	name := os.Getenv("ADMIN_NAME")
+	if name == "" {
+		name = "admin"
+	}
+
+	u, err := ms.SeedAdmin(ctx, models.NewUser{Name: name, Email: email, Password: os.Getenv("ADMIN_PASSWORD")})
+	if err != nil {
+		return fmt.Errorf("seeding admin %w", err)
+	}
+	log.Info().Uint("user", u.ID).Msg("main : admin seeded")
+	return nil
+}
+
+// passwordPolicy returns passwords.DefaultPolicy. If there is a 'breached-passwords' directory, it holds the
+// Pwned Passwords range files and breached passwords are refused as well.
+func passwordPolicy() (passwords.Policy, error) {
+	policy := passwords.DefaultPolicy
+	_, err := os.Stat("breached-passwords")
+	if err != nil {
+		log.Info().Msg("main : no breached-passwords directory, breached passwords are not checked")
+		return policy, nil
+	}
+
+	breached, err := passwords.NewBreachedDir("breached-passwords")
+	if err != nil {
+		return passwords.Policy{}, fmt.Errorf("loading breached passwords %w", err)
+	}
+	policy.Breached = breached
+	return policy, nil
+}
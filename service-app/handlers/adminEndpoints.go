@@ -0,0 +1,131 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"service-app/middlewares"
+	"service-app/models"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/rs/zerolog/log"
+)
+
+// GrantRole adds the role in the request body to the user whose id is in the path.
+func (h *handler) GrantRole(c *gin.Context) {
+	ctx := c.Request.Context()
+	traceId, ok := ctx.Value(middlewares.TraceIdKey).(string)
+	if !ok {
+		log.Error().Msg("traceId missing from context")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+
+	uid, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Send()
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"msg": "invalid user id"})
+		return
+	}
+
+	var req struct {
+		Role string `json:"role" validate:"required"`
+	}
+	err = json.NewDecoder(c.Request.Body).Decode(&req)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Send()
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"msg": "Invalid JSON format"})
+		return
+	}
+	validate := validator.New()
+	err = validate.Struct(req)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Send()
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"msg": "please provide role"})
+		return
+	}
+
+	usr, err := h.s.GrantRole(ctx, uint(uid), req.Role)
+	if err != nil {
+		abortRoleError(c, traceId, err)
+		return
+	}
+
+	log.Info().Str("Trace Id", traceId).Uint64("user", uid).Str("role", req.Role).Msg("role granted")
+	c.JSON(http.StatusOK, usr)
+}
+
+// RevokeRole removes the role in the path from the user whose id is in the path.
+func (h *handler) RevokeRole(c *gin.Context) {
+	ctx := c.Request.Context()
+	traceId, ok := ctx.Value(middlewares.TraceIdKey).(string)
+	if !ok {
+		log.Error().Msg("traceId missing from context")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+
+	uid, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Send()
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"msg": "invalid user id"})
+		return
+	}
+
+	role := c.Param("role")
+	usr, err := h.s.RevokeRole(ctx, uint(uid), role)
+	if err != nil {
+		abortRoleError(c, traceId, err)
+		return
+	}
+
+	log.Info().Str("Trace Id", traceId).Uint64("user", uid).Str("role", role).Msg("role revoked")
+	c.JSON(http.StatusOK, usr)
+}
+
+// UnlockUser lifts the lockout of the user whose id is in the path, after too many failed logins.
+func (h *handler) UnlockUser(c *gin.Context) {
+	ctx := c.Request.Context()
+	traceId, ok := ctx.Value(middlewares.TraceIdKey).(string)
+	if !ok {
+		log.Error().Msg("traceId missing from context")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+
+	uid, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Send()
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"msg": "invalid user id"})
+		return
+	}
+
+	err = h.s.UnlockUser(ctx, uint(uid))
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Msg("unlocking user")
+		if errors.Is(err, models.ErrUserNotFound) {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"msg": "user not found"})
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+
+	log.Info().Str("Trace Id", traceId).Uint64("user", uid).Msg("user unlocked")
+	c.JSON(http.StatusOK, gin.H{"msg": "user unlocked"})
+}
+
+// abortRoleError responds to a failed role change.
+func abortRoleError(c *gin.Context, traceId string, err error) {
+	log.Error().Err(err).Str("Trace Id", traceId).Msg("changing roles")
+	switch {
+	case errors.Is(err, models.ErrUnknownRole):
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"msg": "unknown role"})
+	case errors.Is(err, models.ErrUserNotFound):
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"msg": "user not found"})
+	default:
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+	}
+}
@@ -0,0 +1,164 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"service-app/auth"
+	"service-app/middlewares"
+	"service-app/models"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/rs/zerolog/log"
+)
+
+// CreateAPIKey creates an API key for the logged-in user. The key is only part of this response,
+// the database only keeps its hash. Requests authenticated with an API key can't create, relabel or revoke keys.
+func (h *handler) CreateAPIKey(c *gin.Context) {
+	// A leaked key must not be able to mint keys that outlive its own revocation
+	traceId, claims, uid, ok := accountPrincipal(c)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+
+	var nk models.NewAPIKey
+	err := json.NewDecoder(c.Request.Body).Decode(&nk)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Send()
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"msg": "Invalid JSON format"})
+		return
+	}
+	validate := validator.New()
+	err = validate.Struct(nk)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Send()
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"msg": "please provide label"})
+		return
+	}
+
+	// A key can't do more than the token it was created with
+	nk.Scope, err = auth.NarrowScope(claims.Scope, nk.Scope)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Send()
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_scope", "msg": err.Error()})
+		return
+	}
+
+	k, key, err := h.s.CreateAPIKey(ctx, uid, nk)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Msg("creating api key")
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"msg": "api key creation failed"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"api_key": k, "key": key})
+}
+
+// ListAPIKeys lists the API keys of the logged-in user.
+func (h *handler) ListAPIKeys(c *gin.Context) {
+	ctx := c.Request.Context()
+	traceId, ok := ctx.Value(middlewares.TraceIdKey).(string)
+	if !ok {
+		log.Error().Msg("traceId missing from context")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		log.Error().Str("Trace Id", traceId).Msg("login first")
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": http.StatusText(http.StatusUnauthorized)})
+		return
+	}
+	uid, ok := userIdOrAbort(c, traceId, claims)
+	if !ok {
+		return
+	}
+
+	keys, err := h.s.ListAPIKeys(ctx, uid)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Msg("listing api keys")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"api_keys": keys})
+}
+
+// RelabelAPIKey changes the label of one of the logged-in user's API keys.
+func (h *handler) RelabelAPIKey(c *gin.Context) {
+	traceId, _, uid, ok := accountPrincipal(c)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+
+	keyId, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Send()
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"msg": "invalid api key id"})
+		return
+	}
+
+	var req struct {
+		Label string `json:"label" validate:"required,max=100"`
+	}
+	err = json.NewDecoder(c.Request.Body).Decode(&req)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Send()
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"msg": "Invalid JSON format"})
+		return
+	}
+	validate := validator.New()
+	err = validate.Struct(req)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Send()
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"msg": "please provide label"})
+		return
+	}
+
+	k, err := h.s.RelabelAPIKey(ctx, uid, uint(keyId), req.Label)
+	if err != nil {
+		abortAPIKeyError(c, traceId, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, k)
+}
+
+// RevokeAPIKey revokes one of the logged-in user's API keys.
+func (h *handler) RevokeAPIKey(c *gin.Context) {
+	traceId, _, uid, ok := accountPrincipal(c)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+
+	keyId, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Send()
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"msg": "invalid api key id"})
+		return
+	}
+
+	err = h.s.RevokeAPIKey(ctx, uid, uint(keyId))
+	if err != nil {
+		abortAPIKeyError(c, traceId, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"msg": "api key revoked"})
+}
+
+// abortAPIKeyError responds to a failed change of an API key.
+func abortAPIKeyError(c *gin.Context, traceId string, err error) {
+	log.Error().Err(err).Str("Trace Id", traceId).Msg("changing api key")
+	if errors.Is(err, models.ErrAPIKeyNotFound) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"msg": "api key not found"})
+		return
+	}
+	c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+}
@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"service-app/auth"
+	"service-app/middlewares"
+	"service-app/models"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+// apiKeyService is the part of models.Service the API key endpoints use. calls counts the changes that made it
+// past the handler.
+type apiKeyService struct {
+	models.Service
+	calls int
+}
+
+func (s *apiKeyService) CreateAPIKey(ctx context.Context, userId uint, nk models.NewAPIKey) (models.APIKey, string, error) {
+	s.calls++
+	return models.APIKey{UserId: userId, Label: nk.Label, Scope: nk.Scope}, "sk_test", nil
+}
+
+func (s *apiKeyService) RelabelAPIKey(ctx context.Context, userId, keyId uint, label string) (models.APIKey, error) {
+	s.calls++
+	return models.APIKey{UserId: userId, Label: label}, nil
+}
+
+func (s *apiKeyService) RevokeAPIKey(ctx context.Context, userId, keyId uint) error {
+	s.calls++
+	return nil
+}
+
+// A leaked API key must not be able to mint new keys, rename keys or revoke the other keys of the user.
+func TestAPIKeyEndpointsNeedALogin(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	endpoints := []struct {
+		name    string
+		method  string
+		body    string
+		handler func(h *handler) gin.HandlerFunc
+	}{
+		{name: "create", method: http.MethodPost, body: `{"label":"ci"}`,
+			handler: func(h *handler) gin.HandlerFunc { return h.CreateAPIKey }},
+		{name: "relabel", method: http.MethodPatch, body: `{"label":"ci"}`,
+			handler: func(h *handler) gin.HandlerFunc { return h.RelabelAPIKey }},
+		{name: "revoke", method: http.MethodDelete,
+			handler: func(h *handler) gin.HandlerFunc { return h.RevokeAPIKey }},
+	}
+	principals := []struct {
+		name   string
+		claims auth.Claims
+		code   int
+	}{
+		{name: "user", claims: auth.Claims{Scope: auth.ScopeInventoryRead}, code: http.StatusOK},
+		{name: "api key", claims: auth.Claims{Scope: auth.ScopeInventoryRead, APIKeyID: 3}, code: http.StatusForbidden},
+	}
+	for _, e := range endpoints {
+		for _, p := range principals {
+			t.Run(e.name+" with "+p.name, func(t *testing.T) {
+				s := &apiKeyService{}
+				h := &handler{s: models.NewStore(s)}
+				claims := p.claims
+				claims.Subject = "7"
+
+				req := httptest.NewRequest(e.method, "/me/api-keys/2", strings.NewReader(e.body))
+				ctx := context.WithValue(req.Context(), middlewares.TraceIdKey, "trace")
+				req = req.WithContext(context.WithValue(ctx, auth.Key, claims))
+				w := httptest.NewRecorder()
+				c, _ := gin.CreateTestContext(w)
+				c.Request = req
+				c.Params = gin.Params{{Key: "id", Value: "2"}}
+				e.handler(h)(c)
+
+				require.Equal(t, p.code, w.Code, w.Body.String())
+				if p.code != http.StatusOK {
+					require.Zero(t, s.calls)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"service-app/middlewares"
+	"service-app/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// refreshCookiePath limits the refresh token cookie to the endpoint that takes it, no other request carries it.
+const refreshCookiePath = "/token/refresh"
+
+// respondTokens responds with the tokens of a login or a refresh. Browser clients that asked for a cookie session
+// get them as HttpOnly cookies instead, the body then only carries the CSRF token they have to send back with
+// unsafe requests.
+func respondTokens(c *gin.Context, tkn tokenResponse, cookie bool) error {
+	if !cookie {
+		c.JSON(http.StatusOK, tkn)
+		return nil
+	}
+
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return fmt.Errorf("generating csrf token: %w", err)
+	}
+	csrf := base64.RawURLEncoding.EncodeToString(b)
+
+	setCookie(c, middlewares.TokenCookie, tkn.Token, "/", int(models.AccessTokenTTL.Seconds()), true)
+	setCookie(c, middlewares.RefreshCookie, tkn.RefreshToken, refreshCookiePath, int(models.RefreshTokenTTL.Seconds()), true)
+	// Scripts of the dashboard read this one to put it in the CSRF header
+	setCookie(c, middlewares.CSRFCookie, csrf, "/", int(models.RefreshTokenTTL.Seconds()), false)
+
+	c.JSON(http.StatusOK, gin.H{"csrf_token": csrf, "expires_in": int(models.AccessTokenTTL.Seconds())})
+	return nil
+}
+
+// clearSessionCookies makes the browser forget the cookies of a cookie session.
+func clearSessionCookies(c *gin.Context) {
+	setCookie(c, middlewares.TokenCookie, "", "/", -1, true)
+	setCookie(c, middlewares.RefreshCookie, "", refreshCookiePath, -1, true)
+	setCookie(c, middlewares.CSRFCookie, "", "/", -1, false)
+}
+
+// setCookie sets a cookie that is only sent over HTTPS and only with requests started by our own site.
+// A negative maxAge deletes the cookie.
+func setCookie(c *gin.Context, name, value, path string, maxAge int, httpOnly bool) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		MaxAge:   maxAge,
+		Secure:   true,
+		HttpOnly: httpOnly,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
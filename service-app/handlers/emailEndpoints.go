@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"service-app/mailer"
+	"service-app/middlewares"
+	"service-app/models"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/rs/zerolog/log"
+)
+
+// VerifyEmail verifies the email of a user with the token of the link they were mailed.
+func (h *handler) VerifyEmail(c *gin.Context) {
+	ctx := c.Request.Context()
+	traceId, ok := ctx.Value(middlewares.TraceIdKey).(string)
+	if !ok {
+		log.Error().Msg("traceId missing from context")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+
+	token := c.Query("token")
+	if token == "" {
+		log.Error().Str("Trace Id", traceId).Msg("verification token missing")
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"msg": "please provide token"})
+		return
+	}
+
+	u, err := h.s.VerifyEmail(ctx, token)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Msg("verifying email")
+		if errors.Is(err, models.ErrInvalidUserToken) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"msg": "invalid or expired token"})
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+
+	log.Info().Str("Trace Id", traceId).Str("user", strconv.FormatUint(uint64(u.ID), 10)).Msg("email verified")
+	c.JSON(http.StatusOK, gin.H{"msg": "email verified"})
+}
+
+// ResendVerification mails a new verification link, at most once every models.VerificationResendCooldown.
+// Like ForgotPassword it responds the same no matter whether a mail was sent, so the response doesn't tell
+// which emails have an account.
+func (h *handler) ResendVerification(c *gin.Context) {
+	ctx := c.Request.Context()
+	traceId, ok := ctx.Value(middlewares.TraceIdKey).(string)
+	if !ok {
+		log.Error().Msg("traceId missing from context")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+
+	var req struct {
+		Email string `json:"email" validate:"required,email"`
+	}
+	err := json.NewDecoder(c.Request.Body).Decode(&req)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Send()
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"msg": "Invalid JSON format"})
+		return
+	}
+	validate := validator.New()
+	err = validate.Struct(req)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Send()
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"msg": "please provide Email"})
+		return
+	}
+
+	err = h.sendVerification(traceId, c, req.Email)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"msg": fmt.Sprintf("if the email belongs to an unverified account, a verification link "+
+		"is on its way. Links are sent at most once every %s", models.VerificationResendCooldown)})
+}
+
+// sendVerification mails a verification link to the user with the given email. Reasons not to send one, like an
+// unknown or already verified email or the resend cooldown, are only logged. Any other error is returned.
+func (h *handler) sendVerification(traceId string, c *gin.Context, email string) error {
+	u, token, err := h.s.CreateEmailVerificationToken(c.Request.Context(), email)
+	if errors.Is(err, models.ErrUserNotFound) || errors.Is(err, models.ErrEmailAlreadyVerified) ||
+		errors.Is(err, models.ErrVerificationCooldown) {
+		log.Info().Err(err).Str("Trace Id", traceId).Msg("no verification email sent")
+		return nil
+	}
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Msg("creating verification token")
+		return err
+	}
+
+	link := h.cfg.PublicURL + "/verify-email?token=" + url.QueryEscape(token)
+	h.sendMail(traceId, mailer.Message{
+		To:      u.Email,
+		Subject: "Verify your email",
+		Body: fmt.Sprintf("Hi %s,\n\nplease confirm that this is your email by opening this link:\n\n%s\n\n"+
+			"The link expires in %s. If you didn't sign up, you can ignore this email.\n",
+			u.Name, link, models.EmailVerificationTTL),
+	})
+	log.Info().Str("Trace Id", traceId).Str("user", strconv.FormatUint(uint64(u.ID), 10)).Msg("verification email sent")
+	return nil
+}
@@ -3,21 +3,27 @@ package handlers
 import (
 	"encoding/json"
 	"errors"
+	"math"
 	"net/http"
 	"service-app/auth"
+	"service-app/mailer"
 	"service-app/middlewares"
 	"service-app/models"
+	"service-app/passwords"
 	"strconv"
 
 	"github.com/gin-gonic/gin"
 	"github.com/go-playground/validator/v10"
-	"github.com/golang-jwt/jwt/v5"
 	"github.com/rs/zerolog/log"
 )
 
 type handler struct {
-	s models.Store
-	a *auth.Auth
+	s        models.Store
+	a        auth.Tokens
+	dl       *auth.Denylist
+	ml       mailer.Mailer
+	sessions *middlewares.SessionTracker
+	cfg      Config
 }
 
 // Signup is a method for the handler struct which handles user registration
@@ -68,12 +74,18 @@ func (h *handler) Signup(c *gin.Context) {
 
 	// Attempt to create the user
 	usr, err := h.s.CreateUser(ctx, nu)
+	if abortWeakPassword(c, traceId, "password", err) {
+		return
+	}
 	if err != nil {
 		log.Error().Err(err).Str("Trace Id", traceId).Msg("user signup problem")
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"msg": "user signup failed"})
 		return
 	}
 
+	// The user verifies their email with the link in this mail, if it can't be sent they can ask for another one
+	_ = h.sendVerification(traceId, c, usr.Email)
+
 	// If everything goes right, respond with the created user
 	c.JSON(http.StatusOK, usr)
 }
@@ -89,9 +101,13 @@ func (h *handler) Login(c *gin.Context) {
 	}
 
 	// Define a new struct for login data
+	// Scope is optional, clients that need less than everything the user may do can ask for fewer scopes
+	// Browsers set Cookie to get the tokens as cookies, which scripts can't read, see respondTokens
 	var login struct {
 		Email    string `json:"email" validate:"required,email"`
 		Password string `json:"password" validate:"required"`
+		Scope    string `json:"scope"`
+		Cookie   bool   `json:"cookie"`
 	}
 
 	// Attempt to decode JSON from the request body into the login variable
@@ -110,31 +126,29 @@ func (h *handler) Login(c *gin.Context) {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"msg": "please provide Email and Password"})
 		return
 	}
+	if !h.cookieModeAllowed(c, traceId, login.Cookie) {
+		return
+	}
 
 	// Attempt to authenticate the user with the email and password
-	claims, err := h.s.Authenticate(ctx, login.Email, login.Password)
-	if err != nil {
-		log.Error().Err(err).Str("Trace Id", traceId).Send()
-		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"msg": "login failed"})
+	claims, err := h.s.Authenticate(ctx, login.Email, login.Password, c.ClientIP())
+	if abortThrottled(c, traceId, err) {
 		return
 	}
-
-	// Define a new struct for the token
-	var tkn struct {
-		Token string `json:"token"`
+	if errors.Is(err, models.ErrEmailNotVerified) {
+		log.Error().Err(err).Str("Trace Id", traceId).Send()
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "email_not_verified",
+			"msg": "please verify your email first"})
+		return
 	}
-
-	// Generate a new token and put it in the Token field of the token struct
-	tkn.Token, err = h.a.GenerateToken(claims)
 	if err != nil {
-		log.Error().Err(err).Msg("generating token")
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		log.Error().Err(err).Str("Trace Id", traceId).Send()
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"msg": "login failed"})
 		return
 	}
 
-	// If everything goes right, respond with the token
-	c.JSON(http.StatusOK, tkn)
-
+	// Users with a second factor only get a challenge token here, which they exchange at /login/mfa
+	h.completeLogin(c, traceId, claims, login.Scope, login.Cookie)
 }
 
 func (h *handler) AddInventory(c *gin.Context) {
@@ -146,7 +160,7 @@ func (h *handler) AddInventory(c *gin.Context) {
 		return
 	}
 
-	claims, ok := ctx.Value(auth.Key).(jwt.RegisteredClaims)
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
 	if !ok {
 		log.Error().Str("Trace Id", traceId).Msg("login first")
 		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": http.StatusText(http.StatusUnauthorized)})
@@ -169,14 +183,11 @@ func (h *handler) AddInventory(c *gin.Context) {
 			gin.H{"msg": "please provide Item Name and Quantity"})
 		return
 	}
-	uid, err := strconv.ParseUint(claims.Subject, 10, 64)
-	if err != nil {
-		log.Error().Err(err).Str("Trace Id", traceId)
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.
-			StatusInternalServerError)})
+	uid, ok := userIdOrAbort(c, traceId, claims)
+	if !ok {
 		return
 	}
-	inv, err := h.s.CreatInventory(ctx, newInv, uint(uid))
+	inv, err := h.s.CreatInventory(ctx, newInv, uid)
 	if err != nil {
 		log.Error().Err(err).Str("Trace Id", traceId)
 		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": "Inventory creation failed"})
@@ -196,12 +207,16 @@ func (h *handler) ViewInventory(c *gin.Context) {
 		return
 	}
 
-	claims, ok := ctx.Value(auth.Key).(jwt.RegisteredClaims)
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
 	if !ok {
 		log.Error().Str("Trace Id", traceId).Msg("login first")
 		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": http.StatusText(http.StatusUnauthorized)})
 		return
 	}
+	// Clients have no inventory of their own
+	if _, ok := userIdOrAbort(c, traceId, claims); !ok {
+		return
+	}
 	shirts, total, err := h.s.ViewInventory(ctx, claims.Subject)
 
 	if err != nil {
@@ -212,3 +227,71 @@ func (h *handler) ViewInventory(c *gin.Context) {
 	m := gin.H{"inv": shirts, "total_cost": total}
 	c.JSON(http.StatusOK, m)
 }
+
+// errNotAUser is returned by userIdFromClaims for tokens that OAuth2 clients got on their own behalf.
+var errNotAUser = errors.New("principal is not a user")
+
+// userIdFromClaims returns the id of the user the claims were issued to.
+func userIdFromClaims(claims auth.Claims) (uint, error) {
+	if claims.IsClient() {
+		return 0, errNotAUser
+	}
+	uid, err := strconv.ParseUint(claims.Subject, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return uint(uid), nil
+}
+
+// userIdOrAbort returns the id of the user the claims were issued to. Endpoints that act on a user's own
+// data use it to turn away OAuth2 clients. If there is no user, the request is aborted and false is returned.
+func userIdOrAbort(c *gin.Context, traceId string, claims auth.Claims) (uint, bool) {
+	uid, err := userIdFromClaims(claims)
+	if errors.Is(err, errNotAUser) {
+		log.Error().Str("Trace Id", traceId).Str("client", claims.ClientID).Msg("endpoint needs a user")
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "user_required"})
+		return 0, false
+	}
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Send()
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return 0, false
+	}
+	return uid, true
+}
+
+// cookieModeAllowed reports whether the login may start a cookie session if it asked for one. If it may not,
+// the request is aborted.
+func (h *handler) cookieModeAllowed(c *gin.Context, traceId string, cookie bool) bool {
+	if cookie && !h.cfg.CookieSessions {
+		log.Error().Str("Trace Id", traceId).Msg("cookie session asked for while disabled")
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"msg": "cookie sessions are not enabled"})
+		return false
+	}
+	return true
+}
+
+// abortThrottled responds to a login that was refused because of too many failed attempts.
+// Retry-After tells the client how many seconds to wait. It reports whether the request was aborted.
+func abortThrottled(c *gin.Context, traceId string, err error) bool {
+	var te *models.ThrottleError
+	if !errors.As(err, &te) {
+		return false
+	}
+	log.Error().Err(err).Str("Trace Id", traceId).Str("ip", c.ClientIP()).Msg("login throttled")
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(te.RetryAfter.Seconds()))))
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"msg": "too many failed logins, please try again later"})
+	return true
+}
+
+// abortWeakPassword responds to a password that doesn't satisfy the password policy, with every reason why
+// for the given field of the request. It reports whether the request was aborted.
+func abortWeakPassword(c *gin.Context, traceId, field string, err error) bool {
+	var pe *passwords.PolicyError
+	if !errors.As(err, &pe) {
+		return false
+	}
+	log.Error().Err(err).Str("Trace Id", traceId).Send()
+	c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "weak_password", "field": field, "reasons": pe.Violations})
+	return true
+}
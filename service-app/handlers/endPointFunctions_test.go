@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"service-app/models"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAbortThrottled(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name       string
+		err        error
+		aborted    bool
+		retryAfter string
+	}{
+		{name: "no error"},
+		{name: "other error", err: errors.New("record not found")},
+		{name: "whole seconds", err: &models.ThrottleError{RetryAfter: 4 * time.Second}, aborted: true, retryAfter: "4"},
+		{name: "rounded up", err: &models.ThrottleError{RetryAfter: 1100 * time.Millisecond}, aborted: true, retryAfter: "2"},
+		{name: "lockout", err: &models.ThrottleError{RetryAfter: 15 * time.Minute}, aborted: true, retryAfter: "900"},
+		{name: "wrapped", err: fmt.Errorf("logging in: %w", &models.ThrottleError{RetryAfter: time.Second}),
+			aborted: true, retryAfter: "1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(http.MethodPost, "/login", nil)
+
+			require.Equal(t, tt.aborted, abortThrottled(c, "trace", tt.err))
+			require.Equal(t, tt.retryAfter, w.Header().Get("Retry-After"))
+			if tt.aborted {
+				require.Equal(t, http.StatusTooManyRequests, w.Code)
+			}
+		})
+	}
+}
@@ -4,7 +4,10 @@ import (
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/rs/zerolog/log"
+	"service-app/mailer"
 	"service-app/models"
+	"service-app/sso"
+	"service-app/webauthn"
 	"time"
 
 	"net/http"
@@ -12,21 +15,52 @@ import (
 	"service-app/middlewares"
 )
 
-// Define a function called API that takes an argument a of type *auth.Auth
+// sessionTouchInterval is how often the last-seen time of a session is written at most.
+const sessionTouchInterval = time.Minute
+
+// Config holds the settings of the API.
+type Config struct {
+	// PublicURL is where users reach the API, like https://api.example.com. Links in emails start with it.
+	PublicURL string
+	// CookieSessions lets browsers ask /login for their tokens in HttpOnly cookies instead of the response body.
+	// Requests authenticated with those cookies have to carry a CSRF token, see middlewares.ValidCSRF.
+	CookieSessions bool
+	// SSO is the identity provider users can log in with instead of a password. It is optional, without it
+	// there is no /login/sso.
+	SSO *sso.Provider
+	// WebAuthn lets users register passkeys and log in with them. It is optional, without it there is no
+	// /login/webauthn.
+	WebAuthn *webauthn.RelyingParty
+	// MagicLinkURL is the sign-in page magic links point to, the token is in its query. The page posts it to
+	// /login/magic/verify, mail scanners that open links on their own don't use it up that way. It is optional,
+	// without it there is no /login/magic.
+	MagicLinkURL string
+}
+
+// Define a function called API that takes an argument a of type auth.Tokens, the database connection,
+// the denylist of revoked tokens, the mailer for emails to users and the settings of the API,
 // and returns a pointer to a gin.Engine
 
-func API(a *auth.Auth, c *models.Conn) *gin.Engine {
+func API(a auth.Tokens, c *models.Conn, dl *auth.Denylist, ml mailer.Mailer, cfg Config) *gin.Engine {
 
 	// Create a new Gin engine; Gin is a HTTP web framework written in Go
 	r := gin.New()
 
 	// Attempt to create new middleware with authentication
-	// Here, *auth.Auth passed as a parameter will be used to set up the middleware
-	m, err := middlewares.NewMid(a)
+	// Here, the auth.Tokens passed as a parameter will be used to set up the middleware
 	ms := models.NewStore(c)
+	st, err := middlewares.NewSessionTracker(ms, sessionTouchInterval)
+	if err != nil {
+		log.Panic().Msg("session tracker not set up")
+	}
+	m, err := middlewares.NewMid(a, dl, ms, st)
 	h := handler{
-		s: ms,
-		a: a,
+		s:        ms,
+		a:        a,
+		dl:       dl,
+		ml:       ml,
+		sessions: st,
+		cfg:      cfg,
 	}
 
 	// If there is an error in setting up the middleware, panic and stop the application
@@ -43,9 +77,88 @@ func API(a *auth.Auth, c *models.Conn) *gin.Engine {
 	// If it receives a GET request, it will use the m.Authenticate(check) function.
 	r.POST("/signup", h.Signup)
 	r.POST("/login", h.Login)
+	r.POST("/login/mfa", h.LoginMFA)
+	if cfg.SSO != nil {
+		r.GET("/login/sso", h.StartSSO)
+		r.GET("/login/sso/callback", h.SSOCallback)
+	}
+	if cfg.MagicLinkURL != "" {
+		r.POST("/login/magic", h.SendMagicLink)
+		r.POST("/login/magic/verify", h.VerifyMagicLink)
+	}
+	if cfg.WebAuthn != nil {
+		r.POST("/login/webauthn/begin", h.BeginWebAuthnLogin)
+		r.POST("/login/webauthn/finish", h.FinishWebAuthnLogin)
+	}
+	r.POST("/token/refresh", h.RefreshToken)
+	r.POST("/logout", m.Authenticate(h.Logout))
+	r.POST("/password/forgot", h.ForgotPassword)
+	r.POST("/password/reset", h.ResetPassword)
+	r.GET("/verify-email", h.VerifyEmail)
+	r.POST("/verify-email/resend", h.ResendVerification)
+	r.GET("/.well-known/jwks.json", h.JWKS)
 	r.GET("/check", m.Authenticate(check))
-	r.POST("/add", m.Authenticate(h.AddInventory))
-	r.POST("/view", m.Authenticate(h.ViewInventory))
+	r.POST("/add", m.Authenticate(m.RequireRole(h.AddInventory, auth.RoleManager, auth.RoleAdmin),
+		auth.ScopeInventoryWrite))
+	r.POST("/view", m.Authenticate(h.ViewInventory, auth.ScopeInventoryRead))
+
+	// Only admins can change the roles of users and register OAuth2 clients, and only after
+	// logging in with a second factor
+	r.POST("/admin/users/:id/roles", m.Authenticate(m.RequireRole(m.RequireMFA(h.GrantRole), auth.RoleAdmin),
+		auth.ScopeUsersAdmin))
+	r.DELETE("/admin/users/:id/roles/:role", m.Authenticate(m.RequireRole(m.RequireMFA(h.RevokeRole), auth.RoleAdmin),
+		auth.ScopeUsersAdmin))
+	r.POST("/admin/users/:id/unlock", m.Authenticate(m.RequireRole(m.RequireMFA(h.UnlockUser), auth.RoleAdmin),
+		auth.ScopeUsersAdmin))
+	r.POST("/admin/oauth/clients", m.Authenticate(m.RequireRole(m.RequireMFA(h.CreateOAuthClient), auth.RoleAdmin),
+		auth.ScopeUsersAdmin))
+
+	// Support staff act as a user to see what they see, every impersonation is kept as an audit record
+	r.POST("/admin/users/:id/impersonate", m.Authenticate(m.RequireRole(m.RequireMFA(h.Impersonate), auth.RoleAdmin),
+		auth.ScopeUsersAdmin))
+	r.GET("/admin/users/:id/impersonations", m.Authenticate(m.RequireRole(m.RequireMFA(h.ListImpersonations),
+		auth.RoleAdmin), auth.ScopeUsersAdmin))
+	r.POST("/admin/impersonations/:id/end", m.Authenticate(m.RequireRole(m.RequireMFA(h.EndImpersonation),
+		auth.RoleAdmin), auth.ScopeUsersAdmin))
+
+	// Backend services get tokens for themselves with the client_credentials grant, apps exchange authorization codes
+	r.POST("/oauth/token", h.Token)
+	// and ask whether the tokens they are given are still active
+	r.POST("/oauth/introspect", h.Introspect)
+
+	// Other apps log their users in with service-app through the OpenID Connect authorization code flow
+	r.GET("/.well-known/openid-configuration", h.OpenIDConfiguration)
+	r.GET("/oauth/authorize", h.DescribeAuthorization)
+	r.POST("/oauth/authorize", h.Authorize)
+	r.GET("/userinfo", m.Authenticate(h.UserInfo, auth.ScopeOpenID))
+	r.POST("/userinfo", m.Authenticate(h.UserInfo, auth.ScopeOpenID))
+
+	// Users change their own password
+	r.POST("/me/password", m.Authenticate(h.ChangePassword))
+
+	// Users see where they are logged in and log out devices
+	r.GET("/me/sessions", m.Authenticate(h.ListSessions))
+	r.DELETE("/me/sessions/:id", m.Authenticate(h.RevokeSession))
+	r.DELETE("/me/sessions", m.Authenticate(h.RevokeSessions))
+
+	// Users enrol an authenticator app as their second factor
+	r.POST("/me/mfa/totp", m.Authenticate(h.StartTOTP))
+	r.POST("/me/mfa/totp/confirm", m.Authenticate(h.ConfirmTOTP))
+	r.DELETE("/me/mfa/totp", m.Authenticate(h.DisableTOTP))
+
+	// Users register passkeys to log in without a password
+	if cfg.WebAuthn != nil {
+		r.POST("/me/webauthn/register/begin", m.Authenticate(h.BeginWebAuthnRegistration))
+		r.POST("/me/webauthn/register/finish", m.Authenticate(h.FinishWebAuthnRegistration))
+		r.GET("/me/webauthn/credentials", m.Authenticate(h.ListWebAuthnCredentials))
+		r.DELETE("/me/webauthn/credentials/:id", m.Authenticate(h.DeleteWebAuthnCredential))
+	}
+
+	// Users manage their own API keys
+	r.POST("/me/api-keys", m.Authenticate(h.CreateAPIKey))
+	r.GET("/me/api-keys", m.Authenticate(h.ListAPIKeys))
+	r.PATCH("/me/api-keys/:id", m.Authenticate(h.RelabelAPIKey))
+	r.DELETE("/me/api-keys/:id", m.Authenticate(h.RevokeAPIKey))
 
 	// Return the prepared Gin engine
 	return r
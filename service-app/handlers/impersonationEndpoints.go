@@ -0,0 +1,160 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"service-app/auth"
+	"service-app/middlewares"
+	"service-app/models"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rs/zerolog/log"
+)
+
+// Impersonate gives the admin a short-lived token for the user whose id is in the path, so that support can see
+// what the user sees. The admin has to give a reason, which goes into the audit record of the impersonation.
+// There is no refresh token, once the token expires the admin has to impersonate the user again.
+func (h *handler) Impersonate(c *gin.Context) {
+	ctx := c.Request.Context()
+	traceId, ok := ctx.Value(middlewares.TraceIdKey).(string)
+	if !ok {
+		log.Error().Msg("traceId missing from context")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		log.Error().Str("Trace Id", traceId).Msg("login first")
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": http.StatusText(http.StatusUnauthorized)})
+		return
+	}
+	actorId, ok := userIdOrAbort(c, traceId, claims)
+	if !ok {
+		return
+	}
+
+	uid, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Send()
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"msg": "invalid user id"})
+		return
+	}
+
+	var ni models.NewImpersonation
+	err = json.NewDecoder(c.Request.Body).Decode(&ni)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Send()
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"msg": "Invalid JSON format"})
+		return
+	}
+	validate := validator.New()
+	err = validate.Struct(ni)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Send()
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"msg": "please provide a reason"})
+		return
+	}
+
+	userClaims, rec, err := h.s.Impersonate(ctx, actorId, uint(uid), ni, c.ClientIP(), c.Request.UserAgent())
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Msg("impersonating user")
+		switch {
+		case errors.Is(err, models.ErrUserNotFound):
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"msg": "user not found"})
+		case errors.Is(err, models.ErrImpersonationNotAllowed):
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "impersonation_not_allowed", "msg": err.Error()})
+		default:
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		}
+		return
+	}
+
+	token, err := h.a.GenerateToken(userClaims)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Msg("generating token")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+
+	log.Warn().Str("Trace Id", traceId).Uint("actor", actorId).Uint64("user", uid).Str("reason", ni.Reason).
+		Uint("impersonation", rec.ID).Msg("impersonation started")
+	c.JSON(http.StatusOK, gin.H{
+		"token":         token,
+		"token_type":    "Bearer",
+		"expires_in":    int(time.Until(rec.ExpiresAt).Seconds()),
+		"impersonation": rec,
+	})
+}
+
+// EndImpersonation ends the impersonation whose id is in the path before its token expires.
+func (h *handler) EndImpersonation(c *gin.Context) {
+	ctx := c.Request.Context()
+	traceId, ok := ctx.Value(middlewares.TraceIdKey).(string)
+	if !ok {
+		log.Error().Msg("traceId missing from context")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Send()
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"msg": "invalid impersonation id"})
+		return
+	}
+
+	rec, err := h.s.EndImpersonation(ctx, uint(id))
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Msg("ending impersonation")
+		if errors.Is(err, models.ErrImpersonationNotFound) {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"msg": "no ongoing impersonation with this id"})
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+
+	err = h.dl.Revoke(ctx, jwt.RegisteredClaims{ID: rec.Jti, ExpiresAt: jwt.NewNumericDate(rec.ExpiresAt)})
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Msg("revoking impersonation token")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+
+	log.Warn().Str("Trace Id", traceId).Uint("actor", rec.ActorId).Uint("user", rec.UserId).
+		Uint("impersonation", rec.ID).Msg("impersonation ended")
+	c.JSON(http.StatusOK, rec)
+}
+
+// ListImpersonations lists the audit records of every impersonation of the user whose id is in the path.
+func (h *handler) ListImpersonations(c *gin.Context) {
+	ctx := c.Request.Context()
+	traceId, ok := ctx.Value(middlewares.TraceIdKey).(string)
+	if !ok {
+		log.Error().Msg("traceId missing from context")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+
+	uid, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Send()
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"msg": "invalid user id"})
+		return
+	}
+
+	recs, err := h.s.ListImpersonations(ctx, uint(uid))
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Msg("listing impersonations")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"impersonations": recs})
+}
@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"service-app/mailer"
+	"service-app/middlewares"
+	"service-app/models"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/rs/zerolog/log"
+)
+
+// SendMagicLink mails a link that logs the user in without their password. Like ForgotPassword it responds the
+// same whether a link was sent or not, so that it can't be used to find out who has an account. Only clients that
+// ask for too many links are told, they have to wait.
+func (h *handler) SendMagicLink(c *gin.Context) {
+	ctx := c.Request.Context()
+	traceId, ok := ctx.Value(middlewares.TraceIdKey).(string)
+	if !ok {
+		log.Error().Msg("traceId missing from context")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+
+	var req struct {
+		Email string `json:"email" validate:"required,email"`
+	}
+	err := json.NewDecoder(c.Request.Body).Decode(&req)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Send()
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"msg": "Invalid JSON format"})
+		return
+	}
+	validate := validator.New()
+	err = validate.Struct(req)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Send()
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"msg": "please provide Email"})
+		return
+	}
+
+	msg := fmt.Sprintf("if the email belongs to an account, a sign-in link is on its way. Links are sent at most "+
+		"once every %s", models.MagicLinkCooldown)
+
+	u, token, err := h.s.CreateMagicLinkToken(ctx, req.Email, c.ClientIP())
+	var te *models.ThrottleError
+	if errors.As(err, &te) {
+		log.Error().Err(err).Str("Trace Id", traceId).Str("ip", c.ClientIP()).Msg("magic links throttled")
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(te.RetryAfter.Seconds()))))
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"msg": "too many sign-in links, please try again later"})
+		return
+	}
+	if errors.Is(err, models.ErrUserNotFound) || errors.Is(err, models.ErrMagicLinkCooldown) {
+		log.Info().Err(err).Str("Trace Id", traceId).Msg("no magic link sent")
+		c.JSON(http.StatusOK, gin.H{"msg": msg})
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Msg("creating magic link")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+
+	// Like the password reset mail, it is sent in the background so that the response time doesn't give
+	// existing accounts away
+	link := h.cfg.MagicLinkURL + "?token=" + url.QueryEscape(token)
+	h.sendMail(traceId, mailer.Message{
+		To:      u.Email,
+		Subject: "Your sign-in link",
+		Body: fmt.Sprintf("Hi %s,\n\nopen this link to sign in:\n\n%s\n\n"+
+			"The link can be used once and expires in %s. If you didn't ask for it, you can ignore this email.\n",
+			u.Name, link, models.MagicLinkTTL),
+	})
+
+	log.Info().Str("Trace Id", traceId).Str("user", strconv.FormatUint(uint64(u.ID), 10)).Msg("magic link sent")
+	c.JSON(http.StatusOK, gin.H{"msg": msg})
+}
+
+// VerifyMagicLink logs the user in with the token of their magic link and responds with the tokens /login would
+// give them. Scope and Cookie work like they do for /login, and users with a second factor get a challenge token
+// for /login/mfa as well.
+func (h *handler) VerifyMagicLink(c *gin.Context) {
+	ctx := c.Request.Context()
+	traceId, ok := ctx.Value(middlewares.TraceIdKey).(string)
+	if !ok {
+		log.Error().Msg("traceId missing from context")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+
+	var req struct {
+		Token  string `json:"token" validate:"required"`
+		Scope  string `json:"scope"`
+		Cookie bool   `json:"cookie"`
+	}
+	err := json.NewDecoder(c.Request.Body).Decode(&req)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Send()
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"msg": "Invalid JSON format"})
+		return
+	}
+	validate := validator.New()
+	err = validate.Struct(req)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Send()
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"msg": "please provide token"})
+		return
+	}
+	if !h.cookieModeAllowed(c, traceId, req.Cookie) {
+		return
+	}
+
+	claims, err := h.s.ConsumeMagicLink(ctx, req.Token, c.ClientIP())
+	if abortThrottled(c, traceId, err) {
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Msg("using magic link")
+		if errors.Is(err, models.ErrInvalidUserToken) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"msg": "invalid or expired link"})
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+
+	// The link stands in for the password only, users with a second factor exchange the challenge at /login/mfa
+	h.completeLogin(c, traceId, claims, req.Scope, req.Cookie)
+}
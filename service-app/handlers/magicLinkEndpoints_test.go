@@ -0,0 +1,187 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"service-app/auth"
+	"service-app/mailer"
+	"service-app/middlewares"
+	"service-app/models"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+// magicLinkService is the part of models.Service the magic link endpoints use. createErr is what asking for a
+// link returns, tokens maps the unused links to their user and is used up like the database does, mfa lists the
+// users with TOTP.
+type magicLinkService struct {
+	models.Service
+	createErr error
+
+	mu     sync.Mutex
+	tokens map[string]uint
+	mfa    map[uint]bool
+}
+
+func (s *magicLinkService) CreateMagicLinkToken(ctx context.Context, email, ip string) (models.User, string, error) {
+	if s.createErr != nil {
+		return models.User{}, "", s.createErr
+	}
+	var u models.User
+	u.ID = 7
+	u.Email = email
+	u.Name = "Ada"
+	return u, "link-token", nil
+}
+
+func (s *magicLinkService) ConsumeMagicLink(ctx context.Context, token, ip string) (auth.Claims, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	uid, ok := s.tokens[token]
+	if !ok {
+		return auth.Claims{}, models.ErrInvalidUserToken
+	}
+	delete(s.tokens, token)
+
+	var claims auth.Claims
+	claims.Subject = strconv.FormatUint(uint64(uid), 10)
+	claims.AMR = []string{auth.AMREmail}
+	return claims, nil
+}
+
+func (s *magicLinkService) TOTPEnabled(ctx context.Context, userId uint) (bool, error) {
+	return s.mfa[userId], nil
+}
+
+func (s *magicLinkService) CreateSession(ctx context.Context, userId uint, claims auth.Claims, userAgent, ip string) (auth.Claims, string, error) {
+	return claims, "refresh-token", nil
+}
+
+// magicLinkRequest runs the handler with the JSON body the way the router would.
+func magicLinkRequest(h gin.HandlerFunc, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req = req.WithContext(context.WithValue(req.Context(), middlewares.TraceIdKey, "trace"))
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = req
+	h(c)
+	return w
+}
+
+// Whether a link was sent or not, the response is the same. Only throttled clients are told to wait.
+func TestSendMagicLink(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+		wantMail   bool
+	}{
+		{name: "link sent", wantStatus: http.StatusOK, wantMail: true},
+		{name: "unknown email", err: models.ErrUserNotFound, wantStatus: http.StatusOK},
+		{name: "cooldown or hourly cap", err: models.ErrMagicLinkCooldown, wantStatus: http.StatusOK},
+		{name: "ip throttled", err: &models.ThrottleError{RetryAfter: 90 * time.Second},
+			wantStatus: http.StatusTooManyRequests},
+	}
+	var sentMsg string
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ml := mailer.NewMemoryOutbox()
+			h := &handler{s: models.NewStore(&magicLinkService{createErr: tt.err}), ml: ml,
+				cfg: Config{MagicLinkURL: "https://app.example.com/magic"}}
+
+			w := magicLinkRequest(h.SendMagicLink, "/login/magic", `{"email":"ada@example.com"}`)
+			require.Equal(t, tt.wantStatus, w.Code, w.Body.String())
+			if tt.wantStatus == http.StatusTooManyRequests {
+				require.Equal(t, "90", w.Header().Get("Retry-After"))
+				return
+			}
+
+			var body map[string]string
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+			if sentMsg == "" {
+				sentMsg = body["msg"]
+			}
+			require.Equal(t, sentMsg, body["msg"])
+
+			if !tt.wantMail {
+				// The mail would go out in the background, give it the time it would need
+				time.Sleep(50 * time.Millisecond)
+				require.Empty(t, ml.Messages())
+				return
+			}
+			require.Eventually(t, func() bool { return len(ml.Messages()) == 1 }, time.Second, 10*time.Millisecond)
+			m := ml.Messages()[0]
+			require.Equal(t, "ada@example.com", m.To)
+			require.Contains(t, m.Body, "https://app.example.com/magic?token=link-token")
+		})
+	}
+}
+
+func TestVerifyMagicLink(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ks := auth.NewKeySet()
+	require.NoError(t, ks.Add(auth.SigningKey{PrivateKey: key}))
+	a, err := auth.NewAuth(ks, auth.Config{Issuer: "service-app", Audience: "service-app-api"})
+	require.NoError(t, err)
+
+	s := &magicLinkService{
+		tokens: map[string]uint{"plain-link": 1, "totp-link": 2},
+		mfa:    map[uint]bool{2: true},
+	}
+	h := &handler{s: models.NewStore(s), a: a}
+
+	tests := []struct {
+		name       string
+		token      string
+		wantStatus int
+		wantMFA    bool
+	}{
+		{name: "user without second factor gets tokens", token: "plain-link", wantStatus: http.StatusOK},
+		{name: "link can't be used twice", token: "plain-link", wantStatus: http.StatusUnauthorized},
+		{name: "unknown link", token: "guessed-link", wantStatus: http.StatusUnauthorized},
+		{name: "user with totp gets a challenge", token: "totp-link", wantStatus: http.StatusOK, wantMFA: true},
+	}
+	// The cases run in order, the second one uses the link of the first again
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := magicLinkRequest(h.VerifyMagicLink, "/login/magic/verify", `{"token":"`+tt.token+`"}`)
+			require.Equal(t, tt.wantStatus, w.Code, w.Body.String())
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			var body map[string]any
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+			if !tt.wantMFA {
+				require.Nil(t, body["mfa_required"])
+				require.NotEmpty(t, body["token"])
+				return
+			}
+
+			// The link only stands in for the password, the challenge says so and is no access token
+			require.Equal(t, true, body["mfa_required"])
+			require.Nil(t, body["token"])
+			require.Nil(t, body["refresh_token"])
+			challenge, err := a.ValidateMFAChallenge(body["mfa_token"].(string))
+			require.NoError(t, err)
+			require.Equal(t, []string{auth.AMREmail}, challenge.AMR)
+			_, err = a.ValidateToken(body["mfa_token"].(string))
+			require.Error(t, err)
+		})
+	}
+}
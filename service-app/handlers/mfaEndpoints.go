@@ -0,0 +1,287 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"service-app/auth"
+	"service-app/middlewares"
+	"service-app/models"
+	"service-app/totp"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/rs/zerolog/log"
+	"github.com/skip2/go-qrcode"
+)
+
+// totpIssuer is the name authenticator apps show next to the account.
+const totpIssuer = "service-app"
+
+// mfaCode is the body of the endpoints that take a TOTP code or a recovery code.
+type mfaCode struct {
+	Code string `json:"code" validate:"required"`
+}
+
+// LoginMFA is the second step of logging in for users with a second factor. It exchanges the challenge token
+// /login responded with, together with a TOTP code or a recovery code, for the access and refresh token.
+// A challenge token can be used once: after a wrong code the user has to start over at /login.
+func (h *handler) LoginMFA(c *gin.Context) {
+	ctx := c.Request.Context()
+	traceId, ok := ctx.Value(middlewares.TraceIdKey).(string)
+	if !ok {
+		log.Error().Msg("traceId missing from context")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+
+	var req struct {
+		MFAToken string `json:"mfa_token" validate:"required"`
+		Code     string `json:"code" validate:"required"`
+		Cookie   bool   `json:"cookie"`
+	}
+	err := json.NewDecoder(c.Request.Body).Decode(&req)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Send()
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"msg": "Invalid JSON format"})
+		return
+	}
+	validate := validator.New()
+	err = validate.Struct(req)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Send()
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"msg": "please provide mfa_token and code"})
+		return
+	}
+	if !h.cookieModeAllowed(c, traceId, req.Cookie) {
+		return
+	}
+
+	challenge, err := h.a.ValidateMFAChallenge(req.MFAToken)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Msg("invalid mfa challenge")
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid_mfa_token", "msg": "please log in again"})
+		return
+	}
+	revoked, err := h.dl.IsRevoked(ctx, challenge.RegisteredClaims)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Msg("checking denylist")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+	if revoked {
+		log.Error().Str("Trace Id", traceId).Str("jti", challenge.ID).Msg("mfa challenge already used")
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid_mfa_token", "msg": "please log in again"})
+		return
+	}
+
+	uid, err := userIdFromClaims(challenge)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Send()
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid_mfa_token", "msg": "please log in again"})
+		return
+	}
+
+	claims, err := h.s.CompleteMFA(ctx, uid, req.Code, c.ClientIP())
+
+	// Whatever the outcome, the challenge is used up. Otherwise it could be used to guess codes until it expires.
+	revokeErr := h.dl.Revoke(ctx, challenge.RegisteredClaims)
+	if revokeErr != nil {
+		log.Error().Err(revokeErr).Str("Trace Id", traceId).Msg("revoking mfa challenge")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+
+	if abortThrottled(c, traceId, err) {
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Str("user", challenge.Subject).Msg("second factor failed")
+		if errors.Is(err, models.ErrInvalidMFACode) || errors.Is(err, models.ErrMFANotEnabled) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid_mfa_code", "msg": "login failed"})
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+
+	// The first factor is the one the challenge was issued for, the password, the identity provider or a magic link
+	if len(challenge.AMR) > 0 {
+		claims.AMR = append(append([]string{}, challenge.AMR...), auth.AMROTP, auth.AMRMFA)
+	}
+
+	// The token gets the scopes asked for at /login, as far as the roles of the user still allow them
+	claims.Scope, err = auth.NarrowScope(claims.Scope, challenge.Scope)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Send()
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "invalid_scope", "msg": err.Error()})
+		return
+	}
+
+	tkn, err := h.issueTokens(ctx, claims, c.Request.UserAgent(), c.ClientIP())
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Msg("generating token")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+
+	err = respondTokens(c, tkn, req.Cookie)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Send()
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+}
+
+// StartTOTP starts the enrolment of an authenticator app for the logged-in user. It responds with the secret,
+// the otpauth:// URI and a QR code PNG of that URI, as a data URL. TOTP is only enabled once ConfirmTOTP got a first code.
+func (h *handler) StartTOTP(c *gin.Context) {
+	ctx := c.Request.Context()
+	traceId, claims, uid, ok := accountPrincipal(c)
+	if !ok {
+		return
+	}
+
+	u, secret, err := h.s.StartTOTPEnrolment(ctx, uid)
+	if err != nil {
+		abortMFAError(c, traceId, err)
+		return
+	}
+
+	uri := totp.ProvisioningURI(totpIssuer, u.Email, secret)
+	png, err := qrcode.Encode(uri, qrcode.Medium, 256)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Msg("encoding qr code")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+
+	// The secret is sent along for users who can't scan the QR code
+	c.Header("Cache-Control", "no-store")
+	log.Info().Str("Trace Id", traceId).Str("user", claims.Subject).Msg("totp enrolment started")
+	c.JSON(http.StatusOK, gin.H{
+		"secret":  secret,
+		"uri":     uri,
+		"qr_code": "data:image/png;base64," + base64.StdEncoding.EncodeToString(png),
+	})
+}
+
+// ConfirmTOTP enables TOTP for the logged-in user with a first code of their authenticator app and responds with
+// their recovery codes. They are not shown again.
+func (h *handler) ConfirmTOTP(c *gin.Context) {
+	ctx := c.Request.Context()
+	traceId, claims, uid, ok := accountPrincipal(c)
+	if !ok {
+		return
+	}
+	code, ok := decodeMFACode(c, traceId)
+	if !ok {
+		return
+	}
+
+	codes, err := h.s.ConfirmTOTPEnrolment(ctx, uid, code)
+	if err != nil {
+		abortMFAError(c, traceId, err)
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	log.Info().Str("Trace Id", traceId).Str("user", claims.Subject).Msg("totp enabled")
+	c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+}
+
+// DisableTOTP turns TOTP off for the logged-in user. It takes a TOTP code or a recovery code, after too many
+// wrong ones the user has to wait like after failed logins.
+func (h *handler) DisableTOTP(c *gin.Context) {
+	ctx := c.Request.Context()
+	traceId, claims, uid, ok := accountPrincipal(c)
+	if !ok {
+		return
+	}
+	code, ok := decodeMFACode(c, traceId)
+	if !ok {
+		return
+	}
+
+	err := h.s.DisableTOTP(ctx, uid, code, c.ClientIP())
+	if abortThrottled(c, traceId, err) {
+		return
+	}
+	if err != nil {
+		abortMFAError(c, traceId, err)
+		return
+	}
+
+	log.Info().Str("Trace Id", traceId).Str("user", claims.Subject).Msg("totp disabled")
+	c.JSON(http.StatusOK, gin.H{"msg": "totp disabled"})
+}
+
+// accountPrincipal returns the trace id, the claims and the user id of a request that manages how the user logs
+// in, like their second factor or their password. Only users who logged in themselves may do that, not OAuth2
+// clients and not API keys.
+// If there is no such user, the request is aborted and false is returned.
+func accountPrincipal(c *gin.Context) (string, auth.Claims, uint, bool) {
+	ctx := c.Request.Context()
+	traceId, ok := ctx.Value(middlewares.TraceIdKey).(string)
+	if !ok {
+		log.Error().Msg("traceId missing from context")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return "", auth.Claims{}, 0, false
+	}
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		log.Error().Str("Trace Id", traceId).Msg("login first")
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": http.StatusText(http.StatusUnauthorized)})
+		return "", auth.Claims{}, 0, false
+	}
+	if claims.APIKeyID != 0 {
+		log.Error().Str("Trace Id", traceId).Msg("account managed with api key")
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"msg": "api keys can't change how the user logs in"})
+		return "", auth.Claims{}, 0, false
+	}
+
+	uid, ok := userIdOrAbort(c, traceId, claims)
+	if !ok {
+		return "", auth.Claims{}, 0, false
+	}
+	return traceId, claims, uid, true
+}
+
+// decodeMFACode reads the code from the body of the request. If there is none, the request is aborted and
+// false is returned.
+func decodeMFACode(c *gin.Context, traceId string) (string, bool) {
+	var req mfaCode
+	err := json.NewDecoder(c.Request.Body).Decode(&req)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Send()
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"msg": "Invalid JSON format"})
+		return "", false
+	}
+	validate := validator.New()
+	err = validate.Struct(req)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Send()
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"msg": "please provide code"})
+		return "", false
+	}
+	return req.Code, true
+}
+
+// abortMFAError responds to a failed change of a user's second factor.
+func abortMFAError(c *gin.Context, traceId string, err error) {
+	log.Error().Err(err).Str("Trace Id", traceId).Msg("changing mfa")
+	switch {
+	case errors.Is(err, models.ErrMFAAlreadyEnabled):
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"msg": "totp is already enabled"})
+	case errors.Is(err, models.ErrMFANotEnabled):
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"msg": "totp is not enabled"})
+	case errors.Is(err, models.ErrInvalidMFACode):
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_mfa_code", "msg": "invalid code"})
+	case errors.Is(err, models.ErrUserNotFound):
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"msg": "user not found"})
+	default:
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+	}
+}
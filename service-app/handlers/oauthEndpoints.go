@@ -0,0 +1,274 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"service-app/auth"
+	"service-app/middlewares"
+	"service-app/models"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/rs/zerolog/log"
+)
+
+// oauthError responds with an error as described by RFC 6749 section 5.2.
+func oauthError(c *gin.Context, status int, code, description string) {
+	if status == http.StatusUnauthorized {
+		c.Header("WWW-Authenticate", `Basic realm="service-app"`)
+	}
+	c.AbortWithStatusJSON(status, gin.H{"error": code, "error_description": description})
+}
+
+// clientCredentials returns the client id and secret of the request. Clients send them with HTTP Basic
+// authentication, or as client_id and client_secret form parameters.
+func clientCredentials(c *gin.Context) (string, string, bool) {
+	id, secret, ok := c.Request.BasicAuth()
+	if ok {
+		// RFC 6749 section 2.3.1 form-encodes both before they are put in the header
+		id, err := url.QueryUnescape(id)
+		if err != nil {
+			return "", "", false
+		}
+		secret, err := url.QueryUnescape(secret)
+		if err != nil {
+			return "", "", false
+		}
+		return id, secret, true
+	}
+
+	id, secret = c.PostForm("client_id"), c.PostForm("client_secret")
+	return id, secret, id != "" && secret != ""
+}
+
+// authenticateClient authenticates the OAuth2 client of the request and returns the claims it would get
+// for itself. The request is aborted when that fails.
+func (h *handler) authenticateClient(c *gin.Context, traceId string) (auth.Claims, bool) {
+	id, secret, ok := clientCredentials(c)
+	if !ok {
+		log.Error().Str("Trace Id", traceId).Msg("client credentials missing")
+		oauthError(c, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+		return auth.Claims{}, false
+	}
+
+	claims, err := h.s.AuthenticateClient(c.Request.Context(), id, secret)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Str("client", id).Send()
+		if errors.Is(err, models.ErrInvalidClient) {
+			oauthError(c, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+			return auth.Claims{}, false
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return auth.Claims{}, false
+	}
+	return claims, true
+}
+
+// Token is the OAuth2 token endpoint. It implements the client_credentials grant, which gives a registered
+// client an access token for itself, and the authorization_code grant, with which a client exchanges the code
+// it got from the authorization endpoint for the tokens of the user who logged in.
+func (h *handler) Token(c *gin.Context) {
+	ctx := c.Request.Context()
+	traceId, ok := ctx.Value(middlewares.TraceIdKey).(string)
+	if !ok {
+		log.Error().Msg("traceId missing from context")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+
+	// Token responses must never be cached
+	c.Header("Cache-Control", "no-store")
+	c.Header("Pragma", "no-cache")
+
+	grantType := c.PostForm("grant_type")
+	switch grantType {
+	case "client_credentials":
+		h.clientCredentialsGrant(c, traceId)
+	case "authorization_code":
+		h.authorizationCodeGrant(c, traceId)
+	default:
+		log.Error().Str("Trace Id", traceId).Str("grant_type", grantType).Msg("unsupported grant type")
+		oauthError(c, http.StatusBadRequest, "unsupported_grant_type",
+			"only client_credentials and authorization_code are supported")
+	}
+}
+
+// clientCredentialsGrant issues a client an access token for itself.
+func (h *handler) clientCredentialsGrant(c *gin.Context, traceId string) {
+	claims, ok := h.authenticateClient(c, traceId)
+	if !ok {
+		return
+	}
+	id := claims.ClientID
+
+	// Clients can ask for fewer scopes than they are allowed
+	var err error
+	claims.Scope, err = auth.NarrowScope(claims.Scope, c.PostForm("scope"))
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Str("client", id).Send()
+		oauthError(c, http.StatusBadRequest, "invalid_scope", err.Error())
+		return
+	}
+
+	token, err := h.a.GenerateToken(claims)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Msg("generating token")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+
+	log.Info().Str("Trace Id", traceId).Str("client", id).Str("scope", claims.Scope).Msg("client token issued")
+	c.JSON(http.StatusOK, gin.H{
+		"access_token": token,
+		"token_type":   "Bearer",
+		"expires_in":   int(time.Until(claims.ExpiresAt.Time).Seconds()),
+		"scope":        claims.Scope,
+	})
+}
+
+// Introspect is the token introspection endpoint of RFC 7662. Registered clients use it to find out whether
+// an access token is active, without verifying it themselves. Any token that fails validation or has been
+// revoked is reported as inactive, the response doesn't say why.
+func (h *handler) Introspect(c *gin.Context) {
+	ctx := c.Request.Context()
+	traceId, ok := ctx.Value(middlewares.TraceIdKey).(string)
+	if !ok {
+		log.Error().Msg("traceId missing from context")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.Header("Pragma", "no-cache")
+
+	client, ok := h.authenticateClient(c, traceId)
+	if !ok {
+		return
+	}
+
+	token := c.PostForm("token")
+	if token == "" {
+		log.Error().Str("Trace Id", traceId).Str("client", client.ClientID).Msg("token missing")
+		oauthError(c, http.StatusBadRequest, "invalid_request", "token is required")
+		return
+	}
+
+	claims, err := h.a.ValidateToken(token)
+	if err != nil {
+		log.Info().Err(err).Str("Trace Id", traceId).Str("client", client.ClientID).Msg("introspected token invalid")
+		c.JSON(http.StatusOK, gin.H{"active": false})
+		return
+	}
+
+	revoked, err := h.dl.IsRevoked(ctx, claims.RegisteredClaims)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Msg("checking denylist")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+	if revoked {
+		log.Info().Str("Trace Id", traceId).Str("client", client.ClientID).Str("jti", claims.ID).
+			Msg("introspected token revoked")
+		c.JSON(http.StatusOK, gin.H{"active": false})
+		return
+	}
+	// The request comes from the client, not from the device of the session, so the ip of the session is left alone
+	if claims.SessionID != "" {
+		active, err := h.sessions.Seen(ctx, claims.SessionID, "")
+		if err != nil {
+			log.Error().Err(err).Str("Trace Id", traceId).Msg("checking session")
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+			return
+		}
+		if !active {
+			log.Info().Str("Trace Id", traceId).Str("client", client.ClientID).Str("sid", claims.SessionID).
+				Msg("introspected token of ended session")
+			c.JSON(http.StatusOK, gin.H{"active": false})
+			return
+		}
+	}
+
+	resp := gin.H{
+		"active":     true,
+		"sub":        claims.Subject,
+		"scope":      claims.Scope,
+		"token_type": "Bearer",
+		"exp":        claims.ExpiresAt.Unix(),
+		"iat":        claims.IssuedAt.Unix(),
+		"iss":        claims.Issuer,
+		"aud":        claims.Audience,
+		"jti":        claims.ID,
+	}
+	if claims.ClientID != "" {
+		resp["client_id"] = claims.ClientID
+	}
+	if len(claims.Roles) > 0 {
+		resp["roles"] = claims.Roles
+	}
+	if claims.SessionID != "" {
+		resp["sid"] = claims.SessionID
+	}
+	if claims.IsImpersonation() {
+		resp["act"] = claims.Act
+	}
+
+	log.Info().Str("Trace Id", traceId).Str("client", client.ClientID).Str("jti", claims.ID).Msg("token introspected")
+	c.JSON(http.StatusOK, resp)
+}
+
+// CreateOAuthClient registers a new OAuth2 client. Its secret is only part of this response.
+func (h *handler) CreateOAuthClient(c *gin.Context) {
+	ctx := c.Request.Context()
+	traceId, ok := ctx.Value(middlewares.TraceIdKey).(string)
+	if !ok {
+		log.Error().Msg("traceId missing from context")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+
+	var nc models.NewOAuthClient
+	err := json.NewDecoder(c.Request.Body).Decode(&nc)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Send()
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"msg": "Invalid JSON format"})
+		return
+	}
+	validate := validator.New()
+	err = validate.Struct(nc)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Send()
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"msg": "please provide name and scope"})
+		return
+	}
+
+	// Codes are appended to the query of a redirect URI, a fragment would hide them from the client
+	for _, uri := range nc.RedirectURIs {
+		u, err := url.Parse(uri)
+		if err != nil || !u.IsAbs() || u.Fragment != "" {
+			log.Error().Err(err).Str("Trace Id", traceId).Str("redirect_uri", uri).Msg("invalid redirect uri")
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_redirect_uri",
+				"msg": "redirect uris have to be absolute and without a fragment"})
+			return
+		}
+	}
+
+	nc.Scope, err = auth.NarrowScope(auth.AllScopes, nc.Scope)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Send()
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_scope", "msg": err.Error()})
+		return
+	}
+
+	cl, secret, err := h.s.CreateOAuthClient(ctx, nc)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Msg("creating oauth client")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+
+	log.Info().Str("Trace Id", traceId).Str("client", cl.ClientId).Msg("oauth client registered")
+	c.JSON(http.StatusOK, gin.H{"client": cl, "client_secret": secret})
+}
@@ -0,0 +1,392 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"service-app/auth"
+	"service-app/middlewares"
+	"service-app/models"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+// codeChallengeLength is the length of an S256 code challenge, an unpadded base64url encoded SHA-256 hash.
+const codeChallengeLength = 43
+
+// maxAuthorizeParam is the longest state or nonce a client may send, both are echoed back as they are.
+const maxAuthorizeParam = 512
+
+// authorizeRequest is a request to the authorization endpoint whose parameters have been checked.
+type authorizeRequest struct {
+	models.AuthorizationRequest
+	client models.OAuthClient
+	scope  string
+	state  string
+}
+
+// parseAuthorizeRequest checks the parameters of a request to the authorization endpoint, which come from the
+// query string or the form. Until the client and its redirect URI are known to be right, errors are shown to the
+// user. After that they are sent back to the client through the redirect, as RFC 6749 section 4.1.2.1 describes.
+// The request is aborted when it isn't valid.
+func (h *handler) parseAuthorizeRequest(c *gin.Context, traceId string) (authorizeRequest, bool) {
+	clientId := c.Request.FormValue("client_id")
+	cl, err := h.s.FindOAuthClient(c.Request.Context(), clientId)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Str("client", clientId).Send()
+		if errors.Is(err, models.ErrInvalidClient) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_client", "msg": "unknown client"})
+			return authorizeRequest{}, false
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return authorizeRequest{}, false
+	}
+	redirectURI := c.Request.FormValue("redirect_uri")
+	if !cl.HasRedirectURI(redirectURI) {
+		log.Error().Str("Trace Id", traceId).Str("client", clientId).Str("redirect_uri", redirectURI).
+			Msg("redirect uri not registered")
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_request",
+			"msg": "redirect_uri is not registered for the client"})
+		return authorizeRequest{}, false
+	}
+
+	ar := authorizeRequest{
+		AuthorizationRequest: models.AuthorizationRequest{
+			ClientId:      clientId,
+			RedirectURI:   redirectURI,
+			Nonce:         c.Request.FormValue("nonce"),
+			CodeChallenge: c.Request.FormValue("code_challenge"),
+		},
+		client: cl,
+		state:  c.Request.FormValue("state"),
+	}
+	fail := func(code, description string) (authorizeRequest, bool) {
+		log.Error().Str("Trace Id", traceId).Str("client", clientId).Str("error", code).Msg(description)
+		redirectAuthorizeError(c, ar, code, description)
+		return authorizeRequest{}, false
+	}
+
+	if c.Request.FormValue("response_type") != "code" {
+		return fail("unsupported_response_type", "only the code response type is supported")
+	}
+	// Every client has to use PKCE, so that a code that leaks through the browser is worthless on its own
+	if c.Request.FormValue("code_challenge_method") != "S256" || len(ar.CodeChallenge) != codeChallengeLength {
+		return fail("invalid_request", "a S256 code_challenge is required")
+	}
+	if len(ar.state) > maxAuthorizeParam || len(ar.Nonce) > maxAuthorizeParam {
+		return fail("invalid_request", "state or nonce too long")
+	}
+
+	// Clients can ask for the OpenID Connect scopes and the scopes they were registered with
+	requested := c.Request.FormValue("scope")
+	if !(auth.Claims{Scope: requested}).HasScopes(auth.ScopeOpenID) {
+		return fail("invalid_scope", "the openid scope is required")
+	}
+	ar.scope, err = auth.NarrowScope(cl.Scope+" "+auth.OIDCScopes, requested)
+	if err != nil {
+		return fail("invalid_scope", err.Error())
+	}
+	return ar, true
+}
+
+// redirectAuthorizeError sends the user back to the client with an error, as RFC 6749 section 4.1.2.1 describes.
+func redirectAuthorizeError(c *gin.Context, ar authorizeRequest, code, description string) {
+	redirectAuthorize(c, ar, url.Values{"error": {code}, "error_description": {description}})
+}
+
+// redirectAuthorize sends the user back to the redirect URI of the request with the given parameters and the
+// state of the request. Parameters already in the redirect URI are kept.
+func redirectAuthorize(c *gin.Context, ar authorizeRequest, params url.Values) {
+	// The redirect URI was registered as an absolute URL, so it parses
+	u, _ := url.Parse(ar.RedirectURI)
+	q := u.Query()
+	for k, v := range params {
+		q[k] = v
+	}
+	if ar.state != "" {
+		q.Set("state", ar.state)
+	}
+	u.RawQuery = q.Encode()
+	c.Redirect(http.StatusFound, u.String())
+	c.Abort()
+}
+
+// DescribeAuthorization checks a request to the authorization endpoint and describes it, so that the login page
+// can show the user which app they are logging in to, what it asks for and whether they have to approve it.
+// The login page then posts the same parameters with the credentials of the user to Authorize.
+func (h *handler) DescribeAuthorization(c *gin.Context) {
+	ctx := c.Request.Context()
+	traceId, ok := ctx.Value(middlewares.TraceIdKey).(string)
+	if !ok {
+		log.Error().Msg("traceId missing from context")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+
+	ar, ok := h.parseAuthorizeRequest(c, traceId)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"client_id":        ar.client.ClientId,
+		"client_name":      ar.client.Name,
+		"redirect_uri":     ar.RedirectURI,
+		"scope":            ar.scope,
+		"consent_required": !ar.client.FirstParty,
+	})
+}
+
+// Authorize is the authorization endpoint of the authorization code flow. It logs the user in with their email,
+// password and, if they have one, the code of their second factor, and sends them back to the client with an
+// authorization code. Users of first-party clients are never asked for consent, for any other client the login
+// page has to send consent=approve. consent=deny sends the user back without a code.
+//
+// Failed logins are answered here, so that the login page can let the user try again.
+func (h *handler) Authorize(c *gin.Context) {
+	ctx := c.Request.Context()
+	traceId, ok := ctx.Value(middlewares.TraceIdKey).(string)
+	if !ok {
+		log.Error().Msg("traceId missing from context")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+
+	ar, ok := h.parseAuthorizeRequest(c, traceId)
+	if !ok {
+		return
+	}
+
+	consent := c.PostForm("consent")
+	if consent == "deny" {
+		log.Info().Str("Trace Id", traceId).Str("client", ar.ClientId).Msg("authorization denied by user")
+		redirectAuthorizeError(c, ar, "access_denied", "the user denied the request")
+		return
+	}
+	if !ar.client.FirstParty && consent != "approve" {
+		log.Error().Str("Trace Id", traceId).Str("client", ar.ClientId).Msg("consent missing")
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "consent_required",
+			"msg": "the user has to approve the client"})
+		return
+	}
+
+	claims, ok := h.authenticateForAuthorization(c, traceId)
+	if !ok {
+		return
+	}
+
+	// The client gets what it asked for, as far as the roles of the user allow it
+	claims.Scope = auth.IntersectScopes(claims.Scope+" "+auth.OIDCScopes, ar.scope)
+
+	code, err := h.s.CreateAuthorizationCode(ctx, claims, ar.AuthorizationRequest)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Msg("creating authorization code")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+
+	log.Info().Str("Trace Id", traceId).Str("client", ar.ClientId).Str("user", claims.Subject).
+		Str("scope", claims.Scope).Msg("authorization code issued")
+	redirectAuthorize(c, ar, url.Values{"code": {code}})
+}
+
+// authenticateForAuthorization logs the user of an authorization request in with the email, password and
+// mfa_code form parameters. Users with a second factor have to send its code along with their password.
+// The request is aborted when that fails.
+func (h *handler) authenticateForAuthorization(c *gin.Context, traceId string) (auth.Claims, bool) {
+	ctx := c.Request.Context()
+	email, password := c.PostForm("email"), c.PostForm("password")
+	if email == "" || password == "" {
+		log.Error().Str("Trace Id", traceId).Msg("credentials missing")
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"msg": "please provide Email and Password"})
+		return auth.Claims{}, false
+	}
+
+	claims, err := h.s.Authenticate(ctx, email, password, c.ClientIP())
+	if abortThrottled(c, traceId, err) {
+		return auth.Claims{}, false
+	}
+	if errors.Is(err, models.ErrEmailNotVerified) {
+		log.Error().Err(err).Str("Trace Id", traceId).Send()
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "email_not_verified",
+			"msg": "please verify your email first"})
+		return auth.Claims{}, false
+	}
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Send()
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"msg": "login failed"})
+		return auth.Claims{}, false
+	}
+
+	uid, err := userIdFromClaims(claims)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Send()
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return auth.Claims{}, false
+	}
+	mfa, err := h.s.TOTPEnabled(ctx, uid)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Msg("checking mfa")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return auth.Claims{}, false
+	}
+	if !mfa {
+		return claims, true
+	}
+
+	mfaCode := c.PostForm("mfa_code")
+	if mfaCode == "" {
+		log.Info().Str("Trace Id", traceId).Str("user", claims.Subject).Msg("second factor required")
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "mfa_required",
+			"msg": "please provide the code of your second factor"})
+		return auth.Claims{}, false
+	}
+	mfaClaims, err := h.s.CompleteMFA(ctx, uid, mfaCode, c.ClientIP())
+	if abortThrottled(c, traceId, err) {
+		return auth.Claims{}, false
+	}
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Str("user", claims.Subject).Msg("second factor failed")
+		if errors.Is(err, models.ErrInvalidMFACode) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid_mfa_code", "msg": "login failed"})
+			return auth.Claims{}, false
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return auth.Claims{}, false
+	}
+	return mfaClaims, true
+}
+
+// authorizationCodeGrant exchanges an authorization code for an access token and an ID token of the user who
+// logged in. The client has to authenticate and prove with the code verifier that it started the flow.
+func (h *handler) authorizationCodeGrant(c *gin.Context, traceId string) {
+	client, ok := h.authenticateClient(c, traceId)
+	if !ok {
+		return
+	}
+	id := client.ClientID
+
+	code, redirectURI, verifier := c.PostForm("code"), c.PostForm("redirect_uri"), c.PostForm("code_verifier")
+	if code == "" || redirectURI == "" || verifier == "" {
+		log.Error().Str("Trace Id", traceId).Str("client", id).Msg("authorization code parameters missing")
+		oauthError(c, http.StatusBadRequest, "invalid_request", "code, redirect_uri and code_verifier are required")
+		return
+	}
+
+	claims, idClaims, err := h.s.ExchangeAuthorizationCode(c.Request.Context(), id, code, redirectURI, verifier)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Str("client", id).Msg("exchanging authorization code")
+		if errors.Is(err, models.ErrInvalidGrant) {
+			oauthError(c, http.StatusBadRequest, "invalid_grant", "the authorization code is invalid")
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+
+	// The issuer of ID tokens is where clients find the discovery document
+	idClaims.Issuer = h.cfg.PublicURL
+	token, err := h.a.GenerateToken(claims)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Msg("generating token")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+	idToken, err := h.a.GenerateIDToken(idClaims)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Msg("generating id token")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+
+	log.Info().Str("Trace Id", traceId).Str("client", id).Str("user", claims.Subject).Str("scope", claims.Scope).
+		Msg("authorization code exchanged")
+	c.JSON(http.StatusOK, gin.H{
+		"access_token": token,
+		"token_type":   "Bearer",
+		"expires_in":   int(time.Until(claims.ExpiresAt.Time).Seconds()),
+		"scope":        claims.Scope,
+		"id_token":     idToken,
+	})
+}
+
+// UserInfo is the UserInfo endpoint of OpenID Connect. It returns the claims about the user the scope of the
+// access token gives access to.
+func (h *handler) UserInfo(c *gin.Context) {
+	ctx := c.Request.Context()
+	traceId, ok := ctx.Value(middlewares.TraceIdKey).(string)
+	if !ok {
+		log.Error().Msg("traceId missing from context")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		log.Error().Str("Trace Id", traceId).Msg("login first")
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": http.StatusText(http.StatusUnauthorized)})
+		return
+	}
+
+	info, err := h.s.UserInfo(ctx, claims)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Msg("fetching user info")
+		if errors.Is(err, models.ErrUserNotFound) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid_token"})
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, struct {
+		Subject string `json:"sub"`
+		auth.UserInfo
+	}{Subject: claims.Subject, UserInfo: info})
+}
+
+// OpenIDConfiguration serves the OpenID Connect discovery document, which tells clients where the endpoints and
+// keys are and what is supported.
+func (h *handler) OpenIDConfiguration(c *gin.Context) {
+	// ID tokens are signed with one of the published keys, HS256 secrets are never published
+	var algs []string
+	for _, k := range h.a.JWKS().Keys {
+		if !containsAlg(algs, k.Alg) {
+			algs = append(algs, k.Alg)
+		}
+	}
+
+	issuer := h.cfg.PublicURL
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, gin.H{
+		"issuer":                                issuer,
+		"authorization_endpoint":                issuer + "/oauth/authorize",
+		"token_endpoint":                        issuer + "/oauth/token",
+		"userinfo_endpoint":                     issuer + "/userinfo",
+		"jwks_uri":                              issuer + "/.well-known/jwks.json",
+		"introspection_endpoint":                issuer + "/oauth/introspect",
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{"authorization_code", "client_credentials"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": algs,
+		"scopes_supported":                      strings.Fields(auth.OIDCScopes + " " + auth.AllScopes),
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"claims_supported": []string{"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce", "azp", "amr",
+			"name", "email", "email_verified"},
+	})
+}
+
+// containsAlg reports whether alg is one of algs.
+func containsAlg(algs []string, alg string) bool {
+	for _, a := range algs {
+		if a == alg {
+			return true
+		}
+	}
+	return false
+}
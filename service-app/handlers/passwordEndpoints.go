@@ -0,0 +1,199 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"service-app/mailer"
+	"service-app/middlewares"
+	"service-app/models"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/rs/zerolog/log"
+)
+
+// mailTimeout bounds how long sending an email in the background may take.
+const mailTimeout = 30 * time.Second
+
+// ForgotPassword mails a password reset token to the user with the given email. The response is the same
+// whether there is such a user or not, so that it can't be used to find out who has an account.
+func (h *handler) ForgotPassword(c *gin.Context) {
+	ctx := c.Request.Context()
+	traceId, ok := ctx.Value(middlewares.TraceIdKey).(string)
+	if !ok {
+		log.Error().Msg("traceId missing from context")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+
+	var req struct {
+		Email string `json:"email" validate:"required,email"`
+	}
+	err := json.NewDecoder(c.Request.Body).Decode(&req)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Send()
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"msg": "Invalid JSON format"})
+		return
+	}
+	validate := validator.New()
+	err = validate.Struct(req)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Send()
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"msg": "please provide Email"})
+		return
+	}
+
+	const msg = "if the email belongs to an account, a password reset token is on its way"
+
+	u, token, err := h.s.CreatePasswordResetToken(ctx, req.Email)
+	if errors.Is(err, models.ErrUserNotFound) {
+		log.Info().Str("Trace Id", traceId).Msg("password reset for unknown email")
+		c.JSON(http.StatusOK, gin.H{"msg": msg})
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Msg("creating password reset token")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+
+	// The mail is sent in the background, waiting for the mail server would tell existing accounts apart
+	// from unknown ones by the response time
+	h.sendMail(traceId, mailer.Message{
+		To:      u.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hi %s,\n\nsomebody asked to reset the password of your account. "+
+			"If that was you, send this token together with your new password to /password/reset:\n\n%s\n\n"+
+			"The token can be used once and expires in %s. If it wasn't you, you can ignore this email.\n",
+			u.Name, token, models.PasswordResetTTL),
+	})
+
+	log.Info().Str("Trace Id", traceId).Str("user", strconv.FormatUint(uint64(u.ID), 10)).Msg("password reset requested")
+	c.JSON(http.StatusOK, gin.H{"msg": msg})
+}
+
+// ResetPassword sets a new password with a reset token. Afterwards every session of the user is over:
+// their refresh tokens and every access token issued until now are revoked.
+func (h *handler) ResetPassword(c *gin.Context) {
+	ctx := c.Request.Context()
+	traceId, ok := ctx.Value(middlewares.TraceIdKey).(string)
+	if !ok {
+		log.Error().Msg("traceId missing from context")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+
+	var req struct {
+		Token    string `json:"token" validate:"required"`
+		Password string `json:"password" validate:"required"`
+	}
+	err := json.NewDecoder(c.Request.Body).Decode(&req)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Send()
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"msg": "Invalid JSON format"})
+		return
+	}
+	validate := validator.New()
+	err = validate.Struct(req)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Send()
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"msg": "please provide token and password"})
+		return
+	}
+
+	u, err := h.s.ResetPassword(ctx, req.Token, req.Password)
+	if abortWeakPassword(c, traceId, "password", err) {
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Msg("resetting password")
+		if errors.Is(err, models.ErrInvalidUserToken) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"msg": "invalid or expired token"})
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+
+	// Access tokens issued before the reset stop working, the last of them would have expired after AccessTokenTTL
+	sub := strconv.FormatUint(uint64(u.ID), 10)
+	err = h.dl.RevokeSubject(ctx, sub, time.Now().Add(models.AccessTokenTTL))
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Msg("revoking access tokens")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+
+	log.Info().Str("Trace Id", traceId).Str("user", sub).Msg("password reset")
+	c.JSON(http.StatusOK, gin.H{"msg": "password reset, please log in again"})
+}
+
+// ChangePassword sets a new password for the logged-in user, who has to send their current one as well.
+// Like a reset, it ends every session of the user, including the one the request was made with.
+func (h *handler) ChangePassword(c *gin.Context) {
+	ctx := c.Request.Context()
+	traceId, claims, uid, ok := accountPrincipal(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		CurrentPassword string `json:"current_password" validate:"required"`
+		NewPassword     string `json:"new_password" validate:"required"`
+	}
+	err := json.NewDecoder(c.Request.Body).Decode(&req)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Send()
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"msg": "Invalid JSON format"})
+		return
+	}
+	validate := validator.New()
+	err = validate.Struct(req)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Send()
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"msg": "please provide current_password and new_password"})
+		return
+	}
+
+	_, err = h.s.ChangePassword(ctx, uid, req.CurrentPassword, req.NewPassword, c.ClientIP())
+	if abortThrottled(c, traceId, err) || abortWeakPassword(c, traceId, "new_password", err) {
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Msg("changing password")
+		if errors.Is(err, models.ErrIncorrectPassword) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "incorrect_password", "field": "current_password"})
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+
+	err = h.dl.RevokeSubject(ctx, claims.Subject, time.Now().Add(models.AccessTokenTTL))
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Msg("revoking access tokens")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+
+	log.Info().Str("Trace Id", traceId).Str("user", claims.Subject).Msg("password changed")
+	c.JSON(http.StatusOK, gin.H{"msg": "password changed, please log in again"})
+}
+
+// sendMail sends m in its own goroutine. The request can be over by the time the mail is sent, so it
+// doesn't use the request's context.
+func (h *handler) sendMail(traceId string, m mailer.Message) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), mailTimeout)
+		defer cancel()
+		err := h.ml.Send(ctx, m)
+		if err != nil {
+			log.Error().Err(err).Str("Trace Id", traceId).Str("subject", m.Subject).Msg("sending mail")
+		}
+	}()
+}
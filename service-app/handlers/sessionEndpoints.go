@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"service-app/models"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rs/zerolog/log"
+)
+
+// sessionResponse is a session of the user, Current marks the one the request was made with.
+type sessionResponse struct {
+	models.Session
+	Current bool `json:"current"`
+}
+
+// ListSessions lists where the logged-in user is logged in, with the device and when it was last seen.
+func (h *handler) ListSessions(c *gin.Context) {
+	ctx := c.Request.Context()
+	traceId, claims, uid, ok := accountPrincipal(c)
+	if !ok {
+		return
+	}
+
+	sessions, err := h.s.ListSessions(ctx, uid)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Msg("listing sessions")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+
+	resp := make([]sessionResponse, 0, len(sessions))
+	for _, s := range sessions {
+		resp = append(resp, sessionResponse{Session: s, Current: s.SessionId == claims.SessionID})
+	}
+	c.JSON(http.StatusOK, gin.H{"sessions": resp})
+}
+
+// RevokeSession ends one of the sessions of the logged-in user, e.g. on a device they lost. Its refresh token
+// stops working right away and so do its access tokens.
+func (h *handler) RevokeSession(c *gin.Context) {
+	ctx := c.Request.Context()
+	traceId, _, uid, ok := accountPrincipal(c)
+	if !ok {
+		return
+	}
+
+	sess, err := h.s.RevokeSession(ctx, uid, c.Param("id"))
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Msg("ending session")
+		if errors.Is(err, models.ErrSessionNotFound) {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"msg": "session not found"})
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+	h.sessions.Revoked(sess.SessionId)
+
+	// Other instances of the app only notice the session is gone when they touch it next, the access token
+	// issued last is put on the denylist so that it stops working everywhere right away
+	if sess.Jti != "" {
+		err = h.dl.Revoke(ctx, jwt.RegisteredClaims{ID: sess.Jti,
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(models.AccessTokenTTL))})
+		if err != nil {
+			log.Error().Err(err).Str("Trace Id", traceId).Msg("revoking access token")
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+			return
+		}
+	}
+
+	log.Info().Str("Trace Id", traceId).Uint("user", uid).Str("sid", sess.SessionId).Msg("session ended")
+	c.JSON(http.StatusOK, gin.H{"msg": "session ended"})
+}
+
+// RevokeSessions ends every session of the logged-in user, including the one the request was made with.
+func (h *handler) RevokeSessions(c *gin.Context) {
+	ctx := c.Request.Context()
+	traceId, claims, uid, ok := accountPrincipal(c)
+	if !ok {
+		return
+	}
+
+	sessions, err := h.s.RevokeSessions(ctx, uid)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Msg("ending sessions")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+	for _, s := range sessions {
+		h.sessions.Revoked(s.SessionId)
+	}
+
+	// Access tokens issued until now stop working, the last of them would have expired after AccessTokenTTL
+	err = h.dl.RevokeSubject(ctx, claims.Subject, time.Now().Add(models.AccessTokenTTL))
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Msg("revoking access tokens")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+
+	log.Info().Str("Trace Id", traceId).Uint("user", uid).Int("sessions", len(sessions)).Msg("all sessions ended")
+	c.JSON(http.StatusOK, gin.H{"msg": "all sessions ended, please log in again"})
+}
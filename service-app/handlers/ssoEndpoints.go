@@ -0,0 +1,149 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"service-app/middlewares"
+	"service-app/models"
+	"service-app/sso"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+// ssoCookie remembers the sso.LoginState of a login at the identity provider until the user comes back.
+const ssoCookie = "service_app_sso"
+
+// ssoCookiePath limits the cookie to the endpoints of the login at the identity provider.
+const ssoCookiePath = "/login/sso"
+
+// ssoLoginTTL is how long the user has to log in at the identity provider.
+const ssoLoginTTL = 10 * time.Minute
+
+// StartSSO sends the user to the identity provider to log in. Browsers that want a cookie session ask for it with
+// ?cookie=true, the callback then responds with cookies like /login does.
+func (h *handler) StartSSO(c *gin.Context) {
+	ctx := c.Request.Context()
+	traceId, ok := ctx.Value(middlewares.TraceIdKey).(string)
+	if !ok {
+		log.Error().Msg("traceId missing from context")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+
+	cookie := c.Query("cookie") == "true"
+	if !h.cookieModeAllowed(c, traceId, cookie) {
+		return
+	}
+
+	ls, err := sso.NewLoginState()
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Send()
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+	u, err := h.cfg.SSO.AuthCodeURL(ctx, ls)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Msg("contacting identity provider")
+		c.AbortWithStatusJSON(http.StatusBadGateway, gin.H{"msg": "identity provider unavailable"})
+		return
+	}
+
+	setSSOCookie(c, encodeLoginState(ls, cookie), int(ssoLoginTTL.Seconds()))
+	c.Redirect(http.StatusFound, u)
+}
+
+// SSOCallback is where the identity provider sends the user back to. The authorization code is exchanged for
+// an ID token, the user it names is logged in, linked or created, and gets the tokens /login would give them.
+// Like after /login, users with a second factor get a challenge token for /login/mfa instead.
+func (h *handler) SSOCallback(c *gin.Context) {
+	ctx := c.Request.Context()
+	traceId, ok := ctx.Value(middlewares.TraceIdKey).(string)
+	if !ok {
+		log.Error().Msg("traceId missing from context")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+
+	// The login state can only be used once, whatever happens next
+	value, _ := c.Cookie(ssoCookie)
+	setSSOCookie(c, "", -1)
+	ls, cookie, ok := decodeLoginState(value)
+	if !ok || subtle.ConstantTimeCompare([]byte(ls.State), []byte(c.Query("state"))) != 1 {
+		log.Error().Str("Trace Id", traceId).Msg("sso state missing or wrong")
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_state", "msg": "please start the login again"})
+		return
+	}
+	if e := c.Query("error"); e != "" {
+		log.Error().Str("Trace Id", traceId).Str("error", e).Str("description", c.Query("error_description")).
+			Msg("identity provider refused login")
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "sso_failed", "msg": "login failed"})
+		return
+	}
+
+	id, err := h.cfg.SSO.Exchange(ctx, c.Query("code"), ls)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Msg("exchanging sso code")
+		if errors.Is(err, sso.ErrExchangeFailed) || errors.Is(err, sso.ErrInvalidIDToken) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "sso_failed", "msg": "login failed"})
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusBadGateway, gin.H{"msg": "identity provider unavailable"})
+		return
+	}
+
+	claims, err := h.s.AuthenticateFederated(ctx, id)
+	if errors.Is(err, models.ErrEmailNotVerified) {
+		log.Error().Err(err).Str("Trace Id", traceId).Str("subject", id.Subject).Send()
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "email_not_verified",
+			"msg": "the identity provider hasn't verified your email"})
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Str("subject", id.Subject).Msg("federated login")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+
+	// The identity provider stands in for the password only, users with a second factor exchange the challenge
+	// at /login/mfa like after /login
+	log.Info().Str("Trace Id", traceId).Str("user", claims.Subject).Str("issuer", id.Issuer).
+		Msg("federated identity accepted")
+	h.completeLogin(c, traceId, claims, "", cookie)
+}
+
+// setSSOCookie sets the cookie with the login state. Unlike the cookies of a cookie session it is sent with
+// top-level navigations from other sites, as the redirect back from the identity provider is one.
+func setSSOCookie(c *gin.Context, value string, maxAge int) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     ssoCookie,
+		Value:    value,
+		Path:     ssoCookiePath,
+		MaxAge:   maxAge,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// encodeLoginState puts the login state and whether a cookie session was asked for into the value of ssoCookie.
+// The values of the login state are base64url encoded, so they never contain a dot.
+func encodeLoginState(ls sso.LoginState, cookie bool) string {
+	mode := "token"
+	if cookie {
+		mode = "cookie"
+	}
+	return strings.Join([]string{ls.State, ls.Nonce, ls.Verifier, mode}, ".")
+}
+
+// decodeLoginState reverses encodeLoginState.
+func decodeLoginState(value string) (sso.LoginState, bool, bool) {
+	parts := strings.Split(value, ".")
+	if len(parts) != 4 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return sso.LoginState{}, false, false
+	}
+	return sso.LoginState{State: parts[0], Nonce: parts[1], Verifier: parts[2]}, parts[3] == "cookie", true
+}
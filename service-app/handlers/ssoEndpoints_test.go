@@ -0,0 +1,199 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"service-app/auth"
+	"service-app/middlewares"
+	"service-app/models"
+	"service-app/sso"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/require"
+)
+
+// ssoService is the part of models.Service the SSO callback uses. Users are found by the email the identity
+// provider sends, userIds maps them to their id and mfa lists the ones with TOTP.
+type ssoService struct {
+	models.Service
+	userIds map[string]uint
+	mfa     map[uint]bool
+}
+
+func (s ssoService) AuthenticateFederated(ctx context.Context, id sso.Identity) (auth.Claims, error) {
+	if !id.EmailVerified {
+		return auth.Claims{}, models.ErrEmailNotVerified
+	}
+	var claims auth.Claims
+	claims.Subject = strconv.FormatUint(uint64(s.userIds[id.Email]), 10)
+	// Like the database, an identity provider that did mfa itself is taken at its word
+	claims.AMR = []string{auth.AMRFederated}
+	for _, m := range id.AMR {
+		if m == auth.AMRMFA {
+			claims.AMR = append(claims.AMR, auth.AMRMFA)
+		}
+	}
+	return claims, nil
+}
+
+func (s ssoService) TOTPEnabled(ctx context.Context, userId uint) (bool, error) {
+	return s.mfa[userId], nil
+}
+
+func (s ssoService) CreateSession(ctx context.Context, userId uint, claims auth.Claims, userAgent, ip string) (auth.Claims, string, error) {
+	return claims, "refresh-token", nil
+}
+
+// newSSOStub starts an identity provider that answers every code with an ID token for the given claims, on top
+// of the ones a valid token has.
+func newSSOStub(t *testing.T, claims jwt.MapClaims) *httptest.Server {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{"issuer": srv.URL, "authorization_endpoint": srv.URL + "/authorize",
+			"token_endpoint": srv.URL + "/token", "jwks_uri": srv.URL + "/jwks"})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		b64 := base64.RawURLEncoding.EncodeToString
+		_ = json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{"kty": "RSA", "kid": "k1",
+			"n": b64(key.N.Bytes()), "e": b64(big.NewInt(int64(key.E)).Bytes())}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		// The nonce the login was started with is the one in the code, see ssoCallback
+		_ = r.ParseForm()
+		c := jwt.MapClaims{"iss": srv.URL, "aud": "service-app", "sub": "idp-user", "iat": time.Now().Unix(),
+			"exp": time.Now().Add(time.Minute).Unix(), "nonce": r.PostForm.Get("code"), "email_verified": true}
+		for k, v := range claims {
+			c[k] = v
+		}
+		tk := jwt.NewWithClaims(jwt.SigningMethodRS256, c)
+		tk.Header["kid"] = "k1"
+		idToken, err := tk.SignedString(key)
+		require.NoError(t, err)
+		_ = json.NewEncoder(w).Encode(map[string]string{"id_token": idToken, "token_type": "Bearer"})
+	})
+	return srv
+}
+
+// ssoCallback runs the callback the way the identity provider sends the user back, with a code that makes the
+// stub sign the nonce of the login state.
+func ssoCallback(t *testing.T, h *handler) *httptest.ResponseRecorder {
+	ls, err := sso.NewLoginState()
+	require.NoError(t, err)
+
+	q := url.Values{"code": {ls.Nonce}, "state": {ls.State}}
+	req := httptest.NewRequest(http.MethodGet, "/login/sso/callback?"+q.Encode(), nil)
+	req.AddCookie(&http.Cookie{Name: ssoCookie, Value: encodeLoginState(ls, false)})
+	req = req.WithContext(context.WithValue(req.Context(), middlewares.TraceIdKey, "trace"))
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = req
+	h.SSOCallback(c)
+	return w
+}
+
+func TestSSOCallback(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ks := auth.NewKeySet()
+	require.NoError(t, ks.Add(auth.SigningKey{PrivateKey: key}))
+	a, err := auth.NewAuth(ks, auth.Config{Issuer: "service-app", Audience: "service-app-api"})
+	require.NoError(t, err)
+
+	s := ssoService{
+		userIds: map[string]uint{"plain@example.com": 1, "totp@example.com": 2},
+		mfa:     map[uint]bool{2: true},
+	}
+
+	tests := []struct {
+		name       string
+		claims     jwt.MapClaims
+		wantStatus int
+		wantMFA    bool
+	}{
+		{
+			name:       "user without second factor gets tokens",
+			claims:     jwt.MapClaims{"email": "plain@example.com"},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "user with totp gets a challenge",
+			claims:     jwt.MapClaims{"email": "totp@example.com"},
+			wantStatus: http.StatusOK,
+			wantMFA:    true,
+		},
+		{
+			name:       "idp mfa doesn't skip totp",
+			claims:     jwt.MapClaims{"email": "totp@example.com", "amr": []string{"pwd", "mfa"}},
+			wantStatus: http.StatusOK,
+			wantMFA:    true,
+		},
+		{
+			name:       "unverified email",
+			claims:     jwt.MapClaims{"email": "plain@example.com", "email_verified": false},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "wrong nonce",
+			claims:     jwt.MapClaims{"email": "plain@example.com", "nonce": "someone-elses-nonce"},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "wrong audience",
+			claims:     jwt.MapClaims{"email": "plain@example.com", "aud": "another-client"},
+			wantStatus: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newSSOStub(t, tt.claims)
+			p, err := sso.NewProvider(sso.Config{Issuer: srv.URL, ClientID: "service-app", ClientSecret: "secret",
+				RedirectURL: "https://service-app.example.com/login/sso/callback", HTTPClient: srv.Client()})
+			require.NoError(t, err)
+			h := &handler{s: models.NewStore(s), a: a, cfg: Config{SSO: p}}
+
+			w := ssoCallback(t, h)
+			require.Equal(t, tt.wantStatus, w.Code, w.Body.String())
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			var body map[string]any
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+			if !tt.wantMFA {
+				require.Nil(t, body["mfa_required"])
+				require.NotEmpty(t, body["token"])
+				return
+			}
+
+			// Only the challenge comes back, it is no access token and says the identity provider was the first factor
+			require.Equal(t, true, body["mfa_required"])
+			require.Nil(t, body["token"])
+			require.Nil(t, body["refresh_token"])
+			challenge, err := a.ValidateMFAChallenge(body["mfa_token"].(string))
+			require.NoError(t, err)
+			require.Equal(t, []string{auth.AMRFederated}, challenge.AMR)
+			_, err = a.ValidateToken(body["mfa_token"].(string))
+			require.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,276 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"service-app/auth"
+	"service-app/middlewares"
+	"service-app/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/rs/zerolog/log"
+)
+
+// tokenResponse is the body returned by every endpoint that logs a user in.
+type tokenResponse struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// issueTokens starts a new session for the subject of the claims on the device described by userAgent and ip.
+// It signs an access token for the session and returns it with the first refresh token of the session, which
+// is limited to the scope of the claims.
+func (h *handler) issueTokens(ctx context.Context, claims auth.Claims, userAgent, ip string) (tokenResponse, error) {
+	uid, err := userIdFromClaims(claims)
+	if err != nil {
+		return tokenResponse{}, fmt.Errorf("parsing subject %w", err)
+	}
+
+	claims, refresh, err := h.s.CreateSession(ctx, uid, claims, userAgent, ip)
+	if err != nil {
+		return tokenResponse{}, fmt.Errorf("creating session %w", err)
+	}
+
+	return h.signTokens(claims, refresh)
+}
+
+// completeLogin finishes a login once the user passed their first factor. The claims are narrowed down to scope,
+// which has to be allowed by the roles of the user, and the tokens are sent like respondTokens does. Users with
+// TOTP only get a challenge token, which they exchange at /login/mfa. A passkey counts as both factors, so its
+// logins skip the challenge, other first factors never do, whatever the amr they come with says. If anything
+// fails, the request is aborted.
+func (h *handler) completeLogin(c *gin.Context, traceId string, claims auth.Claims, scope string, cookie bool) {
+	ctx := c.Request.Context()
+
+	var err error
+	claims.Scope, err = auth.NarrowScope(claims.Scope, scope)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Send()
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_scope", "msg": err.Error()})
+		return
+	}
+
+	uid, ok := userIdOrAbort(c, traceId, claims)
+	if !ok {
+		return
+	}
+	mfa := false
+	if !claims.HasAMR(auth.AMRHardwareKey) {
+		mfa, err = h.s.TOTPEnabled(ctx, uid)
+		if err != nil {
+			log.Error().Err(err).Str("Trace Id", traceId).Msg("checking mfa")
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+			return
+		}
+	}
+	if mfa {
+		// The second factor is the one checked at /login/mfa, not one an identity provider says it checked
+		var amr []string
+		for _, m := range claims.AMR {
+			if m != auth.AMRMFA {
+				amr = append(amr, m)
+			}
+		}
+		claims.AMR = amr
+		challenge, err := h.a.GenerateMFAChallenge(claims)
+		if err != nil {
+			log.Error().Err(err).Str("Trace Id", traceId).Msg("generating mfa challenge")
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+			return
+		}
+		log.Info().Str("Trace Id", traceId).Str("user", claims.Subject).Strs("amr", claims.AMR).
+			Msg("login needs second factor")
+		c.JSON(http.StatusOK, gin.H{"mfa_required": true, "mfa_token": challenge})
+		return
+	}
+
+	// Generate the access token and a new refresh token family, and respond with both
+	tkn, err := h.issueTokens(ctx, claims, c.Request.UserAgent(), c.ClientIP())
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Msg("generating token")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+
+	log.Info().Str("Trace Id", traceId).Str("user", claims.Subject).Strs("amr", claims.AMR).Msg("login")
+	err = respondTokens(c, tkn, cookie)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Send()
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+}
+
+// signTokens signs an access token for the claims and pairs it with an already stored refresh token.
+func (h *handler) signTokens(claims auth.Claims, refresh string) (tokenResponse, error) {
+	token, err := h.a.GenerateToken(claims)
+	if err != nil {
+		return tokenResponse{}, err
+	}
+	return tokenResponse{Token: token, RefreshToken: refresh}, nil
+}
+
+// RefreshToken exchanges a refresh token for a new access token and a new refresh token.
+// The presented refresh token can't be used again; replaying it revokes the whole token family.
+// Browsers with a cookie session send no body, their refresh token is in a cookie and the new tokens are as well.
+func (h *handler) RefreshToken(c *gin.Context) {
+	ctx := c.Request.Context()
+	traceId, ok := ctx.Value(middlewares.TraceIdKey).(string)
+	if !ok {
+		log.Error().Msg("traceId missing from context")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+
+	var req struct {
+		RefreshToken string `json:"refresh_token" validate:"required"`
+	}
+	err := json.NewDecoder(c.Request.Body).Decode(&req)
+	if err != nil && !errors.Is(err, io.EOF) {
+		log.Error().Err(err).Str("Trace Id", traceId).Send()
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"msg": "Invalid JSON format"})
+		return
+	}
+
+	// Like any other unsafe request with cookies, a refresh from a cookie has to carry the CSRF token
+	cookie, cookieErr := c.Cookie(middlewares.RefreshCookie)
+	fromCookie := req.RefreshToken == "" && cookieErr == nil && cookie != ""
+	if fromCookie {
+		if !middlewares.ValidCSRF(c.Request) {
+			log.Error().Str("Trace Id", traceId).Msg("csrf token missing or wrong")
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "invalid_csrf_token"})
+			return
+		}
+		req.RefreshToken = cookie
+	}
+
+	validate := validator.New()
+	err = validate.Struct(req)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Send()
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"msg": "please provide refresh_token"})
+		return
+	}
+
+	claims, refresh, err := h.s.RotateRefreshToken(ctx, req.RefreshToken)
+	if err != nil {
+		var reused *models.ReusedRefreshTokenError
+		if errors.As(err, &reused) {
+			// Somebody is replaying a token that was already rotated, the family and its session are revoked
+			// by now. The access tokens of the session must stop working too, not only once they expire.
+			log.Warn().Err(err).Str("Trace Id", traceId).Msg("refresh token family revoked")
+			h.sessions.Revoked(reused.SessionID)
+		} else {
+			log.Error().Err(err).Str("Trace Id", traceId).Send()
+		}
+		if errors.Is(err, models.ErrRefreshTokenReused) || errors.Is(err, models.ErrInvalidRefreshToken) {
+			if fromCookie {
+				clearSessionCookies(c)
+			}
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"msg": "invalid refresh token"})
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+
+	tkn, err := h.signTokens(claims, refresh)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Msg("generating token")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+
+	err = respondTokens(c, tkn, fromCookie)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Send()
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+}
+
+// Logout revokes the access token the request was authenticated with and ends its session, so that the session
+// can't be refreshed anymore. If the body carries a refresh token, its whole family is revoked as well.
+// The cookies of a cookie session are cleared.
+func (h *handler) Logout(c *gin.Context) {
+	ctx := c.Request.Context()
+	traceId, ok := ctx.Value(middlewares.TraceIdKey).(string)
+	if !ok {
+		log.Error().Msg("traceId missing from context")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		log.Error().Str("Trace Id", traceId).Msg("login first")
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": http.StatusText(http.StatusUnauthorized)})
+		return
+	}
+
+	// There is no session behind an API key, keys are revoked through /me/api-keys instead
+	if claims.APIKeyID != 0 {
+		log.Error().Str("Trace Id", traceId).Msg("logout with api key")
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"msg": "api keys can't log out, revoke the key instead"})
+		return
+	}
+
+	// The body is optional, clients that only hold an access token can send none
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	err := json.NewDecoder(c.Request.Body).Decode(&req)
+	if err != nil && !errors.Is(err, io.EOF) {
+		log.Error().Err(err).Str("Trace Id", traceId).Send()
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"msg": "Invalid JSON format"})
+		return
+	}
+
+	if req.RefreshToken != "" {
+		err = h.s.RevokeRefreshToken(ctx, req.RefreshToken)
+		if err != nil {
+			log.Error().Err(err).Str("Trace Id", traceId).Msg("revoking refresh token")
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+			return
+		}
+	}
+
+	if claims.SessionID != "" {
+		uid, ok := userIdOrAbort(c, traceId, claims)
+		if !ok {
+			return
+		}
+		// The session may already have been ended from another device, that's fine here
+		_, err = h.s.RevokeSession(ctx, uid, claims.SessionID)
+		if err != nil && !errors.Is(err, models.ErrSessionNotFound) {
+			log.Error().Err(err).Str("Trace Id", traceId).Msg("ending session")
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+			return
+		}
+		h.sessions.Revoked(claims.SessionID)
+	}
+
+	err = h.dl.Revoke(ctx, claims.RegisteredClaims)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Msg("revoking access token")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+
+	if _, err := c.Cookie(middlewares.TokenCookie); err == nil {
+		clearSessionCookies(c)
+	}
+	c.JSON(http.StatusOK, gin.H{"msg": "logged out"})
+}
+
+// JWKS publishes the public keys service-app tokens can be verified with. Caches may keep the
+// document for a few minutes, so a new key has to be added some time before it is activated.
+func (h *handler) JWKS(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, h.a.JWKS())
+}
@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"service-app/auth"
+	"service-app/middlewares"
+	"service-app/models"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+// refreshService answers every rotation with err, and counts how often a session is touched.
+type refreshService struct {
+	models.Service
+	err     error
+	touches int
+}
+
+func (s *refreshService) RotateRefreshToken(ctx context.Context, token string) (auth.Claims, string, error) {
+	return auth.Claims{}, "", s.err
+}
+
+func (s *refreshService) TouchSession(ctx context.Context, sessionId, ip string) (bool, error) {
+	s.touches++
+	return true, nil
+}
+
+// A replayed refresh token ends its session right away, on this instance the access tokens of the session are
+// refused without waiting for the next touch of the session.
+func TestRefreshTokenReused(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name    string
+		err     error
+		code    int
+		revoked bool
+	}{
+		{name: "reused", err: &models.ReusedRefreshTokenError{SessionID: "s1"}, code: http.StatusUnauthorized, revoked: true},
+		{name: "expired", err: models.ErrInvalidRefreshToken, code: http.StatusUnauthorized},
+		{name: "database down", err: errors.New("connection refused"), code: http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &refreshService{err: tt.err}
+			st, err := middlewares.NewSessionTracker(s, time.Minute)
+			require.NoError(t, err)
+			h := &handler{s: models.NewStore(s), sessions: st}
+
+			req := httptest.NewRequest(http.MethodPost, "/refresh", strings.NewReader(`{"refresh_token":"rt"}`))
+			req = req.WithContext(context.WithValue(req.Context(), middlewares.TraceIdKey, "trace"))
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = req
+			h.RefreshToken(c)
+			require.Equal(t, tt.code, w.Code, w.Body.String())
+
+			active, err := st.Seen(context.Background(), "s1", "")
+			require.NoError(t, err)
+			require.Equal(t, !tt.revoked, active)
+			if tt.revoked {
+				require.Zero(t, s.touches, "a revoked session isn't looked up again")
+			}
+		})
+	}
+}
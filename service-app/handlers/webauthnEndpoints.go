@@ -0,0 +1,272 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"service-app/auth"
+	"service-app/middlewares"
+	"service-app/models"
+	"service-app/webauthn"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/rs/zerolog/log"
+)
+
+// BeginWebAuthnRegistration starts the registration of a passkey for the logged-in user. It responds with the
+// options for navigator.credentials.create, the browser sends what that returns to FinishWebAuthnRegistration.
+func (h *handler) BeginWebAuthnRegistration(c *gin.Context) {
+	ctx := c.Request.Context()
+	traceId, claims, uid, ok := accountPrincipal(c)
+	if !ok || !h.passkeyChangeAllowed(c, traceId, claims, uid) {
+		return
+	}
+
+	u, exclude, err := h.s.StartWebAuthnRegistration(ctx, uid)
+	if err != nil {
+		abortWebAuthnError(c, traceId, err)
+		return
+	}
+	opts, err := h.cfg.WebAuthn.BeginRegistration(u, exclude)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Msg("starting webauthn registration")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, gin.H{"publicKey": opts})
+}
+
+// FinishWebAuthnRegistration checks the new passkey of the logged-in user and stores it. Label is optional, it
+// tells the user's passkeys apart in the list.
+func (h *handler) FinishWebAuthnRegistration(c *gin.Context) {
+	ctx := c.Request.Context()
+	traceId, claims, uid, ok := accountPrincipal(c)
+	if !ok || !h.passkeyChangeAllowed(c, traceId, claims, uid) {
+		return
+	}
+
+	var req struct {
+		Credential webauthn.RegistrationResponse `json:"credential"`
+		Label      string                        `json:"label" validate:"max=100"`
+	}
+	err := json.NewDecoder(c.Request.Body).Decode(&req)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Send()
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"msg": "Invalid JSON format"})
+		return
+	}
+	validate := validator.New()
+	err = validate.Struct(req)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Send()
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"msg": "please provide the credential"})
+		return
+	}
+	if req.Label == "" {
+		req.Label = "Passkey"
+	}
+
+	cred, ch, err := h.cfg.WebAuthn.FinishRegistration(uid, req.Credential)
+	if err != nil {
+		abortWebAuthnError(c, traceId, err)
+		return
+	}
+	err = h.s.ConsumeWebAuthnChallenge(ctx, ch.ID, ch.ExpiresAt)
+	if err != nil {
+		abortWebAuthnError(c, traceId, err)
+		return
+	}
+
+	k, err := h.s.CreateWebAuthnCredential(ctx, cred, req.Label)
+	if err != nil {
+		abortWebAuthnError(c, traceId, err)
+		return
+	}
+
+	log.Info().Str("Trace Id", traceId).Str("user", claims.Subject).Uint("credential", k.ID).Msg("passkey registered")
+	c.JSON(http.StatusCreated, k)
+}
+
+// ListWebAuthnCredentials lists the passkeys of the logged-in user.
+func (h *handler) ListWebAuthnCredentials(c *gin.Context) {
+	ctx := c.Request.Context()
+	traceId, _, uid, ok := accountPrincipal(c)
+	if !ok {
+		return
+	}
+
+	creds, err := h.s.ListWebAuthnCredentials(ctx, uid)
+	if err != nil {
+		abortWebAuthnError(c, traceId, err)
+		return
+	}
+	c.JSON(http.StatusOK, creds)
+}
+
+// DeleteWebAuthnCredential removes one of the passkeys of the logged-in user.
+func (h *handler) DeleteWebAuthnCredential(c *gin.Context) {
+	ctx := c.Request.Context()
+	traceId, claims, uid, ok := accountPrincipal(c)
+	if !ok {
+		return
+	}
+
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Send()
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"msg": "invalid passkey id"})
+		return
+	}
+
+	err = h.s.DeleteWebAuthnCredential(ctx, uid, uint(id))
+	if err != nil {
+		abortWebAuthnError(c, traceId, err)
+		return
+	}
+
+	log.Info().Str("Trace Id", traceId).Str("user", claims.Subject).Uint64("credential", id).Msg("passkey removed")
+	c.JSON(http.StatusOK, gin.H{"msg": "passkey removed"})
+}
+
+// BeginWebAuthnLogin starts a login with a passkey. It responds with the options for navigator.credentials.get,
+// the browser sends what that returns to FinishWebAuthnLogin.
+func (h *handler) BeginWebAuthnLogin(c *gin.Context) {
+	ctx := c.Request.Context()
+	traceId, ok := ctx.Value(middlewares.TraceIdKey).(string)
+	if !ok {
+		log.Error().Msg("traceId missing from context")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+
+	opts, err := h.cfg.WebAuthn.BeginLogin()
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Msg("starting webauthn login")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, gin.H{"publicKey": opts})
+}
+
+// FinishWebAuthnLogin logs the user in with the assertion of their passkey and responds with the tokens /login
+// would give them. Scope and Cookie work like they do for /login. A passkey counts as two factors, so there is no
+// second step even for users with TOTP.
+func (h *handler) FinishWebAuthnLogin(c *gin.Context) {
+	ctx := c.Request.Context()
+	traceId, ok := ctx.Value(middlewares.TraceIdKey).(string)
+	if !ok {
+		log.Error().Msg("traceId missing from context")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+
+	var req struct {
+		Credential webauthn.AssertionResponse `json:"credential"`
+		Scope      string                     `json:"scope"`
+		Cookie     bool                       `json:"cookie"`
+	}
+	err := json.NewDecoder(c.Request.Body).Decode(&req)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Send()
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"msg": "Invalid JSON format"})
+		return
+	}
+	validate := validator.New()
+	err = validate.Struct(req)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Send()
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"msg": "please provide the credential"})
+		return
+	}
+	if !h.cookieModeAllowed(c, traceId, req.Cookie) {
+		return
+	}
+
+	cred, err := h.s.FindWebAuthnCredential(ctx, req.Credential.RawID)
+	if err != nil {
+		abortWebAuthnLogin(c, traceId, err)
+		return
+	}
+	signCount, ch, err := h.cfg.WebAuthn.FinishLogin(cred, req.Credential)
+	if err != nil {
+		abortWebAuthnLogin(c, traceId, err)
+		return
+	}
+	err = h.s.ConsumeWebAuthnChallenge(ctx, ch.ID, ch.ExpiresAt)
+	if err != nil {
+		abortWebAuthnLogin(c, traceId, err)
+		return
+	}
+	claims, err := h.s.CompleteWebAuthnLogin(ctx, cred.ID, signCount)
+	if err != nil {
+		abortWebAuthnLogin(c, traceId, err)
+		return
+	}
+
+	h.completeLogin(c, traceId, claims, req.Scope, req.Cookie)
+}
+
+// passkeyChangeAllowed makes users with TOTP log in with their second factor before they add a passkey. A passkey
+// logs in without TOTP, so adding one with just the password would get around it. If the user isn't allowed, the
+// request is aborted and false is returned.
+func (h *handler) passkeyChangeAllowed(c *gin.Context, traceId string, claims auth.Claims, uid uint) bool {
+	if claims.HasAMR(auth.AMRMFA) {
+		return true
+	}
+	mfa, err := h.s.TOTPEnabled(c.Request.Context(), uid)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Msg("checking mfa")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+		return false
+	}
+	if mfa {
+		log.Error().Str("Trace Id", traceId).Str("sub", claims.Subject).Msg("missing second factor")
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "mfa_required",
+			"msg": "log in with your second factor to add a passkey"})
+		return false
+	}
+	return true
+}
+
+// abortWebAuthnError responds to a failed change of a user's passkeys.
+func abortWebAuthnError(c *gin.Context, traceId string, err error) {
+	log.Error().Err(err).Str("Trace Id", traceId).Msg("changing passkeys")
+	switch {
+	case errors.Is(err, webauthn.ErrInvalidChallenge), errors.Is(err, webauthn.ErrInvalidResponse):
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_credential",
+			"msg": "the passkey couldn't be registered, please try again"})
+	case errors.Is(err, models.ErrWebAuthnCredentialExists):
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"msg": "passkey is already registered"})
+	case errors.Is(err, models.ErrTooManyWebAuthnCredentials):
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"msg": "too many passkeys, remove one first"})
+	case errors.Is(err, models.ErrWebAuthnCredentialNotFound):
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"msg": "passkey not found"})
+	case errors.Is(err, models.ErrUserNotFound):
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"msg": "user not found"})
+	default:
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+	}
+}
+
+// abortWebAuthnLogin responds to a failed login with a passkey. Like /login, it doesn't tell why, apart from an
+// email that still has to be verified.
+func abortWebAuthnLogin(c *gin.Context, traceId string, err error) {
+	log.Error().Err(err).Str("Trace Id", traceId).Msg("passkey login")
+	switch {
+	case errors.Is(err, models.ErrEmailNotVerified):
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "email_not_verified",
+			"msg": "please verify your email first"})
+	case errors.Is(err, models.ErrWebAuthnCredentialNotFound), errors.Is(err, webauthn.ErrInvalidChallenge),
+		errors.Is(err, webauthn.ErrInvalidResponse), errors.Is(err, webauthn.ErrInvalidSignature),
+		errors.Is(err, webauthn.ErrSignCountRegressed):
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"msg": "login failed"})
+	default:
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"msg": http.StatusText(http.StatusInternalServerError)})
+	}
+}
@@ -0,0 +1,167 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"service-app/auth"
+	"service-app/middlewares"
+	"service-app/models"
+	"service-app/webauthn"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+// webauthnService stores one passkey of user 7 and the challenges that were answered, like the database does:
+// recording a challenge a second time fails.
+type webauthnService struct {
+	models.Service
+	cred webauthn.Credential
+
+	mu       sync.Mutex
+	answered map[string]bool
+}
+
+func (s *webauthnService) FindWebAuthnCredential(ctx context.Context, credentialId string) (webauthn.Credential, error) {
+	if credentialId != s.cred.ID {
+		return webauthn.Credential{}, models.ErrWebAuthnCredentialNotFound
+	}
+	return s.cred, nil
+}
+
+func (s *webauthnService) ConsumeWebAuthnChallenge(ctx context.Context, challengeId string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.answered[challengeId] {
+		return fmt.Errorf("%w: already answered", webauthn.ErrInvalidChallenge)
+	}
+	s.answered[challengeId] = true
+	return nil
+}
+
+func (s *webauthnService) CompleteWebAuthnLogin(ctx context.Context, credentialId string, signCount uint32) (auth.Claims, error) {
+	var claims auth.Claims
+	claims.Subject = "7"
+	claims.AMR = []string{auth.AMRHardwareKey, auth.AMRMFA}
+	return claims, nil
+}
+
+func (s *webauthnService) CreateSession(ctx context.Context, userId uint, claims auth.Claims, userAgent, ip string) (auth.Claims, string, error) {
+	return claims, "refresh-token", nil
+}
+
+// passkey signs assertions like a passkey that doesn't count its signatures, which is what most platform
+// authenticators do. Only the challenge keeps such an assertion from being replayed.
+type passkey struct {
+	key *ecdsa.PrivateKey
+	id  string
+}
+
+func (p passkey) assertion(t *testing.T, challenge string) webauthn.AssertionResponse {
+	rpIdHash := sha256.Sum256([]byte("example.com"))
+	// user present and user verified, sign count 0
+	ad := binary.BigEndian.AppendUint32(append(rpIdHash[:], 0x05), 0)
+	cd, err := json.Marshal(map[string]any{"type": "webauthn.get", "challenge": challenge,
+		"origin": "https://app.example.com"})
+	require.NoError(t, err)
+	sum := sha256.Sum256(cd)
+	digest := sha256.Sum256(append(append([]byte{}, ad...), sum[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, p.key, digest[:])
+	require.NoError(t, err)
+
+	var r webauthn.AssertionResponse
+	r.ID, r.RawID, r.Type = p.id, p.id, "public-key"
+	r.Response.ClientDataJSON = base64.RawURLEncoding.EncodeToString(cd)
+	r.Response.AuthenticatorData = base64.RawURLEncoding.EncodeToString(ad)
+	r.Response.Signature = base64.RawURLEncoding.EncodeToString(sig)
+	r.Response.UserHandle = webauthn.UserHandle(7)
+	return r
+}
+
+// finishWebAuthnLogin posts the assertion to FinishWebAuthnLogin. It is called from several goroutines at once,
+// so it doesn't fail the test itself.
+func finishWebAuthnLogin(h *handler, r webauthn.AssertionResponse) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(map[string]any{"credential": r})
+	req := httptest.NewRequest(http.MethodPost, "/login/webauthn/finish", bytes.NewReader(body))
+	req = req.WithContext(context.WithValue(req.Context(), middlewares.TraceIdKey, "trace"))
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = req
+	h.FinishWebAuthnLogin(c)
+	return w
+}
+
+func TestFinishWebAuthnLoginReplay(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	require.NoError(t, err)
+	pk := passkey{key: key, id: base64.RawURLEncoding.EncodeToString([]byte("passkey-of-user-7"))}
+	s := &webauthnService{
+		cred:     webauthn.Credential{ID: pk.id, UserID: 7, PublicKey: der, Algorithm: webauthn.AlgES256},
+		answered: map[string]bool{},
+	}
+
+	rp, err := webauthn.NewRelyingParty(webauthn.Config{RPID: "example.com",
+		Origins: []string{"https://app.example.com"}, ChallengeKey: make([]byte, 32)})
+	require.NoError(t, err)
+	signingKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	ks := auth.NewKeySet()
+	require.NoError(t, ks.Add(auth.SigningKey{PrivateKey: signingKey}))
+	a, err := auth.NewAuth(ks, auth.Config{Issuer: "service-app", Audience: "service-app-api"})
+	require.NoError(t, err)
+	h := &handler{s: models.NewStore(s), a: a, cfg: Config{WebAuthn: rp}}
+
+	o, err := rp.BeginLogin()
+	require.NoError(t, err)
+	assertion := pk.assertion(t, o.Challenge)
+
+	w := finishWebAuthnLogin(h, assertion)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	// The same assertion again checks out as far as the signature goes, the answered challenge stops it
+	w = finishWebAuthnLogin(h, assertion)
+	require.Equal(t, http.StatusUnauthorized, w.Code, w.Body.String())
+
+	// Sent many times at once, only one of them logs in
+	o, err = rp.BeginLogin()
+	require.NoError(t, err)
+	assertion = pk.assertion(t, o.Challenge)
+	codes := make([]int, 20)
+	var wg sync.WaitGroup
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes[i] = finishWebAuthnLogin(h, assertion).Code
+		}(i)
+	}
+	wg.Wait()
+	var ok int
+	for _, code := range codes {
+		if code == http.StatusOK {
+			ok++
+			continue
+		}
+		require.Equal(t, http.StatusUnauthorized, code)
+	}
+	require.Equal(t, 1, ok)
+}
@@ -0,0 +1,84 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// outboxSender is the sender of the emails kept in an outbox.
+const outboxSender = "service-app@localhost"
+
+// FileOutbox writes every email to its own .eml file in a directory instead of sending it.
+type FileOutbox struct {
+	dir string
+
+	mu sync.Mutex
+	n  int
+}
+
+// NewFileOutbox is a constructor function for FileOutbox. The directory is created if it doesn't exist.
+func NewFileOutbox(dir string) (*FileOutbox, error) {
+	if dir == "" {
+		return nil, errors.New("outbox directory cannot be empty")
+	}
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return nil, fmt.Errorf("creating outbox %w", err)
+	}
+	return &FileOutbox{dir: dir}, nil
+}
+
+// Send writes the message to a new file in the outbox. The files sort in the order they were sent.
+func (o *FileOutbox) Send(ctx context.Context, m Message) error {
+	err := validate(m)
+	if err != nil {
+		return err
+	}
+
+	o.mu.Lock()
+	o.n++
+	name := fmt.Sprintf("%s-%04d.eml", time.Now().UTC().Format("20060102T150405.000000000"), o.n)
+	o.mu.Unlock()
+
+	// The emails carry secret tokens, only the owner may read them
+	err = os.WriteFile(filepath.Join(o.dir, name), format(outboxSender, m), 0o600)
+	if err != nil {
+		return fmt.Errorf("writing to outbox %w", err)
+	}
+	return nil
+}
+
+// MemoryOutbox keeps every email in memory instead of sending it.
+type MemoryOutbox struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+// NewMemoryOutbox is a constructor function for MemoryOutbox.
+func NewMemoryOutbox() *MemoryOutbox {
+	return &MemoryOutbox{}
+}
+
+// Send stores the message.
+func (o *MemoryOutbox) Send(ctx context.Context, m Message) error {
+	err := validate(m)
+	if err != nil {
+		return err
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.messages = append(o.messages, m)
+	return nil
+}
+
+// Messages returns every message sent so far, oldest first.
+func (o *MemoryOutbox) Messages() []Message {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return append([]Message(nil), o.messages...)
+}
@@ -0,0 +1,54 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strconv"
+)
+
+// SMTP sends emails through an SMTP server.
+type SMTP struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+// NewSMTP is a constructor function for SMTP. Emails are sent from 'from'. When username is empty the
+// server is used without authentication, otherwise with PLAIN authentication, which net/smtp only does
+// over TLS or to localhost.
+func NewSMTP(host string, port int, username, password, from string) (*SMTP, error) {
+	if host == "" {
+		return nil, errors.New("smtp host cannot be empty")
+	}
+	if from == "" {
+		return nil, errors.New("sender cannot be empty")
+	}
+
+	s := &SMTP{addr: net.JoinHostPort(host, strconv.Itoa(port)), from: from}
+	if username != "" {
+		s.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return s, nil
+}
+
+// Send delivers the message to the SMTP server.
+func (s *SMTP) Send(ctx context.Context, m Message) error {
+	err := validate(m)
+	if err != nil {
+		return err
+	}
+	// net/smtp can't be cancelled, so at least don't start when the request is gone already
+	err = ctx.Err()
+	if err != nil {
+		return err
+	}
+
+	err = smtp.SendMail(s.addr, s.auth, s.from, []string{m.To}, format(s.from, m))
+	if err != nil {
+		return fmt.Errorf("sending mail %w", err)
+	}
+	return nil
+}
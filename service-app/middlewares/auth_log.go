@@ -3,8 +3,10 @@ package middlewares
 import (
 	"context"
 	"errors"
+	"fmt"
 	"net/http"
 	"service-app/auth"
+	"service-app/models"
 	"strings"
 
 	"github.com/gin-gonic/gin"
@@ -19,26 +21,46 @@ const TraceIdKey key = "1"
 // Mid is a structure that holds an authenticated session.
 // This is typically used for maintaining user sessions or secure transactions.
 type Mid struct {
-	// 'a' attribute is a pointer to an 'Auth' object.
-	// It's important to note that 'a'
-	//is a pointer because we want to refer to the original 'Auth' object and not a COPY of it.
-	a *auth.Auth
+	// 'a' validates the tokens of requests, whichever format the app issues them in.
+	a auth.TokenValidator
+	// 'dl' is the denylist of revoked tokens that is consulted after a token has been validated.
+	dl *auth.Denylist
+	// 'keys' checks the API keys machine clients send instead of a token.
+	keys APIKeyAuthenticator
+	// 'sessions' rejects tokens of sessions that were ended and keeps track of when each session was last seen.
+	sessions *SessionTracker
 }
 
-// NewMid is a function which takes an 'Auth' object pointer
-// and returns a Mid instance and an error.
+// APIKeyAuthenticator checks an API key and returns the claims of the request it was sent with,
+// models.Store implements it.
+type APIKeyAuthenticator interface {
+	AuthenticateAPIKey(ctx context.Context, key, ip string) (auth.Claims, error)
+}
+
+// NewMid is a function which takes an 'auth.TokenValidator', a 'Denylist' pointer, an 'APIKeyAuthenticator'
+// and a 'SessionTracker' pointer and returns a Mid instance and an error.
 // Purpose of this function is to initialize
 // and return a new instance of 'Mid' structure.
-func NewMid(a *auth.Auth) (Mid, error) {
+func NewMid(a auth.TokenValidator, dl *auth.Denylist, keys APIKeyAuthenticator, sessions *SessionTracker) (Mid, error) {
 	// It first checks if 'a' is nil
-	// 'a' should not be nil because 'nil' indicates that the 'Auth' object does not exist.
+	// 'a' should not be nil because 'nil' indicates that there is nothing to validate tokens with.
 	if a == nil {
 		// An error is returned when 'a' is 'nil'.
 		return Mid{}, errors.New("auth can't be nil")
 	}
+	// Without a denylist revoked tokens would be accepted, so it is required as well.
+	if dl == nil {
+		return Mid{}, errors.New("denylist can't be nil")
+	}
+	if keys == nil {
+		return Mid{}, errors.New("api key authenticator can't be nil")
+	}
+	if sessions == nil {
+		return Mid{}, errors.New("session tracker can't be nil")
+	}
 	//If 'a' is not 'nil', a new 'Mid' instance is returned with 'a' as a field.
 	// A nil error is returned, indicating that there were no issues with the initialization.
-	return Mid{a: a}, nil
+	return Mid{a: a, dl: dl, keys: keys, sessions: sessions}, nil
 }
 
 func (m *Mid) Log() gin.HandlerFunc {
@@ -66,18 +88,28 @@ func (m *Mid) Log() gin.HandlerFunc {
 
 		log.Info().Str("Trace Id", traceId).Str("Method", c.Request.Method).
 			Str("URL Path", c.Request.URL.Path).Msg("request started")
-		// After the request is processed by the next handler, logs the info again with status code
-		defer log.Info().Str("Trace Id", traceId).Str("Method", c.Request.Method).
-			Str("URL Path", c.Request.URL.Path).
-			Int("status Code", c.Writer.Status()).Msg("Request processing completed")
+		// After the request is processed by the next handler, logs the info again with status code.
+		// It has to be a closure, the arguments of a deferred call are evaluated right away, before there is a status.
+		defer func() {
+			e := log.Info().Str("Trace Id", traceId).Str("Method", c.Request.Method).
+				Str("URL Path", c.Request.URL.Path).
+				Int("status Code", c.Writer.Status())
+			// Authenticate replaced the request by now, its context has the claims. Requests made by an admin
+			// acting as another user are marked, so they can be told apart from the user's own.
+			if claims, ok := c.Request.Context().Value(auth.Key).(auth.Claims); ok && claims.IsImpersonation() {
+				e = e.Bool("impersonated", true).Str("user", claims.Subject).Str("actor", claims.Act.Subject)
+			}
+			e.Msg("Request processing completed")
+		}()
 
 		//we use c.Next only when we are using r.Use() method to assign middlewares
 		c.Next()
 	}
 }
 
-// Authenticate is a method that defines a Middleware function for gin HTTP framework
-func (m *Mid) Authenticate(next gin.HandlerFunc) gin.HandlerFunc {
+// Authenticate is a method that defines a Middleware function for gin HTTP framework.
+// The token has to carry every one of the given scopes, otherwise the request is rejected with 403.
+func (m *Mid) Authenticate(next gin.HandlerFunc, scopes ...string) gin.HandlerFunc {
 	// This middleware function is returned
 	return func(c *gin.Context) {
 		// We get the current request context
@@ -98,30 +130,48 @@ func (m *Mid) Authenticate(next gin.HandlerFunc) gin.HandlerFunc {
 			return
 		}
 
-		// Getting the Authorization header
-		authHeader := c.Request.Header.Get("Authorization")
+		// Machine clients send an API key, everybody else a JWT, either as Bearer token or in a cookie
+		var claims auth.Claims
+		if apiKey := apiKeyFromRequest(c.Request); apiKey != "" {
+			claims, ok = m.apiKeyClaims(c, traceId, apiKey)
+		} else {
+			claims, ok = m.bearerClaims(c, traceId)
+		}
+		// The request has already been aborted when the credentials were not accepted
+		if !ok {
+			return
+		}
 
-		// Splitting the Authorization header based on the space character.
-		// Boats "Bearer" and the actual token
-		parts := strings.Split(authHeader, " ")
-		// Checking the format of the Authorization header
-		if len(parts) != 2 || strings.ToLower(parts[0]) != "bearer" {
-			// If the header format doesn't match required format, log and send an error
-			err := errors.New("expected authorization header format: Bearer <token>")
-			log.Error().Err(err).Str("Trace Id", traceId).Send()
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		// The token has to be meant for what the route does
+		if !claims.HasScopes(scopes...) {
+			required := strings.Join(scopes, " ")
+			log.Error().Str("Trace Id", traceId).Str("scope", claims.Scope).Str("required scope", required).
+				Msg("insufficient scope")
+			c.Header("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope=%q`, required))
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "insufficient_scope", "scope": required})
 			return
 		}
 
-		// ValidateToken presumably checks the token for validity and returns claims if it's valid
-		claims, err := m.a.ValidateToken(parts[1])
-		// If there is an error, log it and return an Unauthorized error message
-		if err != nil {
-			log.Error().Err(err).Str("Trace Id", traceId).Send()
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": http.StatusText(http.StatusUnauthorized)})
+		// Impersonation tokens are for looking at the data of the user. The account routes under /me require no
+		// scope, an admin can't use them to e.g. create an API key in the name of the user.
+		if claims.IsImpersonation() && len(scopes) == 0 {
+			log.Error().Str("Trace Id", traceId).Str("user", claims.Subject).Str("actor", claims.Act.Subject).
+				Msg("impersonation token used for account route")
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "impersonation_not_allowed"})
 			return
 		}
 
+		// Clients acting on their own behalf, users and admins acting as users are logged differently,
+		// so their requests can be told apart
+		if claims.IsClient() {
+			log.Info().Str("Trace Id", traceId).Str("client", claims.ClientID).Msg("client principal")
+		} else if claims.IsImpersonation() {
+			log.Info().Str("Trace Id", traceId).Str("user", claims.Subject).Str("actor", claims.Act.Subject).
+				Msg("impersonated user principal")
+		} else {
+			log.Info().Str("Trace Id", traceId).Str("user", claims.Subject).Msg("user principal")
+		}
+
 		// If the token is valid, then add it to the context
 		ctx = context.WithValue(ctx, auth.Key, claims)
 
@@ -133,3 +183,193 @@ func (m *Mid) Authenticate(next gin.HandlerFunc) gin.HandlerFunc {
 		next(c)
 	}
 }
+
+// bearerClaims validates the JWT of the request and returns its claims. If the token is
+// not accepted, the request is aborted and false is returned.
+func (m *Mid) bearerClaims(c *gin.Context, traceId string) (auth.Claims, bool) {
+	ctx := c.Request.Context()
+
+	token, ok := tokenFromRequest(c, traceId)
+	if !ok {
+		return auth.Claims{}, false
+	}
+
+	// ValidateToken checks the signature and the claims of the token and returns the claims if it's valid
+	claims, err := m.a.ValidateToken(token)
+	// If there is an error, log it and return an Unauthorized error message
+	if err != nil {
+		abortInvalidToken(c, traceId, err)
+		return auth.Claims{}, false
+	}
+
+	// A valid token could still have been revoked, e.g. because the user logged out
+	revoked, err := m.dl.IsRevoked(ctx, claims.RegisteredClaims)
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Send()
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": http.StatusText(http.StatusInternalServerError)})
+		return auth.Claims{}, false
+	}
+	if revoked {
+		log.Error().Str("Trace Id", traceId).Str("jti", claims.ID).Msg("token revoked")
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": http.StatusText(http.StatusUnauthorized)})
+		return auth.Claims{}, false
+	}
+
+	// Tokens of a user belong to a session, which may have been ended from another device in the meantime
+	if claims.SessionID != "" {
+		active, err := m.sessions.Seen(ctx, claims.SessionID, c.ClientIP())
+		if err != nil {
+			log.Error().Err(err).Str("Trace Id", traceId).Send()
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": http.StatusText(http.StatusInternalServerError)})
+			return auth.Claims{}, false
+		}
+		if !active {
+			log.Error().Str("Trace Id", traceId).Str("sid", claims.SessionID).Msg("session ended")
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": http.StatusText(http.StatusUnauthorized)})
+			return auth.Claims{}, false
+		}
+	}
+
+	return claims, true
+}
+
+// tokenFromRequest returns the JWT of the request. API clients send it in the Authorization header, browsers
+// that logged in with a cookie session send the token cookie. The browser sends that cookie along with requests
+// other sites make it send, so unsafe requests with the cookie have to carry the CSRF token as well.
+// If there is no acceptable token, the request is aborted and false is returned.
+func tokenFromRequest(c *gin.Context, traceId string) (string, bool) {
+	// Getting the Authorization header
+	authHeader := c.Request.Header.Get("Authorization")
+
+	cookie, err := c.Request.Cookie(TokenCookie)
+	if authHeader == "" && err == nil && cookie.Value != "" {
+		if !safeMethod(c.Request.Method) && !ValidCSRF(c.Request) {
+			log.Error().Str("Trace Id", traceId).Str("Method", c.Request.Method).Msg("csrf token missing or wrong")
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "invalid_csrf_token"})
+			return "", false
+		}
+		return cookie.Value, true
+	}
+
+	// Splitting the Authorization header based on the space character.
+	// Boats "Bearer" and the actual token
+	parts := strings.Split(authHeader, " ")
+	// Checking the format of the Authorization header
+	if len(parts) != 2 || strings.ToLower(parts[0]) != "bearer" {
+		// If the header format doesn't match required format, log and send an error
+		err := errors.New("expected authorization header format: Bearer <token>")
+		log.Error().Err(err).Str("Trace Id", traceId).Send()
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return "", false
+	}
+	return parts[1], true
+}
+
+// apiKeyClaims checks the API key of the request and returns the claims of its user. If the key is
+// not accepted, the request is aborted and false is returned.
+func (m *Mid) apiKeyClaims(c *gin.Context, traceId string, apiKey string) (auth.Claims, bool) {
+	claims, err := m.keys.AuthenticateAPIKey(c.Request.Context(), apiKey, c.ClientIP())
+	if err != nil {
+		log.Error().Err(err).Str("Trace Id", traceId).Msg("api key rejected")
+		if errors.Is(err, models.ErrInvalidAPIKey) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid_api_key"})
+			return auth.Claims{}, false
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": http.StatusText(http.StatusInternalServerError)})
+		return auth.Claims{}, false
+	}
+	return claims, true
+}
+
+// apiKeyFromRequest returns the API key sent in the X-API-Key header, or as Bearer token, if there is one.
+func apiKeyFromRequest(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if found && strings.HasPrefix(token, models.APIKeyPrefix) {
+		return token
+	}
+	return ""
+}
+
+// RequireRole is a middleware that only lets requests through whose token carries at least one of the roles.
+// It has to run after Authenticate, which puts the claims in the context.
+func (m *Mid) RequireRole(next gin.HandlerFunc, roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		traceId, ok := ctx.Value(TraceIdKey).(string)
+		if !ok {
+			log.Error().Msg("trace id not present in the context")
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": http.StatusText(http.StatusInternalServerError)})
+			return
+		}
+
+		claims, ok := ctx.Value(auth.Key).(auth.Claims)
+		if !ok {
+			log.Error().Str("Trace Id", traceId).Msg("claims not present in the context")
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": http.StatusText(http.StatusUnauthorized)})
+			return
+		}
+
+		// The user needs one of the roles, having some other role is not enough
+		if !claims.HasRole(roles...) {
+			log.Error().Str("Trace Id", traceId).Str("sub", claims.Subject).Strs("required roles", roles).
+				Msg("missing role")
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": http.StatusText(http.StatusForbidden)})
+			return
+		}
+
+		next(c)
+	}
+}
+
+// RequireMFA is a middleware that only lets users through who passed a second factor when they logged in.
+// It goes after Authenticate, which puts the claims in the context.
+func (m *Mid) RequireMFA(next gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		traceId, ok := ctx.Value(TraceIdKey).(string)
+		if !ok {
+			log.Error().Msg("trace id not present in the context")
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": http.StatusText(http.StatusInternalServerError)})
+			return
+		}
+
+		claims, ok := ctx.Value(auth.Key).(auth.Claims)
+		if !ok {
+			log.Error().Str("Trace Id", traceId).Msg("claims not present in the context")
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": http.StatusText(http.StatusUnauthorized)})
+			return
+		}
+
+		// API keys never carry an amr claim, so they can't be used here either
+		if !claims.HasAMR(auth.AMRMFA) {
+			log.Error().Str("Trace Id", traceId).Str("sub", claims.Subject).Msg("missing second factor")
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "mfa_required",
+				"msg": "log in with a second factor to use this endpoint"})
+			return
+		}
+
+		next(c)
+	}
+}
+
+// abortInvalidToken logs why a token was rejected and tells the client, as described by RFC 6750.
+// Errors that are not a *auth.ValidationError are not explained to the client.
+func abortInvalidToken(c *gin.Context, traceId string, err error) {
+	var vErr *auth.ValidationError
+	if !errors.As(err, &vErr) {
+		log.Error().Err(err).Str("Trace Id", traceId).Send()
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": http.StatusText(http.StatusUnauthorized)})
+		return
+	}
+
+	// The reason and the claim are logged as separate fields, so that e.g. expired tokens can be told apart
+	// from tokens with a foreign issuer without parsing the message
+	log.Error().Err(vErr.Cause).Str("Trace Id", traceId).Str("reason", vErr.Err.Error()).
+		Str("claim", vErr.Claim).Msg("invalid token")
+
+	c.Header("WWW-Authenticate", fmt.Sprintf(`Bearer error="invalid_token", error_description=%q`, vErr.Err.Error()))
+	c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid_token", "error_description": vErr.Err.Error()})
+}
@@ -0,0 +1,37 @@
+package middlewares
+
+import (
+	"crypto/subtle"
+	"net/http"
+)
+
+// The cookies browser clients are logged in with when they ask /login for a cookie session. The access token and
+// the refresh token are HttpOnly, scripts only get to read the CSRF token.
+const (
+	TokenCookie   = "service_app_token"
+	RefreshCookie = "service_app_refresh"
+	CSRFCookie    = "service_app_csrf"
+	// CSRFHeader is where scripts send the value of the CSRF cookie back.
+	CSRFHeader = "X-CSRF-Token"
+)
+
+// ValidCSRF reports whether the request repeats the value of its CSRF cookie in the CSRFHeader, which is
+// the double-submit pattern. Another site can make the browser send the cookie along, but it can't read the
+// cookie to put its value in the header.
+func ValidCSRF(r *http.Request) bool {
+	cookie, err := r.Cookie(CSRFCookie)
+	if err != nil || cookie.Value == "" {
+		return false
+	}
+	header := r.Header.Get(CSRFHeader)
+	return subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(header)) == 1
+}
+
+// safeMethod reports whether requests with the HTTP method only read, so that they need no CSRF token.
+func safeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return false
+}
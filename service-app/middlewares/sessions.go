@@ -0,0 +1,82 @@
+package middlewares
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// SessionToucher records that a session was used and reports whether it is still active, models.Store implements it.
+type SessionToucher interface {
+	TouchSession(ctx context.Context, sessionId, ip string) (bool, error)
+}
+
+// sessionEntry remembers whether a session was active when it was last touched, until 'until'.
+type sessionEntry struct {
+	active bool
+	until  time.Time
+}
+
+// SessionTracker keeps the last-seen time of sessions up to date without writing to the database on every request.
+// A session is touched at most once per interval, in between the answer of the last touch is used. That also bounds
+// how long a session revoked by another instance of the app keeps working.
+type SessionTracker struct {
+	store    SessionToucher
+	interval time.Duration
+
+	mu        sync.Mutex
+	sessions  map[string]sessionEntry
+	lastSweep time.Time
+}
+
+// NewSessionTracker is a constructor function for SessionTracker. It returns an error if store is nil.
+func NewSessionTracker(store SessionToucher, interval time.Duration) (*SessionTracker, error) {
+	if store == nil {
+		return nil, errors.New("session store cannot be nil")
+	}
+	return &SessionTracker{
+		store:     store,
+		interval:  interval,
+		sessions:  make(map[string]sessionEntry),
+		lastSweep: time.Now(),
+	}, nil
+}
+
+// Seen records that the session was used from ip and reports whether it is still active.
+func (t *SessionTracker) Seen(ctx context.Context, sessionId, ip string) (bool, error) {
+	now := time.Now()
+	t.mu.Lock()
+	e, ok := t.sessions[sessionId]
+	t.mu.Unlock()
+	if ok && now.Before(e.until) {
+		return e.active, nil
+	}
+
+	active, err := t.store.TouchSession(ctx, sessionId, ip)
+	if err != nil {
+		return false, fmt.Errorf("touching session %w", err)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sessions[sessionId] = sessionEntry{active: active, until: now.Add(t.interval)}
+	// Entries are only useful for one interval, so they are swept out once per interval
+	if now.Sub(t.lastSweep) > t.interval {
+		for id, e := range t.sessions {
+			if now.After(e.until) {
+				delete(t.sessions, id)
+			}
+		}
+		t.lastSweep = now
+	}
+	return active, nil
+}
+
+// Revoked makes the tracker treat the session as revoked right away, instead of after the next touch.
+func (t *SessionTracker) Revoked(sessionId string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sessions[sessionId] = sessionEntry{active: false, until: time.Now().Add(t.interval)}
+}
@@ -0,0 +1,133 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"service-app/auth"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// APIKeyPrefix starts every API key, which lets the middleware tell API keys and JWTs apart.
+const APIKeyPrefix = "sak_"
+
+var (
+	// ErrInvalidAPIKey is returned when an API key is unknown, revoked or expired.
+	ErrInvalidAPIKey = errors.New("invalid api key")
+	// ErrAPIKeyNotFound is returned when a user has no API key with the given id.
+	ErrAPIKeyNotFound = errors.New("api key not found")
+)
+
+// CreateAPIKey creates an API key for the user and returns it together with the plain key,
+// which is the only time the key can be seen.
+func (s *Conn) CreateAPIKey(ctx context.Context, userId uint, nk NewAPIKey) (APIKey, string, error) {
+	if nk.ExpiresAt != nil && nk.ExpiresAt.Before(time.Now()) {
+		return APIKey{}, "", errors.New("expiry is in the past")
+	}
+
+	token, _, err := generateToken()
+	if err != nil {
+		return APIKey{}, "", err
+	}
+	key := APIKeyPrefix + token
+
+	k := APIKey{
+		UserId:    userId,
+		Label:     nk.Label,
+		Prefix:    key[:len(APIKeyPrefix)+8],
+		KeyHash:   hashToken(key),
+		Scope:     nk.Scope,
+		ExpiresAt: nk.ExpiresAt,
+	}
+	err = s.db.WithContext(ctx).Create(&k).Error
+	if err != nil {
+		return APIKey{}, "", fmt.Errorf("storing api key: %w", err)
+	}
+	return k, key, nil
+}
+
+// ListAPIKeys returns every API key of the user, including revoked and expired ones.
+func (s *Conn) ListAPIKeys(ctx context.Context, userId uint) ([]APIKey, error) {
+	var keys = make([]APIKey, 0, 10)
+	err := s.db.WithContext(ctx).Where("user_id = ?", userId).Order("id").Find(&keys).Error
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// RelabelAPIKey changes the label of one of the user's API keys.
+func (s *Conn) RelabelAPIKey(ctx context.Context, userId, keyId uint, label string) (APIKey, error) {
+	var k APIKey
+	err := s.db.WithContext(ctx).Where("id = ? AND user_id = ?", keyId, userId).First(&k).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return APIKey{}, ErrAPIKeyNotFound
+	}
+	if err != nil {
+		return APIKey{}, err
+	}
+
+	err = s.db.WithContext(ctx).Model(&k).Update("label", label).Error
+	if err != nil {
+		return APIKey{}, err
+	}
+	return k, nil
+}
+
+// RevokeAPIKey revokes one of the user's API keys. Revoking a key twice is not an error.
+func (s *Conn) RevokeAPIKey(ctx context.Context, userId, keyId uint) error {
+	var k APIKey
+	err := s.db.WithContext(ctx).Where("id = ? AND user_id = ?", keyId, userId).First(&k).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrAPIKeyNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if k.RevokedAt != nil {
+		return nil
+	}
+	return s.db.WithContext(ctx).Model(&k).Update("revoked_at", time.Now()).Error
+}
+
+// AuthenticateAPIKey checks an API key and returns the claims of the request it was sent with.
+// The claims get the scope of the key, as far as the current roles of its user still allow it.
+// The time and the IP address the key was used from are recorded.
+func (s *Conn) AuthenticateAPIKey(ctx context.Context, key, ip string) (auth.Claims, error) {
+	if !strings.HasPrefix(key, APIKeyPrefix) {
+		return auth.Claims{}, ErrInvalidAPIKey
+	}
+
+	var k APIKey
+	err := s.db.WithContext(ctx).Where("key_hash = ?", hashToken(key)).First(&k).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return auth.Claims{}, ErrInvalidAPIKey
+	}
+	if err != nil {
+		return auth.Claims{}, err
+	}
+
+	now := time.Now()
+	if k.RevokedAt != nil || (k.ExpiresAt != nil && now.After(*k.ExpiresAt)) {
+		return auth.Claims{}, ErrInvalidAPIKey
+	}
+
+	var u User
+	err = s.db.WithContext(ctx).First(&u, k.UserId).Error
+	if err != nil {
+		return auth.Claims{}, fmt.Errorf("fetching user of api key: %w", err)
+	}
+
+	err = s.db.WithContext(ctx).Model(&k).Updates(map[string]any{"last_used_at": now, "last_used_ip": ip}).Error
+	if err != nil {
+		return auth.Claims{}, fmt.Errorf("recording api key use: %w", err)
+	}
+
+	claims := newClaims(u)
+	claims.Scope = auth.IntersectScopes(claims.Scope, k.Scope)
+	claims.APIKeyID = k.ID
+	return claims, nil
+}
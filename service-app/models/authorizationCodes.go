@@ -0,0 +1,168 @@
+package models
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"service-app/auth"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
+)
+
+// AuthorizationCodeTTL is how long a client has to exchange an authorization code. The code travels through
+// the browser, so it is kept short.
+const AuthorizationCodeTTL = time.Minute
+
+// IDTokenTTL is how long an ID token is valid. Clients use it to log the user in right away, not later on.
+const IDTokenTTL = 10 * time.Minute
+
+// ErrInvalidGrant is returned when an authorization code is unknown, expired or already used, or was issued
+// for another client, redirect URI or code challenge.
+var ErrInvalidGrant = errors.New("invalid grant")
+
+// AuthorizationRequest is what a client asked for at the authorization endpoint, as far as it has to be checked
+// again when the code is exchanged or ends up in the ID token.
+type AuthorizationRequest struct {
+	ClientId      string
+	RedirectURI   string
+	Nonce         string
+	CodeChallenge string
+}
+
+// CreateAuthorizationCode stores a new authorization code for the user the claims were issued to and returns the
+// plain code. The claims carry the scope the user granted the client and how they authenticated.
+func (s *Conn) CreateAuthorizationCode(ctx context.Context, claims auth.Claims, ar AuthorizationRequest) (string,
+	error) {
+	userId, err := strconv.ParseUint(claims.Subject, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("parsing subject: %w", err)
+	}
+	code, hash, err := generateToken()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	ac := AuthorizationCode{
+		CodeHash:      hash,
+		ClientId:      ar.ClientId,
+		UserId:        uint(userId),
+		RedirectURI:   ar.RedirectURI,
+		Scope:         claims.Scope,
+		Nonce:         ar.Nonce,
+		CodeChallenge: ar.CodeChallenge,
+		AMR:           claims.AMR,
+		AuthTime:      now,
+		ExpiresAt:     now.Add(AuthorizationCodeTTL),
+	}
+	err = s.db.WithContext(ctx).Create(&ac).Error
+	if err != nil {
+		return "", fmt.Errorf("storing authorization code: %w", err)
+	}
+	return code, nil
+}
+
+// ExchangeAuthorizationCode uses up an authorization code of the client and returns the claims of the access
+// token and of the ID token it is exchanged for. redirectURI has to be the one the code was issued for and
+// verifier the PKCE code verifier behind its code challenge. The ID token has no issuer yet.
+//
+// The access token gets the scope the user granted, as far as their roles still allow it.
+func (s *Conn) ExchangeAuthorizationCode(ctx context.Context, clientId, code, redirectURI, verifier string) (auth.Claims,
+	auth.IDClaims, error) {
+	// Only one request can use the code. It is used up even if the rest of the request doesn't check out,
+	// so that a stolen code can't be tried with one verifier after another.
+	db := s.db.WithContext(ctx)
+	now := time.Now()
+	res := db.Model(&AuthorizationCode{}).
+		Where("code_hash = ? AND used_at IS NULL AND expires_at > ?", hashToken(code), now).
+		Update("used_at", now)
+	if res.Error != nil {
+		return auth.Claims{}, auth.IDClaims{}, fmt.Errorf("using authorization code: %w", res.Error)
+	}
+	if res.RowsAffected == 0 {
+		return auth.Claims{}, auth.IDClaims{}, ErrInvalidGrant
+	}
+	var ac AuthorizationCode
+	err := db.Where("code_hash = ?", hashToken(code)).First(&ac).Error
+	if err != nil {
+		return auth.Claims{}, auth.IDClaims{}, fmt.Errorf("fetching authorization code: %w", err)
+	}
+
+	if ac.ClientId != clientId || ac.RedirectURI != redirectURI || !verifyCodeChallenge(verifier, ac.CodeChallenge) {
+		return auth.Claims{}, auth.IDClaims{}, ErrInvalidGrant
+	}
+
+	var u User
+	err = db.First(&u, ac.UserId).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return auth.Claims{}, auth.IDClaims{}, ErrInvalidGrant
+	}
+	if err != nil {
+		return auth.Claims{}, auth.IDClaims{}, err
+	}
+
+	claims := newClaims(u)
+	claims.Scope = auth.IntersectScopes(claims.Scope+" "+auth.OIDCScopes, ac.Scope)
+	claims.ClientID = clientId
+	claims.AMR = ac.AMR
+
+	idClaims := auth.IDClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   claims.Subject,
+			Audience:  jwt.ClaimStrings{clientId},
+			ExpiresAt: jwt.NewNumericDate(now.Add(IDTokenTTL)),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+		Nonce:           ac.Nonce,
+		AuthTime:        jwt.NewNumericDate(ac.AuthTime),
+		AuthorizedParty: clientId,
+		AMR:             ac.AMR,
+		UserInfo:        userInfo(u, claims),
+	}
+	return claims, idClaims, nil
+}
+
+// UserInfo returns the claims about the user the scope of the claims gives access to.
+func (s *Conn) UserInfo(ctx context.Context, claims auth.Claims) (auth.UserInfo, error) {
+	var u User
+	err := s.db.WithContext(ctx).Where("id = ?", claims.Subject).First(&u).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return auth.UserInfo{}, ErrUserNotFound
+	}
+	if err != nil {
+		return auth.UserInfo{}, err
+	}
+	return userInfo(u, claims), nil
+}
+
+// userInfo picks the claims about u the scope of the claims gives access to.
+func userInfo(u User, claims auth.Claims) auth.UserInfo {
+	var info auth.UserInfo
+	if claims.HasScopes(auth.ScopeProfile) {
+		info.Name = u.Name
+	}
+	if claims.HasScopes(auth.ScopeEmail) {
+		verified := u.EmailVerifiedAt != nil
+		info.Email = u.Email
+		info.EmailVerified = &verified
+	}
+	return info
+}
+
+// verifyCodeChallenge reports whether verifier is the PKCE code verifier behind challenge, with the S256 method
+// of RFC 7636: the challenge is the unpadded base64url encoded SHA-256 hash of the verifier.
+func verifyCodeChallenge(verifier, challenge string) bool {
+	// RFC 7636 section 4.1 asks for at least 43 characters, anything shorter is too easy to guess
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	expected := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(challenge)) == 1
+}
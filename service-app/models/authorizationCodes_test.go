@@ -0,0 +1,87 @@
+package models
+
+import (
+	"service-app/auth"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyCodeChallenge(t *testing.T) {
+	// The example of RFC 7636 appendix B
+	const verifier = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	const challenge = "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+
+	tests := []struct {
+		name      string
+		verifier  string
+		challenge string
+		want      bool
+	}{
+		{name: "RFC 7636 example", verifier: verifier, challenge: challenge, want: true},
+		{name: "wrong verifier", verifier: strings.Replace(verifier, "d", "e", 1), challenge: challenge},
+		{name: "plain method", verifier: verifier, challenge: verifier},
+		{name: "padded challenge", verifier: verifier, challenge: challenge + "="},
+		{name: "empty challenge", verifier: verifier, challenge: ""},
+		{name: "empty verifier", verifier: "", challenge: "47DEQpj8HBSa-_TImW-5JCeuQeRkm5NMpJWZG3hSuFU"},
+		{name: "verifier too short", verifier: verifier[:42], challenge: challenge},
+		{name: "verifier too long", verifier: strings.Repeat("a", 129), challenge: challenge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, verifyCodeChallenge(tt.verifier, tt.challenge))
+		})
+	}
+}
+
+func TestUserInfo(t *testing.T) {
+	verifiedAt := time.Now()
+	verified, unverified := true, false
+	ada := User{Name: "Ada", Email: "ada@example.com", EmailVerifiedAt: &verifiedAt}
+
+	tests := []struct {
+		name  string
+		user  User
+		scope string
+		want  auth.UserInfo
+	}{
+		{name: "openid only", user: ada, scope: "openid"},
+		{name: "profile", user: ada, scope: "openid profile", want: auth.UserInfo{Name: "Ada"}},
+		{name: "email", user: ada, scope: "openid email",
+			want: auth.UserInfo{Email: "ada@example.com", EmailVerified: &verified}},
+		{name: "unverified email", user: User{Name: "Bob", Email: "bob@example.com"}, scope: "openid email",
+			want: auth.UserInfo{Email: "bob@example.com", EmailVerified: &unverified}},
+		{name: "every scope", user: ada, scope: "openid profile email inventory:read",
+			want: auth.UserInfo{Name: "Ada", Email: "ada@example.com", EmailVerified: &verified}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, userInfo(tt.user, auth.Claims{Scope: tt.scope}))
+		})
+	}
+}
+
+func TestHasRedirectURI(t *testing.T) {
+	cl := OAuthClient{RedirectURIs: []string{"https://app.example.com/callback", "http://localhost:3000/cb"}}
+
+	tests := []struct {
+		uri  string
+		want bool
+	}{
+		{uri: "https://app.example.com/callback", want: true},
+		{uri: "http://localhost:3000/cb", want: true},
+		{uri: "https://app.example.com/callback/"},
+		{uri: "https://app.example.com/callback?next=/admin"},
+		{uri: "https://APP.example.com/callback"},
+		{uri: "http://app.example.com/callback"},
+		{uri: "https://app.example.com.evil.example/callback"},
+		{uri: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.uri, func(t *testing.T) {
+			require.Equal(t, tt.want, cl.HasRedirectURI(tt.uri))
+		})
+	}
+}
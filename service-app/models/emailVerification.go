@@ -0,0 +1,92 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// PurposeEmailVerification is the purpose of the user tokens mailed to verify an email address.
+const PurposeEmailVerification = "email_verification"
+
+const (
+	// EmailVerificationTTL is how long an email verification token can be used.
+	EmailVerificationTTL = 24 * time.Hour
+	// VerificationResendCooldown is how long a user has to wait before another verification email is sent.
+	VerificationResendCooldown = 5 * time.Minute
+)
+
+var (
+	// ErrEmailAlreadyVerified is returned when a verification token is requested for a verified email.
+	ErrEmailAlreadyVerified = errors.New("email already verified")
+	// ErrVerificationCooldown is returned when the last verification token was created less than
+	// VerificationResendCooldown ago.
+	ErrVerificationCooldown = errors.New("verification email sent too recently")
+)
+
+// CreateEmailVerificationToken creates a token that verifies the email of the user with the given email and
+// returns the user together with the plain token. ErrUserNotFound, ErrEmailAlreadyVerified and
+// ErrVerificationCooldown are returned when no token should be sent.
+func (s *Conn) CreateEmailVerificationToken(ctx context.Context, email string) (User, string, error) {
+	var u User
+	var token string
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("email = ?", email).First(&u).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrUserNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if u.EmailVerifiedAt != nil {
+			return ErrEmailAlreadyVerified
+		}
+
+		var recent int64
+		err = tx.Model(&UserToken{}).
+			Where("user_id = ? AND purpose = ? AND created_at > ?", u.ID, PurposeEmailVerification,
+				time.Now().Add(-VerificationResendCooldown)).
+			Count(&recent).Error
+		if err != nil {
+			return fmt.Errorf("checking recent verification tokens: %w", err)
+		}
+		if recent > 0 {
+			return ErrVerificationCooldown
+		}
+
+		token, err = createUserToken(tx, u.ID, PurposeEmailVerification, EmailVerificationTTL)
+		return err
+	})
+	if err != nil {
+		return User{}, "", err
+	}
+	return u, token, nil
+}
+
+// VerifyEmail marks the email of the user the token was created for as verified and uses up the token.
+// ErrInvalidUserToken is returned when the token can't be used.
+func (s *Conn) VerifyEmail(ctx context.Context, token string) (User, error) {
+	var u User
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		ut, err := consumeUserToken(tx, token, PurposeEmailVerification)
+		if err != nil {
+			return err
+		}
+
+		err = tx.First(&u, ut.UserId).Error
+		if err != nil {
+			return fmt.Errorf("fetching user: %w", err)
+		}
+		if u.EmailVerifiedAt != nil {
+			return nil
+		}
+		return tx.Model(&u).Update("email_verified_at", time.Now()).Error
+	})
+	if err != nil {
+		return User{}, err
+	}
+	return u, nil
+}
@@ -0,0 +1,115 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"service-app/auth"
+	"service-app/sso"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// AuthenticateFederated logs in the user an external identity provider vouched for and returns the claims of
+// their access token. The user is found by the link to their account at the identity provider. The first time,
+// the account is linked to the user with its email, who is created if there is none. Only a verified email is
+// trusted for that, otherwise ErrEmailNotVerified is returned.
+//
+// The access token carries the fed authentication method, and mfa as well if the identity provider says the user
+// used a second factor there.
+func (s *Conn) AuthenticateFederated(ctx context.Context, id sso.Identity) (auth.Claims, error) {
+	if id.Issuer == "" || id.Subject == "" {
+		return auth.Claims{}, errors.New("identity has no issuer or subject")
+	}
+
+	var u User
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var fi FederatedIdentity
+		err := tx.Where("issuer = ? AND subject = ?", id.Issuer, id.Subject).First(&fi).Error
+		if err == nil {
+			err = tx.First(&u, fi.UserId).Error
+			if err != nil {
+				return fmt.Errorf("fetching linked user: %w", err)
+			}
+			return tx.Model(&fi).Updates(map[string]any{"email": id.Email, "last_login_at": time.Now()}).Error
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		// Linking by email is only safe when the identity provider checked that the email belongs to the user
+		if !id.EmailVerified || id.Email == "" {
+			return ErrEmailNotVerified
+		}
+		u, err = provisionFederatedUser(tx, id)
+		if err != nil {
+			return err
+		}
+		fi = FederatedIdentity{
+			UserId:      u.ID,
+			Issuer:      id.Issuer,
+			Subject:     id.Subject,
+			Email:       id.Email,
+			LastLoginAt: time.Now(),
+		}
+		err = tx.Create(&fi).Error
+		if err != nil {
+			return fmt.Errorf("linking federated identity: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return auth.Claims{}, err
+	}
+
+	claims := newClaims(u)
+	claims.AMR = []string{auth.AMRFederated}
+	for _, m := range id.AMR {
+		if m == auth.AMRMFA {
+			claims.AMR = append(claims.AMR, auth.AMRMFA)
+			break
+		}
+	}
+	return claims, nil
+}
+
+// provisionFederatedUser returns the user with the verified email of the identity, creating them just in time if
+// there is none. The email counts as verified from now on either way. Users created here have no password, they
+// can set one with a password reset.
+//
+// Emails are matched whatever their case, identity providers don't keep the case the user signed up with.
+// Signups don't normalise emails, so if several users only differ in the case of their email, the oldest is taken.
+func provisionFederatedUser(tx *gorm.DB, id sso.Identity) (User, error) {
+	now := time.Now()
+	var u User
+	err := tx.Where("lower(email) = lower(?)", id.Email).First(&u).Error
+	if err == nil {
+		if u.EmailVerifiedAt == nil {
+			err = tx.Model(&u).Update("email_verified_at", now).Error
+			if err != nil {
+				return User{}, fmt.Errorf("verifying email: %w", err)
+			}
+		}
+		return u, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return User{}, err
+	}
+
+	name := id.Name
+	if name == "" {
+		name = id.Email
+	}
+	u = User{
+		Name:            name,
+		Email:           id.Email,
+		EmailVerifiedAt: &now,
+		Roles:           []string{auth.RoleViewer},
+	}
+	err = tx.Create(&u).Error
+	if err != nil {
+		return User{}, fmt.Errorf("creating user: %w", err)
+	}
+	return u, nil
+}
@@ -0,0 +1,113 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"service-app/auth"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
+)
+
+// ImpersonationTTL is how long an admin can act as another user with one impersonation token.
+const ImpersonationTTL = 15 * time.Minute
+
+// impersonationScope is what an impersonation token can do at most. Admins get to look at the data of a user,
+// not to change it.
+const impersonationScope = auth.ScopeInventoryRead
+
+var (
+	// ErrImpersonationNotAllowed is returned when an admin tries to impersonate themselves or another admin.
+	ErrImpersonationNotAllowed = errors.New("user can't be impersonated")
+	// ErrImpersonationNotFound is returned when there is no ongoing impersonation with the given id.
+	ErrImpersonationNotFound = errors.New("impersonation not found")
+)
+
+// Impersonate lets the admin actorId act as the user userId and returns the claims of the token for it.
+// The claims are those of the user, limited to reading, with the admin in their act claim. An audit record
+// with the reason is stored together with the token id, ip and userAgent are where the admin is.
+func (s *Conn) Impersonate(ctx context.Context, actorId, userId uint, ni NewImpersonation, ip,
+	userAgent string) (auth.Claims, Impersonation, error) {
+
+	if actorId == userId {
+		return auth.Claims{}, Impersonation{}, fmt.Errorf("%w: can't impersonate yourself", ErrImpersonationNotAllowed)
+	}
+
+	var actor, u User
+	err := s.db.WithContext(ctx).First(&actor, actorId).Error
+	if err != nil {
+		return auth.Claims{}, Impersonation{}, fmt.Errorf("fetching admin: %w", err)
+	}
+	err = s.db.WithContext(ctx).First(&u, userId).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return auth.Claims{}, Impersonation{}, ErrUserNotFound
+	}
+	if err != nil {
+		return auth.Claims{}, Impersonation{}, err
+	}
+	claims := newClaims(u)
+	// An admin acting as another admin could hide what they did behind somebody else's name
+	if claims.HasRole(auth.RoleAdmin) {
+		return auth.Claims{}, Impersonation{}, fmt.Errorf("%w: user is an admin", ErrImpersonationNotAllowed)
+	}
+	claims.ExpiresAt = jwt.NewNumericDate(time.Now().Add(ImpersonationTTL))
+	claims.Scope = auth.IntersectScopes(claims.Scope, impersonationScope)
+	claims.Act = &auth.Actor{Subject: strconv.FormatUint(uint64(actorId), 10)}
+
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = strings.ToValidUTF8(userAgent[:maxUserAgentLength], "")
+	}
+	rec := Impersonation{
+		ActorId:    actorId,
+		ActorEmail: actor.Email,
+		UserId:     userId,
+		UserEmail:  u.Email,
+		Reason:     ni.Reason,
+		Scope:      claims.Scope,
+		Jti:        claims.ID,
+		IP:         ip,
+		UserAgent:  userAgent,
+		ExpiresAt:  claims.ExpiresAt.Time,
+	}
+	err = s.db.WithContext(ctx).Create(&rec).Error
+	if err != nil {
+		return auth.Claims{}, Impersonation{}, fmt.Errorf("storing impersonation: %w", err)
+	}
+	return claims, rec, nil
+}
+
+// EndImpersonation records that an impersonation ended before its token expired. The ended record is
+// returned, so that its token can be revoked.
+func (s *Conn) EndImpersonation(ctx context.Context, id uint) (Impersonation, error) {
+	var rec Impersonation
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		res := tx.Model(&Impersonation{}).Where("id = ? AND ended_at IS NULL AND expires_at > ?", id, now).
+			Update("ended_at", now)
+		if res.Error != nil {
+			return fmt.Errorf("ending impersonation: %w", res.Error)
+		}
+		if res.RowsAffected == 0 {
+			return ErrImpersonationNotFound
+		}
+		return tx.First(&rec, id).Error
+	})
+	if err != nil {
+		return Impersonation{}, err
+	}
+	return rec, nil
+}
+
+// ListImpersonations returns the audit records of every impersonation of the user, the latest first.
+func (s *Conn) ListImpersonations(ctx context.Context, userId uint) ([]Impersonation, error) {
+	var recs = make([]Impersonation, 0, 10)
+	err := s.db.WithContext(ctx).Where("user_id = ?", userId).Order("created_at DESC").Find(&recs).Error
+	if err != nil {
+		return nil, fmt.Errorf("listing impersonations: %w", err)
+	}
+	return recs, nil
+}
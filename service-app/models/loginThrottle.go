@@ -0,0 +1,157 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ErrLoginThrottled is returned, wrapped in a *ThrottleError, when there were too many failed logins.
+var ErrLoginThrottled = errors.New("too many failed logins")
+
+// ThrottleError tells how long to wait before trying to log in again.
+type ThrottleError struct {
+	RetryAfter time.Duration
+}
+
+// Error implements the error interface.
+func (e *ThrottleError) Error() string {
+	return fmt.Sprintf("%s, retry in %s", ErrLoginThrottled, e.RetryAfter.Round(time.Second))
+}
+
+// Unwrap makes errors.Is(err, ErrLoginThrottled) work.
+func (e *ThrottleError) Unwrap() error {
+	return ErrLoginThrottled
+}
+
+// throttlePolicy decides how failed logins slow down further attempts. The first 'free' failures cost nothing.
+// After that every failure makes the next attempt wait twice as long as the one before, starting at one second,
+// until 'lockoutAfter' failures lock the target out for 'lockout'. Failures older than 'window' are forgotten.
+type throttlePolicy struct {
+	free         int
+	lockoutAfter int
+	lockout      time.Duration
+	window       time.Duration
+}
+
+var (
+	// accountPolicy protects a single account against password guessing.
+	accountPolicy = throttlePolicy{free: 3, lockoutAfter: 10, lockout: 15 * time.Minute, window: 24 * time.Hour}
+	// ipPolicy stops one client from trying many accounts. It is more lenient, a whole office can share an IP.
+	ipPolicy = throttlePolicy{free: 20, lockoutAfter: 100, lockout: time.Hour, window: time.Hour}
+)
+
+// maxWaitShift caps the doubling in wait. A policy with many failures before the lockout would otherwise shift
+// the second out of time.Duration and wait less, or even a negative time, the more failures there are.
+const maxWaitShift = 30
+
+// wait returns how long a target with the given number of failures has to wait before its next attempt.
+func (p throttlePolicy) wait(failures int) time.Duration {
+	if failures >= p.lockoutAfter {
+		return p.lockout
+	}
+	if failures <= p.free {
+		return 0
+	}
+	d := time.Second << min(failures-p.free-1, maxWaitShift)
+	if d > p.lockout {
+		return p.lockout
+	}
+	return d
+}
+
+// accountTarget and ipTarget are the keys failed logins are counted under. Accounts are counted by email,
+// whether there is a user with that email or not, so that unknown emails behave exactly like real ones.
+func accountTarget(email string) string {
+	return "email:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipTarget(ip string) string {
+	return "ip:" + ip
+}
+
+// checkThrottle returns a *ThrottleError if the account or the IP has to wait before the next attempt.
+func (s *Conn) checkThrottle(ctx context.Context, targets ...string) error {
+	var throttles []LoginThrottle
+	err := s.db.WithContext(ctx).Where("target IN ? AND locked_until > ?", targets, time.Now()).Find(&throttles).Error
+	if err != nil {
+		return fmt.Errorf("checking login throttle: %w", err)
+	}
+
+	var retryAfter time.Duration
+	for _, t := range throttles {
+		if d := time.Until(*t.LockedUntil); d > retryAfter {
+			retryAfter = d
+		}
+	}
+	if retryAfter > 0 {
+		return &ThrottleError{RetryAfter: retryAfter}
+	}
+	return nil
+}
+
+// recordLoginFailure counts a failed login against the account and the IP.
+func (s *Conn) recordLoginFailure(ctx context.Context, email, ip string) error {
+	err := s.recordFailure(ctx, accountTarget(email), accountPolicy)
+	if err != nil {
+		return err
+	}
+	return s.recordFailure(ctx, ipTarget(ip), ipPolicy)
+}
+
+// recordFailure counts a failed login against the target and locks it for as long as the policy says.
+func (s *Conn) recordFailure(ctx context.Context, target string, p throttlePolicy) error {
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// Make sure the row exists, then lock it so that concurrent failures are all counted
+		err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&LoginThrottle{Target: target}).Error
+		if err != nil {
+			return fmt.Errorf("recording login failure: %w", err)
+		}
+		var t LoginThrottle
+		err = tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("target = ?", target).First(&t).Error
+		if err != nil {
+			return fmt.Errorf("recording login failure: %w", err)
+		}
+
+		now := time.Now()
+		if t.LastFailureAt != nil && now.Sub(*t.LastFailureAt) > p.window {
+			t.Failures = 0
+		}
+		t.Failures++
+		t.LastFailureAt = &now
+		t.LockedUntil = nil
+		if d := p.wait(t.Failures); d > 0 {
+			until := now.Add(d)
+			t.LockedUntil = &until
+		}
+		return tx.Model(&t).Select("Failures", "LastFailureAt", "LockedUntil").Updates(&t).Error
+	})
+}
+
+// resetAccountThrottle forgets the failed logins of an account. The IP keeps its count, otherwise an attacker
+// could clear it by logging into an account of their own now and then.
+func (s *Conn) resetAccountThrottle(ctx context.Context, email string) error {
+	err := s.db.WithContext(ctx).Unscoped().Where("target = ?", accountTarget(email)).Delete(&LoginThrottle{}).Error
+	if err != nil {
+		return fmt.Errorf("resetting login throttle: %w", err)
+	}
+	return nil
+}
+
+// UnlockUser lifts the lockout of the user's account and forgets its failed logins.
+func (s *Conn) UnlockUser(ctx context.Context, userId uint) error {
+	var u User
+	err := s.db.WithContext(ctx).First(&u, userId).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrUserNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return s.resetAccountThrottle(ctx, u.Email)
+}
@@ -0,0 +1,84 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestThrottlePolicyWait(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   throttlePolicy
+		failures int
+		want     time.Duration
+	}{
+		{"account no failures", accountPolicy, 0, 0},
+		{"account last free failure", accountPolicy, 3, 0},
+		{"account first delay", accountPolicy, 4, time.Second},
+		{"account doubles", accountPolicy, 5, 2 * time.Second},
+		{"account before lockout", accountPolicy, 9, 32 * time.Second},
+		{"account lockout", accountPolicy, 10, 15 * time.Minute},
+		{"account past lockout", accountPolicy, 200, 15 * time.Minute},
+		{"ip last free failure", ipPolicy, 20, 0},
+		{"ip first delay", ipPolicy, 21, time.Second},
+		{"ip capped at lockout", ipPolicy, 40, time.Hour},
+		{"ip far past the shift limit", ipPolicy, 99, time.Hour},
+		{"ip lockout", ipPolicy, 100, time.Hour},
+		{"magic links locked out at once", magicLinkIPPolicy, 20, time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, tt.policy.wait(tt.failures))
+		})
+	}
+}
+
+// More failures must never mean a shorter wait, whatever the policy. A policy that locks out late used to
+// shift the delay out of time.Duration.
+func TestThrottlePolicyWaitNeverDecreases(t *testing.T) {
+	policies := map[string]throttlePolicy{
+		"account":    accountPolicy,
+		"ip":         ipPolicy,
+		"magicLink":  magicLinkIPPolicy,
+		"no lockout": {free: 0, lockoutAfter: 1000, lockout: 1000 * time.Hour, window: time.Hour},
+	}
+	for name, p := range policies {
+		t.Run(name, func(t *testing.T) {
+			var last time.Duration
+			for failures := 0; failures <= 200; failures++ {
+				d := p.wait(failures)
+				require.GreaterOrEqual(t, d, last, "%d failures", failures)
+				require.LessOrEqual(t, d, p.lockout, "%d failures", failures)
+				last = d
+			}
+		})
+	}
+}
+
+// Failed logins of the same email are counted together however it is typed, and never together with an ip.
+func TestThrottleTargets(t *testing.T) {
+	tests := []struct {
+		name string
+		got  string
+		want string
+	}{
+		{"email", accountTarget("ada@example.com"), "email:ada@example.com"},
+		{"email case", accountTarget("Ada@Example.COM"), "email:ada@example.com"},
+		{"email whitespace", accountTarget(" ada@example.com\n"), "email:ada@example.com"},
+		{"ip", ipTarget("192.0.2.1"), "ip:192.0.2.1"},
+		{"ip shaped email", accountTarget("192.0.2.1"), "email:192.0.2.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, tt.got)
+		})
+	}
+}
+
+func TestThrottleError(t *testing.T) {
+	var err error = &ThrottleError{RetryAfter: 1500 * time.Millisecond}
+	require.ErrorIs(t, err, ErrLoginThrottled)
+	require.Equal(t, "too many failed logins, retry in 2s", err.Error())
+}
@@ -0,0 +1,145 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"service-app/auth"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// PurposeMagicLink is the purpose of the user tokens mailed to log in without a password.
+const PurposeMagicLink = "magic_link"
+
+const (
+	// MagicLinkTTL is how long a magic link can be used.
+	MagicLinkTTL = 15 * time.Minute
+	// MagicLinkCooldown is how long a user has to wait before another magic link is sent.
+	MagicLinkCooldown = time.Minute
+	// MagicLinksPerHour is how many magic links a user gets in an hour at most.
+	MagicLinksPerHour = 5
+)
+
+// ErrMagicLinkCooldown is returned when the user was sent a magic link less than MagicLinkCooldown ago, or
+// MagicLinksPerHour of them in the last hour.
+var ErrMagicLinkCooldown = errors.New("magic link sent too recently")
+
+// magicLinkIPPolicy limits how many magic links one client can ask for, whatever the emails. Every request counts,
+// so that nobody can make us mail lots of people.
+var magicLinkIPPolicy = throttlePolicy{free: 20, lockoutAfter: 20, lockout: time.Hour, window: time.Hour}
+
+// magicLinkIPTarget is the key the magic link requests of a client are counted under. Requests are counted apart
+// from failed logins, asking for links doesn't lock the client out of logging in with a password.
+func magicLinkIPTarget(ip string) string {
+	return "magic:" + ipTarget(ip)
+}
+
+// CreateMagicLinkToken creates a token that logs in the user with the given email and returns the user together
+// with the plain token. A *ThrottleError is returned when the client asked for too many links, ErrUserNotFound
+// and ErrMagicLinkCooldown when no token should be sent.
+func (s *Conn) CreateMagicLinkToken(ctx context.Context, email, ip string) (User, string, error) {
+	target := magicLinkIPTarget(ip)
+	err := s.checkThrottle(ctx, target)
+	if err != nil {
+		return User{}, "", err
+	}
+	err = s.recordFailure(ctx, target, magicLinkIPPolicy)
+	if err != nil {
+		return User{}, "", err
+	}
+
+	var u User
+	var token string
+	err = s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("email = ?", email).First(&u).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrUserNotFound
+		}
+		if err != nil {
+			return err
+		}
+		// Concurrent requests for the same email wait here, otherwise they would all count the same tokens and
+		// pass the cooldown together
+		err = lockUser(tx, u.ID, &u)
+		if err != nil {
+			return err
+		}
+
+		// Earlier tokens are used up when a new one is created, so they are counted by when they were created
+		now := time.Now()
+		var sent []time.Time
+		err = tx.Model(&UserToken{}).
+			Where("user_id = ? AND purpose = ? AND created_at > ?", u.ID, PurposeMagicLink, now.Add(-time.Hour)).
+			Order("created_at DESC").Pluck("created_at", &sent).Error
+		if err != nil {
+			return fmt.Errorf("checking recent magic links: %w", err)
+		}
+		err = magicLinkAllowed(sent, now)
+		if err != nil {
+			return err
+		}
+
+		token, err = createUserToken(tx, u.ID, PurposeMagicLink, MagicLinkTTL)
+		return err
+	})
+	if err != nil {
+		return User{}, "", err
+	}
+	return u, token, nil
+}
+
+// magicLinkAllowed returns ErrMagicLinkCooldown when no magic link may be sent at now. sent holds when the links
+// of the last hour were created, newest first.
+func magicLinkAllowed(sent []time.Time, now time.Time) error {
+	if len(sent) >= MagicLinksPerHour || (len(sent) > 0 && now.Sub(sent[0]) < MagicLinkCooldown) {
+		return ErrMagicLinkCooldown
+	}
+	return nil
+}
+
+// ConsumeMagicLink uses up the magic link token and returns the claims of the access token of its user. Tokens
+// are long random strings that can't be guessed, still every unusable token counts as a failed login of the
+// client ip. ErrInvalidUserToken is returned when the token can't be used.
+//
+// The access token carries the email authentication method. Users with a second factor still have to pass it,
+// like after their password.
+func (s *Conn) ConsumeMagicLink(ctx context.Context, token, ip string) (auth.Claims, error) {
+	err := s.checkThrottle(ctx, ipTarget(ip))
+	if err != nil {
+		return auth.Claims{}, err
+	}
+
+	var u User
+	err = s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		ut, err := consumeUserToken(tx, token, PurposeMagicLink)
+		if err != nil {
+			return err
+		}
+
+		err = tx.First(&u, ut.UserId).Error
+		if err != nil {
+			return fmt.Errorf("fetching user: %w", err)
+		}
+		// The link was mailed to the user, so using it proves that the email is theirs
+		if u.EmailVerifiedAt == nil {
+			now := time.Now()
+			err = tx.Model(&u).Update("email_verified_at", now).Error
+			if err != nil {
+				return fmt.Errorf("verifying email: %w", err)
+			}
+		}
+		return nil
+	})
+	if errors.Is(err, ErrInvalidUserToken) {
+		return auth.Claims{}, errors.Join(err, s.recordFailure(ctx, ipTarget(ip), ipPolicy))
+	}
+	if err != nil {
+		return auth.Claims{}, err
+	}
+
+	claims := newClaims(u)
+	claims.AMR = []string{auth.AMREmail}
+	return claims, nil
+}
@@ -0,0 +1,45 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMagicLinkAllowed(t *testing.T) {
+	now := time.Now()
+	// ago returns the creation times of links sent the given durations before now, newest first
+	ago := func(ds ...time.Duration) []time.Time {
+		var sent []time.Time
+		for _, d := range ds {
+			sent = append(sent, now.Add(-d))
+		}
+		return sent
+	}
+
+	tests := []struct {
+		name    string
+		sent    []time.Time
+		allowed bool
+	}{
+		{name: "first link", allowed: true},
+		{name: "within the cooldown", sent: ago(30 * time.Second)},
+		{name: "just before the cooldown ends", sent: ago(MagicLinkCooldown - time.Millisecond)},
+		{name: "cooldown over", sent: ago(MagicLinkCooldown), allowed: true},
+		{name: "below the hourly cap", sent: ago(2*time.Minute, 10*time.Minute, 20*time.Minute, 30*time.Minute),
+			allowed: true},
+		{name: "hourly cap reached", sent: ago(10*time.Minute, 20*time.Minute, 30*time.Minute, 40*time.Minute,
+			50*time.Minute)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := magicLinkAllowed(tt.sent, now)
+			if tt.allowed {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorIs(t, err, ErrMagicLinkCooldown)
+		})
+	}
+}
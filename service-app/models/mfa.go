@@ -0,0 +1,277 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"service-app/auth"
+	"service-app/totp"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// RecoveryCodeCount is how many recovery codes a user gets when they enable TOTP.
+const RecoveryCodeCount = 10
+
+var (
+	// ErrMFAAlreadyEnabled is returned when a user who already uses TOTP starts enrolling again.
+	ErrMFAAlreadyEnabled = errors.New("mfa already enabled")
+	// ErrMFANotEnabled is returned when a user who doesn't use TOTP, or hasn't started enrolling, needs it.
+	ErrMFANotEnabled = errors.New("mfa not enabled")
+	// ErrInvalidMFACode is returned when a TOTP code or recovery code is wrong or was used before.
+	ErrInvalidMFACode = errors.New("invalid mfa code")
+)
+
+// StartTOTPEnrolment creates a new TOTP secret for the user and returns the user together with the secret. It
+// only takes effect once the user confirms it with ConfirmTOTPEnrolment, until then it can be replaced.
+func (s *Conn) StartTOTPEnrolment(ctx context.Context, userId uint) (User, string, error) {
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return User{}, "", err
+	}
+
+	var u User
+	err = s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := lockUser(tx, userId, &u)
+		if err != nil {
+			return err
+		}
+		if u.TOTPEnabledAt != nil {
+			return ErrMFAAlreadyEnabled
+		}
+		return tx.Model(&u).Updates(map[string]any{"totp_secret": secret, "totp_last_step": 0}).Error
+	})
+	if err != nil {
+		return User{}, "", err
+	}
+	return u, secret, nil
+}
+
+// ConfirmTOTPEnrolment enables TOTP for the user once they sent a code of the secret StartTOTPEnrolment created.
+// It returns the plain recovery codes of the user, which is the only time they can be seen.
+func (s *Conn) ConfirmTOTPEnrolment(ctx context.Context, userId uint, code string) ([]string, error) {
+	var codes []string
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var u User
+		err := lockUser(tx, userId, &u)
+		if err != nil {
+			return err
+		}
+		if u.TOTPEnabledAt != nil {
+			return ErrMFAAlreadyEnabled
+		}
+		if u.TOTPSecret == "" {
+			return ErrMFANotEnabled
+		}
+
+		step, err := totp.Validate(u.TOTPSecret, code, time.Now())
+		if errors.Is(err, totp.ErrInvalidCode) {
+			return ErrInvalidMFACode
+		}
+		if err != nil {
+			return err
+		}
+
+		err = tx.Model(&u).Updates(map[string]any{"totp_enabled_at": time.Now(), "totp_last_step": step}).Error
+		if err != nil {
+			return fmt.Errorf("enabling totp: %w", err)
+		}
+
+		codes, err = replaceRecoveryCodes(tx, u.ID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// DisableTOTP turns TOTP off for the user and deletes their recovery codes. It takes a current TOTP code or a
+// recovery code, so that a stolen session alone isn't enough to switch the second factor off. Wrong codes count
+// as failed logins, like at CompleteMFA, so the session can't be used to guess them either.
+func (s *Conn) DisableTOTP(ctx context.Context, userId uint, code, ip string) error {
+	var u User
+	err := s.db.WithContext(ctx).First(&u, userId).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrUserNotFound
+	}
+	if err != nil {
+		return err
+	}
+	err = s.checkThrottle(ctx, accountTarget(u.Email), ipTarget(ip))
+	if err != nil {
+		return err
+	}
+
+	err = s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := lockUser(tx, userId, &u)
+		if err != nil {
+			return err
+		}
+		if u.TOTPEnabledAt == nil {
+			return ErrMFANotEnabled
+		}
+
+		err = verifyMFACode(tx, u, code)
+		if err != nil {
+			return err
+		}
+
+		err = tx.Model(&u).Updates(map[string]any{"totp_secret": "", "totp_enabled_at": nil, "totp_last_step": 0}).Error
+		if err != nil {
+			return fmt.Errorf("disabling totp: %w", err)
+		}
+		return tx.Unscoped().Where("user_id = ?", u.ID).Delete(&RecoveryCode{}).Error
+	})
+	if errors.Is(err, ErrInvalidMFACode) {
+		return errors.Join(err, s.recordLoginFailure(ctx, u.Email, ip))
+	}
+	return err
+}
+
+// TOTPEnabled reports whether the user has to pass a second factor when they log in.
+func (s *Conn) TOTPEnabled(ctx context.Context, userId uint) (bool, error) {
+	var u User
+	err := s.db.WithContext(ctx).First(&u, userId).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, ErrUserNotFound
+	}
+	if err != nil {
+		return false, err
+	}
+	return u.TOTPEnabledAt != nil, nil
+}
+
+// CompleteMFA checks the second factor of a user who already got their password right and returns the claims
+// of their access token. code is either a TOTP code or one of their recovery codes. Wrong codes count as
+// failed logins of the account and the client ip, like wrong passwords do in Authenticate.
+func (s *Conn) CompleteMFA(ctx context.Context, userId uint, code, ip string) (auth.Claims, error) {
+	var u User
+	err := s.db.WithContext(ctx).First(&u, userId).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return auth.Claims{}, ErrUserNotFound
+	}
+	if err != nil {
+		return auth.Claims{}, err
+	}
+	err = s.checkThrottle(ctx, accountTarget(u.Email), ipTarget(ip))
+	if err != nil {
+		return auth.Claims{}, err
+	}
+
+	err = s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := lockUser(tx, userId, &u)
+		if err != nil {
+			return err
+		}
+		if u.TOTPEnabledAt == nil {
+			return ErrMFANotEnabled
+		}
+		return verifyMFACode(tx, u, code)
+	})
+	if errors.Is(err, ErrInvalidMFACode) {
+		return auth.Claims{}, errors.Join(err, s.recordLoginFailure(ctx, u.Email, ip))
+	}
+	if err != nil {
+		return auth.Claims{}, err
+	}
+
+	err = s.resetAccountThrottle(ctx, u.Email)
+	if err != nil {
+		return auth.Claims{}, err
+	}
+
+	claims := newClaims(u)
+	claims.AMR = []string{auth.AMRPassword, auth.AMROTP, auth.AMRMFA}
+	return claims, nil
+}
+
+// lockUser fetches the user and locks their row until the transaction ends.
+func lockUser(tx *gorm.DB, userId uint, u *User) error {
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(u, userId).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrUserNotFound
+	}
+	return err
+}
+
+// verifyMFACode checks a TOTP code or a recovery code of the user and uses it up.
+func verifyMFACode(tx *gorm.DB, u User, code string) error {
+	code = strings.TrimSpace(code)
+	if len(code) != totp.Digits {
+		return useRecoveryCode(tx, u.ID, code)
+	}
+
+	step, err := totp.Validate(u.TOTPSecret, code, time.Now())
+	if errors.Is(err, totp.ErrInvalidCode) {
+		return ErrInvalidMFACode
+	}
+	if err != nil {
+		return err
+	}
+
+	// A code can only be used once, so steps have to keep moving forward
+	res := tx.Model(&User{}).Where("id = ? AND totp_last_step < ?", u.ID, step).Update("totp_last_step", step)
+	if res.Error != nil {
+		return fmt.Errorf("recording totp step: %w", res.Error)
+	}
+	if res.RowsAffected == 0 {
+		return ErrInvalidMFACode
+	}
+	return nil
+}
+
+// useRecoveryCode marks one of the user's recovery codes as used.
+func useRecoveryCode(tx *gorm.DB, userId uint, code string) error {
+	res := tx.Model(&RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userId, hashToken(normalizeRecoveryCode(code))).
+		Update("used_at", time.Now())
+	if res.Error != nil {
+		return fmt.Errorf("using recovery code: %w", res.Error)
+	}
+	if res.RowsAffected == 0 {
+		return ErrInvalidMFACode
+	}
+	return nil
+}
+
+// replaceRecoveryCodes deletes the recovery codes of the user and creates RecoveryCodeCount new ones.
+// Codes look like abcd-efgh-ijkl-mnop, 80 random bits each.
+func replaceRecoveryCodes(tx *gorm.DB, userId uint) ([]string, error) {
+	err := tx.Unscoped().Where("user_id = ?", userId).Delete(&RecoveryCode{}).Error
+	if err != nil {
+		return nil, fmt.Errorf("deleting recovery codes: %w", err)
+	}
+
+	codes := make([]string, 0, RecoveryCodeCount)
+	rows := make([]RecoveryCode, 0, RecoveryCodeCount)
+	for i := 0; i < RecoveryCodeCount; i++ {
+		b := make([]byte, 10)
+		_, err := rand.Read(b)
+		if err != nil {
+			return nil, fmt.Errorf("generating recovery code: %w", err)
+		}
+		raw := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+		code := raw[0:4] + "-" + raw[4:8] + "-" + raw[8:12] + "-" + raw[12:16]
+
+		codes = append(codes, code)
+		rows = append(rows, RecoveryCode{UserId: userId, CodeHash: hashToken(normalizeRecoveryCode(code))})
+	}
+
+	err = tx.Create(&rows).Error
+	if err != nil {
+		return nil, fmt.Errorf("storing recovery codes: %w", err)
+	}
+	return codes, nil
+}
+
+// normalizeRecoveryCode strips what users tend to type differently: case, dashes and spaces.
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
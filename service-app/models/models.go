@@ -1,14 +1,24 @@
 package models
 
 import (
+	"time"
+
 	"gorm.io/gorm"
 )
 
+// User is an account of service-app. TOTPSecret is set as soon as the user starts enrolling an authenticator
+// app, TOTPEnabledAt once they confirmed it with a first code. TOTPLastStep is the time step of the last code
+// that was used, codes of that step or earlier ones are refused so that none can be used twice.
 type User struct {
 	gorm.Model
-	Name         string `json:"name"`
-	Email        string `json:"email"`
-	PasswordHash string `json:"-"`
+	Name            string     `json:"name"`
+	Email           string     `json:"email"`
+	EmailVerifiedAt *time.Time `json:"email_verified_at"`
+	PasswordHash    string     `json:"-"`
+	Roles           []string   `json:"roles" gorm:"serializer:json"`
+	TOTPSecret      string     `json:"-"`
+	TOTPEnabledAt   *time.Time `json:"totp_enabled_at"`
+	TOTPLastStep    int64      `json:"-"`
 }
 
 type NewUser struct {
@@ -33,3 +43,196 @@ type NewInventory struct {
 	CostPerItem float64 `json:"cost_per_item" validate:"required,number,gt=0"`
 	Category    string  `json:"category" validate:"required"`
 }
+
+// RefreshToken is a long-lived, opaque token handed out together with the access token.
+// Only the SHA-256 hash of the token is stored. Every login starts a new family and every
+// rotation revokes the presented token and adds its successor to the same family. Scope is the scope
+// the family was granted at login, refreshed access tokens never get more than that. AMR are the
+// authentication methods used at login, refreshed access tokens carry them as well.
+type RefreshToken struct {
+	gorm.Model
+	UserId    uint       `json:"user_id"`
+	FamilyId  string     `json:"family_id" gorm:"index"`
+	TokenHash string     `json:"-" gorm:"uniqueIndex"`
+	Scope     string     `json:"scope"`
+	AMR       []string   `json:"amr" gorm:"serializer:json"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	RevokedAt *time.Time `json:"revoked_at"`
+}
+
+// Session is a login of a user, e.g. on one of their devices. Its SessionId is the sid claim of every access token
+// issued for it and the family id of its refresh tokens, so that revoking the session ends both. Jti is the id of
+// the access token issued last, ExpiresAt moves along with the refresh token issued last.
+type Session struct {
+	gorm.Model
+	SessionId  string     `json:"session_id" gorm:"uniqueIndex"`
+	UserId     uint       `json:"user_id" gorm:"index"`
+	UserAgent  string     `json:"user_agent"`
+	IP         string     `json:"ip"`
+	Jti        string     `json:"-"`
+	LastSeenAt time.Time  `json:"last_seen_at"`
+	LastSeenIP string     `json:"last_seen_ip"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+}
+
+// FederatedIdentity links a user to their account at an external identity provider. Subject is the id of the
+// account there, which stays the same when the email changes. A user can be linked to several accounts.
+type FederatedIdentity struct {
+	gorm.Model
+	UserId      uint      `json:"user_id" gorm:"index"`
+	Issuer      string    `json:"issuer" gorm:"uniqueIndex:idx_federated_subject"`
+	Subject     string    `json:"subject" gorm:"uniqueIndex:idx_federated_subject"`
+	Email       string    `json:"email"`
+	LastLoginAt time.Time `json:"last_login_at"`
+}
+
+// WebAuthnCredential is a passkey of a user. CredentialId is the unpadded base64url encoded id the authenticator
+// gave it, PublicKey the PKIX DER encoding of its public key. SignCount is the last signature counter the
+// authenticator reported, a counter that goes backwards gives a cloned authenticator away.
+type WebAuthnCredential struct {
+	gorm.Model
+	UserId       uint       `json:"user_id" gorm:"index"`
+	CredentialId string     `json:"credential_id" gorm:"uniqueIndex"`
+	PublicKey    []byte     `json:"-"`
+	Algorithm    int64      `json:"algorithm"`
+	SignCount    uint32     `json:"-"`
+	Transports   []string   `json:"transports" gorm:"serializer:json"`
+	Label        string     `json:"label"`
+	LastUsedAt   *time.Time `json:"last_used_at"`
+}
+
+// Impersonation is the audit record of an admin acting as another user, with the token they were given for it.
+// Records are never deleted, AutoMigrate leaves the table alone. The emails of both are kept next to their ids,
+// so that the record still says who it was about if the users are gone.
+type Impersonation struct {
+	gorm.Model
+	ActorId    uint       `json:"actor_id" gorm:"index"`
+	ActorEmail string     `json:"actor_email"`
+	UserId     uint       `json:"user_id" gorm:"index"`
+	UserEmail  string     `json:"user_email"`
+	Reason     string     `json:"reason"`
+	Scope      string     `json:"scope"`
+	Jti        string     `json:"jti" gorm:"uniqueIndex"`
+	IP         string     `json:"ip"`
+	UserAgent  string     `json:"user_agent"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	EndedAt    *time.Time `json:"ended_at"`
+}
+
+// NewImpersonation contains what an admin has to tell before impersonating a user.
+type NewImpersonation struct {
+	Reason string `json:"reason" validate:"required,max=500"`
+}
+
+// RevokedToken is an entry of the access token denylist. Entries are kept until the token
+// they refer to expires on its own; after that they are pruned.
+type RevokedToken struct {
+	gorm.Model
+	Jti       string    `json:"jti" gorm:"uniqueIndex"`
+	ExpiresAt time.Time `json:"expires_at" gorm:"index"`
+}
+
+// RevokedSubject invalidates every access token of a subject that was issued up to RevokedBefore, for
+// example after the user reset their password. It is kept until the last of those tokens has expired.
+type RevokedSubject struct {
+	gorm.Model
+	Subject       string    `json:"subject" gorm:"uniqueIndex"`
+	RevokedBefore time.Time `json:"revoked_before"`
+	ExpiresAt     time.Time `json:"expires_at" gorm:"index"`
+}
+
+// UserToken is a single-use token that is mailed to a user, like a password reset token. Purpose tells
+// the kinds of tokens apart, a token can't be used for anything else. Only the SHA-256 hash is stored.
+type UserToken struct {
+	gorm.Model
+	UserId    uint       `json:"user_id" gorm:"index"`
+	Purpose   string     `json:"purpose"`
+	TokenHash string     `json:"-" gorm:"uniqueIndex"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at"`
+}
+
+// RecoveryCode is a one-time code that stands in for a TOTP code when the user lost their authenticator app.
+// Only the SHA-256 hash is stored.
+type RecoveryCode struct {
+	gorm.Model
+	UserId   uint       `json:"user_id" gorm:"index"`
+	CodeHash string     `json:"-" gorm:"uniqueIndex"`
+	UsedAt   *time.Time `json:"used_at"`
+}
+
+// LoginThrottle counts the failed logins of a target, which is either an email or a client IP. While LockedUntil
+// is in the future, logins for the target are refused without checking the password.
+type LoginThrottle struct {
+	gorm.Model
+	Target        string     `json:"target" gorm:"uniqueIndex"`
+	Failures      int        `json:"failures"`
+	LastFailureAt *time.Time `json:"last_failure_at"`
+	LockedUntil   *time.Time `json:"locked_until" gorm:"index"`
+}
+
+// APIKey is a personal key a user creates for scripts and other machine clients. Only the SHA-256 hash
+// of the key is stored, Prefix is the start of the key so that users can tell their keys apart.
+type APIKey struct {
+	gorm.Model
+	UserId     uint       `json:"user_id" gorm:"index"`
+	Label      string     `json:"label"`
+	Prefix     string     `json:"prefix"`
+	KeyHash    string     `json:"-" gorm:"uniqueIndex"`
+	Scope      string     `json:"scope"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	LastUsedIP string     `json:"last_used_ip"`
+}
+
+// NewAPIKey contains information needed to create an APIKey. Scope defaults to the scope of the token
+// the key is created with, ExpiresAt is optional.
+type NewAPIKey struct {
+	Label     string     `json:"label" validate:"required,max=100"`
+	Scope     string     `json:"scope"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// OAuthClient is a backend service that calls service-app on its own behalf. It authenticates with its
+// ClientId and a secret, of which only the SHA-256 hash is stored. Scope lists what its tokens may be used for.
+//
+// Apps that log their users in with service-app register the RedirectURIs the authorization endpoint may send
+// users back to. Users of FirstParty clients, our own apps, aren't asked for their consent.
+type OAuthClient struct {
+	gorm.Model
+	ClientId     string   `json:"client_id" gorm:"uniqueIndex"`
+	SecretHash   string   `json:"-"`
+	Name         string   `json:"name"`
+	Scope        string   `json:"scope"`
+	RedirectURIs []string `json:"redirect_uris" gorm:"serializer:json"`
+	FirstParty   bool     `json:"first_party"`
+}
+
+// NewOAuthClient contains information needed to register an OAuthClient. RedirectURIs are only needed for the
+// authorization code flow.
+type NewOAuthClient struct {
+	Name         string   `json:"name" validate:"required,max=100"`
+	Scope        string   `json:"scope" validate:"required"`
+	RedirectURIs []string `json:"redirect_uris" validate:"max=10,dive,url,max=2000"`
+	FirstParty   bool     `json:"first_party"`
+}
+
+// AuthorizationCode is handed to a client through the redirect at the end of the authorization code flow, and
+// exchanged for tokens once. Only the SHA-256 hash is stored. The code is bound to the client, the redirect URI and
+// the PKCE code challenge it was issued for. Nonce and AuthTime end up in the ID token, AMR in both tokens.
+type AuthorizationCode struct {
+	gorm.Model
+	CodeHash      string     `json:"-" gorm:"uniqueIndex"`
+	ClientId      string     `json:"client_id"`
+	UserId        uint       `json:"user_id"`
+	RedirectURI   string     `json:"redirect_uri"`
+	Scope         string     `json:"scope"`
+	Nonce         string     `json:"-"`
+	CodeChallenge string     `json:"-"`
+	AMR           []string   `json:"amr" gorm:"serializer:json"`
+	AuthTime      time.Time  `json:"auth_time"`
+	ExpiresAt     time.Time  `json:"expires_at"`
+	UsedAt        *time.Time `json:"used_at"`
+}
@@ -0,0 +1,87 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+)
+
+// ErrIncorrectPassword is returned when a password doesn't match the one of the user.
+var ErrIncorrectPassword = errors.New("incorrect password")
+
+// ChangePassword replaces the password of the user after checking their current one. Wrong current passwords
+// count as failed logins, so a stolen session can't be used to guess the password. Every refresh token of the
+// user is revoked, the caller has to take care of access tokens that are still valid.
+func (s *Conn) ChangePassword(ctx context.Context, userId uint, current, password, ip string) (User, error) {
+	var u User
+	err := s.db.WithContext(ctx).First(&u, userId).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return User{}, ErrUserNotFound
+	}
+	if err != nil {
+		return User{}, err
+	}
+
+	err = s.checkThrottle(ctx, accountTarget(u.Email), ipTarget(ip))
+	if err != nil {
+		return User{}, err
+	}
+	err = s.checkPassword(ctx, u, current)
+	if errors.Is(err, ErrIncorrectPassword) {
+		return User{}, errors.Join(err, s.recordLoginFailure(ctx, u.Email, ip))
+	}
+	if err != nil {
+		return User{}, err
+	}
+
+	err = s.cfg.PasswordPolicy.Check(password)
+	if err != nil {
+		return User{}, err
+	}
+	hashedPass, err := s.cfg.PasswordHasher.Hash(password)
+	if err != nil {
+		return User{}, fmt.Errorf("generating password hash: %w", err)
+	}
+
+	err = s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&u).Update("password_hash", hashedPass).Error
+		if err != nil {
+			return fmt.Errorf("storing password: %w", err)
+		}
+		return revokeUserSessions(tx, u.ID)
+	})
+	if err != nil {
+		return User{}, err
+	}
+	return u, nil
+}
+
+// checkPassword returns ErrIncorrectPassword unless the password matches the stored hash of the user. If the hash
+// was made with another algorithm or other parameters than the configured hasher uses, it is replaced by a new
+// one while the plain password is at hand. Failing to do so doesn't fail the check, it is tried again next time.
+func (s *Conn) checkPassword(ctx context.Context, u User, password string) error {
+	match, rehash, err := s.cfg.PasswordHasher.Verify(password, u.PasswordHash)
+	if err != nil {
+		return fmt.Errorf("checking password: %w", err)
+	}
+	if !match {
+		return ErrIncorrectPassword
+	}
+	if !rehash {
+		return nil
+	}
+
+	hashedPass, err := s.cfg.PasswordHasher.Hash(password)
+	if err == nil {
+		// Only replace the hash that was checked, the password may have been changed in the meantime
+		err = s.db.WithContext(ctx).Model(&User{}).Where("id = ? AND password_hash = ?", u.ID, u.PasswordHash).
+			Update("password_hash", hashedPass).Error
+	}
+	if err != nil {
+		log.Warn().Err(err).Uint("user", u.ID).Msg("rehashing password")
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// PurposePasswordReset is the purpose of the user tokens mailed to reset a password.
+const PurposePasswordReset = "password_reset"
+
+// PasswordResetTTL is how long a password reset token can be used.
+const PasswordResetTTL = time.Hour
+
+// CreatePasswordResetToken creates a password reset token for the user with the given email and returns the
+// user together with the plain token. ErrUserNotFound is returned when there is no such user.
+func (s *Conn) CreatePasswordResetToken(ctx context.Context, email string) (User, string, error) {
+	var u User
+	err := s.db.WithContext(ctx).Where("email = ?", email).First(&u).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return User{}, "", ErrUserNotFound
+	}
+	if err != nil {
+		return User{}, "", err
+	}
+
+	var token string
+	err = s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		token, err = createUserToken(tx, u.ID, PurposePasswordReset, PasswordResetTTL)
+		return err
+	})
+	if err != nil {
+		return User{}, "", err
+	}
+	return u, token, nil
+}
+
+// ResetPassword sets a new password for the user the reset token was created for and uses up the token.
+// Every refresh token of the user is revoked, the caller has to take care of access tokens that are still valid.
+// ErrInvalidUserToken is returned when the token can't be used. A password that doesn't satisfy the policy
+// doesn't use up the token, the user can try again with a better one.
+func (s *Conn) ResetPassword(ctx context.Context, token, password string) (User, error) {
+	err := s.cfg.PasswordPolicy.Check(password)
+	if err != nil {
+		return User{}, err
+	}
+
+	hashedPass, err := s.cfg.PasswordHasher.Hash(password)
+	if err != nil {
+		return User{}, fmt.Errorf("generating password hash: %w", err)
+	}
+
+	var u User
+	err = s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		ut, err := consumeUserToken(tx, token, PurposePasswordReset)
+		if err != nil {
+			return err
+		}
+
+		err = tx.First(&u, ut.UserId).Error
+		if err != nil {
+			return fmt.Errorf("fetching user: %w", err)
+		}
+		updates := map[string]any{"password_hash": hashedPass}
+		// The token was mailed to the user, so using it proves that the email is theirs
+		if u.EmailVerifiedAt == nil {
+			updates["email_verified_at"] = time.Now()
+		}
+		err = tx.Model(&u).Updates(updates).Error
+		if err != nil {
+			return fmt.Errorf("storing password: %w", err)
+		}
+
+		return revokeUserSessions(tx, u.ID)
+	})
+	if err != nil {
+		return User{}, err
+	}
+	return u, nil
+}
@@ -0,0 +1,185 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"service-app/auth"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// RefreshTokenTTL is how long a refresh token can be used before the user has to log in again.
+const RefreshTokenTTL = 30 * 24 * time.Hour
+
+var (
+	// ErrInvalidRefreshToken is returned when a refresh token is unknown or expired.
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	// ErrRefreshTokenReused is returned, wrapped in a *ReusedRefreshTokenError, when an already rotated refresh
+	// token is presented again. The whole token family and its session are revoked when this happens.
+	ErrRefreshTokenReused = errors.New("refresh token reused")
+)
+
+// ReusedRefreshTokenError tells which session was ended because one of its refresh tokens was replayed, so that
+// the access tokens that are still out there for it can be refused as well.
+type ReusedRefreshTokenError struct {
+	SessionID string
+}
+
+// Error implements the error interface.
+func (e *ReusedRefreshTokenError) Error() string {
+	return fmt.Sprintf("%s, session %s revoked", ErrRefreshTokenReused, e.SessionID)
+}
+
+// Unwrap makes errors.Is(err, ErrRefreshTokenReused) work.
+func (e *ReusedRefreshTokenError) Unwrap() error {
+	return ErrRefreshTokenReused
+}
+
+// generateToken creates a random opaque token and the SHA-256 hash that is stored in its place.
+func generateToken() (string, string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", "", fmt.Errorf("generating random token: %w", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	return token, hashToken(token), nil
+}
+
+// hashToken returns the hex encoded SHA-256 hash of an opaque token.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// addRefreshToken stores a new refresh token in the given family and returns the plain token.
+// The access tokens it is exchanged for carry no more than scope, and the authentication methods in amr
+// the user logged in with. Families are started by CreateSession.
+func (s *Conn) addRefreshToken(tx *gorm.DB, userId uint, familyId, scope string, amr []string) (string, error) {
+	token, hash, err := generateToken()
+	if err != nil {
+		return "", err
+	}
+
+	rt := RefreshToken{
+		UserId:    userId,
+		FamilyId:  familyId,
+		TokenHash: hash,
+		Scope:     scope,
+		AMR:       amr,
+		ExpiresAt: time.Now().Add(RefreshTokenTTL),
+	}
+	err = tx.Create(&rt).Error
+	if err != nil {
+		return "", fmt.Errorf("storing refresh token: %w", err)
+	}
+	return token, nil
+}
+
+// RotateRefreshToken exchanges a refresh token for the claims of a new access token and a new refresh token.
+// The presented token is revoked. If it was already revoked, somebody is replaying an old token,
+// so every token in its family and the session of the family are revoked and a *ReusedRefreshTokenError is returned.
+func (s *Conn) RotateRefreshToken(ctx context.Context, token string) (auth.Claims, string, error) {
+	var claims auth.Claims
+	var next string
+	var reused bool
+
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var rt RefreshToken
+		err := tx.Where("token_hash = ?", hashToken(token)).First(&rt).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrInvalidRefreshToken
+		}
+		if err != nil {
+			return err
+		}
+
+		// Only one caller can flip revoked_at from NULL, so two concurrent rotations of the same token
+		// can't both succeed.
+		now := time.Now()
+		res := tx.Model(&RefreshToken{}).Where("id = ? AND revoked_at IS NULL", rt.ID).
+			Update("revoked_at", now)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			reused = true
+			return ErrRefreshTokenReused
+		}
+
+		if now.After(rt.ExpiresAt) {
+			return ErrInvalidRefreshToken
+		}
+
+		var u User
+		err = tx.First(&u, rt.UserId).Error
+		if err != nil {
+			return fmt.Errorf("fetching user of refresh token: %w", err)
+		}
+
+		// The roles of the user may have changed since login, so the scope is what the family was
+		// granted and the roles still allow
+		claims = newClaims(u)
+		claims.Scope = auth.IntersectScopes(claims.Scope, rt.Scope)
+		claims.AMR = rt.AMR
+
+		next, err = s.addRefreshToken(tx, u.ID, rt.FamilyId, claims.Scope, rt.AMR)
+		if err != nil {
+			return err
+		}
+
+		// The family belongs to a session, which now lasts as long as the new refresh token
+		claims.SessionID = rt.FamilyId
+		err = tx.Model(&Session{}).Where("session_id = ?", rt.FamilyId).
+			Updates(map[string]any{"jti": claims.ID, "last_seen_at": now, "expires_at": now.Add(RefreshTokenTTL)}).Error
+		if err != nil {
+			return fmt.Errorf("updating session: %w", err)
+		}
+		return nil
+	})
+
+	// The family is revoked outside the transaction above, which has been rolled back at this point.
+	if reused {
+		var rt RefreshToken
+		findErr := s.db.WithContext(ctx).Where("token_hash = ?", hashToken(token)).First(&rt).Error
+		if findErr == nil {
+			revokeErr := s.RevokeRefreshTokenFamily(ctx, rt.FamilyId)
+			if revokeErr != nil {
+				return auth.Claims{}, "", errors.Join(err, revokeErr)
+			}
+			err = &ReusedRefreshTokenError{SessionID: rt.FamilyId}
+		}
+	}
+	if err != nil {
+		return auth.Claims{}, "", err
+	}
+	return claims, next, nil
+}
+
+// RevokeRefreshTokenFamily revokes every token that belongs to the family, and ends the session the family
+// belongs to, so that it disappears from the sessions of the user and its access tokens are refused.
+func (s *Conn) RevokeRefreshTokenFamily(ctx context.Context, familyId string) error {
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		return revokeSession(tx, familyId)
+	})
+}
+
+// RevokeRefreshToken revokes the family of the given refresh token, e.g. when the user logs out.
+// Unknown tokens are ignored.
+func (s *Conn) RevokeRefreshToken(ctx context.Context, token string) error {
+	var rt RefreshToken
+	err := s.db.WithContext(ctx).Where("token_hash = ?", hashToken(token)).First(&rt).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return s.RevokeRefreshTokenFamily(ctx, rt.FamilyId)
+}
@@ -0,0 +1,75 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm/clause"
+)
+
+// RevokeToken adds the jti of an access token to the denylist until the token expires.
+// Revoking the same jti twice is not an error.
+func (s *Conn) RevokeToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	rt := RevokedToken{Jti: jti, ExpiresAt: expiresAt}
+	err := s.db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(&rt).Error
+	if err != nil {
+		return fmt.Errorf("revoking token: %w", err)
+	}
+	return nil
+}
+
+// IsTokenRevoked reports whether the jti is on the denylist.
+func (s *Conn) IsTokenRevoked(ctx context.Context, jti string) (bool, error) {
+	var count int64
+	err := s.db.WithContext(ctx).Model(&RevokedToken{}).Where("jti = ?", jti).Count(&count).Error
+	if err != nil {
+		return false, fmt.Errorf("checking revoked token: %w", err)
+	}
+	return count > 0, nil
+}
+
+// RevokeSubject invalidates every access token of subject issued up to revokedBefore. The entry is kept until
+// expiresAt, when the last of those tokens has expired. A later call moves the cutoff forward.
+func (s *Conn) RevokeSubject(ctx context.Context, subject string, revokedBefore, expiresAt time.Time) error {
+	rs := RevokedSubject{Subject: subject, RevokedBefore: revokedBefore, ExpiresAt: expiresAt}
+	err := s.db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "subject"}},
+		DoUpdates: clause.AssignmentColumns([]string{"revoked_before", "expires_at", "updated_at"}),
+	}).Create(&rs).Error
+	if err != nil {
+		return fmt.Errorf("revoking subject: %w", err)
+	}
+	return nil
+}
+
+// SubjectRevokedBefore returns the time up to which the access tokens of subject are revoked. It is the
+// zero time when they aren't.
+func (s *Conn) SubjectRevokedBefore(ctx context.Context, subject string) (time.Time, error) {
+	var rs []RevokedSubject
+	err := s.db.WithContext(ctx).Where("subject = ? AND expires_at > ?", subject, time.Now()).Limit(1).Find(&rs).Error
+	if err != nil {
+		return time.Time{}, fmt.Errorf("checking revoked subject: %w", err)
+	}
+	if len(rs) == 0 {
+		return time.Time{}, nil
+	}
+	return rs[0].RevokedBefore, nil
+}
+
+// PruneRevokedTokens deletes the denylist entries of tokens and subjects that have expired anyway
+// and returns how many entries were removed.
+func (s *Conn) PruneRevokedTokens(ctx context.Context) (int64, error) {
+	now := time.Now()
+	tx := s.db.WithContext(ctx).Unscoped().Where("expires_at < ?", now).Delete(&RevokedToken{})
+	if tx.Error != nil {
+		return 0, fmt.Errorf("pruning revoked tokens: %w", tx.Error)
+	}
+	pruned := tx.RowsAffected
+
+	tx = s.db.WithContext(ctx).Unscoped().Where("expires_at < ?", now).Delete(&RevokedSubject{})
+	if tx.Error != nil {
+		return pruned, fmt.Errorf("pruning revoked subjects: %w", tx.Error)
+	}
+	return pruned + tx.RowsAffected, nil
+}
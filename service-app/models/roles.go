@@ -0,0 +1,121 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"service-app/auth"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	// ErrUserNotFound is returned when no user has the given id or email.
+	ErrUserNotFound = errors.New("user not found")
+	// ErrUnknownRole is returned when a role that doesn't exist is granted or revoked.
+	ErrUnknownRole = errors.New("unknown role")
+	// ErrAdminNotVerified is returned by SeedAdmin when the user with the admin email may not be the operator.
+	ErrAdminNotVerified = errors.New("admin email not verified")
+)
+
+// GrantRole adds the role to the user. Granting a role the user already has is not an error.
+// The user's tokens carry the old roles until they are refreshed.
+func (s *Conn) GrantRole(ctx context.Context, userId uint, role string) (User, error) {
+	return s.updateRoles(ctx, userId, role, func(roles []string) []string {
+		for _, r := range roles {
+			if r == role {
+				return roles
+			}
+		}
+		return append(roles, role)
+	})
+}
+
+// RevokeRole removes the role from the user.
+func (s *Conn) RevokeRole(ctx context.Context, userId uint, role string) (User, error) {
+	return s.updateRoles(ctx, userId, role, func(roles []string) []string {
+		kept := make([]string, 0, len(roles))
+		for _, r := range roles {
+			if r != role {
+				kept = append(kept, r)
+			}
+		}
+		return kept
+	})
+}
+
+// updateRoles replaces the roles of the user with the result of change, inside a transaction
+// that locks the user row so that concurrent updates don't overwrite each other.
+func (s *Conn) updateRoles(ctx context.Context, userId uint, role string, change func([]string) []string) (User, error) {
+	if !auth.ValidRole(role) {
+		return User{}, fmt.Errorf("%w: %q", ErrUnknownRole, role)
+	}
+
+	var u User
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&u, userId).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrUserNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		u.Roles = change(u.Roles)
+		return tx.Model(&u).Select("Roles").Updates(&u).Error
+	})
+	if err != nil {
+		return User{}, err
+	}
+	return u, nil
+}
+
+// SeedAdmin makes sure the user with the email of nu is an admin. The user is created with the name and password
+// of nu if there is none yet, its email counts as verified as the operator chose it. An existing user keeps their
+// password and only gets the admin role. Nobody becomes an admin just by signing up first, this is how the first
+// admin is made.
+//
+// Anybody can sign up with the admin email before the operator gets to it, so an existing user is only made an
+// admin when they verified the email or when the password of nu is theirs. Otherwise ErrAdminNotVerified is returned.
+func (s *Conn) SeedAdmin(ctx context.Context, nu NewUser) (User, error) {
+	var u User
+	err := s.db.WithContext(ctx).Where("email = ?", nu.Email).First(&u).Error
+	if err == nil {
+		if u.EmailVerifiedAt == nil {
+			// Users without a password, like federated ones, can't match, that is not an error here
+			match, _, _ := s.cfg.PasswordHasher.Verify(nu.Password, u.PasswordHash)
+			if !match {
+				return User{}, fmt.Errorf("%w: user %d has to verify their email first, or the admin password has to be theirs",
+					ErrAdminNotVerified, u.ID)
+			}
+		}
+		return s.GrantRole(ctx, u.ID, auth.RoleAdmin)
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return User{}, fmt.Errorf("looking up admin: %w", err)
+	}
+
+	err = s.cfg.PasswordPolicy.Check(nu.Password)
+	if err != nil {
+		return User{}, err
+	}
+	hashedPass, err := s.cfg.PasswordHasher.Hash(nu.Password)
+	if err != nil {
+		return User{}, fmt.Errorf("generating password hash: %w", err)
+	}
+	now := time.Now()
+	u = User{
+		Name:            nu.Name,
+		Email:           nu.Email,
+		EmailVerifiedAt: &now,
+		PasswordHash:    hashedPass,
+		Roles:           []string{auth.RoleAdmin},
+	}
+	err = s.db.WithContext(ctx).Create(&u).Error
+	if err != nil {
+		return User{}, fmt.Errorf("creating admin: %w", err)
+	}
+	return u, nil
+}
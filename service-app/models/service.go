@@ -2,7 +2,10 @@ package models
 
 import (
 	"context"
-	"github.com/golang-jwt/jwt/v5"
+	"service-app/auth"
+	"service-app/sso"
+	"service-app/webauthn"
+	"time"
 )
 //go:generate mockgen -source service.go -destination mockmodels/service_mock.go -package mockmodels
 
@@ -10,7 +13,58 @@ type Service interface {
 	CreatInventory(ctx context.Context, ni NewInventory, userId uint) (Inventory, error)
 	ViewInventory(ctx context.Context, userId string) ([]Inventory, float64, error)
 	CreateUser(ctx context.Context, nu NewUser) (User, error)
-	Authenticate(ctx context.Context, email, password string) (jwt.RegisteredClaims, error)
+	Authenticate(ctx context.Context, email, password, ip string) (auth.Claims, error)
+	AuthenticateFederated(ctx context.Context, id sso.Identity) (auth.Claims, error)
+	StartWebAuthnRegistration(ctx context.Context, userId uint) (webauthn.User, []webauthn.Credential, error)
+	CreateWebAuthnCredential(ctx context.Context, cred webauthn.Credential, label string) (WebAuthnCredential, error)
+	ListWebAuthnCredentials(ctx context.Context, userId uint) ([]WebAuthnCredential, error)
+	DeleteWebAuthnCredential(ctx context.Context, userId, id uint) error
+	FindWebAuthnCredential(ctx context.Context, credentialId string) (webauthn.Credential, error)
+	CompleteWebAuthnLogin(ctx context.Context, credentialId string, signCount uint32) (auth.Claims, error)
+	ConsumeWebAuthnChallenge(ctx context.Context, challengeId string, expiresAt time.Time) error
+	RotateRefreshToken(ctx context.Context, token string) (auth.Claims, string, error)
+	RevokeRefreshToken(ctx context.Context, token string) error
+	CreateSession(ctx context.Context, userId uint, claims auth.Claims, userAgent, ip string) (auth.Claims, string, error)
+	ListSessions(ctx context.Context, userId uint) ([]Session, error)
+	RevokeSession(ctx context.Context, userId uint, sessionId string) (Session, error)
+	RevokeSessions(ctx context.Context, userId uint) ([]Session, error)
+	TouchSession(ctx context.Context, sessionId, ip string) (bool, error)
+	RevokeToken(ctx context.Context, jti string, expiresAt time.Time) error
+	IsTokenRevoked(ctx context.Context, jti string) (bool, error)
+	RevokeSubject(ctx context.Context, subject string, revokedBefore, expiresAt time.Time) error
+	SubjectRevokedBefore(ctx context.Context, subject string) (time.Time, error)
+	PruneRevokedTokens(ctx context.Context) (int64, error)
+	GrantRole(ctx context.Context, userId uint, role string) (User, error)
+	RevokeRole(ctx context.Context, userId uint, role string) (User, error)
+	CreateAPIKey(ctx context.Context, userId uint, nk NewAPIKey) (APIKey, string, error)
+	ListAPIKeys(ctx context.Context, userId uint) ([]APIKey, error)
+	RelabelAPIKey(ctx context.Context, userId, keyId uint, label string) (APIKey, error)
+	RevokeAPIKey(ctx context.Context, userId, keyId uint) error
+	AuthenticateAPIKey(ctx context.Context, key, ip string) (auth.Claims, error)
+	CreateOAuthClient(ctx context.Context, nc NewOAuthClient) (OAuthClient, string, error)
+	AuthenticateClient(ctx context.Context, clientId, secret string) (auth.Claims, error)
+	FindOAuthClient(ctx context.Context, clientId string) (OAuthClient, error)
+	CreateAuthorizationCode(ctx context.Context, claims auth.Claims, ar AuthorizationRequest) (string, error)
+	ExchangeAuthorizationCode(ctx context.Context, clientId, code, redirectURI, verifier string) (auth.Claims,
+		auth.IDClaims, error)
+	UserInfo(ctx context.Context, claims auth.Claims) (auth.UserInfo, error)
+	CreatePasswordResetToken(ctx context.Context, email string) (User, string, error)
+	ResetPassword(ctx context.Context, token, password string) (User, error)
+	ChangePassword(ctx context.Context, userId uint, current, password, ip string) (User, error)
+	CreateEmailVerificationToken(ctx context.Context, email string) (User, string, error)
+	VerifyEmail(ctx context.Context, token string) (User, error)
+	CreateMagicLinkToken(ctx context.Context, email, ip string) (User, string, error)
+	ConsumeMagicLink(ctx context.Context, token, ip string) (auth.Claims, error)
+	StartTOTPEnrolment(ctx context.Context, userId uint) (User, string, error)
+	ConfirmTOTPEnrolment(ctx context.Context, userId uint, code string) ([]string, error)
+	DisableTOTP(ctx context.Context, userId uint, code, ip string) error
+	TOTPEnabled(ctx context.Context, userId uint) (bool, error)
+	CompleteMFA(ctx context.Context, userId uint, code, ip string) (auth.Claims, error)
+	UnlockUser(ctx context.Context, userId uint) error
+	Impersonate(ctx context.Context, actorId, userId uint, ni NewImpersonation, ip, userAgent string) (auth.Claims,
+		Impersonation, error)
+	EndImpersonation(ctx context.Context, id uint) (Impersonation, error)
+	ListImpersonations(ctx context.Context, userId uint) ([]Impersonation, error)
 	AutoMigrate() error
 }
 
@@ -4,28 +4,56 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"service-app/auth"
+	"service-app/passwords"
 	"strconv"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/google/uuid"
 	"gorm.io/gorm"
 )
 
+// Config holds the settings of the Conn layer.
+type Config struct {
+	// RequireVerifiedEmail makes Authenticate refuse users who haven't verified their email yet.
+	RequireVerifiedEmail bool
+	// PasswordPolicy is checked whenever a user sets a password. The zero Policy accepts any password bcrypt can hash.
+	PasswordPolicy passwords.Policy
+	// PasswordHasher hashes new passwords. Stored hashes made with other settings are replaced when the user
+	// logs in. The zero Hasher means passwords.DefaultHasher.
+	PasswordHasher passwords.Hasher
+}
+
+// ErrEmailNotVerified is returned by Authenticate when the user still has to verify their email.
+var ErrEmailNotVerified = errors.New("email not verified")
+
 // Conn is our main struct, including the database instance for working with data.
 type Conn struct {
 	// db is an instance of the SQLite database.
-	db *gorm.DB
+	db  *gorm.DB
+	cfg Config
+	// dummyHash is verified against when there is no user with the given email, so that a login for an unknown
+	// email takes as long as one with a wrong password.
+	dummyHash string
 }
 
 // NewService is the constructor for the Conn struct.
-func NewConn(db *gorm.DB) (*Conn, error) {
+func NewConn(db *gorm.DB, cfg Config) (*Conn, error) {
 	// We check if the database instance is nil, which would indicate an issue.
 	if db == nil {
 		return nil, errors.New("please provide a valid connection")
 	}
+	if cfg.PasswordHasher.Algorithm == "" {
+		cfg.PasswordHasher = passwords.DefaultHasher
+	}
+	dummyHash, err := cfg.PasswordHasher.Hash("service-app dummy password")
+	if err != nil {
+		return nil, fmt.Errorf("checking password hasher: %w", err)
+	}
+
 	// We initialize our service with the passed database instance.
-	s := &Conn{db: db}
+	s := &Conn{db: db, cfg: cfg, dummyHash: dummyHash}
 	return s, nil
 }
 
@@ -93,17 +121,25 @@ func CalculateTotalCost(inventories []Inventory, category string) (float64, erro
 // CreateUser is a method that creates a new user record in the database.
 func (s *Conn) CreateUser(ctx context.Context, nu NewUser) (User, error) {
 
+	// The password has to satisfy the policy, a *passwords.PolicyError says why it doesn't.
+	err := s.cfg.PasswordPolicy.Check(nu.Password)
+	if err != nil {
+		return User{}, err
+	}
+
 	// We hash the user's password for storage in the database.
-	hashedPass, err := bcrypt.GenerateFromPassword([]byte(nu.Password), bcrypt.DefaultCost)
+	hashedPass, err := s.cfg.PasswordHasher.Hash(nu.Password)
 	if err != nil {
 		return User{}, fmt.Errorf("generating password hash: %w", err)
 	}
 
-	// We prepare the User record.
+	// We prepare the User record. New users can only look at the inventory until they are granted more roles,
+	// signing up never makes anybody an admin. The first admin is seeded with SeedAdmin.
 	u := User{
 		Name:         nu.Name,
 		Email:        nu.Email,
-		PasswordHash: string(hashedPass),
+		PasswordHash: hashedPass,
+		Roles:        []string{auth.RoleViewer},
 	}
 
 	// We attempt to create the new User record in the database.
@@ -117,50 +153,99 @@ func (s *Conn) CreateUser(ctx context.Context, nu NewUser) (User, error) {
 }
 
 // Authenticate is a method that checks a user's provided email and password against the database.
-func (s *Conn) Authenticate(ctx context.Context, email, password string) (jwt.RegisteredClaims,
+// Failed attempts are counted per email and per client ip. Once there were too many, a *ThrottleError
+// tells how long to wait, without the password being checked at all.
+func (s *Conn) Authenticate(ctx context.Context, email, password, ip string) (auth.Claims,
 	error) {
 
+	err := s.checkThrottle(ctx, accountTarget(email), ipTarget(ip))
+	if err != nil {
+		return auth.Claims{}, err
+	}
+
 	// We attempt to find the User record where the email
 	// matches the provided email.
 	var u User
-	tx := s.db.Where("email = ?", email).First(&u)
+	tx := s.db.WithContext(ctx).Where("email = ?", email).First(&u)
+	if tx.Error != nil && !errors.Is(tx.Error, gorm.ErrRecordNotFound) {
+		return auth.Claims{}, tx.Error
+	}
 	if tx.Error != nil {
-		return jwt.RegisteredClaims{}, tx.Error
+		// Unknown emails go through the same compare and the same bookkeeping as wrong passwords
+		_, _, _ = s.cfg.PasswordHasher.Verify(password, s.dummyHash)
+		return auth.Claims{}, errors.Join(tx.Error, s.recordLoginFailure(ctx, email, ip))
 	}
 
 	// We check if the provided password matches the hashed password in the database.
-	err := bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password))
+	err = s.checkPassword(ctx, u, password)
 	if err != nil {
-		return jwt.RegisteredClaims{}, err
+		return auth.Claims{}, errors.Join(err, s.recordLoginFailure(ctx, email, ip))
 	}
 
-	// Successful authentication! Generate JWT claims.
-	c := jwt.RegisteredClaims{
-		Issuer:    "service project",
-		Subject:   strconv.FormatUint(uint64(u.ID), 10),
-		Audience:  jwt.ClaimStrings{"students"},
-		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
-		IssuedAt:  jwt.NewNumericDate(time.Now()),
+	// With a second factor the login is only complete after CompleteMFA, so the failures are kept until then.
+	// Otherwise somebody who knows the password could guess codes forever.
+	if u.TOTPEnabledAt == nil {
+		err = s.resetAccountThrottle(ctx, email)
+		if err != nil {
+			return auth.Claims{}, err
+		}
 	}
 
-	// And return those claims.
-	return c, nil
+	// Only checked once the password is right, so that it doesn't tell anybody which emails have an account
+	if s.cfg.RequireVerifiedEmail && u.EmailVerifiedAt == nil {
+		return auth.Claims{}, ErrEmailNotVerified
+	}
+
+	// Successful authentication! Generate JWT claims and return them.
+	claims := newClaims(u)
+	claims.AMR = []string{auth.AMRPassword}
+	return claims, nil
+}
+
+// AccessTokenTTL is how long an access token issued to a user is valid.
+const AccessTokenTTL = time.Hour
+
+// newClaims builds the JWT claims of an access token issued to the user u.
+// The issuer and audience are filled in by auth.Auth when the token is generated. The token gets every
+// scope the roles of the user allow, callers can narrow it down.
+func newClaims(u User) auth.Claims {
+	return auth.Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   strconv.FormatUint(uint64(u.ID), 10),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(AccessTokenTTL)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ID:        uuid.NewString(),
+		},
+		Roles: u.Roles,
+		Scope: auth.AllowedScopes(u.Roles),
+	}
 }
 
 func (s *Conn) AutoMigrate() error {
 	//if s.db.Migrator().HasTable(&User{}) {
 	//	return nil
 	//}
-	err := s.db.Migrator().DropTable(&User{}, &Inventory{})
+	// Only inventories start over. Revoked tokens, sessions, keys and clients have to outlive a restart, or
+	// revoked tokens would be good again. So do users: a new user with the id of a dropped one would inherit
+	// their sessions, keys and passkeys
+	err := s.db.Migrator().DropTable(&Inventory{})
 	if err != nil {
 		return err
 	}
 
 	// AutoMigrate function will ONLY create tables, missing columns and missing indexes, and WON'T change existing column's type or delete unused columns
-	err = s.db.Migrator().AutoMigrate(&User{}, &Inventory{})
+	err = s.db.Migrator().AutoMigrate(&User{}, &Inventory{}, &RefreshToken{}, &RevokedToken{}, &RevokedSubject{}, &APIKey{}, &OAuthClient{},
+		&UserToken{}, &RecoveryCode{}, &LoginThrottle{}, &Session{}, &AuthorizationCode{},
+		&FederatedIdentity{}, &WebAuthnCredential{})
 	if err != nil {
 		// If there is an error while migrating, log the error message and stop the program
 		return err
 	}
+
+	// The audit trail is kept across restarts, so its tables are only ever migrated, never dropped
+	err = s.db.Migrator().AutoMigrate(&Impersonation{})
+	if err != nil {
+		return err
+	}
 	return nil
 }
@@ -0,0 +1,180 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"service-app/auth"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// maxUserAgentLength is how much of the User-Agent header of a login is kept. Clients can send anything there.
+const maxUserAgentLength = 512
+
+// ErrSessionNotFound is returned when a user has no active session with the given id.
+var ErrSessionNotFound = errors.New("session not found")
+
+// CreateSession starts a new session for the user the claims were issued to, e.g. when they log in, and
+// returns the claims with the id of the session as their sid together with the first refresh token of the
+// session. The refresh token is limited to the scope and the authentication methods of the claims.
+func (s *Conn) CreateSession(ctx context.Context, userId uint, claims auth.Claims, userAgent, ip string) (auth.Claims,
+	string, error) {
+
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = strings.ToValidUTF8(userAgent[:maxUserAgentLength], "")
+	}
+
+	now := time.Now()
+	sess := Session{
+		SessionId:  uuid.NewString(),
+		UserId:     userId,
+		UserAgent:  userAgent,
+		IP:         ip,
+		Jti:        claims.ID,
+		LastSeenAt: now,
+		LastSeenIP: ip,
+		ExpiresAt:  now.Add(RefreshTokenTTL),
+	}
+
+	var refresh string
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Create(&sess).Error
+		if err != nil {
+			return fmt.Errorf("storing session: %w", err)
+		}
+		// The refresh tokens of the session are a family of their own, named after it
+		refresh, err = s.addRefreshToken(tx, userId, sess.SessionId, claims.Scope, claims.AMR)
+		return err
+	})
+	if err != nil {
+		return auth.Claims{}, "", err
+	}
+
+	claims.SessionID = sess.SessionId
+	return claims, refresh, nil
+}
+
+// ListSessions returns the sessions of the user that are still active, the most recently seen first.
+func (s *Conn) ListSessions(ctx context.Context, userId uint) ([]Session, error) {
+	var sessions = make([]Session, 0, 10)
+	err := s.db.WithContext(ctx).
+		Where("user_id = ? AND revoked_at IS NULL AND expires_at > ?", userId, time.Now()).
+		Order("last_seen_at DESC").Find(&sessions).Error
+	if err != nil {
+		return nil, fmt.Errorf("listing sessions: %w", err)
+	}
+	return sessions, nil
+}
+
+// RevokeSession ends one of the sessions of the user, its refresh tokens can't be used anymore.
+// The revoked session is returned, so that its access tokens can be revoked as well.
+func (s *Conn) RevokeSession(ctx context.Context, userId uint, sessionId string) (Session, error) {
+	var sess Session
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("session_id = ? AND user_id = ? AND revoked_at IS NULL", sessionId, userId).
+			First(&sess).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrSessionNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		res := tx.Model(&Session{}).Where("id = ? AND revoked_at IS NULL", sess.ID).Update("revoked_at", now)
+		if res.Error != nil {
+			return fmt.Errorf("revoking session: %w", res.Error)
+		}
+		// Somebody else revoked it in the meantime
+		if res.RowsAffected == 0 {
+			return ErrSessionNotFound
+		}
+		sess.RevokedAt = &now
+
+		err = tx.Model(&RefreshToken{}).Where("family_id = ? AND revoked_at IS NULL", sess.SessionId).
+			Update("revoked_at", now).Error
+		if err != nil {
+			return fmt.Errorf("revoking refresh tokens: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return Session{}, err
+	}
+	return sess, nil
+}
+
+// RevokeSessions ends every session of the user and returns the sessions that were active until now.
+func (s *Conn) RevokeSessions(ctx context.Context, userId uint) ([]Session, error) {
+	var sessions []Session
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("user_id = ? AND revoked_at IS NULL", userId).Find(&sessions).Error
+		if err != nil {
+			return fmt.Errorf("listing sessions: %w", err)
+		}
+		return revokeUserSessions(tx, userId)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// TouchSession records that the session was used just now from ip, and reports whether it is still active.
+// An empty ip keeps the one the session was last seen from. Sessions that were revoked or have expired are left alone.
+func (s *Conn) TouchSession(ctx context.Context, sessionId, ip string) (bool, error) {
+	now := time.Now()
+	updates := map[string]any{"last_seen_at": now}
+	if ip != "" {
+		updates["last_seen_ip"] = ip
+	}
+	res := s.db.WithContext(ctx).Model(&Session{}).
+		Where("session_id = ? AND revoked_at IS NULL AND expires_at > ?", sessionId, now).
+		Updates(updates)
+	if res.Error != nil {
+		return false, fmt.Errorf("recording session use: %w", res.Error)
+	}
+	return res.RowsAffected > 0, nil
+}
+
+// revokeSession revokes the session with the given id together with all of its refresh tokens.
+func revokeSession(tx *gorm.DB, sessionId string) error {
+	now := time.Now()
+	err := tx.Model(&Session{}).
+		Where("session_id = ? AND revoked_at IS NULL", sessionId).
+		Update("revoked_at", now).Error
+	if err != nil {
+		return fmt.Errorf("revoking session: %w", err)
+	}
+
+	err = tx.Model(&RefreshToken{}).
+		Where("family_id = ? AND revoked_at IS NULL", sessionId).
+		Update("revoked_at", now).Error
+	if err != nil {
+		return fmt.Errorf("revoking refresh tokens: %w", err)
+	}
+	return nil
+}
+
+// revokeUserSessions revokes every session of the user together with all of their refresh tokens.
+func revokeUserSessions(tx *gorm.DB, userId uint) error {
+	now := time.Now()
+	err := tx.Model(&Session{}).
+		Where("user_id = ? AND revoked_at IS NULL", userId).
+		Update("revoked_at", now).Error
+	if err != nil {
+		return fmt.Errorf("revoking sessions: %w", err)
+	}
+
+	err = tx.Model(&RefreshToken{}).
+		Where("user_id = ? AND revoked_at IS NULL", userId).
+		Update("revoked_at", now).Error
+	if err != nil {
+		return fmt.Errorf("revoking refresh tokens: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ErrInvalidUserToken is returned when a mailed token is unknown, expired, already used or meant for
+// something else.
+var ErrInvalidUserToken = errors.New("invalid user token")
+
+// createUserToken stores a new single-use token of the given purpose for the user and returns the plain token.
+// Tokens of the same purpose that weren't used yet stop working, only the latest mail counts.
+func createUserToken(tx *gorm.DB, userId uint, purpose string, ttl time.Duration) (string, error) {
+	token, hash, err := generateToken()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	err = tx.Model(&UserToken{}).
+		Where("user_id = ? AND purpose = ? AND used_at IS NULL", userId, purpose).
+		Update("used_at", now).Error
+	if err != nil {
+		return "", fmt.Errorf("invalidating earlier tokens: %w", err)
+	}
+
+	ut := UserToken{
+		UserId:    userId,
+		Purpose:   purpose,
+		TokenHash: hash,
+		ExpiresAt: now.Add(ttl),
+	}
+	err = tx.Create(&ut).Error
+	if err != nil {
+		return "", fmt.Errorf("storing user token: %w", err)
+	}
+	return token, nil
+}
+
+// consumeUserToken marks a token of the given purpose as used and returns it. The update only matches a
+// token that is still unused and unexpired, so of two concurrent requests only one can use it.
+func consumeUserToken(tx *gorm.DB, token, purpose string) (UserToken, error) {
+	now := time.Now()
+	res := tx.Model(&UserToken{}).
+		Where("token_hash = ? AND purpose = ? AND used_at IS NULL AND expires_at > ?", hashToken(token), purpose, now).
+		Update("used_at", now)
+	if res.Error != nil {
+		return UserToken{}, fmt.Errorf("using token: %w", res.Error)
+	}
+	if res.RowsAffected == 0 {
+		return UserToken{}, ErrInvalidUserToken
+	}
+
+	var ut UserToken
+	err := tx.Where("token_hash = ?", hashToken(token)).First(&ut).Error
+	if err != nil {
+		return UserToken{}, fmt.Errorf("fetching token: %w", err)
+	}
+	return ut, nil
+}
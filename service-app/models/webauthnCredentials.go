@@ -0,0 +1,195 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"service-app/auth"
+	"service-app/webauthn"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// MaxWebAuthnCredentials is how many passkeys a user can register.
+const MaxWebAuthnCredentials = 10
+
+var (
+	// ErrWebAuthnCredentialNotFound is returned when there is no passkey with the given id, or it belongs to
+	// another user.
+	ErrWebAuthnCredentialNotFound = errors.New("webauthn credential not found")
+	// ErrWebAuthnCredentialExists is returned when a passkey is registered a second time.
+	ErrWebAuthnCredentialExists = errors.New("webauthn credential already registered")
+	// ErrTooManyWebAuthnCredentials is returned when a user already has MaxWebAuthnCredentials passkeys.
+	ErrTooManyWebAuthnCredentials = errors.New("too many webauthn credentials")
+)
+
+// StartWebAuthnRegistration returns the user who registers a passkey and the passkeys they already have.
+func (s *Conn) StartWebAuthnRegistration(ctx context.Context, userId uint) (webauthn.User, []webauthn.Credential,
+	error) {
+	var u User
+	err := s.db.WithContext(ctx).First(&u, userId).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return webauthn.User{}, nil, ErrUserNotFound
+	}
+	if err != nil {
+		return webauthn.User{}, nil, err
+	}
+
+	creds, err := s.ListWebAuthnCredentials(ctx, userId)
+	if err != nil {
+		return webauthn.User{}, nil, err
+	}
+	if len(creds) >= MaxWebAuthnCredentials {
+		return webauthn.User{}, nil, ErrTooManyWebAuthnCredentials
+	}
+	exclude := make([]webauthn.Credential, 0, len(creds))
+	for _, c := range creds {
+		exclude = append(exclude, c.credential())
+	}
+	return webauthn.User{ID: u.ID, Name: u.Email, DisplayName: u.Name}, exclude, nil
+}
+
+// CreateWebAuthnCredential stores a passkey the user registered.
+func (s *Conn) CreateWebAuthnCredential(ctx context.Context, cred webauthn.Credential, label string) (
+	WebAuthnCredential, error) {
+	c := WebAuthnCredential{
+		UserId:       cred.UserID,
+		CredentialId: cred.ID,
+		PublicKey:    cred.PublicKey,
+		Algorithm:    cred.Algorithm,
+		SignCount:    cred.SignCount,
+		Transports:   cred.Transports,
+		Label:        label,
+	}
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var count int64
+		err := tx.Model(&WebAuthnCredential{}).Where("credential_id = ?", cred.ID).Count(&count).Error
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			return ErrWebAuthnCredentialExists
+		}
+		err = tx.Model(&WebAuthnCredential{}).Where("user_id = ?", cred.UserID).Count(&count).Error
+		if err != nil {
+			return err
+		}
+		if count >= MaxWebAuthnCredentials {
+			return ErrTooManyWebAuthnCredentials
+		}
+		return tx.Create(&c).Error
+	})
+	if err != nil {
+		return WebAuthnCredential{}, fmt.Errorf("storing webauthn credential: %w", err)
+	}
+	return c, nil
+}
+
+// ListWebAuthnCredentials returns the passkeys of a user.
+func (s *Conn) ListWebAuthnCredentials(ctx context.Context, userId uint) ([]WebAuthnCredential, error) {
+	var creds []WebAuthnCredential
+	err := s.db.WithContext(ctx).Where("user_id = ?", userId).Order("id").Find(&creds).Error
+	if err != nil {
+		return nil, err
+	}
+	return creds, nil
+}
+
+// DeleteWebAuthnCredential removes a passkey of a user. It can't be used to log in anymore.
+func (s *Conn) DeleteWebAuthnCredential(ctx context.Context, userId, id uint) error {
+	res := s.db.WithContext(ctx).Where("id = ? AND user_id = ?", id, userId).Delete(&WebAuthnCredential{})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrWebAuthnCredentialNotFound
+	}
+	return nil
+}
+
+// FindWebAuthnCredential returns the passkey with the id its authenticator gave it.
+func (s *Conn) FindWebAuthnCredential(ctx context.Context, credentialId string) (webauthn.Credential, error) {
+	var c WebAuthnCredential
+	err := s.db.WithContext(ctx).Where("credential_id = ?", credentialId).First(&c).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return webauthn.Credential{}, ErrWebAuthnCredentialNotFound
+	}
+	if err != nil {
+		return webauthn.Credential{}, err
+	}
+	return c.credential(), nil
+}
+
+// CompleteWebAuthnLogin records that the passkey was used to log in and returns the claims of its user. The
+// sign count is only moved forward: if another login with a greater count got there first, the authenticator
+// was cloned and webauthn.ErrSignCountRegressed is returned.
+func (s *Conn) CompleteWebAuthnLogin(ctx context.Context, credentialId string, signCount uint32) (auth.Claims,
+	error) {
+	var c WebAuthnCredential
+	err := s.db.WithContext(ctx).Where("credential_id = ?", credentialId).First(&c).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return auth.Claims{}, ErrWebAuthnCredentialNotFound
+	}
+	if err != nil {
+		return auth.Claims{}, err
+	}
+
+	// Authenticators that don't count always report 0, for all others the count has to go up
+	res := s.db.WithContext(ctx).Model(&WebAuthnCredential{}).
+		Where("id = ? AND (sign_count < ? OR (sign_count = 0 AND ? = 0))", c.ID, signCount, signCount).
+		Updates(map[string]any{"sign_count": signCount, "last_used_at": time.Now()})
+	if res.Error != nil {
+		return auth.Claims{}, fmt.Errorf("recording webauthn login: %w", res.Error)
+	}
+	if res.RowsAffected == 0 {
+		return auth.Claims{}, webauthn.ErrSignCountRegressed
+	}
+
+	var u User
+	err = s.db.WithContext(ctx).First(&u, c.UserId).Error
+	if err != nil {
+		return auth.Claims{}, fmt.Errorf("fetching user of webauthn credential: %w", err)
+	}
+	if s.cfg.RequireVerifiedEmail && u.EmailVerifiedAt == nil {
+		return auth.Claims{}, ErrEmailNotVerified
+	}
+
+	// The authenticator verified the user with a PIN or biometrics before signing, so the passkey alone is
+	// two factors: something the user has and something they know or are
+	claims := newClaims(u)
+	claims.AMR = []string{auth.AMRHardwareKey, auth.AMRMFA}
+	return claims, nil
+}
+
+// ConsumeWebAuthnChallenge makes sure a challenge is answered only once. Challenges aren't stored when they are
+// handed out, so answered ones are recorded like revoked tokens until they expire. Recording it is a single insert:
+// when another request answered the challenge first, no row is inserted and webauthn.ErrInvalidChallenge is
+// returned, there is no window between checking and recording.
+func (s *Conn) ConsumeWebAuthnChallenge(ctx context.Context, challengeId string, expiresAt time.Time) error {
+	rt := RevokedToken{Jti: "webauthn:" + challengeId, ExpiresAt: expiresAt}
+	res := s.db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "jti"}},
+		DoNothing: true,
+	}).Create(&rt)
+	if res.Error != nil {
+		return fmt.Errorf("consuming webauthn challenge: %w", res.Error)
+	}
+	if res.RowsAffected == 0 {
+		return fmt.Errorf("%w: already answered", webauthn.ErrInvalidChallenge)
+	}
+	return nil
+}
+
+// credential returns the passkey the way the webauthn package knows it.
+func (c WebAuthnCredential) credential() webauthn.Credential {
+	return webauthn.Credential{
+		ID:         c.CredentialId,
+		UserID:     c.UserId,
+		PublicKey:  c.PublicKey,
+		Algorithm:  c.Algorithm,
+		SignCount:  c.SignCount,
+		Transports: c.Transports,
+	}
+}
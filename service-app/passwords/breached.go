@@ -0,0 +1,60 @@
+package passwords
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// BreachedDir checks passwords against a local copy of the Pwned Passwords range files. The SHA-1 hashes of
+// breached passwords are split by the first 5 hex characters of the hash: the file <dir>/<PREFIX>.txt holds
+// the remaining 35 characters of every hash with that prefix, one 'SUFFIX:COUNT' per line. That is the format
+// of https://api.pwnedpasswords.com/range/<PREFIX>, so the files can be downloaded once and used offline.
+// Only the one file of the password's prefix is read for a check.
+type BreachedDir struct {
+	dir string
+}
+
+// NewBreachedDir is a constructor function for BreachedDir. It returns an error if dir isn't a directory.
+func NewBreachedDir(dir string) (*BreachedDir, error) {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return nil, fmt.Errorf("opening breached passwords %w", err)
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("breached passwords %s is not a directory", dir)
+	}
+	return &BreachedDir{dir: dir}, nil
+}
+
+// IsBreached reports whether the SHA-1 hash of the password is in the range file of its prefix.
+// A missing range file means no breached password has that prefix.
+func (b *BreachedDir) IsBreached(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	f, err := os.Open(filepath.Join(b.dir, prefix+".txt"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line, _, _ := strings.Cut(strings.TrimSpace(s.Text()), ":")
+		if strings.EqualFold(line, suffix) {
+			return true, nil
+		}
+	}
+	return false, s.Err()
+}
@@ -0,0 +1,60 @@
+package passwords
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBreachedDir(t *testing.T) {
+	// The SHA-1 of "password" is 5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8, of "P@ssw0rd" it is
+	// 21BD12DC183F740EE76F27B78EB39C8AD972A757 and of "Password" 8BE3C943B1609FFFBFC51AAD666D0A04ADF83C9D. The
+	// range files look like the ones the Pwned Passwords API serves, with a lowercase line and the CRLF line
+	// endings of a download thrown in.
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "5BAA6.txt"), []byte(strings.Join([]string{
+		"003D68EB55068C33ACE09247EE4C639306B:3",
+		"1e4c9b93f3f0682250b6cf8331b7ee68fd8:10434004",
+		"1E4C9B93F3F0682250B6CF8331B7EE68FD9:1",
+	}, "\r\n")), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "21BD1.txt"), []byte(
+		"2DC183F740EE76F27B78EB39C8AD972A757:52579\n"), 0o600))
+	// Near misses of "Password": its suffix with the last character changed, and a suffix that only ends like it
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "8BE3C.txt"), []byte(
+		"943B1609FFFBFC51AAD666D0A04ADF83C9E:7\n000000000000000000000000000ADF83C9D:2\n"), 0o600))
+
+	b, err := NewBreachedDir(dir)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		password string
+		breached bool
+	}{
+		{name: "lowercase line", password: "password", breached: true},
+		{name: "uppercase line", password: "P@ssw0rd", breached: true},
+		{name: "other suffix of a known prefix", password: "Password"},
+		{name: "prefix without range file", password: "correct horse battery staple"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			breached, err := b.IsBreached(tt.password)
+			require.NoError(t, err)
+			require.Equal(t, tt.breached, breached)
+		})
+	}
+}
+
+func TestNewBreachedDir(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "5BAA6.txt")
+	require.NoError(t, os.WriteFile(file, nil, 0o600))
+
+	_, err := NewBreachedDir(filepath.Join(dir, "missing"))
+	require.Error(t, err)
+	_, err = NewBreachedDir(file)
+	require.Error(t, err)
+}
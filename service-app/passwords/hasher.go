@@ -0,0 +1,178 @@
+package passwords
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// The algorithms a Hasher can hash passwords with.
+const (
+	Argon2id = "argon2id"
+	Bcrypt   = "bcrypt"
+)
+
+// ErrUnknownHash is returned when a stored hash isn't in a format Verify knows.
+var ErrUnknownHash = errors.New("unknown password hash format")
+
+// Argon2Params are the parameters of argon2id. Memory is in KiB.
+type Argon2Params struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// Hasher hashes passwords with Algorithm and the parameters of that algorithm. Hashes are stored in the PHC
+// string format, like $argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>. bcrypt hashes keep their own
+// $2a$<cost>$<salt and hash> format, which has the same shape and is what every existing hash looks like.
+type Hasher struct {
+	Algorithm  string
+	Argon2     Argon2Params
+	BcryptCost int
+}
+
+// DefaultHasher hashes with argon2id, using the parameters recommended by RFC 9106 for memory constrained
+// environments. Every hash and every check takes 64 MiB, see hashSlots for how many run at once. The bcrypt cost
+// only matters when Algorithm is switched to Bcrypt.
+var DefaultHasher = Hasher{
+	Algorithm: Argon2id,
+	Argon2: Argon2Params{
+		Memory:      64 * 1024,
+		Iterations:  3,
+		Parallelism: 4,
+		SaltLength:  16,
+		KeyLength:   32,
+	},
+	BcryptCost: 12,
+}
+
+// hashSlots bounds how many hashes are computed at once, by every Hasher together. An argon2id hash holds
+// Argon2.Memory KiB until it is done, and every login computes one, logins for unknown emails included as they
+// are checked against a dummy hash. Without a bound a burst of logins takes as much memory as it likes, with it
+// argon2id takes at most GOMAXPROCS times Argon2.Memory and the other logins wait for a slot. More slots than
+// CPUs wouldn't hash any faster anyway.
+var hashSlots = make(chan struct{}, runtime.GOMAXPROCS(0))
+
+// withHashSlot runs f once a slot in hashSlots is free.
+func withHashSlot(f func()) {
+	hashSlots <- struct{}{}
+	defer func() { <-hashSlots }()
+	f()
+}
+
+// b64 is the encoding of salts and hashes in PHC strings: standard base64 without padding.
+var b64 = base64.RawStdEncoding
+
+// Hash hashes the password with a new random salt.
+func (h Hasher) Hash(password string) (string, error) {
+	switch h.Algorithm {
+	case Argon2id:
+		p := h.Argon2
+		salt := make([]byte, p.SaltLength)
+		_, err := rand.Read(salt)
+		if err != nil {
+			return "", fmt.Errorf("generating salt %w", err)
+		}
+		var key []byte
+		withHashSlot(func() {
+			key = argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
+		})
+		return fmt.Sprintf("$%s$v=%d$m=%d,t=%d,p=%d$%s$%s", Argon2id, argon2.Version, p.Memory, p.Iterations,
+			p.Parallelism, b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+	case Bcrypt:
+		var hash []byte
+		var err error
+		withHashSlot(func() {
+			hash, err = bcrypt.GenerateFromPassword([]byte(password), h.BcryptCost)
+		})
+		if err != nil {
+			return "", fmt.Errorf("generating password hash %w", err)
+		}
+		return string(hash), nil
+	default:
+		return "", fmt.Errorf("unknown password hash algorithm %q", h.Algorithm)
+	}
+}
+
+// Verify reports whether the password matches the stored hash, which can be in any format Hash produces, with
+// any parameters. needsRehash is true when the password matched but the hash wasn't made with the algorithm
+// and parameters of h, the caller should then store a new hash of the password.
+func (h Hasher) Verify(password, hash string) (match bool, needsRehash bool, err error) {
+	switch {
+	case strings.HasPrefix(hash, "$"+Argon2id+"$"):
+		p, salt, key, err := decodeArgon2id(hash)
+		if err != nil {
+			return false, false, err
+		}
+		var got []byte
+		withHashSlot(func() {
+			got = argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, uint32(len(key)))
+		})
+		if subtle.ConstantTimeCompare(got, key) != 1 {
+			return false, false, nil
+		}
+		p.SaltLength = uint32(len(salt))
+		return true, h.Algorithm != Argon2id || p != h.Argon2, nil
+
+	case strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$"):
+		var err error
+		withHashSlot(func() {
+			err = bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		})
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, false, nil
+		}
+		if err != nil {
+			return false, false, fmt.Errorf("checking bcrypt hash %w", err)
+		}
+		cost, err := bcrypt.Cost([]byte(hash))
+		if err != nil {
+			return false, false, fmt.Errorf("reading bcrypt cost %w", err)
+		}
+		return true, h.Algorithm != Bcrypt || cost != h.BcryptCost, nil
+
+	default:
+		return false, false, ErrUnknownHash
+	}
+}
+
+// decodeArgon2id parses an argon2id PHC string into its parameters, salt and key.
+func decodeArgon2id(hash string) (Argon2Params, []byte, []byte, error) {
+	// "", "argon2id", "v=19", "m=..,t=..,p=..", salt, key
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return Argon2Params{}, nil, nil, ErrUnknownHash
+	}
+
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return Argon2Params{}, nil, nil, fmt.Errorf("%w: argon2 version %q", ErrUnknownHash, parts[2])
+	}
+
+	var p Argon2Params
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Iterations, &p.Parallelism)
+	if err != nil {
+		return Argon2Params{}, nil, nil, fmt.Errorf("%w: argon2 parameters %q", ErrUnknownHash, parts[3])
+	}
+
+	salt, err := b64.DecodeString(parts[4])
+	if err != nil {
+		return Argon2Params{}, nil, nil, fmt.Errorf("%w: argon2 salt", ErrUnknownHash)
+	}
+	key, err := b64.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return Argon2Params{}, nil, nil, fmt.Errorf("%w: argon2 hash", ErrUnknownHash)
+	}
+	p.KeyLength = uint32(len(key))
+	return p, salt, key, nil
+}
@@ -0,0 +1,151 @@
+package passwords
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// referenceHash is "password" hashed with the salt "somesalt", m=65536, t=2 and p=1. It is one of the test
+// vectors of the argon2 reference implementation, so it checks that our hashes work with other implementations.
+const referenceHash = "$argon2id$v=19$m=65536,t=2,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc"
+
+// testHasher is a cheap argon2id Hasher, so that the tests don't spend their time hashing.
+var testHasher = Hasher{
+	Algorithm:  Argon2id,
+	Argon2:     Argon2Params{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32},
+	BcryptCost: bcrypt.MinCost,
+}
+
+func TestDecodeArgon2id(t *testing.T) {
+	p, salt, key, err := decodeArgon2id(referenceHash)
+	require.NoError(t, err)
+	require.Equal(t, Argon2Params{Memory: 65536, Iterations: 2, Parallelism: 1, KeyLength: 32}, p)
+	require.Equal(t, []byte("somesalt"), salt)
+	require.Len(t, key, 32)
+
+	tests := []struct {
+		name string
+		hash string
+	}{
+		{name: "too few parts", hash: "$argon2id$v=19$m=65536,t=2,p=1$c29tZXNhbHQ"},
+		{name: "too many parts", hash: referenceHash + "$x"},
+		{name: "older version", hash: "$argon2id$v=16$m=65536,t=2,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc"},
+		{name: "no version", hash: "$argon2id$$m=65536,t=2,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc"},
+		{name: "parameters missing", hash: "$argon2id$v=19$m=65536$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc"},
+		{name: "parameters not numbers", hash: "$argon2id$v=19$m=lots,t=2,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc"},
+		{name: "parallelism too big", hash: "$argon2id$v=19$m=65536,t=2,p=256$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc"},
+		{name: "padded salt", hash: "$argon2id$v=19$m=65536,t=2,p=1$c29tZXNhbHQ=$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc"},
+		{name: "hash not base64", hash: "$argon2id$v=19$m=65536,t=2,p=1$c29tZXNhbHQ$!!!"},
+		{name: "empty hash", hash: "$argon2id$v=19$m=65536,t=2,p=1$c29tZXNhbHQ$"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, _, err := decodeArgon2id(tt.hash)
+			require.ErrorIs(t, err, ErrUnknownHash)
+		})
+	}
+}
+
+func TestHasherVerify(t *testing.T) {
+	argon2Hash, err := testHasher.Hash("correct horse")
+	require.NoError(t, err)
+	bcryptHasher := testHasher
+	bcryptHasher.Algorithm = Bcrypt
+	bcryptHash, err := bcryptHasher.Hash("correct horse")
+	require.NoError(t, err)
+	strongerHasher := testHasher
+	strongerHasher.Argon2.Iterations = 2
+	longerSalt := testHasher
+	longerSalt.Argon2.SaltLength = 32
+	costlierBcrypt := bcryptHasher
+	costlierBcrypt.BcryptCost = bcrypt.MinCost + 1
+
+	tests := []struct {
+		name        string
+		hasher      Hasher
+		password    string
+		hash        string
+		match       bool
+		needsRehash bool
+	}{
+		{name: "reference vector", hasher: testHasher, password: "password", hash: referenceHash, match: true, needsRehash: true},
+		{name: "reference vector, wrong password", hasher: testHasher, password: "passw0rd", hash: referenceHash},
+		{name: "argon2id", hasher: testHasher, password: "correct horse", hash: argon2Hash, match: true},
+		{name: "argon2id, wrong password", hasher: testHasher, password: "correct horse ", hash: argon2Hash},
+		{name: "argon2id, more iterations configured", hasher: strongerHasher, password: "correct horse", hash: argon2Hash,
+			match: true, needsRehash: true},
+		{name: "argon2id, longer salt configured", hasher: longerSalt, password: "correct horse", hash: argon2Hash,
+			match: true, needsRehash: true},
+		{name: "argon2id, wrong password isn't rehashed", hasher: strongerHasher, password: "wrong", hash: argon2Hash},
+		{name: "argon2id, bcrypt configured", hasher: bcryptHasher, password: "correct horse", hash: argon2Hash,
+			match: true, needsRehash: true},
+		{name: "bcrypt", hasher: bcryptHasher, password: "correct horse", hash: bcryptHash, match: true},
+		{name: "bcrypt, wrong password", hasher: bcryptHasher, password: "Correct horse", hash: bcryptHash},
+		{name: "bcrypt, higher cost configured", hasher: costlierBcrypt, password: "correct horse", hash: bcryptHash,
+			match: true, needsRehash: true},
+		{name: "bcrypt, argon2id configured", hasher: testHasher, password: "correct horse", hash: bcryptHash,
+			match: true, needsRehash: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			match, needsRehash, err := tt.hasher.Verify(tt.password, tt.hash)
+			require.NoError(t, err)
+			require.Equal(t, tt.match, match)
+			require.Equal(t, tt.needsRehash, needsRehash)
+		})
+	}
+}
+
+func TestHasherVerifyUnknownHash(t *testing.T) {
+	for _, hash := range []string{"", "correct horse", "$argon2i$v=19$m=65536,t=2,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc",
+		"$scrypt$ln=16,r=8,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc", "$argon2id$v=19"} {
+		t.Run(hash, func(t *testing.T) {
+			match, _, err := testHasher.Verify("correct horse", hash)
+			require.ErrorIs(t, err, ErrUnknownHash)
+			require.False(t, match)
+		})
+	}
+}
+
+func TestHasherHash(t *testing.T) {
+	// Every hash gets its own salt
+	first, err := testHasher.Hash("correct horse")
+	require.NoError(t, err)
+	second, err := testHasher.Hash("correct horse")
+	require.NoError(t, err)
+	require.NotEqual(t, first, second)
+	require.Regexp(t, `^\$argon2id\$v=19\$m=1024,t=1,p=1\$[A-Za-z0-9+/]{22}\$[A-Za-z0-9+/]{43}$`, first)
+
+	_, err = Hasher{Algorithm: "md5"}.Hash("correct horse")
+	require.Error(t, err)
+}
+
+// A check waits while every hash slot is taken, so that a burst of logins can't hold more argon2id memory than
+// the slots allow.
+func TestHasherWaitsForHashSlot(t *testing.T) {
+	hash, err := testHasher.Hash("correct horse")
+	require.NoError(t, err)
+
+	for i := 0; i < cap(hashSlots); i++ {
+		hashSlots <- struct{}{}
+	}
+	done := make(chan bool)
+	go func() {
+		match, _, _ := testHasher.Verify("correct horse", hash)
+		done <- match
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("verified without a free slot")
+	case <-time.After(50 * time.Millisecond):
+	}
+	<-hashSlots
+	require.True(t, <-done)
+	for i := 1; i < cap(hashSlots); i++ {
+		<-hashSlots
+	}
+}
@@ -0,0 +1,130 @@
+package passwords
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// BcryptMaxBytes is the most bcrypt looks at, anything after the 72nd byte of a password is ignored.
+// A policy never allows longer passwords, so two passwords that only differ after that can't both work.
+const BcryptMaxBytes = 72
+
+// ErrWeakPassword is returned, wrapped in a *PolicyError, when a password doesn't satisfy the policy.
+var ErrWeakPassword = errors.New("password does not satisfy the policy")
+
+// Violation is one reason a password was refused. Code is meant for programs, Message for people.
+type Violation struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// PolicyError lists every reason a password was refused.
+type PolicyError struct {
+	Violations []Violation
+}
+
+// Error implements the error interface.
+func (e *PolicyError) Error() string {
+	msgs := make([]string, 0, len(e.Violations))
+	for _, v := range e.Violations {
+		msgs = append(msgs, v.Message)
+	}
+	return fmt.Sprintf("%s: %s", ErrWeakPassword, strings.Join(msgs, ", "))
+}
+
+// Unwrap makes errors.Is(err, ErrWeakPassword) work.
+func (e *PolicyError) Unwrap() error {
+	return ErrWeakPassword
+}
+
+// BreachedChecker reports whether a password is known from a data breach.
+type BreachedChecker interface {
+	IsBreached(password string) (bool, error)
+}
+
+// Policy describes what a password needs to look like. The zero Policy accepts any password of at most
+// BcryptMaxBytes bytes.
+type Policy struct {
+	// MinLength is the least number of characters.
+	MinLength int
+	// MaxBytes is the most number of bytes, it can't be more than BcryptMaxBytes.
+	MaxBytes int
+	// RequireLower, RequireUpper, RequireDigit and RequireSymbol each require at least one character of that class.
+	RequireLower  bool
+	RequireUpper  bool
+	RequireDigit  bool
+	RequireSymbol bool
+	// Breached, if set, refuses passwords that are known from data breaches.
+	Breached BreachedChecker
+}
+
+// DefaultPolicy is the policy service-app uses unless it is configured otherwise.
+var DefaultPolicy = Policy{
+	MinLength:    10,
+	MaxBytes:     BcryptMaxBytes,
+	RequireLower: true,
+	RequireUpper: true,
+	RequireDigit: true,
+}
+
+// Check returns a *PolicyError listing every rule the password breaks, or nil if it breaks none. Other errors
+// come from the BreachedChecker.
+func (p Policy) Check(password string) error {
+	var violations []Violation
+
+	if n := utf8.RuneCountInString(password); n < p.MinLength {
+		violations = append(violations, Violation{"too_short", fmt.Sprintf("must be at least %d characters long", p.MinLength)})
+	}
+	maxBytes := p.MaxBytes
+	if maxBytes <= 0 || maxBytes > BcryptMaxBytes {
+		maxBytes = BcryptMaxBytes
+	}
+	if len(password) > maxBytes {
+		violations = append(violations, Violation{"too_long", fmt.Sprintf("must be at most %d bytes long", maxBytes)})
+	}
+
+	var lower, upper, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r) || unicode.IsSpace(r):
+			symbol = true
+		}
+	}
+	if p.RequireLower && !lower {
+		violations = append(violations, Violation{"missing_lower", "must contain a lowercase letter"})
+	}
+	if p.RequireUpper && !upper {
+		violations = append(violations, Violation{"missing_upper", "must contain an uppercase letter"})
+	}
+	if p.RequireDigit && !digit {
+		violations = append(violations, Violation{"missing_digit", "must contain a digit"})
+	}
+	if p.RequireSymbol && !symbol {
+		violations = append(violations, Violation{"missing_symbol", "must contain a symbol"})
+	}
+
+	// Only worth a lookup when the password is acceptable otherwise
+	if len(violations) == 0 && p.Breached != nil {
+		breached, err := p.Breached.IsBreached(password)
+		if err != nil {
+			return fmt.Errorf("checking breached passwords %w", err)
+		}
+		if breached {
+			violations = append(violations, Violation{"breached", "is known from a data breach, please choose another one"})
+		}
+	}
+
+	if len(violations) > 0 {
+		return &PolicyError{Violations: violations}
+	}
+	return nil
+}
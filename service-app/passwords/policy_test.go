@@ -0,0 +1,108 @@
+package passwords
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// breachedList is a BreachedChecker that knows the passwords in it, and counts how often it was asked.
+type breachedList struct {
+	passwords map[string]bool
+	err       error
+	calls     int
+}
+
+func (b *breachedList) IsBreached(password string) (bool, error) {
+	b.calls++
+	return b.passwords[password], b.err
+}
+
+func TestPolicyCheck(t *testing.T) {
+	symbols := Policy{RequireSymbol: true}
+
+	tests := []struct {
+		name     string
+		policy   Policy
+		password string
+		want     []string
+	}{
+		{name: "default policy satisfied", policy: DefaultPolicy, password: "Correct horse 9"},
+		{name: "zero policy takes anything short enough", password: ""},
+		{name: "too short", policy: DefaultPolicy, password: "Horse9", want: []string{"too_short"}},
+		{name: "length counts characters, not bytes", policy: DefaultPolicy, password: "Äöüäöüäöü1"},
+		{name: "multibyte characters still too short", policy: DefaultPolicy, password: "Äöüäöü1", want: []string{"too_short"}},
+		{name: "missing lowercase", policy: DefaultPolicy, password: "CORRECT HORSE 9", want: []string{"missing_lower"}},
+		{name: "missing uppercase", policy: DefaultPolicy, password: "correct horse 9", want: []string{"missing_upper"}},
+		{name: "missing digit", policy: DefaultPolicy, password: "Correct horse", want: []string{"missing_digit"}},
+		{name: "missing symbol", policy: symbols, password: "correcthorse", want: []string{"missing_symbol"}},
+		{name: "space is a symbol", policy: symbols, password: "correct horse"},
+		{name: "punctuation is a symbol", policy: symbols, password: "correct.horse"},
+		{name: "every rule broken at once", policy: Policy{MinLength: 5, RequireLower: true, RequireUpper: true,
+			RequireDigit: true, RequireSymbol: true}, password: "",
+			want: []string{"too_short", "missing_lower", "missing_upper", "missing_digit", "missing_symbol"}},
+
+		// bcrypt ignores everything after the 72nd byte, so that is where passwords end, whatever the characters
+		{name: "72 bytes of ascii", password: strings.Repeat("a", 72)},
+		{name: "73 bytes of ascii", password: strings.Repeat("a", 73), want: []string{"too_long"}},
+		{name: "72 bytes of two byte characters", password: strings.Repeat("é", 36)},
+		{name: "37 two byte characters", password: strings.Repeat("é", 37), want: []string{"too_long"}},
+		{name: "25 three byte characters", password: strings.Repeat("€", 25), want: []string{"too_long"}},
+		{name: "four byte character across the cap", password: strings.Repeat("a", 70) + "😀", want: []string{"too_long"}},
+		{name: "lower MaxBytes", policy: Policy{MaxBytes: 8}, password: "ééééé", want: []string{"too_long"}},
+		{name: "MaxBytes above the cap", policy: Policy{MaxBytes: 100}, password: strings.Repeat("a", 73),
+			want: []string{"too_long"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.Check(tt.password)
+			if tt.want == nil {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorIs(t, err, ErrWeakPassword)
+			var pe *PolicyError
+			require.True(t, errors.As(err, &pe))
+			var codes []string
+			for _, v := range pe.Violations {
+				codes = append(codes, v.Code)
+				require.NotEmpty(t, v.Message)
+			}
+			require.Equal(t, tt.want, codes)
+		})
+	}
+}
+
+func TestPolicyCheckTooLongMessage(t *testing.T) {
+	err := Policy{MaxBytes: 100}.Check(strings.Repeat("a", 73))
+	require.EqualError(t, err, "password does not satisfy the policy: must be at most 72 bytes long")
+}
+
+func TestPolicyCheckBreached(t *testing.T) {
+	b := &breachedList{passwords: map[string]bool{"Password123": true}}
+	p := DefaultPolicy
+	p.MinLength = 8
+	p.Breached = b
+
+	var pe *PolicyError
+	err := p.Check("Password123")
+	require.True(t, errors.As(err, &pe))
+	require.Equal(t, "breached", pe.Violations[0].Code)
+	require.Len(t, pe.Violations, 1)
+
+	require.NoError(t, p.Check("Correct horse 9"))
+	require.Equal(t, 2, b.calls)
+
+	// Passwords that break another rule aren't looked up
+	err = p.Check("password")
+	require.True(t, errors.As(err, &pe))
+	require.Equal(t, 2, b.calls)
+
+	// The checker failing isn't a weak password
+	b.err = errors.New("disk gone")
+	err = p.Check("Correct horse 9")
+	require.Error(t, err)
+	require.NotErrorIs(t, err, ErrWeakPassword)
+}
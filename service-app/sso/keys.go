@@ -0,0 +1,187 @@
+package sso
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// supportedAlgorithms are the algorithms ID tokens of the identity provider may be signed with. HS256 isn't one
+// of them, there is no reason to share a secret with the identity provider for that.
+var supportedAlgorithms = []string{
+	jwt.SigningMethodRS256.Alg(),
+	jwt.SigningMethodES256.Alg(),
+	jwt.SigningMethodEdDSA.Alg(),
+}
+
+// minRefetchInterval is how long the keys are kept at least before a token with an unknown kid makes them
+// be fetched again. Otherwise every such token would hit the identity provider.
+const minRefetchInterval = time.Minute
+
+// jwk is a key of the JWKS of the identity provider.
+type jwk struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// keyCache keeps the public keys of the identity provider by kid.
+type keyCache struct {
+	p   *Provider
+	uri string
+
+	mu        sync.Mutex
+	keys      map[string]publicKey
+	fetchedAt time.Time
+}
+
+// publicKey is a key of the identity provider with the algorithm it is used with.
+type publicKey struct {
+	alg string
+	key crypto.PublicKey
+}
+
+// newKeyCache is a constructor function for keyCache, the keys are fetched from uri when they are first needed.
+func newKeyCache(p *Provider, uri string) *keyCache {
+	return &keyCache{p: p, uri: uri}
+}
+
+// key returns the key with the given kid for a token signed with alg. Tokens without a kid are accepted when the
+// identity provider has a single key.
+func (kc *keyCache) key(ctx context.Context, kid, alg string) (crypto.PublicKey, error) {
+	kc.mu.Lock()
+	defer kc.mu.Unlock()
+
+	k, ok := kc.find(kid)
+	if !ok && time.Since(kc.fetchedAt) >= minRefetchInterval {
+		err := kc.fetch(ctx)
+		if err != nil {
+			return nil, err
+		}
+		k, ok = kc.find(kid)
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	if k.alg != alg {
+		return nil, fmt.Errorf("key %q is for %s, not %s", kid, k.alg, alg)
+	}
+	return k.key, nil
+}
+
+// find looks up a key by kid. The caller holds mu.
+func (kc *keyCache) find(kid string) (publicKey, bool) {
+	if kid == "" && len(kc.keys) == 1 {
+		for _, k := range kc.keys {
+			return k, true
+		}
+	}
+	k, ok := kc.keys[kid]
+	return k, ok
+}
+
+// fetch replaces the keys with the current JWKS of the identity provider. Keys that can't be used to verify
+// signatures with one of the supported algorithms are skipped. The caller holds mu.
+func (kc *keyCache) fetch(ctx context.Context) error {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	err := kc.p.getJSON(ctx, kc.uri, &set)
+	if err != nil {
+		return fmt.Errorf("fetching jwks %w", err)
+	}
+
+	keys := make(map[string]publicKey)
+	for _, j := range set.Keys {
+		if j.Use != "" && j.Use != "sig" {
+			continue
+		}
+		k, err := parseJWK(j)
+		if err != nil {
+			continue
+		}
+		keys[j.Kid] = k
+	}
+	kc.keys = keys
+	kc.fetchedAt = time.Now()
+	return nil
+}
+
+// parseJWK turns a JWK into a public key. Without an alg member the algorithm follows from the type of the key.
+func parseJWK(j jwk) (publicKey, error) {
+	switch {
+	case j.Kty == "RSA":
+		n, err := decodeBigInt(j.N)
+		if err != nil {
+			return publicKey{}, err
+		}
+		e, err := decodeBigInt(j.E)
+		if err != nil {
+			return publicKey{}, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return publicKey{}, errors.New("rsa exponent too large")
+		}
+		return withAlg(j, jwt.SigningMethodRS256.Alg(), &rsa.PublicKey{N: n, E: int(e.Int64())})
+	case j.Kty == "EC" && j.Crv == "P-256":
+		x, err := decodeBigInt(j.X)
+		if err != nil {
+			return publicKey{}, err
+		}
+		y, err := decodeBigInt(j.Y)
+		if err != nil {
+			return publicKey{}, err
+		}
+		if !elliptic.P256().IsOnCurve(x, y) {
+			return publicKey{}, errors.New("ec point not on curve")
+		}
+		return withAlg(j, jwt.SigningMethodES256.Alg(), &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y})
+	case j.Kty == "OKP" && j.Crv == "Ed25519":
+		x, err := base64.RawURLEncoding.DecodeString(j.X)
+		if err != nil {
+			return publicKey{}, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return publicKey{}, errors.New("ed25519 key has the wrong size")
+		}
+		return withAlg(j, jwt.SigningMethodEdDSA.Alg(), ed25519.PublicKey(x))
+	}
+	return publicKey{}, fmt.Errorf("unsupported key type %s %s", j.Kty, j.Crv)
+}
+
+// withAlg pairs the key with the algorithm of its type, unless the JWK names another one.
+func withAlg(j jwk, alg string, key crypto.PublicKey) (publicKey, error) {
+	if j.Alg != "" && j.Alg != alg {
+		return publicKey{}, fmt.Errorf("unsupported algorithm %s", j.Alg)
+	}
+	return publicKey{alg: alg, key: key}, nil
+}
+
+// decodeBigInt decodes an unpadded base64url encoded big-endian integer, as JWKs carry them.
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, errors.New("empty integer")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,310 @@
+package sso
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// defaultScopes are asked for when Config.Scopes is empty. openid is always asked for.
+var defaultScopes = []string{"email", "profile"}
+
+// maxResponseSize is the largest response of the identity provider that is read.
+const maxResponseSize = 1 << 20
+
+var (
+	// ErrExchangeFailed is returned when the identity provider refuses to exchange an authorization code.
+	ErrExchangeFailed = errors.New("code exchange failed")
+	// ErrInvalidIDToken is returned when the ID token of the identity provider doesn't check out.
+	ErrInvalidIDToken = errors.New("invalid id token")
+)
+
+// Config describes the OpenID Connect identity provider users log in with and how service-app is registered there.
+type Config struct {
+	// Issuer is the issuer of the identity provider, its discovery document is found below it.
+	Issuer string
+	// ClientID and ClientSecret are the credentials service-app was registered with.
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is the callback the identity provider sends users back to, it has to be registered there.
+	RedirectURL string
+	// Scopes are asked for next to openid. The zero value asks for email and profile.
+	Scopes []string
+	// Leeway is the clock skew allowed when checking the times in ID tokens.
+	Leeway time.Duration
+	// HTTPClient talks to the identity provider. The zero value is a client with a 10 second timeout.
+	HTTPClient *http.Client
+}
+
+// Identity is who the identity provider says the user is. Subject is only unique together with Issuer.
+type Identity struct {
+	Issuer        string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+	AMR           []string
+}
+
+// LoginState is what has to be remembered between sending a user to the identity provider and the callback.
+// State ties the callback to the browser that started the login, Nonce ties the ID token to it and Verifier is
+// the PKCE code verifier.
+type LoginState struct {
+	State    string
+	Nonce    string
+	Verifier string
+}
+
+// NewLoginState returns a LoginState with fresh random values.
+func NewLoginState() (LoginState, error) {
+	var ls LoginState
+	for _, v := range []*string{&ls.State, &ls.Nonce, &ls.Verifier} {
+		b := make([]byte, 32)
+		_, err := rand.Read(b)
+		if err != nil {
+			return LoginState{}, fmt.Errorf("generating login state: %w", err)
+		}
+		*v = base64.RawURLEncoding.EncodeToString(b)
+	}
+	return ls, nil
+}
+
+// metadata is the part of the discovery document of the identity provider service-app needs.
+type metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Provider logs users in with an OpenID Connect identity provider, as a relying party using the authorization
+// code flow with PKCE. The discovery document is fetched when it is first needed and then kept, the keys of the
+// provider are fetched again when an ID token is signed with a key that isn't known yet.
+type Provider struct {
+	cfg    Config
+	client *http.Client
+
+	mu   sync.Mutex
+	meta *metadata
+	keys *keyCache
+}
+
+// NewProvider is a constructor function for Provider. It doesn't contact the identity provider yet, so the app
+// starts even when the identity provider is down.
+func NewProvider(cfg Config) (*Provider, error) {
+	u, err := url.Parse(cfg.Issuer)
+	if err != nil || !u.IsAbs() {
+		return nil, fmt.Errorf("issuer has to be an absolute url: %q", cfg.Issuer)
+	}
+	if cfg.ClientID == "" || cfg.ClientSecret == "" {
+		return nil, errors.New("client id and secret are required")
+	}
+	if cfg.RedirectURL == "" {
+		return nil, errors.New("redirect url is required")
+	}
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = defaultScopes
+	}
+	client := cfg.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &Provider{cfg: cfg, client: client}, nil
+}
+
+// Issuer returns the issuer of the identity provider.
+func (p *Provider) Issuer() string {
+	return p.cfg.Issuer
+}
+
+// discover returns the discovery document of the identity provider, fetching it the first time.
+func (p *Provider) discover(ctx context.Context) (metadata, error) {
+	p.mu.Lock()
+	meta := p.meta
+	p.mu.Unlock()
+	if meta != nil {
+		return *meta, nil
+	}
+
+	var m metadata
+	err := p.getJSON(ctx, strings.TrimSuffix(p.cfg.Issuer, "/")+"/.well-known/openid-configuration", &m)
+	if err != nil {
+		return metadata{}, fmt.Errorf("fetching discovery document %w", err)
+	}
+	// OpenID Connect Discovery section 4.3: the document has to be about the issuer it was fetched from
+	if m.Issuer != p.cfg.Issuer {
+		return metadata{}, fmt.Errorf("discovery document is for issuer %q, not %q", m.Issuer, p.cfg.Issuer)
+	}
+	if m.AuthorizationEndpoint == "" || m.TokenEndpoint == "" || m.JWKSURI == "" {
+		return metadata{}, errors.New("discovery document is missing endpoints")
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.meta = &m
+	p.keys = newKeyCache(p, m.JWKSURI)
+	return m, nil
+}
+
+// AuthCodeURL returns the URL of the identity provider the user is sent to, to log in for the LoginState.
+func (p *Provider) AuthCodeURL(ctx context.Context, ls LoginState) (string, error) {
+	m, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(m.AuthorizationEndpoint)
+	if err != nil {
+		return "", fmt.Errorf("parsing authorization endpoint %w", err)
+	}
+
+	sum := sha256.Sum256([]byte(ls.Verifier))
+	q := u.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", p.cfg.ClientID)
+	q.Set("redirect_uri", p.cfg.RedirectURL)
+	q.Set("scope", strings.Join(append([]string{"openid"}, p.cfg.Scopes...), " "))
+	q.Set("state", ls.State)
+	q.Set("nonce", ls.Nonce)
+	q.Set("code_challenge", base64.RawURLEncoding.EncodeToString(sum[:]))
+	q.Set("code_challenge_method", "S256")
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// Exchange exchanges the authorization code the identity provider sent the user back with for an ID token, and
+// returns the Identity in it. The ID token has to be for the LoginState the login was started with.
+func (p *Provider) Exchange(ctx context.Context, code string, ls LoginState) (Identity, error) {
+	m, err := p.discover(ctx)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.cfg.RedirectURL},
+		"code_verifier": {ls.Verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return Identity{}, fmt.Errorf("building token request %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	// RFC 6749 section 2.3.1 form-encodes the credentials before they are put in the header
+	req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return Identity{}, fmt.Errorf("calling token endpoint %w", err)
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	err = json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(&body)
+	// A refused code is the fault of the user or of an attacker, not of the identity provider
+	if resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusUnauthorized {
+		return Identity{}, fmt.Errorf("%w: %s %s", ErrExchangeFailed, body.Error, body.ErrorDescription)
+	}
+	if err != nil {
+		return Identity{}, fmt.Errorf("decoding token response %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return Identity{}, fmt.Errorf("token endpoint responded with %s", resp.Status)
+	}
+	if body.IDToken == "" {
+		return Identity{}, fmt.Errorf("%w: token response has no id token", ErrInvalidIDToken)
+	}
+
+	return p.verify(ctx, m, body.IDToken, ls.Nonce)
+}
+
+// idClaims are the claims of an ID token of the identity provider that are looked at.
+type idClaims struct {
+	jwt.RegisteredClaims
+	Nonce           string   `json:"nonce"`
+	AuthorizedParty string   `json:"azp"`
+	Email           string   `json:"email"`
+	EmailVerified   bool     `json:"email_verified"`
+	Name            string   `json:"name"`
+	AMR             []string `json:"amr"`
+}
+
+// verify checks the ID token as OpenID Connect Core section 3.1.3.7 describes and returns the Identity in it.
+func (p *Provider) verify(ctx context.Context, m metadata, raw, nonce string) (Identity, error) {
+	var c idClaims
+	_, err := jwt.ParseWithClaims(raw, &c, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return p.keyCache().key(ctx, kid, t.Method.Alg())
+	},
+		jwt.WithValidMethods(supportedAlgorithms),
+		jwt.WithIssuer(m.Issuer),
+		jwt.WithAudience(p.cfg.ClientID),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(p.cfg.Leeway),
+	)
+	if err != nil {
+		return Identity{}, fmt.Errorf("%w: %w", ErrInvalidIDToken, err)
+	}
+
+	if c.Subject == "" || c.ExpiresAt == nil || c.IssuedAt == nil {
+		return Identity{}, fmt.Errorf("%w: sub, exp and iat are required", ErrInvalidIDToken)
+	}
+	// A token for several audiences has to name us as the party it was issued to
+	if len(c.Audience) > 1 && c.AuthorizedParty != p.cfg.ClientID {
+		return Identity{}, fmt.Errorf("%w: issued to %q", ErrInvalidIDToken, c.AuthorizedParty)
+	}
+	if c.Nonce != nonce {
+		return Identity{}, fmt.Errorf("%w: nonce doesn't match", ErrInvalidIDToken)
+	}
+
+	return Identity{
+		Issuer:        c.Issuer,
+		Subject:       c.Subject,
+		Email:         c.Email,
+		EmailVerified: c.EmailVerified,
+		Name:          c.Name,
+		AMR:           c.AMR,
+	}, nil
+}
+
+// keyCache returns the cache of the keys of the identity provider. discover has set it up.
+func (p *Provider) keyCache() *keyCache {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.keys
+}
+
+// getJSON fetches a JSON document from the identity provider.
+func (p *Provider) getJSON(ctx context.Context, u string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s responded with %s", u, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(v)
+}
@@ -0,0 +1,219 @@
+package sso
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/require"
+)
+
+// stubIdP is an identity provider that hands out an ID token for every code it issued, signed with the claims
+// the test sets.
+type stubIdP struct {
+	srv *httptest.Server
+	key *rsa.PrivateKey
+
+	mu     sync.Mutex
+	codes  map[string]url.Values
+	claims jwt.MapClaims
+}
+
+func newStubIdP(t *testing.T) *stubIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	s := &stubIdP{key: key, codes: map[string]url.Values{}}
+	mux := http.NewServeMux()
+	s.srv = httptest.NewServer(mux)
+	t.Cleanup(s.srv.Close)
+
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 s.srv.URL,
+			"authorization_endpoint": s.srv.URL + "/authorize",
+			"token_endpoint":         s.srv.URL + "/token",
+			"jwks_uri":               s.srv.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		b64 := base64.RawURLEncoding.EncodeToString
+		_ = json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA", "use": "sig", "alg": "RS256", "kid": "k1",
+			"n": b64(key.N.Bytes()), "e": b64(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		_ = r.ParseForm()
+		s.mu.Lock()
+		q, ok := s.codes[r.PostForm.Get("code")]
+		delete(s.codes, r.PostForm.Get("code"))
+		claims := s.claims
+		s.mu.Unlock()
+
+		sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if id != "service-app" || secret != "secret" || !ok ||
+			q.Get("code_challenge") != base64.RawURLEncoding.EncodeToString(sum[:]) {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+
+		c := jwt.MapClaims{
+			"iss":            s.srv.URL,
+			"aud":            "service-app",
+			"sub":            "idp-user",
+			"exp":            time.Now().Add(time.Minute).Unix(),
+			"iat":            time.Now().Unix(),
+			"nonce":          q.Get("nonce"),
+			"email":          "user@example.com",
+			"email_verified": true,
+			"name":           "User",
+		}
+		for k, v := range claims {
+			if v == nil {
+				delete(c, k)
+				continue
+			}
+			c[k] = v
+		}
+		tk := jwt.NewWithClaims(jwt.SigningMethodRS256, c)
+		tk.Header["kid"] = "k1"
+		idToken, err := tk.SignedString(key)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"id_token": idToken, "token_type": "Bearer"})
+	})
+	return s
+}
+
+// authorize does what the user does at the identity provider: it follows the URL of AuthCodeURL and returns the
+// code the identity provider sends them back with.
+func (s *stubIdP) authorize(t *testing.T, p *Provider, ls LoginState) string {
+	u, err := p.AuthCodeURL(context.Background(), ls)
+	require.NoError(t, err)
+	parsed, err := url.Parse(u)
+	require.NoError(t, err)
+	q := parsed.Query()
+	require.Equal(t, ls.State, q.Get("state"))
+	require.Equal(t, "S256", q.Get("code_challenge_method"))
+
+	code := "code-" + ls.State
+	s.mu.Lock()
+	s.codes[code] = q
+	s.mu.Unlock()
+	return code
+}
+
+func TestProviderExchange(t *testing.T) {
+	tests := []struct {
+		name string
+		// claims override the claims of the ID token, nil removes one
+		claims jwt.MapClaims
+		// verifier replaces the PKCE code verifier sent with the code
+		verifier string
+		// nonce replaces the nonce the ID token is checked against
+		nonce   string
+		wantErr error
+		want    Identity
+	}{
+		{
+			name: "valid",
+			want: Identity{Subject: "idp-user", Email: "user@example.com", EmailVerified: true, Name: "User"},
+		},
+		{
+			name: "unverified email",
+			// Whether an unverified email may log in is up to the caller, the identity says what the IdP said
+			claims: jwt.MapClaims{"email_verified": false},
+			want:   Identity{Subject: "idp-user", Email: "user@example.com", EmailVerified: false, Name: "User"},
+		},
+		{
+			name:    "wrong nonce",
+			nonce:   "someone-elses-nonce",
+			wantErr: ErrInvalidIDToken,
+		},
+		{
+			name:    "nonce missing",
+			claims:  jwt.MapClaims{"nonce": nil},
+			wantErr: ErrInvalidIDToken,
+		},
+		{
+			name:    "wrong audience",
+			claims:  jwt.MapClaims{"aud": "another-client"},
+			wantErr: ErrInvalidIDToken,
+		},
+		{
+			name:    "several audiences without azp",
+			claims:  jwt.MapClaims{"aud": []string{"service-app", "another-client"}},
+			wantErr: ErrInvalidIDToken,
+		},
+		{
+			name:    "wrong issuer",
+			claims:  jwt.MapClaims{"iss": "https://evil.example.com"},
+			wantErr: ErrInvalidIDToken,
+		},
+		{
+			name:    "expired",
+			claims:  jwt.MapClaims{"exp": time.Now().Add(-time.Hour).Unix()},
+			wantErr: ErrInvalidIDToken,
+		},
+		{
+			name:    "subject missing",
+			claims:  jwt.MapClaims{"sub": nil},
+			wantErr: ErrInvalidIDToken,
+		},
+		{
+			name:     "wrong code verifier",
+			verifier: "not-the-verifier",
+			wantErr:  ErrExchangeFailed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idp := newStubIdP(t)
+			idp.claims = tt.claims
+			p, err := NewProvider(Config{
+				Issuer:       idp.srv.URL,
+				ClientID:     "service-app",
+				ClientSecret: "secret",
+				RedirectURL:  "https://service-app.example.com/login/sso/callback",
+				HTTPClient:   idp.srv.Client(),
+			})
+			require.NoError(t, err)
+
+			ls, err := NewLoginState()
+			require.NoError(t, err)
+			code := idp.authorize(t, p, ls)
+			if tt.verifier != "" {
+				ls.Verifier = tt.verifier
+			}
+			if tt.nonce != "" {
+				ls.Nonce = tt.nonce
+			}
+
+			id, err := p.Exchange(context.Background(), code, ls)
+			if tt.wantErr != nil {
+				require.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			tt.want.Issuer = idp.srv.URL
+			require.Equal(t, tt.want, id)
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Codes are time-based one-time passwords as described by RFC 6238, with the parameters every authenticator
+// app supports: HMAC-SHA1, 6 digits and a period of 30 seconds.
+const (
+	// Digits is the length of a code.
+	Digits = 6
+	// Period is how long a code is valid.
+	Period = 30 * time.Second
+	// Skew is how many periods before and after the current one are accepted as well,
+	// to make up for clocks that are off and codes that were typed slowly.
+	Skew = 1
+)
+
+// ErrInvalidCode is returned when a code doesn't match the secret.
+var ErrInvalidCode = errors.New("invalid code")
+
+// encoding is the base32 encoding of secrets, authenticator apps expect it without padding.
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateSecret returns a new random 160 bit secret, base32 encoded.
+func GenerateSecret() (string, error) {
+	b := make([]byte, 20)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", fmt.Errorf("generating secret %w", err)
+	}
+	return encoding.EncodeToString(b), nil
+}
+
+// Step returns the number of the period t falls in.
+func Step(t time.Time) int64 {
+	return t.Unix() / int64(Period/time.Second)
+}
+
+// Code returns the code of the given step.
+func Code(secret string, step int64) (string, error) {
+	key, err := encoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", fmt.Errorf("decoding secret %w", err)
+	}
+
+	// RFC 4226 section 5.3: HMAC the counter, then take 31 bits at the offset named by the last nibble
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	n := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", Digits, n%1_000_000), nil
+}
+
+// Validate checks code against the codes of the steps around t and returns the step it matched. Callers
+// should remember the step and refuse codes of that step or earlier ones, so that a code can't be used twice.
+func Validate(secret, code string, t time.Time) (int64, error) {
+	if len(code) != Digits {
+		return 0, ErrInvalidCode
+	}
+
+	now := Step(t)
+	for step := now - Skew; step <= now+Skew; step++ {
+		want, err := Code(secret, step)
+		if err != nil {
+			return 0, err
+		}
+		if subtle.ConstantTimeCompare([]byte(want), []byte(code)) == 1 {
+			return step, nil
+		}
+	}
+	return 0, ErrInvalidCode
+}
+
+// ProvisioningURI returns the otpauth:// URI authenticator apps read from the QR code, in the format of
+// https://github.com/google/google-authenticator/wiki/Key-Uri-Format.
+func ProvisioningURI(issuer, account, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(Digits))
+	v.Set("period", fmt.Sprint(int(Period/time.Second)))
+
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(account)
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
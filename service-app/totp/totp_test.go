@@ -0,0 +1,106 @@
+package totp
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// rfcSecret is the SHA1 seed of the test vectors in RFC 6238 appendix B, "12345678901234567890", base32 encoded.
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// The RFC lists 8 digit codes, ours are their last 6 digits.
+func TestCode(t *testing.T) {
+	tests := []struct {
+		time int64
+		want string
+	}{
+		{time: 59, want: "287082"},
+		{time: 1111111109, want: "081804"},
+		{time: 1111111111, want: "050471"},
+		{time: 1234567890, want: "005924"},
+		{time: 2000000000, want: "279037"},
+		{time: 20000000000, want: "353130"},
+	}
+	for _, tt := range tests {
+		t.Run(time.Unix(tt.time, 0).UTC().Format(time.RFC3339), func(t *testing.T) {
+			got, err := Code(rfcSecret, Step(time.Unix(tt.time, 0)))
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestCodeSecret(t *testing.T) {
+	lower, err := Code("gezdgnbvgy3tqojqgezdgnbvgy3tqojq", 1)
+	require.NoError(t, err)
+	upper, err := Code(rfcSecret, 1)
+	require.NoError(t, err)
+	require.Equal(t, upper, lower)
+
+	_, err = Code("not base32!", 1)
+	require.Error(t, err)
+
+	secret, err := GenerateSecret()
+	require.NoError(t, err)
+	require.Len(t, secret, 32)
+	_, err = Code(secret, 1)
+	require.NoError(t, err)
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	step := Step(now)
+	code := func(step int64) string {
+		c, err := Code(rfcSecret, step)
+		require.NoError(t, err)
+		return c
+	}
+
+	tests := []struct {
+		name     string
+		code     string
+		wantStep int64
+		err      bool
+	}{
+		{name: "current step", code: code(step), wantStep: step},
+		{name: "previous step", code: code(step - 1), wantStep: step - 1},
+		{name: "next step", code: code(step + 1), wantStep: step + 1},
+		{name: "two steps ago", code: code(step - 2), err: true},
+		{name: "two steps ahead", code: code(step + 2), err: true},
+		{name: "wrong code", code: "000000", err: true},
+		{name: "too short", code: code(step)[:5], err: true},
+		{name: "too long", code: code(step) + "0", err: true},
+		{name: "empty", code: "", err: true},
+		{name: "8 digit code of the RFC", code: "07081804", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Validate(rfcSecret, tt.code, now)
+			if tt.err {
+				require.ErrorIs(t, err, ErrInvalidCode)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.wantStep, got)
+		})
+	}
+}
+
+func TestProvisioningURI(t *testing.T) {
+	uri := ProvisioningURI("service app", "ada@example.com", rfcSecret)
+	u, err := url.Parse(uri)
+	require.NoError(t, err)
+	require.Equal(t, "otpauth", u.Scheme)
+	require.Equal(t, "totp", u.Host)
+	require.Equal(t, "/service app:ada@example.com", u.Path)
+	require.Equal(t, url.Values{
+		"secret":    {rfcSecret},
+		"issuer":    {"service app"},
+		"algorithm": {"SHA1"},
+		"digits":    {"6"},
+		"period":    {"30"},
+	}, u.Query())
+}
@@ -0,0 +1,156 @@
+package webauthn
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// maxCBORDepth is how deeply arrays and maps may be nested. Attestation objects and COSE keys nest two levels.
+const maxCBORDepth = 8
+
+// The major types of CBOR, RFC 8949 section 3.1.
+const (
+	cborUnsigned = 0
+	cborNegative = 1
+	cborBytes    = 2
+	cborText     = 3
+	cborArray    = 4
+	cborMap      = 5
+	cborTag      = 6
+	cborSimple   = 7
+)
+
+var errCBORTruncated = errors.New("cbor: unexpected end of data")
+
+// decodeCBOR decodes the first CBOR data item of b and returns it with the bytes that follow it. It only knows
+// the subset of CBOR that WebAuthn uses: integers become int64, byte strings []byte, text strings string, arrays
+// []any, maps map[any]any with int64 or string keys, and false, true and null become bool and nil. Tags, floats
+// and indefinite lengths are rejected.
+func decodeCBOR(b []byte) (any, []byte, error) {
+	return decodeCBORItem(b, 0)
+}
+
+// decodeCBORItem decodes one data item at the given nesting depth.
+func decodeCBORItem(b []byte, depth int) (any, []byte, error) {
+	if depth > maxCBORDepth {
+		return nil, nil, errors.New("cbor: nested too deeply")
+	}
+	if len(b) == 0 {
+		return nil, nil, errCBORTruncated
+	}
+	major, info := b[0]>>5, b[0]&0x1f
+	b = b[1:]
+
+	if major == cborSimple {
+		switch info {
+		case 20:
+			return false, b, nil
+		case 21:
+			return true, b, nil
+		case 22:
+			return nil, b, nil
+		}
+		return nil, nil, fmt.Errorf("cbor: unsupported simple value or float %d", info)
+	}
+
+	n, b, err := decodeCBORArgument(info, b)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch major {
+	case cborUnsigned:
+		if n > math.MaxInt64 {
+			return nil, nil, errors.New("cbor: integer overflows int64")
+		}
+		return int64(n), b, nil
+	case cborNegative:
+		if n > math.MaxInt64 {
+			return nil, nil, errors.New("cbor: integer overflows int64")
+		}
+		return -1 - int64(n), b, nil
+	case cborBytes, cborText:
+		if n > uint64(len(b)) {
+			return nil, nil, errCBORTruncated
+		}
+		s := b[:n]
+		if major == cborText {
+			return string(s), b[n:], nil
+		}
+		return append([]byte(nil), s...), b[n:], nil
+	case cborArray:
+		// Every item takes at least a byte, so a longer array can't be in b
+		if n > uint64(len(b)) {
+			return nil, nil, errCBORTruncated
+		}
+		items := make([]any, 0, n)
+		for i := uint64(0); i < n; i++ {
+			var item any
+			item, b, err = decodeCBORItem(b, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			items = append(items, item)
+		}
+		return items, b, nil
+	case cborMap:
+		if n > uint64(len(b))/2 {
+			return nil, nil, errCBORTruncated
+		}
+		m := make(map[any]any, n)
+		for i := uint64(0); i < n; i++ {
+			var k, v any
+			k, b, err = decodeCBORItem(b, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch k.(type) {
+			case int64, string:
+			default:
+				return nil, nil, errors.New("cbor: map keys have to be integers or text")
+			}
+			if _, ok := m[k]; ok {
+				return nil, nil, fmt.Errorf("cbor: duplicate map key %v", k)
+			}
+			v, b, err = decodeCBORItem(b, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			m[k] = v
+		}
+		return m, b, nil
+	}
+	return nil, nil, fmt.Errorf("cbor: unsupported major type %d", major)
+}
+
+// decodeCBORArgument decodes the argument of a data item, which is its value, length or count depending on the
+// major type.
+func decodeCBORArgument(info byte, b []byte) (uint64, []byte, error) {
+	switch {
+	case info < 24:
+		return uint64(info), b, nil
+	case info == 24:
+		if len(b) < 1 {
+			return 0, nil, errCBORTruncated
+		}
+		return uint64(b[0]), b[1:], nil
+	case info == 25:
+		if len(b) < 2 {
+			return 0, nil, errCBORTruncated
+		}
+		return uint64(binary.BigEndian.Uint16(b)), b[2:], nil
+	case info == 26:
+		if len(b) < 4 {
+			return 0, nil, errCBORTruncated
+		}
+		return uint64(binary.BigEndian.Uint32(b)), b[4:], nil
+	case info == 27:
+		if len(b) < 8 {
+			return 0, nil, errCBORTruncated
+		}
+		return binary.BigEndian.Uint64(b), b[8:], nil
+	}
+	return 0, nil, errors.New("cbor: indefinite lengths are not supported")
+}
@@ -0,0 +1,133 @@
+package webauthn
+
+import (
+	"encoding/hex"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Most of the examples come from RFC 8949 appendix A.
+func TestDecodeCBOR(t *testing.T) {
+	tests := []struct {
+		hex  string
+		want any
+	}{
+		{hex: "00", want: int64(0)},
+		{hex: "17", want: int64(23)},
+		{hex: "1818", want: int64(24)},
+		{hex: "1903e8", want: int64(1000)},
+		{hex: "1a000f4240", want: int64(1000000)},
+		{hex: "1b000000e8d4a51000", want: int64(1000000000000)},
+		{hex: "1b7fffffffffffffff", want: int64(math.MaxInt64)},
+		{hex: "20", want: int64(-1)},
+		{hex: "3903e7", want: int64(-1000)},
+		{hex: "390100", want: int64(-257)},
+		{hex: "3b7fffffffffffffff", want: int64(math.MinInt64)},
+		{hex: "40", want: []byte(nil)},
+		{hex: "4401020304", want: []byte{1, 2, 3, 4}},
+		{hex: "60", want: ""},
+		{hex: "6449455446", want: "IETF"},
+		{hex: "62c3bc", want: "ü"},
+		{hex: "80", want: []any{}},
+		{hex: "83010203", want: []any{int64(1), int64(2), int64(3)}},
+		{hex: "8301820203820405", want: []any{int64(1), []any{int64(2), int64(3)}, []any{int64(4), int64(5)}}},
+		{hex: "a0", want: map[any]any{}},
+		{hex: "a201020304", want: map[any]any{int64(1): int64(2), int64(3): int64(4)}},
+		{hex: "a26161016162820203", want: map[any]any{"a": int64(1), "b": []any{int64(2), int64(3)}}},
+		{hex: "f4", want: false},
+		{hex: "f5", want: true},
+		{hex: "f6", want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.hex, func(t *testing.T) {
+			b, err := hex.DecodeString(tt.hex)
+			require.NoError(t, err)
+			got, rest, err := decodeCBOR(b)
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+			require.Empty(t, rest)
+		})
+	}
+}
+
+func TestDecodeCBORErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		hex  string
+	}{
+		{name: "empty", hex: ""},
+		{name: "uint64 beyond int64", hex: "1bffffffffffffffff"},
+		{name: "negative beyond int64", hex: "3b8000000000000000"},
+		{name: "argument truncated", hex: "19 01"},
+		{name: "byte string truncated", hex: "44 010203"},
+		{name: "text string truncated", hex: "64 494554"},
+		{name: "array truncated", hex: "83 0102"},
+		{name: "map value missing", hex: "a1 01"},
+		{name: "huge array count", hex: "9b ffffffffffffffff 00"},
+		{name: "huge map count", hex: "bb ffffffffffffffff 0000"},
+		{name: "reserved argument", hex: "1c"},
+		{name: "indefinite byte string", hex: "5f 4101 ff"},
+		{name: "indefinite array", hex: "9f 01 ff"},
+		{name: "indefinite map", hex: "bf 0102 ff"},
+		{name: "tag", hex: "c1 1a514b67b0"},
+		{name: "undefined", hex: "f7"},
+		{name: "half float", hex: "f93c00"},
+		{name: "double", hex: "fb3ff199999999999a"},
+		{name: "byte string key", hex: "a1 4100 01"},
+		{name: "array key", hex: "a1 8101 01"},
+		{name: "duplicate key", hex: "a2 0102 0103"},
+		{name: "error in map value", hex: "a1 01 f7"},
+		{name: "nested too deeply", hex: "818181818181818181 00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := hex.DecodeString(strings.ReplaceAll(tt.hex, " ", ""))
+			require.NoError(t, err)
+			_, _, err = decodeCBOR(b)
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestDecodeCBORRest(t *testing.T) {
+	// Attestation objects are followed by nothing, but the credential public key in authenticator data is followed
+	// by the extensions, so the bytes after the first item are handed back.
+	b := append(encodeCBOR([]cborPair{{1, 2}}), 0x61, 'x')
+	got, rest, err := decodeCBOR(b)
+	require.NoError(t, err)
+	require.Equal(t, map[any]any{int64(1): int64(2)}, got)
+	require.Equal(t, []byte{0x61, 'x'}, rest)
+
+	// Eight levels of nesting are fine, only the ninth is refused
+	b, err = hex.DecodeString("8181818181818181" + "00")
+	require.NoError(t, err)
+	_, _, err = decodeCBOR(b)
+	require.NoError(t, err)
+}
+
+// encodeCBOR is what the other tests build authenticator responses with, so it has to agree with the decoder.
+func TestEncodeCBOR(t *testing.T) {
+	tests := []struct {
+		in   any
+		want any
+	}{
+		{in: 0, want: int64(0)},
+		{in: 24, want: int64(24)},
+		{in: 70000, want: int64(70000)},
+		{in: 1 << 40, want: int64(1 << 40)},
+		{in: -7, want: int64(-7)},
+		{in: -257, want: int64(-257)},
+		{in: make([]byte, 300), want: make([]byte, 300)},
+		{in: "public-key", want: "public-key"},
+		{in: []cborPair{{"fmt", "none"}, {-1, []byte{1}}}, want: map[any]any{"fmt": "none", int64(-1): []byte{1}}},
+	}
+	for _, tt := range tests {
+		got, rest, err := decodeCBOR(encodeCBOR(tt.in))
+		require.NoError(t, err)
+		require.Equal(t, tt.want, got)
+		require.Empty(t, rest)
+	}
+}
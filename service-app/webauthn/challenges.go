@@ -0,0 +1,99 @@
+package webauthn
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// The ceremonies a challenge can be used for.
+const (
+	purposeRegistration byte = 1
+	purposeLogin        byte = 2
+)
+
+// challengeVersion is the first byte of every challenge, so that the layout can change later on.
+const challengeVersion byte = 1
+
+// challengeLength is the length of a challenge: version, purpose, expiry, user id, 16 random bytes and the
+// HMAC-SHA256 of all of that.
+const challengeLength = 1 + 1 + 8 + 8 + 16 + sha256.Size
+
+// ErrInvalidChallenge is returned when the challenge of a ceremony wasn't issued by us, has expired or was issued
+// for another ceremony or user.
+var ErrInvalidChallenge = errors.New("invalid challenge")
+
+// Challenge is the random challenge of a ceremony. Challenges aren't stored: everything needed to check one is
+// in it, with an HMAC that only the relying party can compute. To keep a challenge from being used twice, its
+// ID has to be remembered until it expires.
+type Challenge struct {
+	// Value is the challenge as the browser gets it, unpadded base64url encoded.
+	Value     string
+	ID        string
+	UserID    uint
+	ExpiresAt time.Time
+}
+
+// newChallenge issues a challenge for the purpose and the user, who is 0 for a login.
+func (rp *RelyingParty) newChallenge(purpose byte, userId uint) (Challenge, error) {
+	b := make([]byte, 0, challengeLength)
+	exp := time.Now().Add(rp.cfg.Timeout).Truncate(time.Second)
+	b = append(b, challengeVersion, purpose)
+	b = binary.BigEndian.AppendUint64(b, uint64(exp.Unix()))
+	b = binary.BigEndian.AppendUint64(b, uint64(userId))
+
+	random := make([]byte, 16)
+	_, err := rand.Read(random)
+	if err != nil {
+		return Challenge{}, fmt.Errorf("generating challenge: %w", err)
+	}
+	b = append(b, random...)
+	b = append(b, rp.mac(b)...)
+
+	return Challenge{
+		Value:     base64.RawURLEncoding.EncodeToString(b),
+		ID:        hex.EncodeToString(random),
+		UserID:    userId,
+		ExpiresAt: exp,
+	}, nil
+}
+
+// checkChallenge checks that the challenge the browser signed is one we issued for the purpose, and that it hasn't
+// expired yet.
+func (rp *RelyingParty) checkChallenge(value string, purpose byte) (Challenge, error) {
+	b, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(b) != challengeLength {
+		return Challenge{}, ErrInvalidChallenge
+	}
+	payload, sum := b[:challengeLength-sha256.Size], b[challengeLength-sha256.Size:]
+	if !hmac.Equal(sum, rp.mac(payload)) {
+		return Challenge{}, ErrInvalidChallenge
+	}
+	if payload[0] != challengeVersion || payload[1] != purpose {
+		return Challenge{}, ErrInvalidChallenge
+	}
+
+	exp := time.Unix(int64(binary.BigEndian.Uint64(payload[2:10])), 0)
+	if !time.Now().Before(exp) {
+		return Challenge{}, fmt.Errorf("%w: expired", ErrInvalidChallenge)
+	}
+	return Challenge{
+		Value:     value,
+		ID:        hex.EncodeToString(payload[18:34]),
+		UserID:    uint(binary.BigEndian.Uint64(payload[10:18])),
+		ExpiresAt: exp,
+	}, nil
+}
+
+// mac returns the HMAC-SHA256 of a challenge.
+func (rp *RelyingParty) mac(b []byte) []byte {
+	h := hmac.New(sha256.New, rp.cfg.ChallengeKey)
+	h.Write(b)
+	return h.Sum(nil)
+}
@@ -0,0 +1,113 @@
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// The COSE algorithms credentials may use, from the IANA COSE Algorithms registry. They are offered to
+// authenticators in this order.
+const (
+	AlgES256 int64 = -7
+	AlgEdDSA int64 = -8
+	AlgRS256 int64 = -257
+)
+
+// supportedAlgorithms are the COSE algorithms offered to authenticators.
+var supportedAlgorithms = []int64{AlgES256, AlgEdDSA, AlgRS256}
+
+// The labels and values of COSE keys, RFC 9053 section 7 and RFC 8230 section 4.
+const (
+	coseKty = 1
+	coseAlg = 3
+
+	coseKtyOKP = 1
+	coseKtyEC2 = 2
+	coseKtyRSA = 3
+
+	coseCrv  = -1
+	coseX    = -2
+	coseY    = -3
+	coseRSAN = -1
+	coseRSAE = -2
+
+	coseCrvP256    = 1
+	coseCrvEd25519 = 6
+)
+
+// parseCOSEKey turns the COSE key of a new credential into a public key and returns it with its algorithm.
+func parseCOSEKey(b []byte) (crypto.PublicKey, int64, error) {
+	v, rest, err := decodeCBOR(b)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(rest) != 0 {
+		return nil, 0, errors.New("trailing bytes after cose key")
+	}
+	m, ok := v.(map[any]any)
+	if !ok {
+		return nil, 0, errors.New("cose key is not a map")
+	}
+	kty, _ := m[int64(coseKty)].(int64)
+	alg, _ := m[int64(coseAlg)].(int64)
+
+	switch {
+	case kty == coseKtyEC2 && alg == AlgES256:
+		crv, _ := m[int64(coseCrv)].(int64)
+		x, _ := m[int64(coseX)].([]byte)
+		y, _ := m[int64(coseY)].([]byte)
+		if crv != coseCrvP256 || len(x) != 32 || len(y) != 32 {
+			return nil, 0, errors.New("es256 key is not on P-256")
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, 0, errors.New("es256 key is not on P-256")
+		}
+		return pub, alg, nil
+	case kty == coseKtyOKP && alg == AlgEdDSA:
+		crv, _ := m[int64(coseCrv)].(int64)
+		x, _ := m[int64(coseX)].([]byte)
+		if crv != coseCrvEd25519 || len(x) != ed25519.PublicKeySize {
+			return nil, 0, errors.New("eddsa key is not an Ed25519 key")
+		}
+		return ed25519.PublicKey(x), alg, nil
+	case kty == coseKtyRSA && alg == AlgRS256:
+		n, _ := m[int64(coseRSAN)].([]byte)
+		e, _ := m[int64(coseRSAE)].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, 0, errors.New("rs256 key is shorter than 2048 bits or has a bad exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, alg, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported cose key type %d with algorithm %d", kty, alg)
+}
+
+// verifySignature checks the signature of an assertion over data with the public key of a credential.
+func verifySignature(pub crypto.PublicKey, alg int64, data, sig []byte) error {
+	sum := sha256.Sum256(data)
+	switch alg {
+	case AlgES256:
+		k, ok := pub.(*ecdsa.PublicKey)
+		if ok && ecdsa.VerifyASN1(k, sum[:], sig) {
+			return nil
+		}
+	case AlgEdDSA:
+		k, ok := pub.(ed25519.PublicKey)
+		if ok && ed25519.Verify(k, data, sig) {
+			return nil
+		}
+	case AlgRS256:
+		k, ok := pub.(*rsa.PublicKey)
+		if ok && rsa.VerifyPKCS1v15(k, crypto.SHA256, sum[:], sig) == nil {
+			return nil
+		}
+	}
+	return ErrInvalidSignature
+}
@@ -0,0 +1,130 @@
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCOSEKey(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	x := ecKey.X.FillBytes(make([]byte, 32))
+	y := ecKey.Y.FillBytes(make([]byte, 32))
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.NoError(t, err)
+	edPub, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	smallRSA, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.NoError(t, err)
+	e := big.NewInt(int64(rsaKey.E)).Bytes()
+
+	// offCurve is a point that isn't on P-256, the x coordinate of the key with y moved by one
+	offCurve := new(big.Int).Add(ecKey.Y, big.NewInt(1)).FillBytes(make([]byte, 32))
+
+	tests := []struct {
+		name string
+		key  []byte
+		want crypto.PublicKey
+		alg  int64
+	}{
+		{name: "ES256", key: encodeCBOR([]cborPair{{1, 2}, {3, -7}, {-1, 1}, {-2, x}, {-3, y}}),
+			want: &ecKey.PublicKey, alg: AlgES256},
+		{name: "ES256 with labels in another order", key: encodeCBOR([]cborPair{{-3, y}, {-2, x}, {-1, 1}, {3, -7}, {1, 2}}),
+			want: &ecKey.PublicKey, alg: AlgES256},
+		{name: "EdDSA", key: encodeCBOR([]cborPair{{1, 1}, {3, -8}, {-1, 6}, {-2, []byte(edPub)}}),
+			want: edPub, alg: AlgEdDSA},
+		{name: "RS256", key: encodeCBOR([]cborPair{{1, 3}, {3, -257}, {-1, rsaKey.N.Bytes()}, {-2, e}}),
+			want: &rsaKey.PublicKey, alg: AlgRS256},
+
+		{name: "not a map", key: encodeCBOR(x)},
+		{name: "trailing bytes", key: append(encodeCBOR([]cborPair{{1, 2}, {3, -7}, {-1, 1}, {-2, x}, {-3, y}}), 0)},
+		{name: "no algorithm", key: encodeCBOR([]cborPair{{1, 2}, {-1, 1}, {-2, x}, {-3, y}})},
+		{name: "ES384", key: encodeCBOR([]cborPair{{1, 2}, {3, -35}, {-1, 2},
+			{-2, p384.X.FillBytes(make([]byte, 48))}, {-3, p384.Y.FillBytes(make([]byte, 48))}})},
+		{name: "ES256 on P-384", key: encodeCBOR([]cborPair{{1, 2}, {3, -7}, {-1, 2}, {-2, x}, {-3, y}})},
+		{name: "ES256 point off the curve", key: encodeCBOR([]cborPair{{1, 2}, {3, -7}, {-1, 1}, {-2, x}, {-3, offCurve}})},
+		{name: "ES256 short coordinate", key: encodeCBOR([]cborPair{{1, 2}, {3, -7}, {-1, 1}, {-2, x[1:]}, {-3, y}})},
+		{name: "ES256 compressed point", key: encodeCBOR([]cborPair{{1, 2}, {3, -7}, {-1, 1}, {-2, x}, {-3, 1}})},
+		{name: "ES256 with an OKP key", key: encodeCBOR([]cborPair{{1, 1}, {3, -7}, {-1, 6}, {-2, []byte(edPub)}})},
+		{name: "EdDSA on X25519", key: encodeCBOR([]cborPair{{1, 1}, {3, -8}, {-1, 4}, {-2, []byte(edPub)}})},
+		{name: "EdDSA short key", key: encodeCBOR([]cborPair{{1, 1}, {3, -8}, {-1, 6}, {-2, []byte(edPub[:31])}})},
+		{name: "RS256 1024 bits", key: encodeCBOR([]cborPair{{1, 3}, {3, -257}, {-1, smallRSA.N.Bytes()}, {-2, e}})},
+		{name: "RS256 without exponent", key: encodeCBOR([]cborPair{{1, 3}, {3, -257}, {-1, rsaKey.N.Bytes()}})},
+		{name: "RS256 huge exponent", key: encodeCBOR([]cborPair{{1, 3}, {3, -257}, {-1, rsaKey.N.Bytes()}, {-2, make([]byte, 5)}})},
+		{name: "PS256", key: encodeCBOR([]cborPair{{1, 3}, {3, -37}, {-1, rsaKey.N.Bytes()}, {-2, e}})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pub, alg, err := parseCOSEKey(tt.key)
+			if tt.want == nil {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.alg, alg)
+			require.True(t, tt.want.(interface{ Equal(crypto.PublicKey) bool }).Equal(pub))
+		})
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	data := []byte("authenticator data and client data hash")
+	other := []byte("something else")
+	sum := sha256.Sum256(data)
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	ecSig, err := ecdsa.SignASN1(rand.Reader, ecKey, sum[:])
+	require.NoError(t, err)
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	edSig := ed25519.Sign(edKey, data)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	rsaSig, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, sum[:])
+	require.NoError(t, err)
+	otherEC, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name  string
+		pub   crypto.PublicKey
+		alg   int64
+		data  []byte
+		sig   []byte
+		valid bool
+	}{
+		{name: "ES256", pub: &ecKey.PublicKey, alg: AlgES256, data: data, sig: ecSig, valid: true},
+		{name: "EdDSA", pub: edPub, alg: AlgEdDSA, data: data, sig: edSig, valid: true},
+		{name: "RS256", pub: &rsaKey.PublicKey, alg: AlgRS256, data: data, sig: rsaSig, valid: true},
+		{name: "ES256 other data", pub: &ecKey.PublicKey, alg: AlgES256, data: other, sig: ecSig},
+		{name: "EdDSA other data", pub: edPub, alg: AlgEdDSA, data: other, sig: edSig},
+		{name: "RS256 other data", pub: &rsaKey.PublicKey, alg: AlgRS256, data: other, sig: rsaSig},
+		{name: "ES256 other key", pub: &otherEC.PublicKey, alg: AlgES256, data: data, sig: ecSig},
+		{name: "ES256 empty signature", pub: &ecKey.PublicKey, alg: AlgES256, data: data},
+		{name: "EdDSA algorithm for an ECDSA key", pub: &ecKey.PublicKey, alg: AlgEdDSA, data: data, sig: ecSig},
+		{name: "ES256 algorithm for an RSA key", pub: &rsaKey.PublicKey, alg: AlgES256, data: data, sig: rsaSig},
+		{name: "unknown algorithm", pub: &ecKey.PublicKey, alg: -35, data: data, sig: ecSig},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifySignature(tt.pub, tt.alg, tt.data, tt.sig)
+			if tt.valid {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorIs(t, err, ErrInvalidSignature)
+		})
+	}
+}
@@ -0,0 +1,427 @@
+package webauthn
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// defaultTimeout is how long users have for a ceremony when Config.Timeout isn't set.
+const defaultTimeout = 5 * time.Minute
+
+// The flags of the authenticator data, WebAuthn section 6.1.
+const (
+	flagUserPresent   = 0x01
+	flagUserVerified  = 0x04
+	flagAttestedData  = 0x40
+	flagExtensionData = 0x80
+)
+
+var (
+	// ErrInvalidResponse is returned when what the authenticator and the browser sent doesn't check out.
+	ErrInvalidResponse = errors.New("invalid webauthn response")
+	// ErrInvalidSignature is returned when the signature of an assertion doesn't verify.
+	ErrInvalidSignature = errors.New("invalid webauthn signature")
+	// ErrSignCountRegressed is returned when the sign count of an assertion isn't greater than the stored one,
+	// which means the authenticator was probably cloned.
+	ErrSignCountRegressed = errors.New("webauthn sign count did not increase")
+)
+
+// Config holds the settings of the relying party, which is us.
+type Config struct {
+	// RPID is the domain credentials are scoped to, like example.com. It has to be the domain of the origins or
+	// a parent domain of it.
+	RPID string
+	// RPName is shown to users by their authenticator.
+	RPName string
+	// Origins are where the ceremonies may take place, like https://app.example.com.
+	Origins []string
+	// ChallengeKey signs the challenges. It has to be the same on every instance, and at least 32 bytes long.
+	ChallengeKey []byte
+	// Timeout is how long users have for a ceremony, 5 minutes if it isn't set.
+	Timeout time.Duration
+}
+
+// RelyingParty runs the WebAuthn registration and authentication ceremonies. It doesn't store anything: the
+// credentials are stored by the caller, and challenges are checked with their HMAC.
+type RelyingParty struct {
+	cfg      Config
+	rpIdHash [32]byte
+}
+
+// NewRelyingParty returns a relying party for cfg.
+func NewRelyingParty(cfg Config) (*RelyingParty, error) {
+	if cfg.RPID == "" {
+		return nil, errors.New("webauthn rp id cannot be empty")
+	}
+	if len(cfg.Origins) == 0 {
+		return nil, errors.New("webauthn needs at least one origin")
+	}
+	if len(cfg.ChallengeKey) < 32 {
+		return nil, errors.New("webauthn challenge key has to be at least 32 bytes")
+	}
+	if cfg.RPName == "" {
+		cfg.RPName = cfg.RPID
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultTimeout
+	}
+	return &RelyingParty{cfg: cfg, rpIdHash: sha256.Sum256([]byte(cfg.RPID))}, nil
+}
+
+// User is the user a credential is registered for.
+type User struct {
+	ID          uint
+	Name        string
+	DisplayName string
+}
+
+// Credential is a public key credential registered by a user. IDs are unpadded base64url encoded.
+type Credential struct {
+	ID     string
+	UserID uint
+	// PublicKey is the PKIX DER encoding of the public key.
+	PublicKey  []byte
+	Algorithm  int64
+	SignCount  uint32
+	Transports []string
+}
+
+// CredentialDescriptor names a credential in the options of a ceremony.
+type CredentialDescriptor struct {
+	Type       string   `json:"type"`
+	ID         string   `json:"id"`
+	Transports []string `json:"transports,omitempty"`
+}
+
+// CredentialParameter is a kind of credential the relying party accepts.
+type CredentialParameter struct {
+	Type string `json:"type"`
+	Alg  int64  `json:"alg"`
+}
+
+// CreationOptions are the options of a registration, for navigator.credentials.create. Binary values are
+// unpadded base64url encoded, as PublicKeyCredential.parseCreationOptionsFromJSON expects.
+type CreationOptions struct {
+	Challenge string `json:"challenge"`
+	RP        struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"rp"`
+	User struct {
+		ID          string `json:"id"`
+		Name        string `json:"name"`
+		DisplayName string `json:"displayName"`
+	} `json:"user"`
+	PubKeyCredParams       []CredentialParameter  `json:"pubKeyCredParams"`
+	Timeout                int64                  `json:"timeout"`
+	ExcludeCredentials     []CredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection struct {
+		ResidentKey      string `json:"residentKey"`
+		UserVerification string `json:"userVerification"`
+	} `json:"authenticatorSelection"`
+	Attestation string `json:"attestation"`
+}
+
+// RequestOptions are the options of an authentication, for navigator.credentials.get.
+type RequestOptions struct {
+	Challenge        string `json:"challenge"`
+	Timeout          int64  `json:"timeout"`
+	RPID             string `json:"rpId"`
+	UserVerification string `json:"userVerification"`
+}
+
+// RegistrationResponse is the credential navigator.credentials.create returns, as PublicKeyCredential.toJSON
+// encodes it.
+type RegistrationResponse struct {
+	ID       string `json:"id" validate:"required"`
+	RawID    string `json:"rawId" validate:"required"`
+	Type     string `json:"type" validate:"required,eq=public-key"`
+	Response struct {
+		ClientDataJSON    string   `json:"clientDataJSON" validate:"required"`
+		AttestationObject string   `json:"attestationObject" validate:"required"`
+		Transports        []string `json:"transports" validate:"max=10,dive,max=32"`
+	} `json:"response"`
+}
+
+// AssertionResponse is the credential navigator.credentials.get returns, as PublicKeyCredential.toJSON
+// encodes it.
+type AssertionResponse struct {
+	ID       string `json:"id" validate:"required"`
+	RawID    string `json:"rawId" validate:"required"`
+	Type     string `json:"type" validate:"required,eq=public-key"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON" validate:"required"`
+		AuthenticatorData string `json:"authenticatorData" validate:"required"`
+		Signature         string `json:"signature" validate:"required"`
+		UserHandle        string `json:"userHandle"`
+	} `json:"response"`
+}
+
+// clientData is the part of clientDataJSON that is checked, WebAuthn section 5.8.1.
+type clientData struct {
+	Type        string `json:"type"`
+	Challenge   string `json:"challenge"`
+	Origin      string `json:"origin"`
+	CrossOrigin bool   `json:"crossOrigin"`
+}
+
+// authenticatorData is the parsed authenticator data, WebAuthn section 6.1.
+type authenticatorData struct {
+	rpIdHash     []byte
+	flags        byte
+	signCount    uint32
+	credentialId []byte
+	publicKey    []byte
+}
+
+// BeginRegistration starts the registration of a new credential for the user. exclude are the credentials the
+// user already has, so that an authenticator isn't registered twice.
+func (rp *RelyingParty) BeginRegistration(u User, exclude []Credential) (CreationOptions, error) {
+	ch, err := rp.newChallenge(purposeRegistration, u.ID)
+	if err != nil {
+		return CreationOptions{}, err
+	}
+
+	var o CreationOptions
+	o.Challenge = ch.Value
+	o.RP.ID = rp.cfg.RPID
+	o.RP.Name = rp.cfg.RPName
+	o.User.ID = UserHandle(u.ID)
+	o.User.Name = u.Name
+	o.User.DisplayName = u.DisplayName
+	for _, alg := range supportedAlgorithms {
+		o.PubKeyCredParams = append(o.PubKeyCredParams, CredentialParameter{Type: "public-key", Alg: alg})
+	}
+	o.Timeout = rp.cfg.Timeout.Milliseconds()
+	o.ExcludeCredentials = []CredentialDescriptor{}
+	for _, c := range exclude {
+		o.ExcludeCredentials = append(o.ExcludeCredentials,
+			CredentialDescriptor{Type: "public-key", ID: c.ID, Transports: c.Transports})
+	}
+	// Passkeys are discoverable credentials, so that users can log in without typing their email
+	o.AuthenticatorSelection.ResidentKey = "preferred"
+	o.AuthenticatorSelection.UserVerification = "required"
+	// The kind of authenticator doesn't matter to us, so there is no attestation to check
+	o.Attestation = "none"
+	return o, nil
+}
+
+// FinishRegistration checks the response of a registration the user started with BeginRegistration and returns
+// the new credential, along with the challenge it answered. The caller has to make sure that challenge isn't
+// used again.
+func (rp *RelyingParty) FinishRegistration(userId uint, r RegistrationResponse) (Credential, Challenge, error) {
+	ch, err := rp.checkClientData(r.Response.ClientDataJSON, "webauthn.create", purposeRegistration)
+	if err != nil {
+		return Credential{}, Challenge{}, err
+	}
+	if ch.UserID != userId {
+		return Credential{}, Challenge{}, fmt.Errorf("%w: challenge issued to another user", ErrInvalidChallenge)
+	}
+
+	att, err := base64.RawURLEncoding.DecodeString(r.Response.AttestationObject)
+	if err != nil {
+		return Credential{}, Challenge{}, fmt.Errorf("%w: attestation object is not base64url", ErrInvalidResponse)
+	}
+	v, rest, err := decodeCBOR(att)
+	if err != nil || len(rest) != 0 {
+		return Credential{}, Challenge{}, fmt.Errorf("%w: decoding attestation object %v", ErrInvalidResponse, err)
+	}
+	m, ok := v.(map[any]any)
+	if !ok {
+		return Credential{}, Challenge{}, fmt.Errorf("%w: attestation object is not a map", ErrInvalidResponse)
+	}
+	// We asked for no attestation, so there is no statement to check. Authenticators that send one anyway are
+	// turned away rather than trusted blindly.
+	if f, _ := m["fmt"].(string); f != "none" {
+		return Credential{}, Challenge{}, fmt.Errorf("%w: unexpected attestation format %q", ErrInvalidResponse, f)
+	}
+	raw, _ := m["authData"].([]byte)
+
+	ad, err := rp.parseAuthenticatorData(raw, true)
+	if err != nil {
+		return Credential{}, Challenge{}, err
+	}
+	rawId, err := base64.RawURLEncoding.DecodeString(r.RawID)
+	if err != nil || !bytes.Equal(rawId, ad.credentialId) || r.ID != r.RawID {
+		return Credential{}, Challenge{}, fmt.Errorf("%w: credential id doesn't match", ErrInvalidResponse)
+	}
+
+	pub, alg, err := parseCOSEKey(ad.publicKey)
+	if err != nil {
+		return Credential{}, Challenge{}, fmt.Errorf("%w: %v", ErrInvalidResponse, err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return Credential{}, Challenge{}, fmt.Errorf("encoding public key: %w", err)
+	}
+
+	return Credential{
+		ID:         r.RawID,
+		UserID:     userId,
+		PublicKey:  der,
+		Algorithm:  alg,
+		SignCount:  ad.signCount,
+		Transports: r.Response.Transports,
+	}, ch, nil
+}
+
+// BeginLogin starts a login with a passkey. No credentials are named: the authenticator offers the user the
+// passkeys it has for us, and the response says whose it is.
+func (rp *RelyingParty) BeginLogin() (RequestOptions, error) {
+	ch, err := rp.newChallenge(purposeLogin, 0)
+	if err != nil {
+		return RequestOptions{}, err
+	}
+	return RequestOptions{
+		Challenge:        ch.Value,
+		Timeout:          rp.cfg.Timeout.Milliseconds(),
+		RPID:             rp.cfg.RPID,
+		UserVerification: "required",
+	}, nil
+}
+
+// FinishLogin checks the response of a login against the stored credential with the ID r.RawID. It returns the
+// new sign count of the credential and the challenge that was answered, which the caller has to make sure isn't
+// used again.
+func (rp *RelyingParty) FinishLogin(cred Credential, r AssertionResponse) (uint32, Challenge, error) {
+	if r.RawID != cred.ID || r.ID != r.RawID {
+		return 0, Challenge{}, fmt.Errorf("%w: credential id doesn't match", ErrInvalidResponse)
+	}
+	ch, err := rp.checkClientData(r.Response.ClientDataJSON, "webauthn.get", purposeLogin)
+	if err != nil {
+		return 0, Challenge{}, err
+	}
+	// Authenticators return the user handle of discoverable credentials, it has to be the owner of the credential
+	if r.Response.UserHandle != "" && r.Response.UserHandle != UserHandle(cred.UserID) {
+		return 0, Challenge{}, fmt.Errorf("%w: user handle doesn't match", ErrInvalidResponse)
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(r.Response.AuthenticatorData)
+	if err != nil {
+		return 0, Challenge{}, fmt.Errorf("%w: authenticator data is not base64url", ErrInvalidResponse)
+	}
+	ad, err := rp.parseAuthenticatorData(raw, false)
+	if err != nil {
+		return 0, Challenge{}, err
+	}
+
+	cdj, _ := base64.RawURLEncoding.DecodeString(r.Response.ClientDataJSON)
+	sig, err := base64.RawURLEncoding.DecodeString(r.Response.Signature)
+	if err != nil {
+		return 0, Challenge{}, fmt.Errorf("%w: signature is not base64url", ErrInvalidResponse)
+	}
+	pub, err := x509.ParsePKIXPublicKey(cred.PublicKey)
+	if err != nil {
+		return 0, Challenge{}, fmt.Errorf("parsing stored public key: %w", err)
+	}
+	// The authenticator signs its data followed by the hash of the client data, WebAuthn section 6.3.3
+	sum := sha256.Sum256(cdj)
+	err = verifySignature(pub, cred.Algorithm, append(raw, sum[:]...), sig)
+	if err != nil {
+		return 0, Challenge{}, err
+	}
+
+	// Many passkeys always report 0, the count only means something once it has been greater than that
+	if (ad.signCount != 0 || cred.SignCount != 0) && ad.signCount <= cred.SignCount {
+		return 0, Challenge{}, ErrSignCountRegressed
+	}
+	return ad.signCount, ch, nil
+}
+
+// UserHandle returns the user handle of a user, the user id of WebAuthn. It is the user's id as 8 big-endian
+// bytes, unpadded base64url encoded; their email doesn't go into it, as the spec asks.
+func UserHandle(userId uint) string {
+	return base64.RawURLEncoding.EncodeToString(binary.BigEndian.AppendUint64(nil, uint64(userId)))
+}
+
+// checkClientData checks the client data the browser put together for the ceremony, and the challenge in it.
+func (rp *RelyingParty) checkClientData(encoded, typ string, purpose byte) (Challenge, error) {
+	b, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return Challenge{}, fmt.Errorf("%w: client data is not base64url", ErrInvalidResponse)
+	}
+	var cd clientData
+	err = json.Unmarshal(b, &cd)
+	if err != nil {
+		return Challenge{}, fmt.Errorf("%w: decoding client data %v", ErrInvalidResponse, err)
+	}
+	if cd.Type != typ {
+		return Challenge{}, fmt.Errorf("%w: client data type %q", ErrInvalidResponse, cd.Type)
+	}
+	if cd.CrossOrigin || !rp.allowedOrigin(cd.Origin) {
+		return Challenge{}, fmt.Errorf("%w: origin %q not allowed", ErrInvalidResponse, cd.Origin)
+	}
+	return rp.checkChallenge(cd.Challenge, purpose)
+}
+
+// allowedOrigin reports whether the ceremony may take place at origin.
+func (rp *RelyingParty) allowedOrigin(origin string) bool {
+	for _, o := range rp.cfg.Origins {
+		if o == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// parseAuthenticatorData parses and checks the authenticator data. A registration has to carry the new
+// credential, an assertion must not.
+func (rp *RelyingParty) parseAuthenticatorData(b []byte, registration bool) (authenticatorData, error) {
+	if len(b) < 37 {
+		return authenticatorData{}, fmt.Errorf("%w: authenticator data too short", ErrInvalidResponse)
+	}
+	ad := authenticatorData{rpIdHash: b[:32], flags: b[32], signCount: binary.BigEndian.Uint32(b[33:37])}
+	b = b[37:]
+
+	if !bytes.Equal(ad.rpIdHash, rp.rpIdHash[:]) {
+		return authenticatorData{}, fmt.Errorf("%w: credential is for another relying party", ErrInvalidResponse)
+	}
+	// The passkey stands in for the password and the second factor, so the user has to be verified as well
+	if ad.flags&flagUserPresent == 0 || ad.flags&flagUserVerified == 0 {
+		return authenticatorData{}, fmt.Errorf("%w: user not present or not verified", ErrInvalidResponse)
+	}
+	if (ad.flags&flagAttestedData != 0) != registration {
+		return authenticatorData{}, fmt.Errorf("%w: unexpected attested credential data", ErrInvalidResponse)
+	}
+
+	if registration {
+		// aaguid, then the length of the credential id, the credential id and its COSE key
+		if len(b) < 18 {
+			return authenticatorData{}, fmt.Errorf("%w: attested credential data too short", ErrInvalidResponse)
+		}
+		n := int(binary.BigEndian.Uint16(b[16:18]))
+		b = b[18:]
+		if n == 0 || n > 1023 || len(b) < n {
+			return authenticatorData{}, fmt.Errorf("%w: bad credential id length", ErrInvalidResponse)
+		}
+		ad.credentialId = b[:n]
+		b = b[n:]
+
+		_, rest, err := decodeCBOR(b)
+		if err != nil {
+			return authenticatorData{}, fmt.Errorf("%w: decoding public key %v", ErrInvalidResponse, err)
+		}
+		ad.publicKey = b[:len(b)-len(rest)]
+		b = rest
+	}
+
+	// Extensions aren't asked for, but authenticators may add some on their own
+	if ad.flags&flagExtensionData != 0 {
+		_, rest, err := decodeCBOR(b)
+		if err != nil {
+			return authenticatorData{}, fmt.Errorf("%w: decoding extensions %v", ErrInvalidResponse, err)
+		}
+		b = rest
+	}
+	if len(b) != 0 {
+		return authenticatorData{}, fmt.Errorf("%w: trailing authenticator data", ErrInvalidResponse)
+	}
+	return ad, nil
+}
@@ -0,0 +1,338 @@
+package webauthn
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// cborPair is a key and value of a CBOR map, encodeCBOR keeps them in order.
+type cborPair struct {
+	key, value any
+}
+
+// encodeCBOR encodes the few CBOR types authenticators send: integers, byte and text strings and maps.
+func encodeCBOR(v any) []byte {
+	switch x := v.(type) {
+	case int:
+		if x < 0 {
+			return cborHead(1, uint64(-1-x))
+		}
+		return cborHead(0, uint64(x))
+	case []byte:
+		return append(cborHead(2, uint64(len(x))), x...)
+	case string:
+		return append(cborHead(3, uint64(len(x))), x...)
+	case []cborPair:
+		b := cborHead(5, uint64(len(x)))
+		for _, p := range x {
+			b = append(b, encodeCBOR(p.key)...)
+			b = append(b, encodeCBOR(p.value)...)
+		}
+		return b
+	}
+	panic(fmt.Sprintf("can't encode %T", v))
+}
+
+// cborHead encodes the major type and the argument of a CBOR item, in the shortest form.
+func cborHead(major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return []byte{major<<5 | byte(n)}
+	case n < 1<<8:
+		return []byte{major<<5 | 24, byte(n)}
+	case n < 1<<16:
+		return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(n))
+	case n < 1<<32:
+		return binary.BigEndian.AppendUint32([]byte{major<<5 | 26}, uint32(n))
+	}
+	return binary.BigEndian.AppendUint64([]byte{major<<5 | 27}, n)
+}
+
+// softAuthenticator is a passkey in software. It answers ceremonies the way a browser hands them over, with an
+// ES256 key, and can be told to misbehave.
+type softAuthenticator struct {
+	key    *ecdsa.PrivateKey
+	id     []byte
+	rpId   string
+	origin string
+	flags  byte
+	count  uint32
+	// counting makes every assertion increase count, like most security keys do
+	counting bool
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	id := make([]byte, 16)
+	_, err = rand.Read(id)
+	require.NoError(t, err)
+	return &softAuthenticator{key: key, id: id, rpId: "example.com", origin: "https://app.example.com",
+		flags: flagUserPresent | flagUserVerified, counting: true}
+}
+
+// coseKey returns the public key the way authenticators encode it, RFC 9053 section 7.1.1.
+func (a *softAuthenticator) coseKey() []byte {
+	x := a.key.PublicKey.X.FillBytes(make([]byte, 32))
+	y := a.key.PublicKey.Y.FillBytes(make([]byte, 32))
+	return encodeCBOR([]cborPair{{1, 2}, {3, int(AlgES256)}, {-1, 1}, {-2, x}, {-3, y}})
+}
+
+func (a *softAuthenticator) clientData(typ, challenge string) []byte {
+	b, _ := json.Marshal(clientData{Type: typ, Challenge: challenge, Origin: a.origin})
+	return b
+}
+
+func (a *softAuthenticator) authenticatorData(flags byte, attested []byte) []byte {
+	h := sha256.Sum256([]byte(a.rpId))
+	b := append(h[:], flags)
+	b = binary.BigEndian.AppendUint32(b, a.count)
+	return append(b, attested...)
+}
+
+// create answers navigator.credentials.create.
+func (a *softAuthenticator) create(challenge string) RegistrationResponse {
+	attested := make([]byte, 16)
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(a.id)))
+	attested = append(attested, a.id...)
+	attested = append(attested, a.coseKey()...)
+	obj := encodeCBOR([]cborPair{
+		{"fmt", "none"},
+		{"attStmt", []cborPair{}},
+		{"authData", a.authenticatorData(a.flags|flagAttestedData, attested)},
+	})
+
+	var r RegistrationResponse
+	r.ID = base64.RawURLEncoding.EncodeToString(a.id)
+	r.RawID = r.ID
+	r.Type = "public-key"
+	r.Response.ClientDataJSON = base64.RawURLEncoding.EncodeToString(a.clientData("webauthn.create", challenge))
+	r.Response.AttestationObject = base64.RawURLEncoding.EncodeToString(obj)
+	r.Response.Transports = []string{"internal"}
+	return r
+}
+
+// get answers navigator.credentials.get for the user with the given user handle.
+func (a *softAuthenticator) get(challenge, userHandle string) AssertionResponse {
+	if a.counting {
+		a.count++
+	}
+	ad := a.authenticatorData(a.flags, nil)
+	cd := a.clientData("webauthn.get", challenge)
+	sum := sha256.Sum256(cd)
+	digest := sha256.Sum256(append(append([]byte{}, ad...), sum[:]...))
+	sig, _ := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+
+	var r AssertionResponse
+	r.ID = base64.RawURLEncoding.EncodeToString(a.id)
+	r.RawID = r.ID
+	r.Type = "public-key"
+	r.Response.ClientDataJSON = base64.RawURLEncoding.EncodeToString(cd)
+	r.Response.AuthenticatorData = base64.RawURLEncoding.EncodeToString(ad)
+	r.Response.Signature = base64.RawURLEncoding.EncodeToString(sig)
+	r.Response.UserHandle = userHandle
+	return r
+}
+
+func newTestRelyingParty(t *testing.T) *RelyingParty {
+	rp, err := NewRelyingParty(Config{RPID: "example.com", Origins: []string{"https://app.example.com"},
+		ChallengeKey: make([]byte, 32)})
+	require.NoError(t, err)
+	return rp
+}
+
+// register runs a registration ceremony of the authenticator for user 7 and returns the credential.
+func register(t *testing.T, rp *RelyingParty, a *softAuthenticator) Credential {
+	o, err := rp.BeginRegistration(User{ID: 7, Name: "user@example.com"}, nil)
+	require.NoError(t, err)
+	cred, _, err := rp.FinishRegistration(7, a.create(o.Challenge))
+	require.NoError(t, err)
+	return cred
+}
+
+func TestRegistration(t *testing.T) {
+	tests := []struct {
+		name string
+		// userId finishes the ceremony, it was started for user 7
+		userId uint
+		change func(a *softAuthenticator)
+		// tamper changes the response after it was made
+		tamper  func(r *RegistrationResponse)
+		wantErr error
+	}{
+		{name: "valid", userId: 7},
+		{name: "other user", userId: 8, wantErr: ErrInvalidChallenge},
+		{name: "wrong origin", userId: 7, change: func(a *softAuthenticator) { a.origin = "https://evil.example" },
+			wantErr: ErrInvalidResponse},
+		{name: "other relying party", userId: 7, change: func(a *softAuthenticator) { a.rpId = "evil.example" },
+			wantErr: ErrInvalidResponse},
+		{name: "user not verified", userId: 7, change: func(a *softAuthenticator) { a.flags = flagUserPresent },
+			wantErr: ErrInvalidResponse},
+		{name: "raw id of another credential", userId: 7, tamper: func(r *RegistrationResponse) {
+			r.RawID = base64.RawURLEncoding.EncodeToString([]byte("another-credential"))
+			r.ID = r.RawID
+		}, wantErr: ErrInvalidResponse},
+		{name: "attestation statement", userId: 7, tamper: func(r *RegistrationResponse) {
+			r.Response.AttestationObject = base64.RawURLEncoding.EncodeToString(encodeCBOR([]cborPair{
+				{"fmt", "packed"}, {"attStmt", []cborPair{}}, {"authData", []byte{}}}))
+		}, wantErr: ErrInvalidResponse},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rp := newTestRelyingParty(t)
+			a := newSoftAuthenticator(t)
+			if tt.change != nil {
+				tt.change(a)
+			}
+			o, err := rp.BeginRegistration(User{ID: 7, Name: "user@example.com"}, nil)
+			require.NoError(t, err)
+			r := a.create(o.Challenge)
+			if tt.tamper != nil {
+				tt.tamper(&r)
+			}
+
+			cred, ch, err := rp.FinishRegistration(tt.userId, r)
+			if tt.wantErr != nil {
+				require.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, r.RawID, cred.ID)
+			require.Equal(t, uint(7), cred.UserID)
+			require.Equal(t, AlgES256, cred.Algorithm)
+			require.Equal(t, o.Challenge, ch.Value)
+			require.NotEmpty(t, ch.ID)
+		})
+	}
+}
+
+func TestLogin(t *testing.T) {
+	tests := []struct {
+		name string
+		// change makes the authenticator misbehave after it was registered
+		change     func(a *softAuthenticator)
+		userHandle string
+		// challenge returns the challenge that is answered instead of one of BeginLogin
+		challenge func(t *testing.T, rp *RelyingParty) string
+		tamper    func(r *AssertionResponse)
+		// signCount is the count stored with the credential
+		signCount uint32
+		wantErr   error
+	}{
+		{name: "valid"},
+		{name: "valid with user handle", userHandle: UserHandle(7)},
+		{name: "authenticator without counter", change: func(a *softAuthenticator) { a.counting = false }},
+		{name: "user handle of another user", userHandle: UserHandle(8), wantErr: ErrInvalidResponse},
+		{name: "wrong origin", change: func(a *softAuthenticator) { a.origin = "https://evil.example" },
+			wantErr: ErrInvalidResponse},
+		{name: "other relying party", change: func(a *softAuthenticator) { a.rpId = "evil.example" },
+			wantErr: ErrInvalidResponse},
+		{name: "user not verified", change: func(a *softAuthenticator) { a.flags = flagUserPresent },
+			wantErr: ErrInvalidResponse},
+		{name: "registration challenge", challenge: func(t *testing.T, rp *RelyingParty) string {
+			o, err := rp.BeginRegistration(User{ID: 7}, nil)
+			require.NoError(t, err)
+			return o.Challenge
+		}, wantErr: ErrInvalidChallenge},
+		{name: "challenge of another relying party", challenge: func(t *testing.T, _ *RelyingParty) string {
+			rp, err := NewRelyingParty(Config{RPID: "example.com", Origins: []string{"https://app.example.com"},
+				ChallengeKey: []byte("another-key-that-is-32-bytes-long")})
+			require.NoError(t, err)
+			o, err := rp.BeginLogin()
+			require.NoError(t, err)
+			return o.Challenge
+		}, wantErr: ErrInvalidChallenge},
+		{name: "bad signature", tamper: func(r *AssertionResponse) {
+			sig, _ := base64.RawURLEncoding.DecodeString(r.Response.Signature)
+			sig[len(sig)-1] ^= 1
+			r.Response.Signature = base64.RawURLEncoding.EncodeToString(sig)
+		}, wantErr: ErrInvalidSignature},
+		{name: "cloned authenticator", signCount: 5, wantErr: ErrSignCountRegressed},
+		{name: "counter stopped counting", signCount: 5, change: func(a *softAuthenticator) { a.counting = false },
+			wantErr: ErrSignCountRegressed},
+		{name: "credential id of another passkey", tamper: func(r *AssertionResponse) {
+			r.RawID = base64.RawURLEncoding.EncodeToString([]byte("another-credential"))
+			r.ID = r.RawID
+		}, wantErr: ErrInvalidResponse},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rp := newTestRelyingParty(t)
+			a := newSoftAuthenticator(t)
+			cred := register(t, rp, a)
+			cred.SignCount = tt.signCount
+			if tt.change != nil {
+				tt.change(a)
+			}
+
+			var challenge string
+			if tt.challenge != nil {
+				challenge = tt.challenge(t, rp)
+			} else {
+				o, err := rp.BeginLogin()
+				require.NoError(t, err)
+				challenge = o.Challenge
+			}
+			r := a.get(challenge, tt.userHandle)
+			if tt.tamper != nil {
+				tt.tamper(&r)
+			}
+
+			signCount, ch, err := rp.FinishLogin(cred, r)
+			if tt.wantErr != nil {
+				require.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, a.count, signCount)
+			require.Equal(t, challenge, ch.Value)
+		})
+	}
+}
+
+// The relying party doesn't store challenges, so a replayed assertion checks out again. It has to come back with
+// the same challenge ID, that is what the caller refuses the second time.
+func TestLoginReplay(t *testing.T) {
+	rp := newTestRelyingParty(t)
+	a := newSoftAuthenticator(t)
+	a.counting = false
+	cred := register(t, rp, a)
+
+	o, err := rp.BeginLogin()
+	require.NoError(t, err)
+	r := a.get(o.Challenge, UserHandle(7))
+
+	_, first, err := rp.FinishLogin(cred, r)
+	require.NoError(t, err)
+	_, replayed, err := rp.FinishLogin(cred, r)
+	require.NoError(t, err)
+	require.Equal(t, first.ID, replayed.ID)
+
+	// A fresh login has another challenge
+	o, err = rp.BeginLogin()
+	require.NoError(t, err)
+	_, next, err := rp.FinishLogin(cred, a.get(o.Challenge, UserHandle(7)))
+	require.NoError(t, err)
+	require.NotEqual(t, first.ID, next.ID)
+
+	// Authenticators that count give the replay away on their own, once the count was stored
+	a.counting = true
+	o, err = rp.BeginLogin()
+	require.NoError(t, err)
+	r = a.get(o.Challenge, UserHandle(7))
+	cred.SignCount, _, err = rp.FinishLogin(cred, r)
+	require.NoError(t, err)
+	_, _, err = rp.FinishLogin(cred, r)
+	require.ErrorIs(t, err, ErrSignCountRegressed)
+}